@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cheebz/go-auth/models"
+)
+
+// Event types
+const (
+	LoginSuccess    = "login_success"
+	LoginFailure    = "login_failure"
+	PasswordExpired = "password_expired"
+	Register        = "register"
+	PasswordChange  = "password_change"
+	Logout          = "logout"
+	LogoutAll       = "logout_all"
+	RefreshReuse    = "refresh_reuse"
+	AdminAuditQuery = "admin_audit_query"
+	AdminUserExport = "admin_user_export"
+	AdminUserImport = "admin_user_import"
+	FederatedLink   = "federated_link"
+	FederatedUnlink = "federated_unlink"
+)
+
+// Sink receives every audit event
+type Sink interface {
+	Write(ctx context.Context, event models.AuditEvent) error
+}
+
+type Logger struct {
+	sinks []Sink
+	// Take the client IP from the last X-Forwarded-For entry, only safe behind a proxy that sets it
+	TrustProxy bool
+}
+
+func NewLogger(trustProxy bool, sinks ...Sink) *Logger {
+	return &Logger{
+		sinks:      sinks,
+		TrustProxy: trustProxy,
+	}
+}
+
+// Log fills in the request details and writes the event to every sink.
+// Sink failures are logged rather than returned so that auditing never
+// fails the request. A nil Logger discards events.
+func (l *Logger) Log(r *http.Request, event models.AuditEvent) {
+	if l == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.IP = l.clientIP(r)
+	event.UserAgent = r.UserAgent()
+	event.RequestID = RequestIDFromContext(r.Context())
+	// keep writing if the client goes away mid-request
+	ctx := context.WithoutCancel(r.Context())
+	for _, sink := range l.sinks {
+		err := sink.Write(ctx, event)
+		if err != nil {
+			log.Println("failed to write audit event", event.Type, err)
+		}
+	}
+}
+
+// Close closes every sink that holds resources
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	var err error
+	for _, sink := range l.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// The proxy appends the address it received the request from to
+// X-Forwarded-For, earlier entries are whatever the client sent
+func (l *Logger) clientIP(r *http.Request) string {
+	if l.TrustProxy {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			hop := strings.TrimSpace(hops[len(hops)-1])
+			if hop != "" {
+				return hop
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,106 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/models"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if seen == "" || w.Header().Get("X-Request-ID") != seen {
+		t.Fatal("request id not generated", seen)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if seen != "abc-123" {
+		t.Fatal("incoming request id not used", seen)
+	}
+
+	req.Header.Set("X-Request-ID", "bad id\n")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if seen == "bad id\n" {
+		t.Fatal("invalid request id accepted")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := NewConfiguredLogger(config.AuditConfig{Sinks: "file", File: path, TrustProxy: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/auth/login", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 203.0.113.7")
+	logger.Log(req, models.AuditEvent{Type: LoginSuccess, UserID: 1, UUID: "uuid"})
+	logger.Log(req, models.AuditEvent{Type: Logout, UserID: 1})
+	err = logger.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []models.AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event models.AuditEvent
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			t.Fatal("audit line is not JSON", scanner.Text())
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 {
+		t.Fatal("unexpected events", events)
+	}
+	event := events[0]
+	if event.Type != LoginSuccess || event.IP != "203.0.113.7" || event.UserAgent != "test-agent" || event.Time.IsZero() {
+		t.Fatal("unexpected event", event)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "198.51.100.1:4321"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if ip := NewLogger(false).clientIP(req); ip != "198.51.100.1" {
+		t.Fatal("forwarded header trusted without TrustProxy", ip)
+	}
+	if ip := NewLogger(true).clientIP(req); ip != "203.0.113.7" {
+		t.Fatal("forwarded header not used", ip)
+	}
+	// entries before the one added by the proxy come from the client
+	req.Header.Set("X-Forwarded-For", "192.0.2.1, 203.0.113.7")
+	req.Header.Add("X-Forwarded-For", "203.0.113.8")
+	if ip := NewLogger(true).clientIP(req); ip != "203.0.113.8" {
+		t.Fatal("forged forwarded entry used", ip)
+	}
+}
+
+func TestUnsupportedSink(t *testing.T) {
+	_, err := NewConfiguredLogger(config.AuditConfig{Sinks: "stdout,syslog"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "syslog") {
+		t.Fatal("expected unsupported sink error", err)
+	}
+}
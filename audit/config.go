@@ -0,0 +1,34 @@
+package audit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/repositories"
+)
+
+// NewConfiguredLogger creates a Logger with the sinks listed in AUDIT_SINKS
+func NewConfiguredLogger(c config.AuditConfig, repo repositories.Repository) (*Logger, error) {
+	var sinks []Sink
+	for _, name := range strings.Split(c.Sinks, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "stdout":
+			sinks = append(sinks, NewStdoutSink())
+		case "file":
+			sink, err := NewFileSink(c.File)
+			if err != nil {
+				NewLogger(false, sinks...).Close()
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case "database":
+			sinks = append(sinks, NewRepositorySink(repo))
+		default:
+			NewLogger(false, sinks...).Close()
+			return nil, fmt.Errorf("unsupported audit sink: %s", name)
+		}
+	}
+	return NewLogger(c.TrustProxy, sinks...), nil
+}
@@ -0,0 +1,63 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+)
+
+// writerSink writes one JSON event per line
+type writerSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewStdoutSink() Sink {
+	return &writerSink{w: os.Stdout}
+}
+
+// NewFileSink appends events to the file at path
+func NewFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{w: f, closer: f}, nil
+}
+
+func (s *writerSink) Write(ctx context.Context, event models.AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+func (s *writerSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+type repositorySink struct {
+	repo repositories.Repository
+}
+
+// NewRepositorySink stores events in the audit_log table
+func NewRepositorySink(repo repositories.Repository) Sink {
+	return &repositorySink{repo: repo}
+}
+
+func (s *repositorySink) Write(ctx context.Context, event models.AuditEvent) error {
+	return s.repo.SaveAuditEvent(ctx, event)
+}
@@ -0,0 +1,171 @@
+package authgrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/authpb"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Serve the Auth service, and the health service behind the interceptors
+func newTestConn(t *testing.T, repo repositories.Repository, helper *jwt.JWTHelper) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if info.FullMethod == healthpb.Health_Check_FullMethodName {
+				return UnaryServerInterceptor(NewVerifier(helper))(ctx, req, info, handler)
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(StreamServerInterceptor(NewVerifier(helper))),
+	)
+	authpb.RegisterAuthServer(server, NewServer(repo, helper))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("expected %s, got %v", code, err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	repo := repositories.NewMemoryRepository(config.Configuration{})
+	helper := jwt.NewJWTHelper("secret", 20, 3600)
+	client := authpb.NewAuthClient(newTestConn(t, repo, helper))
+
+	user, err := repo.CreateUser(ctx, models.User{Username: "alice", UUID: uuid.New().String(), Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.AddUserToGroup(ctx, user.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, _ := repo.GetUserGroups(ctx, user.ID)
+	token, err := helper.CreateJWT(user, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validated, err := client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: token.Value})
+	if err != nil || validated.Uuid != user.UUID || len(validated.Groups) != 2 {
+		t.Fatal("unexpected claims", validated, err)
+	}
+	_, err = client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: "invalid"})
+	expectCode(t, err, codes.Unauthenticated)
+
+	pb, err := client.GetUser(ctx, &authpb.GetUserRequest{Uuid: user.UUID})
+	if err != nil || pb.Username != "alice" || int(pb.Id) != user.ID {
+		t.Fatal("unexpected user", pb, err)
+	}
+	_, err = client.GetUser(ctx, &authpb.GetUserRequest{Uuid: uuid.New().String()})
+	expectCode(t, err, codes.NotFound)
+	_, err = client.ListGroups(ctx, &authpb.ListGroupsRequest{})
+	expectCode(t, err, codes.InvalidArgument)
+	listed, err := client.ListGroups(ctx, &authpb.ListGroupsRequest{Uuid: user.UUID})
+	if err != nil || len(listed.Groups) != 2 || listed.Groups[1].Name != "admin" {
+		t.Fatal("unexpected groups", listed, err)
+	}
+
+	check := &authpb.CheckPermissionRequest{Uuid: user.UUID, Groups: []string{"billing", "admin"}}
+	allowed, err := client.CheckPermission(ctx, check)
+	if err != nil || !allowed.Allowed || len(allowed.Groups) != 1 || allowed.Groups[0] != "admin" {
+		t.Fatal("permission not granted", allowed, err)
+	}
+	denied, err := client.CheckPermission(ctx, &authpb.CheckPermissionRequest{Uuid: user.UUID, Groups: []string{"billing"}})
+	if err != nil || denied.Allowed {
+		t.Fatal("permission granted without group", denied, err)
+	}
+	err = repo.SetUserDisabled(ctx, user.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled, err := client.CheckPermission(ctx, check)
+	if err != nil || disabled.Allowed {
+		t.Fatal("permission granted to disabled user", disabled, err)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	ctx := context.Background()
+	helper := jwt.NewJWTHelper("secret", 20, 3600)
+	conn := newTestConn(t, repositories.NewMemoryRepository(config.Configuration{}), helper)
+	client := healthpb.NewHealthClient(conn)
+	token, err := helper.CreateJWT(models.User{ID: 1, Username: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := helper.CreateRefresh(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token.Value)
+
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = client.Check(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+refresh.Value), &healthpb.HealthCheckRequest{})
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = client.Check(authorized, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal("valid token rejected", err)
+	}
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	expectCode(t, err, codes.Unauthenticated)
+	stream, err = client.Watch(authorized, &healthpb.HealthCheckRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		t.Fatal("valid token rejected on stream", err)
+	}
+}
+
+func TestRequireGroup(t *testing.T) {
+	ctx := context.Background()
+	expectCode(t, RequireGroup(ctx, "admin"), codes.Unauthenticated)
+	helper := jwt.NewJWTHelper("secret", 20, 3600)
+	token, _ := helper.CreateJWT(models.User{ID: 1}, []models.Group{{ID: 2, Name: "admin"}})
+	ctx, err := authenticate(metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "bearer "+token.Value)), NewVerifier(helper))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if RequireGroup(ctx, "billing", "admin") != nil {
+		t.Fatal("member rejected")
+	}
+	expectCode(t, RequireGroup(ctx, "billing"), codes.PermissionDenied)
+}
@@ -0,0 +1,105 @@
+package authgrpc
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Verifier validates session tokens. Services behind go-auth use a
+// *middleware.Middleware, go-auth itself uses NewVerifier.
+type Verifier interface {
+	Verify(ctx context.Context, token string) (*jwt.JWTClaims, error)
+}
+
+type helperVerifier struct {
+	jwt *jwt.JWTHelper
+}
+
+// NewVerifier verifies tokens with the helper's keys
+func NewVerifier(j *jwt.JWTHelper) Verifier {
+	return &helperVerifier{jwt: j}
+}
+
+func (v *helperVerifier) Verify(ctx context.Context, token string) (*jwt.JWTClaims, error) {
+	return v.jwt.ParseJWT(token)
+}
+
+// Token returns the bearer token in the authorization metadata of a call
+func Token(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, header := range md.Get("authorization") {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") && token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// Put the claims of the call's token in its context. The claims are read
+// with middleware.ClaimsFromContext, as in HTTP handlers.
+func authenticate(ctx context.Context, v Verifier) (context.Context, error) {
+	token, ok := Token(ctx)
+	if !ok {
+		return ctx, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	claims, err := v.Verify(ctx, token)
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return middleware.NewContext(ctx, claims), nil
+}
+
+// UnaryServerInterceptor rejects calls without a valid session token
+func UnaryServerInterceptor(v Verifier) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, v)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// StreamServerInterceptor rejects streams without a valid session token
+func StreamServerInterceptor(v Verifier) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), v)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// RequireGroup returns PermissionDenied unless the claims in the context
+// include any of the groups. Call it from handlers behind the interceptors.
+func RequireGroup(ctx context.Context, groups ...string) error {
+	claims, ok := middleware.ClaimsFromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "not authenticated")
+	}
+	if !middleware.InGroup(claims, groups...) {
+		return status.Error(codes.PermissionDenied, "group required")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Package authgrpc serves the Auth gRPC service and authenticates gRPC calls
+// with go-auth session tokens.
+package authgrpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cheebz/go-auth/authpb"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/cheebz/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Server implements the Auth service with the same repository and keys as
+// the HTTP handlers
+type Server struct {
+	authpb.UnimplementedAuthServer
+	repo repositories.Repository
+	jwt  *jwt.JWTHelper
+}
+
+func NewServer(repo repositories.Repository, jwt *jwt.JWTHelper) *Server {
+	return &Server{repo: repo, jwt: jwt}
+}
+
+// Map repository errors to status codes, logging the unexpected ones
+func repositoryError(err error) error {
+	if errors.Is(err, repositories.ErrNotFound) {
+		return status.Error(codes.NotFound, "user not found")
+	}
+	logging.LogCaller(err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+func groupsToProto(groups []models.Group) []*authpb.Group {
+	pb := make([]*authpb.Group, len(groups))
+	for i, group := range groups {
+		pb[i] = &authpb.Group{Id: int32(group.ID), Name: group.Name}
+	}
+	return pb
+}
+
+func (s *Server) ValidateToken(ctx context.Context, req *authpb.ValidateTokenRequest) (*authpb.ValidateTokenResponse, error) {
+	claims, err := s.jwt.ParseJWT(req.Token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return &authpb.ValidateTokenResponse{
+		UserId:    int32(claims.UserID),
+		Username:  claims.Username,
+		Uuid:      claims.UUID,
+		Groups:    groupsToProto(claims.Groups),
+		ExpiresAt: timestamppb.New(time.Unix(claims.ExpiresAt, 0)),
+	}, nil
+}
+
+// Look up the user of a request and their groups
+func (s *Server) user(ctx context.Context, uuid string) (models.User, []models.Group, error) {
+	if uuid == "" {
+		return models.User{}, nil, status.Error(codes.InvalidArgument, "uuid is required")
+	}
+	user, err := s.repo.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		return user, nil, repositoryError(err)
+	}
+	groups, err := s.repo.GetUserGroups(ctx, user.ID)
+	if err != nil {
+		return user, nil, repositoryError(err)
+	}
+	return user, groups, nil
+}
+
+func (s *Server) GetUser(ctx context.Context, req *authpb.GetUserRequest) (*authpb.User, error) {
+	user, groups, err := s.user(ctx, req.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	return &authpb.User{
+		Id:              int32(user.ID),
+		Username:        user.Username,
+		Uuid:            user.UUID,
+		Groups:          groupsToProto(groups),
+		Created:         timestamppb.New(user.Created),
+		PasswordChanged: timestamppb.New(user.PasswordChanged),
+		Disabled:        user.Disabled,
+	}, nil
+}
+
+func (s *Server) ListGroups(ctx context.Context, req *authpb.ListGroupsRequest) (*authpb.ListGroupsResponse, error) {
+	_, groups, err := s.user(ctx, req.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	return &authpb.ListGroupsResponse{Groups: groupsToProto(groups)}, nil
+}
+
+func (s *Server) CheckPermission(ctx context.Context, req *authpb.CheckPermissionRequest) (*authpb.CheckPermissionResponse, error) {
+	if len(req.Groups) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "groups are required")
+	}
+	user, groups, err := s.user(ctx, req.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	res := &authpb.CheckPermissionResponse{}
+	if user.Disabled {
+		return res, nil
+	}
+	for _, name := range req.Groups {
+		for _, group := range groups {
+			if group.Name == name {
+				res.Groups = append(res.Groups, name)
+				break
+			}
+		}
+	}
+	res.Allowed = len(res.Groups) > 0
+	return res, nil
+}
@@ -0,0 +1,78 @@
+// Package authn defines how logins are checked. The handlers try the
+// configured authenticators, such as a directory, before the local
+// password hashes.
+package authn
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/cheebz/go-auth/models"
+)
+
+var (
+	// ErrUnknownUser is returned when an authenticator does not know the
+	// username, so the next one is tried
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrInvalidCredentials is returned when the password is wrong, or the
+	// account can't log in through the authenticator
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// An external marker is stored as the password of users provisioned by an
+// external authenticator. It is not a hash, so it never matches a password
+// and those users can't log in or change their password locally. The marker
+// records which authenticator provisioned the user, and an authenticator
+// only logs in the users it provisioned.
+const (
+	// LDAPPassword marks users provisioned by a directory
+	LDAPPassword = "!ldap"
+	// federatedPrefix is followed by the identity provider that created
+	// the user
+	federatedPrefix = "!federated:"
+)
+
+// FederatedPassword marks users registered by the identity provider
+func FederatedPassword(provider string) string {
+	return federatedPrefix + provider
+}
+
+// IsExternal reports whether the password is the marker of an external
+// authenticator rather than a hash
+func IsExternal(password string) bool {
+	return strings.HasPrefix(password, "!")
+}
+
+// Authenticator checks the credentials of a login and returns the local
+// user. With ErrInvalidCredentials the local user is returned when known.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (models.User, error)
+}
+
+// Chain tries authenticators in order until one knows the user. When an
+// authenticator fails, for example because a directory is unreachable, the
+// others are still tried and its error is returned if none knows the user.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, username, password string) (models.User, error) {
+	var failure error
+	for _, a := range c {
+		user, err := a.Authenticate(ctx, username, password)
+		switch {
+		case err == nil, errors.Is(err, ErrInvalidCredentials):
+			return user, err
+		case errors.Is(err, ErrUnknownUser):
+		default:
+			log.Println("authenticator failed", err)
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+	if failure != nil {
+		return models.User{}, failure
+	}
+	return models.User{}, ErrUnknownUser
+}
@@ -0,0 +1,164 @@
+// Package authtest runs go-auth in process, with in-memory storage, for
+// tests of services that sit behind it. It also mints session tokens for
+// any user and groups, including invalid ones for the negative paths.
+//
+//	s := authtest.NewServer(t, config.Configuration{})
+//	auth, _ := middleware.New(s.MiddlewareConfig())
+//	token := s.Token(s.Claims("alice", "admin"))
+//	expired := s.ExpiredToken(s.Claims("alice", "admin"))
+package authtest
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/audit"
+	"github.com/cheebz/go-auth/client"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/handlers"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/middleware"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/policy"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/cheebz/go-auth/responses"
+	"github.com/cheebz/go-auth/templates"
+	"github.com/google/uuid"
+)
+
+// Secret is the JWT_KEY of servers configured without one
+const Secret = "authtest"
+
+type Server struct {
+	*httptest.Server
+	Conf   config.Configuration
+	Repo   repositories.Repository
+	Hasher hash.Hash
+	JWT    *jwt.JWTHelper
+	t      testing.TB
+}
+
+// NewServer starts go-auth with a memory repository and a cheap hash. It
+// signs tokens with the configuration's JWT_KEY, or Secret, until RotateKey
+// is called. The server is closed when the test ends.
+func NewServer(t testing.TB, conf config.Configuration) *Server {
+	t.Helper()
+	if conf.JWTKey == "" {
+		conf.JWTKey = Secret
+	}
+	if conf.JWTMaxAge == 0 {
+		conf.JWTMaxAge = 1200
+	}
+	if conf.RefreshMaxAge == 0 {
+		conf.RefreshMaxAge = 2592000
+	}
+	tmpl, err := templates.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Conf:   conf,
+		Repo:   repositories.NewMemoryRepository(conf),
+		Hasher: hash.NewMultiHash(hash.NewArgon2Hash(1024, 1, 1)),
+		JWT:    jwt.NewJWTHelper(conf.JWTKey, conf.JWTMaxAge, conf.RefreshMaxAge),
+		t:      t,
+	}
+	handler := handlers.NewMuxHandler(handlers.MuxHandlerConfig{
+		Conf:      conf,
+		Resp:      responses.NewAuthResponses(true),
+		Hasher:    s.Hasher,
+		Policy:    &policy.Policy{MinLength: 8},
+		Repo:      s.Repo,
+		JWT:       s.JWT,
+		Templates: tmpl,
+		Audit:     audit.NewLogger(false, audit.NewRepositorySink(s.Repo)),
+	})
+	s.Server = httptest.NewServer(handler.GetRouter())
+	t.Cleanup(s.Close)
+	return s
+}
+
+// MiddlewareConfig verifies the server's tokens and refreshes its sessions
+func (s *Server) MiddlewareConfig() middleware.Config {
+	return middleware.Config{
+		Secret:     s.Conf.JWTKey,
+		JWKSURL:    s.URL + "/auth/.well-known/jwks.json",
+		RefreshURL: s.URL + "/auth/",
+		Client:     s.Client(),
+	}
+}
+
+// RotateKey generates a signing key of the algorithm, which signs new
+// tokens from then on. ES256 keys are published in the JWKS, HS256 keys
+// are secret, so only the server verifies the tokens they sign.
+func (s *Server) RotateKey(algorithm string) models.SigningKey {
+	s.t.Helper()
+	ctx := context.Background()
+	key, err := jwt.GenerateKey(algorithm)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	err = s.Repo.SaveSigningKey(ctx, key)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	err = s.JWT.LoadKeys(ctx, s.Repo)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return key
+}
+
+// CreateUser creates a user who can log in with the password, in the
+// public group and the given groups, which are created if needed
+func (s *Server) CreateUser(username, password string, groups ...string) models.User {
+	s.t.Helper()
+	ctx := context.Background()
+	hashed, err := s.Hasher.Generate(password)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	now := time.Now()
+	user, err := s.Repo.CreateUser(ctx, models.User{
+		Username:        username,
+		Password:        hashed,
+		UUID:            uuid.New().String(),
+		Created:         now,
+		PasswordChanged: now,
+	})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for _, name := range groups {
+		group, err := s.Repo.GetGroupByName(ctx, name)
+		if errors.Is(err, repositories.ErrNotFound) {
+			group, err = s.Repo.CreateGroup(ctx, name)
+		}
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		err = s.Repo.AddUserToGroup(ctx, user.ID, group.ID)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	return user
+}
+
+// Login returns a client with a session of the user
+func (s *Server) Login(username, password string) *client.Client {
+	s.t.Helper()
+	c, err := client.New(s.URL, s.Client())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	err = c.Login(context.Background(), username, password)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,85 @@
+package authtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/middleware"
+)
+
+var admin = middleware.RequireGroup("admin")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	claims, _ := middleware.ClaimsFromContext(r.Context())
+	w.Write([]byte(claims.Username))
+}))
+
+func serve(t *testing.T, m *middleware.Middleware, token string) int {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	m.Require(admin).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestTokens(t *testing.T) {
+	for _, algorithm := range []string{"", jwt.ES256} {
+		t.Run(algorithm, func(t *testing.T) {
+			s := NewServer(t, config.Configuration{})
+			if algorithm != "" {
+				s.RotateKey(algorithm)
+			}
+			m, err := middleware.New(s.MiddlewareConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := s.Claims("alice", "admin")
+			if claims.Groups[0].ID != 2 {
+				t.Fatal("existing group not looked up", claims.Groups)
+			}
+			if code := serve(t, m, s.Token(claims)); code != http.StatusOK {
+				t.Fatal("valid token rejected", code)
+			}
+			if code := serve(t, m, s.Token(s.Claims("alice"))); code != http.StatusForbidden {
+				t.Fatal("token without group allowed", code)
+			}
+			for name, token := range map[string]string{
+				"expired":         s.ExpiredToken(claims),
+				"tampered":        s.TamperedToken(s.Claims("alice"), claims),
+				"wrong algorithm": s.WrongAlgorithmToken(claims),
+				"unsigned":        s.UnsignedToken(claims),
+			} {
+				if code := serve(t, m, token); code != http.StatusUnauthorized {
+					t.Fatal(name, "token accepted", code)
+				}
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := NewServer(t, config.Configuration{})
+	user := s.CreateUser("alice", "correct horse", "admin", "billing")
+	c := s.Login("alice", "correct horse")
+	auth, err := c.Auth(context.Background())
+	if err != nil || auth.UUID != user.UUID || len(auth.Groups) != 3 {
+		t.Fatal("unexpected session", auth, err)
+	}
+	token, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := middleware.New(s.MiddlewareConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(t, m, token); code != http.StatusOK {
+		t.Fatal("session token rejected", code)
+	}
+	if claims := s.Claims("alice", "billing"); claims.UserID != user.ID || claims.Groups[0].ID == 0 {
+		t.Fatal("existing user not looked up", claims)
+	}
+}
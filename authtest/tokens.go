@@ -0,0 +1,131 @@
+package authtest
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	gojwt "github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// Claims of a session of the user in the groups. Users and groups that
+// exist on the server keep their IDs, the others get a new UUID and ID 0.
+func (s *Server) Claims(username string, groups ...string) jwt.JWTClaims {
+	s.t.Helper()
+	ctx := context.Background()
+	claims := jwt.JWTClaims{Username: username, Groups: []models.Group{}}
+	user, err := s.Repo.GetUserByName(ctx, username)
+	switch {
+	case err == nil:
+		claims.UserID = user.ID
+		claims.UUID = user.UUID
+	case errors.Is(err, repositories.ErrNotFound):
+		claims.UUID = uuid.New().String()
+	default:
+		s.t.Fatal(err)
+	}
+	for _, name := range groups {
+		group, err := s.Repo.GetGroupByName(ctx, name)
+		if errors.Is(err, repositories.ErrNotFound) {
+			group = models.Group{Name: name}
+		} else if err != nil {
+			s.t.Fatal(err)
+		}
+		claims.Groups = append(claims.Groups, group)
+	}
+	return claims
+}
+
+// Token signs the claims like a session token of the server. Claims
+// without an expiry expire after JWT_MAX_AGE.
+func (s *Server) Token(claims jwt.JWTClaims) string {
+	s.t.Helper()
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = time.Now().Add(time.Duration(s.Conf.JWTMaxAge) * time.Minute).Unix()
+	}
+	if claims.Issuer == "" {
+		claims.Issuer = "dev"
+	}
+	token, err := s.JWT.SignJWT(claims)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return token
+}
+
+// ExpiredToken signs the claims with an expiry an hour ago
+func (s *Server) ExpiredToken(claims jwt.JWTClaims) string {
+	s.t.Helper()
+	claims.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+	return s.Token(claims)
+}
+
+// TamperedToken returns a token signed for the issued claims that carries
+// the claims instead, like one a client edited to add groups
+func (s *Server) TamperedToken(issued, claims jwt.JWTClaims) string {
+	s.t.Helper()
+	parts := strings.Split(s.Token(issued), ".")
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = time.Now().Add(time.Duration(s.Conf.JWTMaxAge) * time.Minute).Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+// WrongAlgorithmToken signs the claims with a key the verifier knows, but
+// an algorithm the key is not used with. With an ES256 key it is the
+// public key used as an HMAC secret, otherwise the secret with HS512.
+func (s *Server) WrongAlgorithmToken(claims jwt.JWTClaims) string {
+	s.t.Helper()
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = time.Now().Add(time.Duration(s.Conf.JWTMaxAge) * time.Minute).Unix()
+	}
+	var token string
+	var err error
+	jwks := s.JWT.JWKS()
+	if len(jwks.Keys) == 0 {
+		token, err = gojwt.NewWithClaims(gojwt.SigningMethodHS512, claims).SignedString([]byte(s.Conf.JWTKey))
+	} else {
+		var der []byte
+		der, err = publicKeyDER(jwks.Keys[0])
+		if err == nil {
+			t := gojwt.NewWithClaims(gojwt.SigningMethodHS256, claims)
+			t.Header["kid"] = jwks.Keys[0].Kid
+			token, err = t.SignedString(der)
+		}
+	}
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return token
+}
+
+// UnsignedToken returns the claims with the "none" algorithm
+func (s *Server) UnsignedToken(claims jwt.JWTClaims) string {
+	s.t.Helper()
+	token, err := gojwt.NewWithClaims(gojwt.SigningMethodNone, claims).SignedString(gojwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return token
+}
+
+func publicKeyDER(key jwt.JWK) ([]byte, error) {
+	public, err := key.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKIXPublicKey(public)
+}
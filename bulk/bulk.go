@@ -0,0 +1,297 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cheebz/go-auth/authn"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/google/uuid"
+)
+
+// ErrMalformed is returned when the input cannot be decoded
+var ErrMalformed = errors.New("malformed input")
+
+// Users are read and written in pages and batches of this size by default
+const DefaultBatchSize = 100
+
+// Larger batches are cut to this size, so one transaction can't hold its
+// locks for the whole import
+const MaxBatchSize = 1000
+
+// Records without groups are put in this group, like registered users
+const defaultGroup = "public"
+
+// ImportOptions controls how records are imported
+type ImportOptions struct {
+	// repositories.ImportSkip, ImportOverwrite or ImportFail
+	OnConflict string
+	// Validate and report what would happen without writing anything
+	DryRun bool
+	// Users written per transaction, at most MaxBatchSize
+	BatchSize int
+}
+
+// Report summarizes an import. Rejected records were invalid, or conflicted
+// with an existing user when conflicts fail the import.
+type Report struct {
+	DryRun   bool          `json:"dry_run"`
+	Created  int           `json:"created"`
+	Updated  int           `json:"updated"`
+	Skipped  int           `json:"skipped"`
+	Rejected int           `json:"rejected"`
+	Errors   []RecordError `json:"errors,omitempty"`
+}
+
+// RecordError reports why a record was rejected. Records are numbered from 1.
+type RecordError struct {
+	Record   int    `json:"record"`
+	Username string `json:"username,omitempty"`
+	Error    string `json:"error"`
+}
+
+// Export writes every user with its groups and returns how many were written
+func Export(ctx context.Context, repo repositories.Repository, enc Encoder) (int, error) {
+	count := 0
+	afterID := 0
+	for {
+		users, err := repo.ListUsers(ctx, afterID, DefaultBatchSize)
+		if err != nil {
+			return count, err
+		}
+		for _, user := range users {
+			groups, err := repo.GetUserGroups(ctx, user.ID)
+			if err != nil {
+				return count, err
+			}
+			record := Record{
+				Username:        user.Username,
+				Password:        user.Password,
+				UUID:            user.UUID,
+				Created:         user.Created,
+				PasswordChanged: user.PasswordChanged,
+				Disabled:        user.Disabled,
+				Groups:          []string{},
+			}
+			for _, group := range groups {
+				record.Groups = append(record.Groups, group.Name)
+			}
+			err = enc.Encode(record)
+			if err != nil {
+				return count, err
+			}
+			count++
+			afterID = user.ID
+		}
+		if len(users) < DefaultBatchSize {
+			break
+		}
+	}
+	return count, enc.Flush()
+}
+
+type importer struct {
+	repo     repositories.Repository
+	verifier hash.Verifier
+	opts     ImportOptions
+	report   Report
+	groups   map[string]models.Group
+	// usernames seen during a dry run
+	seen map[string]bool
+}
+
+// Import reads records and writes them in batches, each in one transaction.
+// Invalid records are reported and left out. The verifier has to accept
+// every password hash, so users can log in once imported.
+//
+// When conflicts fail the import it stops at the batch with the conflict,
+// and batches before it stay written. Run a dry run first to find them.
+func Import(ctx context.Context, repo repositories.Repository, verifier hash.Verifier, dec Decoder, opts ImportOptions) (Report, error) {
+	switch opts.OnConflict {
+	case repositories.ImportSkip, repositories.ImportOverwrite, repositories.ImportFail:
+	default:
+		return Report{}, fmt.Errorf("unsupported conflict strategy: %s", opts.OnConflict)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.BatchSize > MaxBatchSize {
+		opts.BatchSize = MaxBatchSize
+	}
+	i := &importer{
+		repo:     repo,
+		verifier: verifier,
+		opts:     opts,
+		report:   Report{DryRun: opts.DryRun},
+		groups:   make(map[string]models.Group),
+		seen:     make(map[string]bool),
+	}
+	var batch []models.UserImport
+	var numbers []int
+	for n := 1; ; n++ {
+		record, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return i.report, fmt.Errorf("%w: %s", ErrMalformed, err.Error())
+		}
+		user, err := i.validate(ctx, record)
+		if err != nil {
+			i.reject(n, record.Username, err)
+			continue
+		}
+		if opts.DryRun {
+			err = i.check(ctx, n, user)
+			if err != nil {
+				return i.report, err
+			}
+			continue
+		}
+		batch = append(batch, user)
+		numbers = append(numbers, n)
+		if len(batch) == opts.BatchSize {
+			err = i.write(ctx, batch, numbers)
+			if err != nil {
+				return i.report, err
+			}
+			batch, numbers = batch[:0], numbers[:0]
+		}
+	}
+	if len(batch) > 0 {
+		err := i.write(ctx, batch, numbers)
+		if err != nil {
+			return i.report, err
+		}
+	}
+	return i.report, nil
+}
+
+func (i *importer) reject(n int, username string, err error) {
+	i.report.Rejected++
+	i.report.Errors = append(i.report.Errors, RecordError{Record: n, Username: username, Error: err.Error()})
+}
+
+// Turn a record into a user, filling in defaults and resolving groups
+func (i *importer) validate(ctx context.Context, record Record) (models.UserImport, error) {
+	user := models.UserImport{User: models.User{
+		Username:        record.Username,
+		Password:        record.Password,
+		UUID:            record.UUID,
+		Created:         record.Created,
+		PasswordChanged: record.PasswordChanged,
+		Disabled:        record.Disabled,
+	}}
+	if record.Username == "" {
+		return user, errors.New("username is required")
+	}
+	if record.Password == "" {
+		return user, errors.New("password hash is required")
+	}
+	// users provisioned by an external authenticator keep their marker
+	if !authn.IsExternal(record.Password) {
+		err := i.verifier.Validate(record.Password)
+		if err != nil {
+			return user, fmt.Errorf("invalid password hash: %w", err)
+		}
+	}
+	if user.User.UUID == "" {
+		user.User.UUID = uuid.New().String()
+	} else if _, err := uuid.Parse(user.User.UUID); err != nil {
+		return user, fmt.Errorf("invalid uuid: %w", err)
+	}
+	if user.User.Created.IsZero() {
+		user.User.Created = time.Now()
+	}
+	if user.User.PasswordChanged.IsZero() {
+		user.User.PasswordChanged = user.User.Created
+	}
+	names := record.Groups
+	if len(names) == 0 {
+		names = []string{defaultGroup}
+	}
+	added := make(map[int]bool)
+	for _, name := range names {
+		group, err := i.group(ctx, name)
+		if err != nil {
+			return user, err
+		}
+		if !added[group.ID] {
+			added[group.ID] = true
+			user.GroupIDs = append(user.GroupIDs, group.ID)
+		}
+	}
+	return user, nil
+}
+
+func (i *importer) group(ctx context.Context, name string) (models.Group, error) {
+	group, ok := i.groups[name]
+	if ok {
+		return group, nil
+	}
+	group, err := i.repo.GetGroupByName(ctx, name)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return group, fmt.Errorf("group %s does not exist", name)
+	}
+	if err != nil {
+		return group, err
+	}
+	i.groups[name] = group
+	return group, nil
+}
+
+// Predict what importing a user would do, counting usernames repeated in
+// the input as existing
+func (i *importer) check(ctx context.Context, n int, user models.UserImport) error {
+	username := user.User.Username
+	exists := i.seen[username]
+	if !exists {
+		_, err := i.repo.GetUserByName(ctx, username)
+		if err != nil && !errors.Is(err, repositories.ErrNotFound) {
+			return err
+		}
+		exists = err == nil
+	}
+	i.seen[username] = true
+	switch {
+	case !exists:
+		i.report.Created++
+	case i.opts.OnConflict == repositories.ImportSkip:
+		i.report.Skipped++
+	case i.opts.OnConflict == repositories.ImportOverwrite:
+		i.report.Updated++
+	default:
+		i.reject(n, username, fmt.Errorf("username %s already exists", username))
+	}
+	return nil
+}
+
+func (i *importer) write(ctx context.Context, batch []models.UserImport, numbers []int) error {
+	outcomes, err := i.repo.ImportUsers(ctx, batch, i.opts.OnConflict)
+	if errors.Is(err, repositories.ErrConflict) {
+		i.report.Rejected += len(batch)
+		i.report.Errors = append(i.report.Errors, RecordError{
+			Record: numbers[0],
+			Error:  fmt.Sprintf("records %d to %d not imported: %s", numbers[0], numbers[len(numbers)-1], err.Error()),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	for _, outcome := range outcomes {
+		switch outcome {
+		case repositories.ImportCreated:
+			i.report.Created++
+		case repositories.ImportUpdated:
+			i.report.Updated++
+		case repositories.ImportSkipped:
+			i.report.Skipped++
+		}
+	}
+	return nil
+}
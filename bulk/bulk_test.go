@@ -0,0 +1,217 @@
+package bulk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/google/uuid"
+)
+
+var testHash = hash.NewMultiHash(hash.NewArgon2Hash(1024, 1, 1), hash.NewBCryptHash(4))
+
+func newTestRepository(t *testing.T) (repositories.Repository, models.User) {
+	t.Helper()
+	repo := repositories.NewMemoryRepository(config.Configuration{})
+	password, err := testHash.Generate("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := repo.CreateUser(context.Background(), models.User{
+		Username: "alice",
+		Password: password,
+		Created:  time.Now().Add(-time.Hour).Truncate(time.Second),
+		UUID:     uuid.New().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.AddUserToGroup(context.Background(), user.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, user
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []string{FormatJSONL, FormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			source, user := newTestRepository(t)
+			var buf bytes.Buffer
+			enc, err := NewEncoder(&buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, err := Export(context.Background(), source, enc)
+			if err != nil || count != 1 {
+				t.Fatal("failed to export", count, err)
+			}
+
+			target := repositories.NewMemoryRepository(config.Configuration{})
+			dec, err := NewDecoder(&buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := Import(context.Background(), target, testHash, dec, ImportOptions{OnConflict: repositories.ImportFail})
+			if err != nil {
+				t.Fatal("failed to import", err)
+			}
+			if report.Created != 1 || report.Rejected != 0 {
+				t.Fatal("unexpected report", report)
+			}
+			imported, err := target.GetUserByName(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported.UUID != user.UUID || imported.Password != user.Password || !imported.Created.Equal(user.Created) {
+				t.Fatal("imported user does not match", imported, user)
+			}
+			if testHash.Check(imported.Password, "correct horse") != nil {
+				t.Fatal("imported password does not verify")
+			}
+			groups, err := target.GetUserGroups(context.Background(), imported.ID)
+			if err != nil || len(groups) != 2 || groups[1].Name != "admin" {
+				t.Fatal("groups not imported", groups, err)
+			}
+		})
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	bcrypt, err := hash.NewBCryptHash(4).Generate("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Join([]string{
+		"username,password,groups,disabled",
+		"bob," + bcrypt + ",,",
+		"alice," + bcrypt + ",admin,true",
+		"carol,plaintext,,",
+		"dave," + bcrypt + ",missing,",
+		"," + bcrypt + ",,",
+	}, "\n")
+	newDecoder := func() Decoder {
+		dec, err := NewDecoder(strings.NewReader(input), FormatCSV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dec
+	}
+	ctx := context.Background()
+
+	repo, alice := newTestRepository(t)
+	report, err := Import(ctx, repo, testHash, newDecoder(), ImportOptions{OnConflict: repositories.ImportFail, DryRun: true})
+	if err != nil {
+		t.Fatal("dry run failed", err)
+	}
+	if !report.DryRun || report.Created != 1 || report.Rejected != 4 || len(report.Errors) != 4 {
+		t.Fatal("unexpected dry run report", report)
+	}
+	_, err = repo.GetUserByName(ctx, "bob")
+	if !errors.Is(err, repositories.ErrNotFound) {
+		t.Fatal("dry run wrote users", err)
+	}
+
+	report, err = Import(ctx, repo, testHash, newDecoder(), ImportOptions{OnConflict: repositories.ImportFail})
+	if !errors.Is(err, repositories.ErrConflict) {
+		t.Fatal("expected conflict", err)
+	}
+	if report.Created != 0 {
+		t.Fatal("batch with conflict was partly imported", report)
+	}
+
+	report, err = Import(ctx, repo, testHash, newDecoder(), ImportOptions{OnConflict: repositories.ImportSkip, BatchSize: 1})
+	if err != nil {
+		t.Fatal("failed to import", err)
+	}
+	if report.Created != 1 || report.Skipped != 1 || report.Rejected != 3 {
+		t.Fatal("unexpected report skipping conflicts", report)
+	}
+	unchanged, _ := repo.GetUserByName(ctx, "alice")
+	if unchanged.Password != alice.Password {
+		t.Fatal("skipped user was changed")
+	}
+
+	report, err = Import(ctx, repo, testHash, newDecoder(), ImportOptions{OnConflict: repositories.ImportOverwrite})
+	if err != nil {
+		t.Fatal("failed to import", err)
+	}
+	if report.Updated != 2 || report.Rejected != 3 {
+		t.Fatal("unexpected report overwriting", report)
+	}
+	overwritten, _ := repo.GetUserByName(ctx, "alice")
+	if overwritten.Password != bcrypt || !overwritten.Disabled || overwritten.UUID != alice.UUID {
+		t.Fatal("user not overwritten", overwritten)
+	}
+
+	_, err = Import(ctx, repo, testHash, newDecoder(), ImportOptions{OnConflict: "merge"})
+	if err == nil {
+		t.Fatal("imported with unsupported conflict strategy")
+	}
+}
+
+func TestImportInvalidHashes(t *testing.T) {
+	hashes := []string{
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$!!!!",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0",
+		"$2a$04$truncated",
+	}
+	var input strings.Builder
+	for i, hash := range hashes {
+		input.WriteString(fmt.Sprintf(`{"username":"user%d","password":%q}`+"\n", i, hash))
+	}
+	dec, err := NewDecoder(strings.NewReader(input.String()), FormatJSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := repositories.NewMemoryRepository(config.Configuration{})
+	report, err := Import(context.Background(), repo, testHash, dec, ImportOptions{OnConflict: repositories.ImportFail})
+	if err != nil {
+		t.Fatal("failed to import", err)
+	}
+	if report.Created != 0 || report.Rejected != len(hashes) {
+		t.Fatal("invalid hashes imported", report)
+	}
+}
+
+// Counts the users written per transaction
+type batchRepository struct {
+	repositories.Repository
+	batches []int
+}
+
+func (r *batchRepository) ImportUsers(ctx context.Context, users []models.UserImport, onConflict string) ([]string, error) {
+	r.batches = append(r.batches, len(users))
+	return r.Repository.ImportUsers(ctx, users, onConflict)
+}
+
+func TestImportMaxBatchSize(t *testing.T) {
+	password, err := testHash.Generate("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var input strings.Builder
+	for i := 0; i <= MaxBatchSize; i++ {
+		input.WriteString(fmt.Sprintf(`{"username":"user%d","password":%q}`+"\n", i, password))
+	}
+	dec, err := NewDecoder(strings.NewReader(input.String()), FormatJSONL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &batchRepository{Repository: repositories.NewMemoryRepository(config.Configuration{})}
+	report, err := Import(context.Background(), repo, testHash, dec, ImportOptions{OnConflict: repositories.ImportFail, BatchSize: 1 << 30})
+	if err != nil || report.Created != MaxBatchSize+1 {
+		t.Fatal("failed to import", report, err)
+	}
+	if len(repo.batches) != 2 || repo.batches[0] != MaxBatchSize {
+		t.Fatal("unexpected batches", repo.batches)
+	}
+}
@@ -0,0 +1,234 @@
+package bulk
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported formats
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// Groups are joined with this separator in CSV
+const groupSeparator = ";"
+
+// Longest JSON line accepted on import
+const maxLineSize = 1024 * 1024
+
+var csvHeader = []string{"username", "password", "uuid", "created", "password_changed", "disabled", "groups"}
+
+// Record is a user as it is exported and imported, with its password hash
+// and the names of its groups
+type Record struct {
+	Username        string    `json:"username"`
+	Password        string    `json:"password"`
+	UUID            string    `json:"uuid,omitempty"`
+	Created         time.Time `json:"created"`
+	PasswordChanged time.Time `json:"password_changed"`
+	Disabled        bool      `json:"disabled"`
+	Groups          []string  `json:"groups"`
+}
+
+// Encoder writes records in one of the supported formats
+type Encoder interface {
+	Encode(record Record) error
+	Flush() error
+}
+
+// Decoder reads records, returning io.EOF once there are none left
+type Decoder interface {
+	Decode() (Record, error)
+}
+
+func NewEncoder(w io.Writer, format string) (Encoder, error) {
+	switch format {
+	case FormatJSONL:
+		return &jsonlEncoder{enc: json.NewEncoder(w)}, nil
+	case FormatCSV:
+		return &csvEncoder{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+func NewDecoder(r io.Reader, format string) (Decoder, error) {
+	switch format {
+	case FormatJSONL:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, maxLineSize)
+		return &jsonlDecoder{scanner: scanner}, nil
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		return &csvDecoder{r: reader}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+// FormatForName picks a format from a file name, defaulting to JSON Lines
+func FormatForName(name string) string {
+	if strings.HasSuffix(name, ".csv") {
+		return FormatCSV
+	}
+	return FormatJSONL
+}
+
+type jsonlEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlEncoder) Encode(record Record) error {
+	return e.enc.Encode(record)
+}
+
+func (e *jsonlEncoder) Flush() error {
+	return nil
+}
+
+type jsonlDecoder struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (d *jsonlDecoder) Decode() (Record, error) {
+	var record Record
+	for d.scanner.Scan() {
+		d.line++
+		line := strings.TrimSpace(d.scanner.Text())
+		if line == "" {
+			continue
+		}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			return record, fmt.Errorf("line %d: %w", d.line, err)
+		}
+		return record, nil
+	}
+	err := d.scanner.Err()
+	if err != nil {
+		return record, err
+	}
+	return record, io.EOF
+}
+
+type csvEncoder struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (e *csvEncoder) Encode(record Record) error {
+	if !e.headerWritten {
+		err := e.w.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+		e.headerWritten = true
+	}
+	return e.w.Write([]string{
+		record.Username,
+		record.Password,
+		record.UUID,
+		formatTime(record.Created),
+		formatTime(record.PasswordChanged),
+		strconv.FormatBool(record.Disabled),
+		strings.Join(record.Groups, groupSeparator),
+	})
+}
+
+// The header is written even if there were no records
+func (e *csvEncoder) Flush() error {
+	if !e.headerWritten {
+		err := e.w.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+		e.headerWritten = true
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// csvDecoder maps columns by the names in the header, so they can be in any
+// order and only username and password are required
+type csvDecoder struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func (d *csvDecoder) Decode() (Record, error) {
+	var record Record
+	if d.columns == nil {
+		header, err := d.r.Read()
+		if err != nil {
+			return record, err
+		}
+		d.columns = make(map[string]int, len(header))
+		for i, name := range header {
+			d.columns[strings.TrimSpace(strings.ToLower(name))] = i
+		}
+		for _, name := range []string{"username", "password"} {
+			if _, ok := d.columns[name]; !ok {
+				return record, fmt.Errorf("missing column: %s", name)
+			}
+		}
+	}
+	row, err := d.r.Read()
+	if err != nil {
+		return record, err
+	}
+	line, _ := d.r.FieldPos(0)
+	field := func(name string) string {
+		i, ok := d.columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+	record.Username = field("username")
+	record.Password = field("password")
+	record.UUID = field("uuid")
+	record.Created, err = parseTime(field("created"))
+	if err != nil {
+		return record, fmt.Errorf("line %d: invalid created: %w", line, err)
+	}
+	record.PasswordChanged, err = parseTime(field("password_changed"))
+	if err != nil {
+		return record, fmt.Errorf("line %d: invalid password_changed: %w", line, err)
+	}
+	if v := field("disabled"); v != "" {
+		record.Disabled, err = strconv.ParseBool(v)
+		if err != nil {
+			return record, fmt.Errorf("line %d: invalid disabled: %w", line, err)
+		}
+	}
+	for _, group := range strings.Split(field("groups"), groupSeparator) {
+		group = strings.TrimSpace(group)
+		if group != "" {
+			record.Groups = append(record.Groups, group)
+		}
+	}
+	return record, nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -1,6 +1,7 @@
 package captcha
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -8,6 +9,9 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+
+	"github.com/cheebz/go-auth/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // HCaptchaValidation struct
@@ -15,14 +19,17 @@ type HCaptchaValidation struct {
 	Success bool `json:"success"`
 }
 
-func ValidateHCaptcha(hCaptchaResponse string, hCaptchaSecret string) error {
+func ValidateHCaptcha(ctx context.Context, hCaptchaResponse string, hCaptchaSecret string) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "captcha.ValidateHCaptcha", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
 	endpoint := "https://hcaptcha.com/siteverify"
 	data := url.Values{}
 	data.Set("secret", hCaptchaSecret)
 	data.Set("response", hCaptchaResponse)
 
 	client := &http.Client{}
-	r, err := http.NewRequest("POST", endpoint, strings.NewReader(data.Encode())) // URL-encoded payload
+	r, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(data.Encode())) // URL-encoded payload
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cheebz/go-auth/bulk"
+	"github.com/cheebz/go-auth/models"
+)
+
+// The admin endpoints need a session of a user in the admin group, and
+// return ErrForbidden otherwise.
+
+// AuditEvents returns the audit events matching the filter
+func (c *Client) AuditEvents(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error) {
+	query := url.Values{}
+	if filter.UserID != 0 {
+		query.Set("user_id", strconv.Itoa(filter.UserID))
+	}
+	if filter.Type != "" {
+		query.Set("type", filter.Type)
+	}
+	if !filter.Since.IsZero() {
+		query.Set("since", filter.Since.Format(time.RFC3339))
+	}
+	if !filter.Until.IsZero() {
+		query.Set("until", filter.Until.Format(time.RFC3339))
+	}
+	if filter.Limit != 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	var events []models.AuditEvent
+	err := c.getJSON(ctx, "/auth/admin/audit", query, &events)
+	return events, err
+}
+
+// ExportUsers writes every user to w in the bulk format, which defaults to
+// JSON Lines
+func (c *Client) ExportUsers(ctx context.Context, format string, w io.Writer) error {
+	query := url.Values{}
+	if format != "" {
+		query.Set("format", format)
+	}
+	req, err := c.newRequest(ctx, "GET", "/auth/admin/users/export", query, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Content types of the import formats
+var importContentTypes = map[string]string{
+	"":               "application/x-ndjson",
+	bulk.FormatJSONL: "application/x-ndjson",
+	bulk.FormatCSV:   "text/csv",
+}
+
+// ImportUsers imports users read from r in the bulk format, which defaults
+// to JSON Lines. When they conflict with existing users and opts.OnConflict
+// is fail, the report is returned with an error matching ErrConflict.
+func (c *Client) ImportUsers(ctx context.Context, format string, r io.Reader, opts bulk.ImportOptions) (bulk.Report, error) {
+	var report bulk.Report
+	contentType, ok := importContentTypes[format]
+	if !ok {
+		return report, fmt.Errorf("unsupported format: %s", format)
+	}
+	query := url.Values{}
+	if opts.OnConflict != "" {
+		query.Set("on_conflict", opts.OnConflict)
+	}
+	if opts.DryRun {
+		query.Set("dry_run", "true")
+	}
+	if opts.BatchSize != 0 {
+		query.Set("batch_size", strconv.Itoa(opts.BatchSize))
+	}
+	req, err := c.newRequest(ctx, "POST", "/auth/admin/users/import", query, r)
+	if err != nil {
+		return report, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	res, err := c.do(req)
+	if err != nil {
+		return report, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusConflict {
+		return report, responseError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&report)
+	if err != nil {
+		return report, err
+	}
+	if res.StatusCode == http.StatusConflict {
+		return report, &Error{StatusCode: res.StatusCode, Message: "users conflict with existing users"}
+	}
+	return report, nil
+}
@@ -0,0 +1,290 @@
+// Package client is a Go client for the go-auth HTTP API. It keeps the
+// session cookies in a cookie jar and refreshes expired sessions.
+//
+//	c, err := client.New("https://example.com", nil)
+//	err = c.Login(ctx, "alice", "correct horse")
+//	auth, err := c.Auth(ctx)
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/models"
+)
+
+type Client struct {
+	base *url.URL
+	http *http.Client
+}
+
+// New creates a client for the go-auth server at baseURL. The http client
+// is copied, given a cookie jar if it has none, and set not to follow
+// redirects. When nil, a client with a ten second timeout is used.
+func New(baseURL string, httpClient *http.Client) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("invalid base URL: %s", baseURL)
+	}
+	c := &Client{base: base, http: &http.Client{Timeout: 10 * time.Second}}
+	if httpClient != nil {
+		copied := *httpClient
+		c.http = &copied
+	}
+	if c.http.Jar == nil {
+		c.http.Jar, err = cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// redirects tell login and logout results apart
+	c.http.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return c, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *c.base
+	u.Path += path
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+func (c *Client) postForm(ctx context.Context, path string, form url.Values) (*http.Response, error) {
+	req, err := c.newRequest(ctx, "POST", path, nil, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.http.Do(req)
+}
+
+// Value of a session cookie in the jar, or "" if it is missing or expired
+func (c *Client) cookie(name string) string {
+	for _, cookie := range c.http.Jar.Cookies(c.base) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// Send a request that needs a session. An expired session is refreshed
+// before the request, and the request is retried once if it is still
+// unauthorized and its body can be replayed.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.cookie("jwt") == "" && c.cookie("refresh") != "" {
+		// the jar drops the jwt cookie when the token expires
+		_, _ = c.Auth(req.Context())
+	}
+	c.authorize(req)
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusUnauthorized || c.cookie("refresh") == "" {
+		return res, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return res, nil
+	}
+	if _, err := c.Auth(req.Context()); err != nil {
+		return res, nil
+	}
+	res.Body.Close()
+	retry := req.Clone(req.Context())
+	// the client added the expired cookies to the request
+	retry.Header.Del("Cookie")
+	c.authorize(retry)
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.http.Do(retry)
+}
+
+// Send the session token as a bearer token too, which state changing admin
+// endpoints require
+func (c *Client) authorize(req *http.Request) {
+	if token := c.cookie("jwt"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// Send a request that needs a session and decode its JSON response
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	req, err := c.newRequest(ctx, "GET", path, query, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Login creates a session. ErrPasswordExpired is returned when the password
+// must be changed first.
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	res, err := c.postForm(ctx, "/auth/login", url.Values{
+		"username": {username},
+		"password": {password},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		return responseError(res)
+	}
+	location, err := res.Location()
+	if err == nil && location.Path == "/auth/password" {
+		return ErrPasswordExpired
+	}
+	return nil
+}
+
+// Register creates a user, without logging in. Passwords violating the
+// policy return a *policy.Error.
+func (c *Client) Register(ctx context.Context, username, password string) error {
+	res, err := c.postForm(ctx, "/auth/register", url.Values{
+		"username":         {username},
+		"password":         {password},
+		"confirm-password": {password},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return nil
+}
+
+// Auth returns the user of the session, refreshing it if it has expired
+func (c *Client) Auth(ctx context.Context) (models.Auth, error) {
+	var auth models.Auth
+	req, err := c.newRequest(ctx, "GET", "/auth/", nil, nil)
+	if err != nil {
+		return auth, err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return auth, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return auth, responseError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&auth)
+	return auth, err
+}
+
+// Token returns the session token, to be sent as a bearer token to
+// services using the middleware package
+func (c *Client) Token(ctx context.Context) (string, error) {
+	if token := c.cookie("jwt"); token != "" {
+		return token, nil
+	}
+	if _, err := c.Auth(ctx); err != nil {
+		return "", err
+	}
+	if token := c.cookie("jwt"); token != "" {
+		return token, nil
+	}
+	return "", &Error{StatusCode: http.StatusUnauthorized, Message: "no session"}
+}
+
+// ChangePassword changes the password of the session's user, or of the
+// user whose login returned ErrPasswordExpired, which also creates their
+// session. Passwords violating the policy return a *policy.Error.
+func (c *Client) ChangePassword(ctx context.Context, currentPassword, newPassword string) error {
+	res, err := c.postForm(ctx, "/auth/password", url.Values{
+		"current-password": {currentPassword},
+		"new-password":     {newPassword},
+		"confirm-password": {newPassword},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// without a session the form redirects to the login page
+	if res.StatusCode == http.StatusSeeOther {
+		return &Error{StatusCode: http.StatusUnauthorized, Message: "no session"}
+	}
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	return nil
+}
+
+// Logout ends the session
+func (c *Client) Logout(ctx context.Context) error {
+	return c.logout(ctx, "/auth/logout")
+}
+
+// LogoutAll ends every session of the user
+func (c *Client) LogoutAll(ctx context.Context) error {
+	return c.logout(ctx, "/auth/logoutAll")
+}
+
+// A logout without a session redirects, which leaves it logged out too
+func (c *Client) logout(ctx context.Context, path string) error {
+	req, err := c.newRequest(ctx, "GET", path, nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusSeeOther {
+		return responseError(res)
+	}
+	return nil
+}
+
+// JWKS returns the public keys that verify session tokens
+func (c *Client) JWKS(ctx context.Context) (jwt.JWKS, error) {
+	var jwks jwt.JWKS
+	req, err := c.newRequest(ctx, "GET", "/auth/.well-known/jwks.json", nil, nil)
+	if err != nil {
+		return jwks, err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return jwks, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return jwks, responseError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&jwks)
+	return jwks, err
+}
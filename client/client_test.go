@@ -0,0 +1,245 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/audit"
+	"github.com/cheebz/go-auth/bulk"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/handlers"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/policy"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/cheebz/go-auth/responses"
+)
+
+func newTestServer(t *testing.T, conf config.Configuration) (*httptest.Server, repositories.Repository) {
+	conf.Register = true
+	conf.JWTKey = "secret"
+	conf.JWTMaxAge = 1200
+	conf.RefreshMaxAge = 3600
+	repo := repositories.NewMemoryRepository(conf)
+	handler := handlers.NewMuxHandler(handlers.MuxHandlerConfig{
+		Conf:      conf,
+		Resp:      responses.NewAuthResponses(false),
+		Hasher:    hash.NewMultiHash(hash.NewArgon2Hash(1024, 1, 1)),
+		Policy:    &policy.Policy{MinLength: 8, RejectUsername: true},
+		Repo:      repo,
+		JWT:       jwt.NewJWTHelper(conf.JWTKey, conf.JWTMaxAge, conf.RefreshMaxAge),
+		Templates: template.Must(template.ParseGlob("../templates/*.html")),
+		Audit:     audit.NewLogger(false, audit.NewRepositorySink(repo)),
+	})
+	server := httptest.NewServer(handler.GetRouter())
+	t.Cleanup(server.Close)
+	return server, repo
+}
+
+func newTestClient(t *testing.T, server *httptest.Server) *Client {
+	c, err := New(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Replace the jwt cookie in the client's jar, or drop it when value is empty
+func (c *Client) setJWT(value string) {
+	cookie := &http.Cookie{Name: "jwt", Value: value, Path: "/"}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	c.http.Jar.SetCookies(c.base, []*http.Cookie{cookie})
+}
+
+func TestSession(t *testing.T) {
+	server, _ := newTestServer(t, config.Configuration{})
+	c := newTestClient(t, server)
+	ctx := context.Background()
+
+	err := c.Register(ctx, "alice", "short")
+	var policyErr *policy.Error
+	if !errors.As(err, &policyErr) || len(policyErr.Violations) != 1 || policyErr.Violations[0].Code != policy.TooShort {
+		t.Fatal("expected policy violation", err)
+	}
+	err = c.Register(ctx, "alice", "correct horse")
+	if err != nil {
+		t.Fatal("failed to register", err)
+	}
+	err = c.Register(ctx, "alice", "correct horse")
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatal("registered duplicate user", err)
+	}
+
+	_, err = c.Auth(ctx)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected unauthorized before login", err)
+	}
+	err = c.Login(ctx, "alice", "wrong password")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("logged in with wrong password", err)
+	}
+	err = c.Login(ctx, "alice", "correct horse")
+	if err != nil {
+		t.Fatal("failed to log in", err)
+	}
+	auth, err := c.Auth(ctx)
+	if err != nil || auth.Username != "alice" || len(auth.Groups) != 1 {
+		t.Fatal("unexpected auth", auth, err)
+	}
+
+	c.setJWT("")
+	token, err := c.Token(ctx)
+	if err != nil || token == "" {
+		t.Fatal("session not refreshed for token", err)
+	}
+
+	err = c.ChangePassword(ctx, "correct horse", "alice123")
+	if !errors.As(err, &policyErr) || policyErr.Violations[0].Code != policy.SimilarUsername {
+		t.Fatal("expected policy violation", err)
+	}
+	err = c.ChangePassword(ctx, "wrong password", "battery staple")
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatal("changed password with wrong current password", err)
+	}
+	err = c.ChangePassword(ctx, "correct horse", "battery staple")
+	if err != nil {
+		t.Fatal("failed to change password", err)
+	}
+
+	err = c.Logout(ctx)
+	if err != nil {
+		t.Fatal("failed to log out", err)
+	}
+	_, err = c.Auth(ctx)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("session survived logout", err)
+	}
+	err = c.Logout(ctx)
+	if err != nil {
+		t.Fatal("logout without session failed", err)
+	}
+	err = c.ChangePassword(ctx, "battery staple", "correct horse")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("changed password without session", err)
+	}
+}
+
+func TestPasswordExpired(t *testing.T) {
+	server, repo := newTestServer(t, config.Configuration{Password: config.PasswordConfig{MaxAge: 3600}})
+	c := newTestClient(t, server)
+	ctx := context.Background()
+	err := c.Register(ctx, "alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := repo.GetUserByName(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.PasswordChanged = time.Now().Add(-2 * time.Hour)
+	_, err = repo.ImportUsers(ctx, []models.UserImport{{User: user, GroupIDs: []int{1}}}, repositories.ImportOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Login(ctx, "alice", "correct horse")
+	if !errors.Is(err, ErrPasswordExpired) {
+		t.Fatal("expected expired password", err)
+	}
+	_, err = c.Auth(ctx)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("session created with expired password", err)
+	}
+	err = c.ChangePassword(ctx, "correct horse", "battery staple")
+	if err != nil {
+		t.Fatal("failed to change expired password", err)
+	}
+	auth, err := c.Auth(ctx)
+	if err != nil || auth.Username != "alice" {
+		t.Fatal("password change did not log in", auth, err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	server, repo := newTestServer(t, config.Configuration{})
+	c := newTestClient(t, server)
+	ctx := context.Background()
+	err := c.Register(ctx, "alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Login(ctx, "alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.AuditEvents(ctx, models.AuditFilter{})
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatal("expected forbidden for non-admin", err)
+	}
+
+	user, err := repo.GetUserByName(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.AddUserToGroup(ctx, user.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an invalid token is refreshed, which picks up the new group
+	c.setJWT("invalid")
+	events, err := c.AuditEvents(ctx, models.AuditFilter{UserID: user.ID, Type: audit.LoginSuccess})
+	if err != nil || len(events) != 1 {
+		t.Fatal("unexpected audit events", events, err)
+	}
+
+	var export bytes.Buffer
+	c.setJWT("")
+	err = c.ExportUsers(ctx, bulk.FormatCSV, &export)
+	if err != nil || !strings.Contains(export.String(), "alice,") {
+		t.Fatal("failed to export users", export.String(), err)
+	}
+	report, err := c.ImportUsers(ctx, bulk.FormatCSV, bytes.NewReader(export.Bytes()), bulk.ImportOptions{})
+	if !errors.Is(err, ErrConflict) || report.Rejected != 1 {
+		t.Fatal("expected conflict", report, err)
+	}
+	report, err = c.ImportUsers(ctx, bulk.FormatCSV, bytes.NewReader(export.Bytes()), bulk.ImportOptions{OnConflict: repositories.ImportSkip})
+	if err != nil || report.Skipped != 1 {
+		t.Fatal("unexpected report", report, err)
+	}
+
+	jwks, err := c.JWKS(ctx)
+	if err != nil || len(jwks.Keys) != 0 {
+		t.Fatal("unexpected keys", jwks, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, baseURL := range []string{"", "example.com", "://"} {
+		_, err := New(baseURL, nil)
+		if err == nil {
+			t.Fatal("accepted invalid base URL", baseURL)
+		}
+	}
+	c, err := New("https://example.com/", &http.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.http.Jar == nil {
+		t.Fatal("no cookie jar")
+	}
+	u, _ := url.Parse("https://example.com/auth/login")
+	if c.base.ResolveReference(u).String() != u.String() {
+		t.Fatal("unexpected base URL", c.base)
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cheebz/go-auth/policy"
+)
+
+// Errors matched by the status of an Error
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+)
+
+// ErrPasswordExpired is returned by Login when the password must be changed
+// before a session is created. ChangePassword completes the login.
+var ErrPasswordExpired = errors.New("password expired")
+
+// Error is returned for unexpected responses from go-auth
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("go-auth: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("go-auth: %d %s", e.StatusCode, e.Message)
+}
+
+// Is matches the error for its status code
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return target == ErrBadRequest
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	}
+	return false
+}
+
+// Read the error from a response. Password policy violations are returned
+// as a *policy.Error.
+func responseError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode == http.StatusBadRequest && strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		var violations struct {
+			Violations []policy.Violation `json:"violations"`
+		}
+		if json.Unmarshal(body, &violations) == nil && len(violations.Violations) > 0 {
+			return &policy.Error{Violations: violations.Violations}
+		}
+	}
+	return &Error{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(body))}
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cheebz/go-auth/bulk"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/policy"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/google/uuid"
+)
+
+const usage = `usage: go-auth [command]
+
+Commands:
+  serve                                  serve HTTP (default)
+  migrate [up | down [steps] | status]   apply or roll back migrations
+  user create [-group name]... [-skip-policy] <username>
+  user list
+  user disable <username>
+  user enable <username>
+  user delete <username>
+  user set-password [-skip-policy] <username>
+  user export [-format jsonl|csv] [file]
+  user import [-format jsonl|csv] [-on-conflict skip|overwrite|fail]
+              [-dry-run] [-batch-size n] [file]
+  group create <name>
+  group add-member <group> <username>
+  group remove-member <group> <username>
+  sessions revoke <username>
+  keys rotate [-algorithm ES256|HS256] [-keep n]
+  keys list
+
+Passwords are read from the first line of standard input. Users are
+exported to standard output and imported from standard input unless a file
+is given, whose extension picks the default format.
+Configuration is read the same way as for serve.
+`
+
+// Number of users fetched per query by user list
+const listPageSize = bulk.DefaultBatchSize
+
+// cli holds what the admin subcommands need
+type cli struct {
+	repo   repositories.Repository
+	hasher hash.Hash
+	policy *policy.Policy
+	in     *bufio.Reader
+	out    io.Writer
+}
+
+// Open the configured repository and run an admin subcommand against it
+func runCommand(conf config.Configuration, command string, args []string) error {
+	ctx := context.Background()
+	repo, migrator, err := openRepository(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+	err = repositories.Retry(ctx, conf.Db.ConnectTimeout, "database not ready", repo.Ping)
+	if err != nil {
+		return err
+	}
+	if command == "migrate" {
+		if migrator == nil {
+			return errors.New("the demo driver has no migrations")
+		}
+		return runMigrate(migrator, args)
+	}
+	if conf.MigrateOnStart && migrator != nil {
+		err = migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	hasher, err := newHasher(conf.Hash)
+	if err != nil {
+		return err
+	}
+	passwordPolicy, err := policy.NewConfiguredPolicy(conf.Password)
+	if err != nil {
+		return err
+	}
+	c := &cli{
+		repo:   repo,
+		hasher: hasher,
+		policy: passwordPolicy,
+		in:     bufio.NewReader(os.Stdin),
+		out:    os.Stdout,
+	}
+	return c.run(ctx, command, args)
+}
+
+func (c *cli) run(ctx context.Context, command string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand for %s\n\n%s", command, usage)
+	}
+	subcommand, args := args[0], args[1:]
+	switch command + " " + subcommand {
+	case "user create":
+		return c.createUser(ctx, args)
+	case "user list":
+		return c.listUsers(ctx, args)
+	case "user disable":
+		return c.setUserDisabled(ctx, args, true)
+	case "user enable":
+		return c.setUserDisabled(ctx, args, false)
+	case "user delete":
+		return c.deleteUser(ctx, args)
+	case "user set-password":
+		return c.setPassword(ctx, args)
+	case "user export":
+		return c.exportUsers(ctx, args)
+	case "user import":
+		return c.importUsers(ctx, args)
+	case "group create":
+		return c.createGroup(ctx, args)
+	case "group add-member":
+		return c.addMember(ctx, args)
+	case "group remove-member":
+		return c.removeMember(ctx, args)
+	case "sessions revoke":
+		return c.revokeSessions(ctx, args)
+	case "keys rotate":
+		return c.rotateKeys(ctx, args)
+	case "keys list":
+		return c.listKeys(ctx, args)
+	default:
+		return fmt.Errorf("unknown command: %s %s\n\n%s", command, subcommand, usage)
+	}
+}
+
+// groupFlags collects repeated -group flags
+type groupFlags []string
+
+func (g *groupFlags) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *groupFlags) Set(value string) error {
+	*g = append(*g, value)
+	return nil
+}
+
+// Parse flags followed by exactly the named positional arguments
+func parseArgs(flags *flag.FlagSet, args []string, names ...string) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() != len(names) {
+		return nil, fmt.Errorf("expected arguments: %s", strings.Join(names, " "))
+	}
+	return flags.Args(), nil
+}
+
+// Read a password from the first line of input
+func (c *cli) readPassword() (string, error) {
+	line, err := c.in.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("no password on standard input")
+	}
+	return password, nil
+}
+
+// Read, check and hash a new password for username
+func (c *cli) newPasswordHash(username string, skipPolicy bool) (string, error) {
+	password, err := c.readPassword()
+	if err != nil {
+		return "", err
+	}
+	if !skipPolicy {
+		err = c.policy.Check(username, password)
+		if err != nil {
+			return "", err
+		}
+	}
+	return c.hasher.Generate(password)
+}
+
+func (c *cli) getUser(ctx context.Context, username string) (models.User, error) {
+	user, err := c.repo.GetUserByName(ctx, username)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return user, fmt.Errorf("user %s does not exist", username)
+	}
+	return user, err
+}
+
+func (c *cli) getGroup(ctx context.Context, name string) (models.Group, error) {
+	group, err := c.repo.GetGroupByName(ctx, name)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return group, fmt.Errorf("group %s does not exist", name)
+	}
+	return group, err
+}
+
+func (c *cli) createUser(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	var groups groupFlags
+	flags.Var(&groups, "group", "add the user to a group, may be repeated")
+	skipPolicy := flags.Bool("skip-policy", false, "do not check the password policy")
+	args, err := parseArgs(flags, args, "<username>")
+	if err != nil {
+		return err
+	}
+	user := models.User{Username: args[0]}
+	// resolve groups first so a typo does not leave a half configured user
+	var members []models.Group
+	for _, name := range groups {
+		group, err := c.getGroup(ctx, name)
+		if err != nil {
+			return err
+		}
+		members = append(members, group)
+	}
+	user.Password, err = c.newPasswordHash(user.Username, *skipPolicy)
+	if err != nil {
+		return err
+	}
+	user.UUID = uuid.New().String()
+	user.Created = time.Now()
+	user, err = c.repo.CreateUser(ctx, user)
+	if errors.Is(err, repositories.ErrConflict) {
+		return fmt.Errorf("user %s already exists", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	for _, group := range members {
+		err = c.repo.AddUserToGroup(ctx, user.ID, group.ID)
+		if err != nil && !errors.Is(err, repositories.ErrConflict) {
+			return err
+		}
+	}
+	fmt.Fprintf(c.out, "Created user %s (%s)\n", user.Username, user.UUID)
+	return nil
+}
+
+func (c *cli) listUsers(ctx context.Context, args []string) error {
+	_, err := parseArgs(flag.NewFlagSet("user list", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tUUID\tCREATED\tSTATUS")
+	afterID := 0
+	for {
+		users, err := c.repo.ListUsers(ctx, afterID, listPageSize)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			status := "active"
+			if user.Disabled {
+				status = "disabled"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", user.ID, user.Username, user.UUID, user.Created.Format("2006-01-02 15:04:05"), status)
+			afterID = user.ID
+		}
+		if len(users) < listPageSize {
+			break
+		}
+	}
+	return w.Flush()
+}
+
+// Disabling a user also revokes their sessions
+func (c *cli) setUserDisabled(ctx context.Context, args []string, disabled bool) error {
+	name := "user enable"
+	if disabled {
+		name = "user disable"
+	}
+	args, err := parseArgs(flag.NewFlagSet(name, flag.ContinueOnError), args, "<username>")
+	if err != nil {
+		return err
+	}
+	user, err := c.getUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	err = c.repo.SetUserDisabled(ctx, user.ID, disabled)
+	if err != nil {
+		return err
+	}
+	if !disabled {
+		fmt.Fprintf(c.out, "Enabled user %s\n", user.Username)
+		return nil
+	}
+	err = c.repo.DeleteAllRefresh(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Disabled user %s\n", user.Username)
+	return nil
+}
+
+func (c *cli) deleteUser(ctx context.Context, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("user delete", flag.ContinueOnError), args, "<username>")
+	if err != nil {
+		return err
+	}
+	user, err := c.getUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	err = c.repo.DeleteUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Deleted user %s\n", user.Username)
+	return nil
+}
+
+// Setting a password revokes existing sessions
+func (c *cli) setPassword(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user set-password", flag.ContinueOnError)
+	skipPolicy := flags.Bool("skip-policy", false, "do not check the password policy")
+	args, err := parseArgs(flags, args, "<username>")
+	if err != nil {
+		return err
+	}
+	user, err := c.getUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	password, err := c.newPasswordHash(user.Username, *skipPolicy)
+	if err != nil {
+		return err
+	}
+	err = c.repo.UpdatePassword(ctx, user.ID, password)
+	if err != nil {
+		return err
+	}
+	err = c.repo.DeleteAllRefresh(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Password set for user %s\n", user.Username)
+	return nil
+}
+
+// Parse flags followed by an optional file name
+func parseFileArgs(flags *flag.FlagSet, args []string) (string, error) {
+	flags.SetOutput(io.Discard)
+	err := flags.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if flags.NArg() > 1 {
+		return "", errors.New("expected arguments: [file]")
+	}
+	return flags.Arg(0), nil
+}
+
+func (c *cli) exportUsers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user export", flag.ContinueOnError)
+	format := flags.String("format", "", "jsonl or csv")
+	file, err := parseFileArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = bulk.FormatForName(file)
+	}
+	out := c.out
+	if file != "" {
+		// the export holds password hashes
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc, err := bulk.NewEncoder(out, *format)
+	if err != nil {
+		return err
+	}
+	count, err := bulk.Export(ctx, c.repo, enc)
+	if err != nil {
+		return err
+	}
+	if file != "" {
+		fmt.Fprintf(c.out, "Exported %d users to %s\n", count, file)
+	}
+	return nil
+}
+
+// Print the import report. Rejected records make the command fail.
+func (c *cli) importUsers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user import", flag.ContinueOnError)
+	format := flags.String("format", "", "jsonl or csv")
+	opts := bulk.ImportOptions{}
+	flags.StringVar(&opts.OnConflict, "on-conflict", repositories.ImportFail, "skip, overwrite or fail")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "validate without importing")
+	flags.IntVar(&opts.BatchSize, "batch-size", bulk.DefaultBatchSize, fmt.Sprintf("users written per transaction, at most %d", bulk.MaxBatchSize))
+	file, err := parseFileArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = bulk.FormatForName(file)
+	}
+	var in io.Reader = c.in
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	dec, err := bulk.NewDecoder(in, *format)
+	if err != nil {
+		return err
+	}
+	report, importErr := bulk.Import(ctx, c.repo, c.hasher, dec, opts)
+	for _, e := range report.Errors {
+		fmt.Fprintf(c.out, "record %d %s: %s\n", e.Record, e.Username, e.Error)
+	}
+	prefix := ""
+	if report.DryRun {
+		prefix = "Dry run: "
+	}
+	fmt.Fprintf(c.out, "%s%d created, %d updated, %d skipped, %d rejected\n", prefix, report.Created, report.Updated, report.Skipped, report.Rejected)
+	if importErr != nil {
+		return importErr
+	}
+	if report.Rejected > 0 {
+		return fmt.Errorf("%d records rejected", report.Rejected)
+	}
+	return nil
+}
+
+func (c *cli) createGroup(ctx context.Context, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("group create", flag.ContinueOnError), args, "<name>")
+	if err != nil {
+		return err
+	}
+	group, err := c.repo.CreateGroup(ctx, args[0])
+	if errors.Is(err, repositories.ErrConflict) {
+		return fmt.Errorf("group %s already exists", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Created group %s (%d)\n", group.Name, group.ID)
+	return nil
+}
+
+func (c *cli) getMembership(ctx context.Context, name string, args []string) (models.User, models.Group, error) {
+	args, err := parseArgs(flag.NewFlagSet(name, flag.ContinueOnError), args, "<group>", "<username>")
+	if err != nil {
+		return models.User{}, models.Group{}, err
+	}
+	group, err := c.getGroup(ctx, args[0])
+	if err != nil {
+		return models.User{}, group, err
+	}
+	user, err := c.getUser(ctx, args[1])
+	return user, group, err
+}
+
+func (c *cli) addMember(ctx context.Context, args []string) error {
+	user, group, err := c.getMembership(ctx, "group add-member", args)
+	if err != nil {
+		return err
+	}
+	err = c.repo.AddUserToGroup(ctx, user.ID, group.ID)
+	if errors.Is(err, repositories.ErrConflict) {
+		return fmt.Errorf("user %s is already in group %s", user.Username, group.Name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Added user %s to group %s\n", user.Username, group.Name)
+	return nil
+}
+
+func (c *cli) removeMember(ctx context.Context, args []string) error {
+	user, group, err := c.getMembership(ctx, "group remove-member", args)
+	if err != nil {
+		return err
+	}
+	err = c.repo.RemoveUserFromGroup(ctx, user.ID, group.ID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return fmt.Errorf("user %s is not in group %s", user.Username, group.Name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Removed user %s from group %s\n", user.Username, group.Name)
+	return nil
+}
+
+// Revoke refresh tokens. Issued JWTs stay valid until they expire.
+func (c *cli) revokeSessions(ctx context.Context, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("sessions revoke", flag.ContinueOnError), args, "<username>")
+	if err != nil {
+		return err
+	}
+	user, err := c.getUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	err = c.repo.DeleteAllRefresh(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Revoked sessions of user %s\n", user.Username)
+	return nil
+}
+
+// Add a new signing key. Running servers start signing with it once they
+// reload their keys. Older keys keep verifying tokens until they are pruned
+// with -keep, which should not happen before REFRESH_MAX_AGE has passed.
+func (c *cli) rotateKeys(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("keys rotate", flag.ContinueOnError)
+	algorithm := flags.String("algorithm", jwt.ES256, "signing algorithm")
+	keep := flags.Int("keep", 0, "number of keys to keep including the new one, 0 keeps all")
+	_, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return fmt.Errorf("invalid number of keys to keep: %d", *keep)
+	}
+	key, err := jwt.GenerateKey(*algorithm)
+	if err != nil {
+		return err
+	}
+	err = c.repo.SaveSigningKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Created %s key %s\n", key.Algorithm, key.KID)
+	if *keep == 0 {
+		return nil
+	}
+	keys, err := c.repo.GetSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+	for i, old := range keys {
+		if i < *keep {
+			continue
+		}
+		err = c.repo.DeleteSigningKey(ctx, old.KID)
+		if err != nil && !errors.Is(err, repositories.ErrNotFound) {
+			return err
+		}
+		fmt.Fprintf(c.out, "Deleted key %s\n", old.KID)
+	}
+	return nil
+}
+
+func (c *cli) listKeys(ctx context.Context, args []string) error {
+	_, err := parseArgs(flag.NewFlagSet("keys list", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	keys, err := c.repo.GetSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tALGORITHM\tCREATED\tSTATUS")
+	for i, key := range keys {
+		status := "verify"
+		if i == 0 {
+			status = "sign"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.KID, key.Algorithm, key.Created.Format("2006-01-02 15:04:05"), status)
+	}
+	return w.Flush()
+}
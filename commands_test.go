@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/policy"
+	"github.com/cheebz/go-auth/repositories"
+)
+
+func newTestCLI() *cli {
+	return &cli{
+		repo:   repositories.NewMemoryRepository(config.Configuration{}),
+		hasher: hash.NewMultiHash(hash.NewArgon2Hash(1024, 1, 1)),
+		policy: &policy.Policy{MinLength: 8, RejectUsername: true},
+		out:    &bytes.Buffer{},
+	}
+}
+
+// Run a command with input on stdin
+func (c *cli) exec(t *testing.T, input string, args ...string) error {
+	t.Helper()
+	c.in = bufio.NewReader(strings.NewReader(input))
+	return c.run(context.Background(), args[0], args[1:])
+}
+
+func TestUserCommands(t *testing.T) {
+	c := newTestCLI()
+	ctx := context.Background()
+
+	err := c.exec(t, "correct horse\n", "group", "create", "operators")
+	if err != nil {
+		t.Fatal("failed to create group", err)
+	}
+	err = c.exec(t, "correct horse\n", "user", "create", "-group", "missing", "alice")
+	if err == nil {
+		t.Fatal("created user in missing group")
+	}
+	err = c.exec(t, "short\n", "user", "create", "alice")
+	if err == nil {
+		t.Fatal("created user with password violating the policy")
+	}
+	err = c.exec(t, "correct horse\n", "user", "create", "-group", "operators", "alice")
+	if err != nil {
+		t.Fatal("failed to create user", err)
+	}
+	err = c.exec(t, "correct horse\n", "user", "create", "alice")
+	if err == nil {
+		t.Fatal("created duplicate user")
+	}
+	user, err := c.repo.GetUserByName(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.hasher.Check(user.Password, "correct horse") != nil {
+		t.Fatal("password not hashed", user.Password)
+	}
+	groups, err := c.repo.GetUserGroups(ctx, user.ID)
+	if err != nil || len(groups) != 2 || groups[1].Name != "operators" {
+		t.Fatal("user not added to group", groups, err)
+	}
+
+	err = c.exec(t, "", "group", "remove-member", "operators", "alice")
+	if err != nil {
+		t.Fatal("failed to remove member", err)
+	}
+	err = c.exec(t, "", "group", "add-member", "operators", "alice")
+	if err != nil {
+		t.Fatal("failed to add member", err)
+	}
+
+	err = c.exec(t, "battery staple\n", "user", "set-password", "alice")
+	if err != nil {
+		t.Fatal("failed to set password", err)
+	}
+	user, _ = c.repo.GetUserByName(ctx, "alice")
+	if c.hasher.Check(user.Password, "battery staple") != nil {
+		t.Fatal("password not changed")
+	}
+
+	err = c.exec(t, "", "user", "disable", "alice")
+	if err != nil {
+		t.Fatal("failed to disable user", err)
+	}
+	user, _ = c.repo.GetUserByName(ctx, "alice")
+	if !user.Disabled {
+		t.Fatal("user not disabled")
+	}
+	c.out = &bytes.Buffer{}
+	err = c.exec(t, "", "user", "list")
+	if err != nil {
+		t.Fatal("failed to list users", err)
+	}
+	if !strings.Contains(c.out.(*bytes.Buffer).String(), "disabled") {
+		t.Fatal("disabled user not listed", c.out)
+	}
+
+	err = c.exec(t, "", "user", "delete", "alice")
+	if err != nil {
+		t.Fatal("failed to delete user", err)
+	}
+	err = c.exec(t, "", "sessions", "revoke", "alice")
+	if err == nil {
+		t.Fatal("revoked sessions of deleted user")
+	}
+	err = c.exec(t, "", "user", "frobnicate")
+	if err == nil {
+		t.Fatal("ran unknown command")
+	}
+}
+
+func TestKeyCommands(t *testing.T) {
+	c := newTestCLI()
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		err := c.exec(t, "", "keys", "rotate", "-algorithm", "HS256")
+		if err != nil {
+			t.Fatal("failed to rotate keys", err)
+		}
+	}
+	keys, err := c.repo.GetSigningKeys(ctx)
+	if err != nil || len(keys) != 3 {
+		t.Fatal("expected three keys", keys, err)
+	}
+	err = c.exec(t, "", "keys", "rotate", "-keep", "2")
+	if err != nil {
+		t.Fatal("failed to rotate and prune keys", err)
+	}
+	pruned, err := c.repo.GetSigningKeys(ctx)
+	if err != nil || len(pruned) != 2 {
+		t.Fatal("expected two keys after pruning", pruned, err)
+	}
+	if pruned[1].KID != keys[0].KID {
+		t.Fatal("newest previous key not kept", pruned)
+	}
+	err = c.exec(t, "", "keys", "rotate", "-algorithm", "none")
+	if err == nil {
+		t.Fatal("rotated to unsupported algorithm")
+	}
+	c.out = &bytes.Buffer{}
+	err = c.exec(t, "", "keys", "list")
+	if err != nil {
+		t.Fatal("failed to list keys", err)
+	}
+	if !strings.Contains(c.out.(*bytes.Buffer).String(), pruned[0].KID) {
+		t.Fatal("key not listed", c.out)
+	}
+}
+
+func TestUserExportImportCommands(t *testing.T) {
+	source := newTestCLI()
+	err := source.exec(t, "correct horse\n", "user", "create", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "users.csv")
+	err = source.exec(t, "", "user", "export", file)
+	if err != nil {
+		t.Fatal("failed to export users", err)
+	}
+
+	target := newTestCLI()
+	err = target.exec(t, "", "user", "import", "-dry-run", file)
+	if err != nil {
+		t.Fatal("dry run failed", err)
+	}
+	_, err = target.repo.GetUserByName(context.Background(), "alice")
+	if !errors.Is(err, repositories.ErrNotFound) {
+		t.Fatal("dry run imported users", err)
+	}
+	err = target.exec(t, "", "user", "import", file)
+	if err != nil {
+		t.Fatal("failed to import users", err)
+	}
+	user, err := target.repo.GetUserByName(context.Background(), "alice")
+	if err != nil || target.hasher.Check(user.Password, "correct horse") != nil {
+		t.Fatal("imported user cannot log in", err)
+	}
+	err = target.exec(t, "", "user", "import", file)
+	if !errors.Is(err, repositories.ErrConflict) {
+		t.Fatal("expected conflict importing twice", err)
+	}
+}
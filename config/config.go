@@ -8,21 +8,97 @@ import (
 
 var (
 	defaults = map[string]interface{}{
-		"DEBUG":           true,
-		"PORT":            80,
-		"SSL_CERT":        "",
-		"SSL_KEY":         "",
-		"DB_HOST":         "host",
-		"DB_PORT":         5432,
-		"DB_NAME":         "database",
-		"DB_USER":         "user",
-		"DB_PASSWORD":     "password",
-		"JWT_KEY":         "secret",
-		"JWT_MAX_AGE":     1200,
-		"REFRESH_MAX_AGE": 2592000,
-		"HCAPTCHA_SECRET": "",
-		"REGISTER":        true,
-		"ALLOWED_ORIGINS": "",
+		"DEBUG":                    true,
+		"PORT":                     80,
+		"SSL_CERT":                 "",
+		"SSL_KEY":                  "",
+		"METRICS_PORT":             0,
+		"GRPC_PORT":                0,
+		"TRACING_EXPORTER":         "",
+		"TRACING_FILE":             "",
+		"TRACING_SAMPLE_RATIO":     1.0,
+		"TRACING_SERVICE_NAME":     "go-auth",
+		"AUDIT_SINKS":              "stdout",
+		"AUDIT_FILE":               "audit.log",
+		"TRUST_PROXY_HEADERS":      false,
+		"WEBHOOK_URLS":             "",
+		"WEBHOOK_SECRET":           "",
+		"WEBHOOK_MAX_ATTEMPTS":     10,
+		"WEBHOOK_POLL_INTERVAL":    5,
+		"WEBHOOK_TIMEOUT":          10,
+		"JOB_JITTER":               60,
+		"JOB_RETRIES":              3,
+		"JOB_RETRY_BACKOFF":        10,
+		"JOB_TIMEOUT":              300,
+		"PURGE_REFRESH_SCHEDULE":   "@daily",
+		"READ_TIMEOUT":             10,
+		"WRITE_TIMEOUT":            30,
+		"IDLE_TIMEOUT":             120,
+		"SHUTDOWN_DRAIN":           5,
+		"SHUTDOWN_TIMEOUT":         20,
+		"DB_DRIVER":                "postgres",
+		"DB_HOST":                  "host",
+		"DB_PORT":                  5432,
+		"DB_NAME":                  "database",
+		"DB_USER":                  "user",
+		"DB_PASSWORD":              "password",
+		"DB_PATH":                  "go-auth.db",
+		"DB_QUERY_TIMEOUT":         5,
+		"DB_URL":                   "",
+		"DB_SSL_MODE":              "prefer",
+		"DB_SSL_ROOT_CERT":         "",
+		"DB_SSL_CERT":              "",
+		"DB_SSL_KEY":               "",
+		"DB_MAX_CONNS":             0,
+		"DB_MIN_CONNS":             0,
+		"DB_MAX_CONN_LIFETIME":     0,
+		"DB_MAX_CONN_IDLE_TIME":    0,
+		"DB_CONNECT_TIMEOUT":       0,
+		"JWT_KEY":                  "secret",
+		"JWT_MAX_AGE":              1200,
+		"REFRESH_MAX_AGE":          2592000,
+		"HCAPTCHA_SECRET":          "",
+		"REGISTER":                 true,
+		"ALLOWED_ORIGINS":          "",
+		"HASH_ALGORITHM":           "argon2id",
+		"BCRYPT_COST":              14,
+		"ARGON2_MEMORY":            65536,
+		"ARGON2_TIME":              3,
+		"ARGON2_THREADS":           2,
+		"PEPPER_KEYS":              "",
+		"PEPPER_KEY_FILE":          "",
+		"PEPPER_VERSION":           "",
+		"PASSWORD_MIN_LENGTH":      8,
+		"PASSWORD_MAX_LENGTH":      128,
+		"PASSWORD_BANNED":          "",
+		"PASSWORD_BANNED_FILE":     "",
+		"PASSWORD_REJECT_USERNAME": true,
+		"PASSWORD_BREACHED_FILE":   "",
+		"PASSWORD_BREACHED_BLOOM":  true,
+		"PASSWORD_HISTORY":         0,
+		"PASSWORD_MAX_AGE":         0,
+		"MIGRATE_ON_START":         true,
+		"LDAP_URL":                 "",
+		"LDAP_START_TLS":           false,
+		"LDAP_CA_FILE":             "",
+		"LDAP_BIND_DN":             "",
+		"LDAP_BIND_PASSWORD":       "",
+		"LDAP_USER_BASE_DN":        "",
+		"LDAP_USER_FILTER":         "(uid=%s)",
+		"LDAP_GROUP_BASE_DN":       "",
+		"LDAP_GROUP_FILTER":        "(member=%s)",
+		"LDAP_GROUP_ATTRIBUTE":     "cn",
+		"LDAP_GROUP_MAP":           "",
+		"LDAP_TIMEOUT":             10,
+		"OIDC_BASE_URL":            "",
+		"GOOGLE_CLIENT_ID":         "",
+		"GOOGLE_CLIENT_SECRET":     "",
+		"GITHUB_CLIENT_ID":         "",
+		"GITHUB_CLIENT_SECRET":     "",
+		"OIDC_ISSUER":              "",
+		"OIDC_CLIENT_ID":           "",
+		"OIDC_CLIENT_SECRET":       "",
+		"OIDC_NAME":                "SSO",
 	}
 	configPaths = []string{
 		".",
@@ -31,26 +107,153 @@ var (
 
 // Configuration struct
 type Configuration struct {
-	Debug          bool       `mapstructure:"DEBUG"`
-	Port           int        `mapstructure:"PORT"`
-	SSLCert        string     `mapstructure:"SSL_CERT"`
-	SSLKey         string     `mapstructure:"SSL_KEY"`
-	Db             DataSource `mapstructure:",squash"`
-	JWTKey         string     `mapstructure:"JWT_KEY"`
-	JWTMaxAge      int        `mapstructure:"JWT_MAX_AGE"`
-	RefreshMaxAge  int        `mapstructure:"REFRESH_MAX_AGE"`
-	HCaptchaSecret string     `mapstructure:"HCAPTCHA_SECRET"`
-	Register       bool       `mapstructure:"REGISTER"`
-	AllowedOrigins string     `mapstructure:"ALLOWED_ORIGINS"`
+	Debug          bool             `mapstructure:"DEBUG"`
+	Port           int              `mapstructure:"PORT"`
+	SSLCert        string           `mapstructure:"SSL_CERT"`
+	SSLKey         string           `mapstructure:"SSL_KEY"`
+	Server         ServerConfig     `mapstructure:",squash"`
+	MetricsPort    int              `mapstructure:"METRICS_PORT"`
+	GRPCPort       int              `mapstructure:"GRPC_PORT"`
+	Tracing        TracingConfig    `mapstructure:",squash"`
+	Audit          AuditConfig      `mapstructure:",squash"`
+	Webhook        WebhookConfig    `mapstructure:",squash"`
+	Scheduler      SchedulerConfig  `mapstructure:",squash"`
+	Db             DataSource       `mapstructure:",squash"`
+	JWTKey         string           `mapstructure:"JWT_KEY"`
+	JWTMaxAge      int              `mapstructure:"JWT_MAX_AGE"`
+	RefreshMaxAge  int              `mapstructure:"REFRESH_MAX_AGE"`
+	HCaptchaSecret string           `mapstructure:"HCAPTCHA_SECRET"`
+	Register       bool             `mapstructure:"REGISTER"`
+	AllowedOrigins string           `mapstructure:"ALLOWED_ORIGINS"`
+	Hash           HashConfig       `mapstructure:",squash"`
+	Password       PasswordConfig   `mapstructure:",squash"`
+	MigrateOnStart bool             `mapstructure:"MIGRATE_ON_START"`
+	LDAP           LDAPConfig       `mapstructure:",squash"`
+	Federation     FederationConfig `mapstructure:",squash"`
+}
+
+// ServerConfig struct, all values in seconds
+type ServerConfig struct {
+	ReadTimeout  int `mapstructure:"READ_TIMEOUT"`
+	WriteTimeout int `mapstructure:"WRITE_TIMEOUT"`
+	IdleTimeout  int `mapstructure:"IDLE_TIMEOUT"`
+	// Time readiness fails before the server stops accepting requests
+	ShutdownDrain int `mapstructure:"SHUTDOWN_DRAIN"`
+	// Time in-flight requests get to finish once the server stops
+	ShutdownTimeout int `mapstructure:"SHUTDOWN_TIMEOUT"`
+}
+
+// TracingConfig struct
+type TracingConfig struct {
+	// otlp, stdout, or empty to disable tracing
+	Exporter    string  `mapstructure:"TRACING_EXPORTER"`
+	File        string  `mapstructure:"TRACING_FILE"`
+	SampleRatio float64 `mapstructure:"TRACING_SAMPLE_RATIO"`
+	ServiceName string  `mapstructure:"TRACING_SERVICE_NAME"`
+}
+
+// AuditConfig struct
+type AuditConfig struct {
+	// Comma separated list of stdout, file and database
+	Sinks      string `mapstructure:"AUDIT_SINKS"`
+	File       string `mapstructure:"AUDIT_FILE"`
+	TrustProxy bool   `mapstructure:"TRUST_PROXY_HEADERS"`
+}
+
+// WebhookConfig struct
+type WebhookConfig struct {
+	// Comma separated endpoints, webhooks are disabled when empty
+	URLs        string `mapstructure:"WEBHOOK_URLS"`
+	Secret      string `mapstructure:"WEBHOOK_SECRET"`
+	MaxAttempts int    `mapstructure:"WEBHOOK_MAX_ATTEMPTS"`
+	// Seconds between outbox polls
+	PollInterval int `mapstructure:"WEBHOOK_POLL_INTERVAL"`
+	// Seconds to wait for an endpoint to respond
+	Timeout int `mapstructure:"WEBHOOK_TIMEOUT"`
+}
+
+// SchedulerConfig struct, durations in seconds
+type SchedulerConfig struct {
+	Jitter       int `mapstructure:"JOB_JITTER"`
+	Retries      int `mapstructure:"JOB_RETRIES"`
+	RetryBackoff int `mapstructure:"JOB_RETRY_BACKOFF"`
+	Timeout      int `mapstructure:"JOB_TIMEOUT"`
+	// Cron expression, @hourly style descriptor or "@every <duration>"
+	PurgeRefreshSchedule string `mapstructure:"PURGE_REFRESH_SCHEDULE"`
 }
 
 // DataSource struct
 type DataSource struct {
-	Host     string `mapstructure:"DB_HOST"`
-	Port     int    `mapstructure:"DB_PORT"`
-	Dbname   string `mapstructure:"DB_NAME"`
-	User     string `mapstructure:"DB_USER"`
-	Password string `mapstructure:"DB_PASSWORD"`
+	Driver       string `mapstructure:"DB_DRIVER"`
+	Host         string `mapstructure:"DB_HOST"`
+	Port         int    `mapstructure:"DB_PORT"`
+	Dbname       string `mapstructure:"DB_NAME"`
+	User         string `mapstructure:"DB_USER"`
+	Password     string `mapstructure:"DB_PASSWORD"`
+	Path         string `mapstructure:"DB_PATH"`
+	QueryTimeout int    `mapstructure:"DB_QUERY_TIMEOUT"`
+	// Full DSN or URL, overrides the individual connection settings
+	URL             string `mapstructure:"DB_URL"`
+	SSLMode         string `mapstructure:"DB_SSL_MODE"`
+	SSLRootCert     string `mapstructure:"DB_SSL_ROOT_CERT"`
+	SSLCert         string `mapstructure:"DB_SSL_CERT"`
+	SSLKey          string `mapstructure:"DB_SSL_KEY"`
+	MaxConns        int    `mapstructure:"DB_MAX_CONNS"`
+	MinConns        int    `mapstructure:"DB_MIN_CONNS"`
+	MaxConnLifetime int    `mapstructure:"DB_MAX_CONN_LIFETIME"`
+	MaxConnIdleTime int    `mapstructure:"DB_MAX_CONN_IDLE_TIME"`
+	// Seconds to wait for the database at startup, zero waits indefinitely
+	ConnectTimeout int `mapstructure:"DB_CONNECT_TIMEOUT"`
+}
+
+// HashConfig struct
+type HashConfig struct {
+	Algorithm     string `mapstructure:"HASH_ALGORITHM"`
+	BCryptCost    int    `mapstructure:"BCRYPT_COST"`
+	Argon2Memory  uint32 `mapstructure:"ARGON2_MEMORY"`
+	Argon2Time    uint32 `mapstructure:"ARGON2_TIME"`
+	Argon2Threads uint8  `mapstructure:"ARGON2_THREADS"`
+	PepperKeys    string `mapstructure:"PEPPER_KEYS"`
+	PepperKeyFile string `mapstructure:"PEPPER_KEY_FILE"`
+	PepperVersion string `mapstructure:"PEPPER_VERSION"`
+}
+
+// PasswordConfig struct
+type PasswordConfig struct {
+	MinLength      int    `mapstructure:"PASSWORD_MIN_LENGTH"`
+	MaxLength      int    `mapstructure:"PASSWORD_MAX_LENGTH"`
+	Banned         string `mapstructure:"PASSWORD_BANNED"`
+	BannedFile     string `mapstructure:"PASSWORD_BANNED_FILE"`
+	RejectUsername bool   `mapstructure:"PASSWORD_REJECT_USERNAME"`
+	BreachedFile   string `mapstructure:"PASSWORD_BREACHED_FILE"`
+	BreachedBloom  bool   `mapstructure:"PASSWORD_BREACHED_BLOOM"`
+	History        int    `mapstructure:"PASSWORD_HISTORY"`
+	MaxAge         int    `mapstructure:"PASSWORD_MAX_AGE"`
+}
+
+// LDAPConfig struct, directory logins are disabled when URL is empty
+type LDAPConfig struct {
+	// ldap:// or ldaps:// URL of the directory
+	URL      string `mapstructure:"LDAP_URL"`
+	StartTLS bool   `mapstructure:"LDAP_START_TLS"`
+	// PEM encoded CA certificates of the directory, defaults to the system pool
+	CAFile string `mapstructure:"LDAP_CA_FILE"`
+	// Account that searches the directory, anonymous when empty
+	BindDN       string `mapstructure:"LDAP_BIND_DN"`
+	BindPassword string `mapstructure:"LDAP_BIND_PASSWORD"`
+	UserBaseDN   string `mapstructure:"LDAP_USER_BASE_DN"`
+	// %s is replaced with the escaped username, (sAMAccountName=%s) for AD
+	UserFilter  string `mapstructure:"LDAP_USER_FILTER"`
+	GroupBaseDN string `mapstructure:"LDAP_GROUP_BASE_DN"`
+	// %s is replaced with the escaped DN of the user
+	GroupFilter string `mapstructure:"LDAP_GROUP_FILTER"`
+	// Attribute holding the name of a directory group
+	GroupAttribute string `mapstructure:"LDAP_GROUP_ATTRIBUTE"`
+	// Comma separated directory:go-auth group name pairs, other directory
+	// groups are ignored
+	GroupMap string `mapstructure:"LDAP_GROUP_MAP"`
+	// Seconds to wait for the directory
+	Timeout int `mapstructure:"LDAP_TIMEOUT"`
 }
 
 func ReadConfig(ENV string) (Configuration, error) {
@@ -78,3 +281,20 @@ func ReadConfig(ENV string) (Configuration, error) {
 	}
 	return config, nil
 }
+
+// FederationConfig struct, a provider is enabled when its client ID is set
+type FederationConfig struct {
+	// External URL of go-auth, providers redirect back to
+	// <BaseURL>/auth/oidc/<provider>/callback
+	BaseURL            string `mapstructure:"OIDC_BASE_URL"`
+	GoogleClientID     string `mapstructure:"GOOGLE_CLIENT_ID"`
+	GoogleClientSecret string `mapstructure:"GOOGLE_CLIENT_SECRET"`
+	GitHubClientID     string `mapstructure:"GITHUB_CLIENT_ID"`
+	GitHubClientSecret string `mapstructure:"GITHUB_CLIENT_SECRET"`
+	// Generic OpenID Connect provider, discovered from its issuer
+	Issuer       string `mapstructure:"OIDC_ISSUER"`
+	ClientID     string `mapstructure:"OIDC_CLIENT_ID"`
+	ClientSecret string `mapstructure:"OIDC_CLIENT_SECRET"`
+	// Shown on the sign in button of the generic provider
+	Name string `mapstructure:"OIDC_NAME"`
+}
@@ -0,0 +1,76 @@
+// Package federation signs users in with external identity providers, using
+// OpenID Connect or, for GitHub, OAuth 2.0 and its user API. The handlers
+// keep the state, nonce and PKCE verifier of a sign in and link the
+// returned identity to a local user.
+package federation
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/cheebz/go-auth/config"
+)
+
+// Identity is the account a user signed in with at a provider
+type Identity struct {
+	// Stable identifier of the account at the provider
+	Subject string
+	// Suggested username for a new local user, which is prefixed with the
+	// provider name. May be empty
+	Username string
+	// Only set when the provider verified it
+	Email string
+}
+
+// Provider is an external identity provider
+type Provider interface {
+	// Name is used in URLs and stored with linked identities
+	Name() string
+	// Title is shown on sign in buttons
+	Title() string
+	// AuthCodeURL is where the user is sent to sign in. The verifier's
+	// challenge is sent along with the state and nonce. It fails while the
+	// provider is unavailable.
+	AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error)
+	// Exchange redeems the code the provider redirected back with
+	Exchange(ctx context.Context, code, nonce, verifier string) (Identity, error)
+}
+
+// Path the provider redirects back to
+func CallbackPath(name string) string {
+	return "/auth/oidc/" + name + "/callback"
+}
+
+// NewConfiguredProviders creates the providers that have a client ID, in
+// the order their buttons are shown. OpenID Connect providers are discovered
+// in the background.
+func NewConfiguredProviders(c config.FederationConfig) ([]Provider, error) {
+	if c.GoogleClientID == "" && c.GitHubClientID == "" && c.ClientID == "" {
+		return nil, nil
+	}
+	if c.BaseURL == "" {
+		return nil, errors.New("OIDC_BASE_URL is required for external sign in")
+	}
+	base := strings.TrimSuffix(c.BaseURL, "/")
+	var providers []Provider
+	if c.GoogleClientID != "" {
+		providers = append(providers, NewOIDC("google", "Google", "https://accounts.google.com", c.GoogleClientID, c.GoogleClientSecret, base+CallbackPath("google")))
+	}
+	if c.GitHubClientID != "" {
+		providers = append(providers, NewGitHub(c.GitHubClientID, c.GitHubClientSecret, base+CallbackPath("github")))
+	}
+	if c.ClientID != "" {
+		if c.Issuer == "" {
+			return nil, errors.New("OIDC_ISSUER is required with OIDC_CLIENT_ID")
+		}
+		providers = append(providers, NewOIDC("oidc", c.Name, c.Issuer, c.ClientID, c.ClientSecret, base+CallbackPath("oidc")))
+	}
+	return providers, nil
+}
+
+// The local part of an email address
+func emailUsername(email string) string {
+	username, _, _ := strings.Cut(email, "@")
+	return username
+}
@@ -0,0 +1,206 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/federation/oidctest"
+	"golang.org/x/oauth2"
+)
+
+const redirectURL = "http://go-auth.test/auth/oidc/oidc/callback"
+
+// Follow the provider's redirect back to the callback and return its query
+func authorize(t *testing.T, p Provider, state, nonce, verifier string) url.Values {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	authURL, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || res.StatusCode != http.StatusFound {
+		t.Fatal("provider did not redirect back", res.Status, err)
+	}
+	return location.Query()
+}
+
+func TestOIDC(t *testing.T) {
+	ctx := context.Background()
+	mock := oidctest.NewProvider(t)
+	p := NewOIDC("oidc", "Test", mock.URL, oidctest.ClientID, oidctest.ClientSecret, redirectURL)
+	verifier := oauth2.GenerateVerifier()
+
+	mock.SignIn(&oidctest.User{Subject: "alice-sub", Email: "alice@example.com", EmailVerified: true})
+	query := authorize(t, p, "state", "nonce", verifier)
+	if query.Get("state") != "state" {
+		t.Fatal("state not returned", query)
+	}
+	identity, err := p.Exchange(ctx, query.Get("code"), "nonce", verifier)
+	if err != nil {
+		t.Fatal("exchange failed", err)
+	}
+	if identity != (Identity{Subject: "alice-sub", Username: "alice", Email: "alice@example.com"}) {
+		t.Fatal("unexpected identity", identity)
+	}
+	_, err = p.Exchange(ctx, query.Get("code"), "nonce", verifier)
+	if err == nil {
+		t.Fatal("code redeemed twice")
+	}
+
+	mock.SignIn(&oidctest.User{Subject: "bob-sub", Email: "bob@example.com", PreferredUsername: "bobby"})
+	query = authorize(t, p, "state", "nonce", verifier)
+	identity, err = p.Exchange(ctx, query.Get("code"), "nonce", verifier)
+	if err != nil || identity != (Identity{Subject: "bob-sub", Username: "bobby"}) {
+		t.Fatal("unverified email returned", identity, err)
+	}
+	query = authorize(t, p, "state", "nonce", verifier)
+	_, err = p.Exchange(ctx, query.Get("code"), "other nonce", verifier)
+	if err == nil {
+		t.Fatal("ID token with wrong nonce accepted")
+	}
+	query = authorize(t, p, "state", "nonce", verifier)
+	_, err = p.Exchange(ctx, query.Get("code"), "nonce", oauth2.GenerateVerifier())
+	if err == nil {
+		t.Fatal("code redeemed with wrong verifier")
+	}
+
+	mock.SignIn(nil)
+	query = authorize(t, p, "state", "nonce", verifier)
+	if query.Get("error") != "access_denied" || query.Get("code") != "" {
+		t.Fatal("denied sign in returned a code", query)
+	}
+}
+
+func TestOIDCUnavailable(t *testing.T) {
+	ctx := context.Background()
+	mock := oidctest.NewProvider(t)
+	mock.SetDown(true)
+	p := NewOIDC("oidc", "Test", mock.URL, oidctest.ClientID, oidctest.ClientSecret, redirectURL)
+	_, err := p.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	if err == nil {
+		t.Fatal("unavailable provider returned an authorization URL")
+	}
+	_, err = p.Exchange(ctx, "code", "nonce", "verifier")
+	if err == nil {
+		t.Fatal("exchange with unavailable provider succeeded")
+	}
+
+	// discovered again once the interval has passed
+	mock.SetDown(false)
+	p.mu.Lock()
+	p.attempted = time.Now().Add(-minDiscoveryInterval)
+	p.mu.Unlock()
+	mock.SignIn(&oidctest.User{Subject: "alice-sub"})
+	verifier := oauth2.GenerateVerifier()
+	query := authorize(t, p, "state", "nonce", verifier)
+	identity, err := p.Exchange(ctx, query.Get("code"), "nonce", verifier)
+	if err != nil || identity.Subject != "alice-sub" {
+		t.Fatal("exchange failed after recovery", identity, err)
+	}
+}
+
+func TestGitHub(t *testing.T) {
+	ctx := context.Background()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "code" || r.PostFormValue("code_verifier") != "verifier" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "token", "token_type": "bearer"})
+	})
+	api := func(v interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(v)
+		}
+	}
+	mux.Handle("GET /user", api(map[string]interface{}{"id": 42, "login": "octocat", "email": "public@example.com"}))
+	mux.Handle("GET /user/emails", api([]map[string]interface{}{
+		{"email": "public@example.com", "primary": false, "verified": false},
+		{"email": "octocat@example.com", "primary": true, "verified": true},
+	}))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	p := NewGitHub("client", "secret", redirectURL)
+	p.oauth.Endpoint = oauth2.Endpoint{AuthURL: server.URL + "/authorize", TokenURL: server.URL + "/token"}
+	p.apiURL = server.URL
+
+	rawURL, _ := p.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	authURL, err := url.Parse(rawURL)
+	if err != nil || authURL.Query().Get("code_challenge") != oauth2.S256ChallengeFromVerifier("verifier") {
+		t.Fatal("no PKCE challenge", authURL, err)
+	}
+	identity, err := p.Exchange(ctx, "code", "", "verifier")
+	if err != nil {
+		t.Fatal("exchange failed", err)
+	}
+	if identity != (Identity{Subject: "42", Username: "octocat", Email: "octocat@example.com"}) {
+		t.Fatal("unexpected identity", identity)
+	}
+	_, err = p.Exchange(ctx, "code", "", "wrong")
+	if err == nil {
+		t.Fatal("exchange with wrong verifier succeeded")
+	}
+}
+
+func TestNewConfiguredProviders(t *testing.T) {
+	ctx := context.Background()
+	providers, err := NewConfiguredProviders(config.FederationConfig{})
+	if err != nil || providers != nil {
+		t.Fatal("providers without client IDs", providers, err)
+	}
+	mock := oidctest.NewProvider(t)
+	c := config.FederationConfig{
+		GitHubClientID: "client",
+		Issuer:         mock.URL,
+		ClientID:       oidctest.ClientID,
+		Name:           "Acme",
+	}
+	_, err = NewConfiguredProviders(c)
+	if err == nil {
+		t.Fatal("providers without a base URL")
+	}
+	c.BaseURL = "https://auth.example.com/"
+	providers, err = NewConfiguredProviders(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 2 || providers[0].Name() != "github" || providers[1].Title() != "Acme" {
+		t.Fatal("unexpected providers", providers)
+	}
+	rawURL, err := providers[1].AuthCodeURL(ctx, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, _ := url.Parse(rawURL)
+	if authURL.Query().Get("redirect_uri") != "https://auth.example.com/auth/oidc/oidc/callback" {
+		t.Fatal("unexpected redirect URI", authURL)
+	}
+
+	// an outage of a provider doesn't stop go-auth from starting
+	mock.SetDown(true)
+	providers, err = NewConfiguredProviders(c)
+	if err != nil || len(providers) != 2 {
+		t.Fatal("unavailable provider not created", providers, err)
+	}
+}
@@ -0,0 +1,98 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// GitHub does not support OpenID Connect, the identity is read from its API
+type GitHub struct {
+	oauth  oauth2.Config
+	apiURL string
+}
+
+func NewGitHub(clientID, clientSecret, redirectURL string) *GitHub {
+	return &GitHub{
+		oauth: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     github.Endpoint,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"read:user", "user:email"},
+		},
+		apiURL: "https://api.github.com",
+	}
+}
+
+func (p *GitHub) Name() string {
+	return "github"
+}
+
+func (p *GitHub) Title() string {
+	return "GitHub"
+}
+
+// GitHub has no ID token, so the nonce is not used
+func (p *GitHub) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	return p.oauth.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), nil
+}
+
+func (p *GitHub) Exchange(ctx context.Context, code, nonce, verifier string) (Identity, error) {
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return Identity{}, err
+	}
+	client := p.oauth.Client(ctx, token)
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+	}
+	err = p.get(ctx, client, "/user", &user)
+	if err != nil {
+		return Identity{}, err
+	}
+	if user.ID == 0 {
+		return Identity{}, errors.New("GitHub user has no id")
+	}
+	// the public email of the profile may be unverified
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	err = p.get(ctx, client, "/user/emails", &emails)
+	if err != nil {
+		return Identity{}, err
+	}
+	identity := Identity{Subject: strconv.FormatInt(user.ID, 10), Username: user.Login}
+	for _, email := range emails {
+		if email.Primary && email.Verified {
+			identity.Email = email.Email
+		}
+	}
+	return identity, nil
+}
+
+func (p *GitHub) get(ctx context.Context, client *http.Client, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitHub API %s returned %s", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,169 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Failed discoveries are only retried this often, so sign ins don't
+	// flood a provider that is down
+	minDiscoveryInterval = 10 * time.Second
+	// Discoveries outlive the request that started them, so they need
+	// their own limit
+	discoveryTimeout = 30 * time.Second
+)
+
+// OIDC is an OpenID Connect provider, such as Google
+type OIDC struct {
+	name   string
+	title  string
+	issuer string
+	mu     sync.Mutex
+	// the endpoint and verifier are set once discovered
+	oauth     oauth2.Config
+	verifier  *oidc.IDTokenVerifier
+	attempted time.Time
+	// closed once the discovery in flight is done, nil when there is none
+	discovering chan struct{}
+	err         error
+}
+
+// NewOIDC starts discovering the provider's endpoints and keys from its
+// issuer. A provider that is unavailable is discovered again when it is
+// used, so an outage doesn't stop go-auth from starting.
+func NewOIDC(name, title, issuer, clientID, clientSecret, redirectURL string) *OIDC {
+	p := &OIDC{
+		name:   name,
+		title:  title,
+		issuer: issuer,
+		oauth: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+	}
+	p.mu.Lock()
+	p.startDiscovery()
+	p.mu.Unlock()
+	return p
+}
+
+func (p *OIDC) Name() string {
+	return p.name
+}
+
+func (p *OIDC) Title() string {
+	return p.title
+}
+
+// Wait for the provider to be discovered, starting a discovery when the
+// last one failed
+func (p *OIDC) discover(ctx context.Context) (oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	if p.verifier != nil {
+		defer p.mu.Unlock()
+		return p.oauth, p.verifier, nil
+	}
+	done := p.discovering
+	if done == nil && time.Since(p.attempted) >= minDiscoveryInterval {
+		done = p.startDiscovery()
+	}
+	p.mu.Unlock()
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return oauth2.Config{}, nil, ctx.Err()
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.verifier == nil {
+		return oauth2.Config{}, nil, p.err
+	}
+	return p.oauth, p.verifier, nil
+}
+
+// Start discovering the provider unless a discovery is already in flight,
+// and return a channel closed once it is done. Callers must hold the lock.
+func (p *OIDC) startDiscovery() chan struct{} {
+	if p.discovering != nil {
+		return p.discovering
+	}
+	done := make(chan struct{})
+	p.discovering = done
+	p.attempted = time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+		defer cancel()
+		provider, err := oidc.NewProvider(ctx, p.issuer)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if err != nil {
+			p.err = fmt.Errorf("failed to discover %s: %w", p.issuer, err)
+			log.Println(fmt.Sprintf("Identity provider %s is unavailable:", p.name), p.err)
+		} else {
+			p.oauth.Endpoint = provider.Endpoint()
+			p.verifier = provider.Verifier(&oidc.Config{ClientID: p.oauth.ClientID})
+		}
+		p.discovering = nil
+		close(done)
+	}()
+	return done
+}
+
+func (p *OIDC) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	oauth, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+func (p *OIDC) Exchange(ctx context.Context, code, nonce, verifier string) (Identity, error) {
+	oauth, idVerifier, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	token, err := oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return Identity{}, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Identity{}, errors.New("token response has no ID token")
+	}
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return Identity{}, err
+	}
+	if idToken.Nonce != nonce {
+		return Identity{}, errors.New("ID token nonce does not match")
+	}
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return Identity{}, err
+	}
+	identity := Identity{Subject: idToken.Subject, Username: claims.PreferredUsername}
+	if claims.EmailVerified {
+		identity.Email = claims.Email
+	}
+	if identity.Username == "" {
+		identity.Username = emailUsername(identity.Email)
+	}
+	return identity, nil
+}
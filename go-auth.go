@@ -1,65 +1,470 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/cheebz/go-auth/audit"
+	"github.com/cheebz/go-auth/authgrpc"
+	"github.com/cheebz/go-auth/authn"
+	"github.com/cheebz/go-auth/authpb"
 	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/federation"
 	"github.com/cheebz/go-auth/handlers"
 	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/health"
 	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/ldapauth"
+	"github.com/cheebz/go-auth/metrics"
+	"github.com/cheebz/go-auth/migrations"
+	"github.com/cheebz/go-auth/policy"
 	"github.com/cheebz/go-auth/repositories"
 	"github.com/cheebz/go-auth/responses"
+	"github.com/cheebz/go-auth/tracing"
 	"github.com/cheebz/go-auth/workers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+// How often keys rotated by the keys command are picked up
+const keyReloadInterval = time.Minute
+
 func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Run a subcommand, serving HTTP when there is none
+func run(args []string) error {
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if command == "help" || command == "-h" || command == "--help" {
+		fmt.Print(usage)
+		return nil
+	}
 	// Get configuration
 	ENV := os.Getenv("ENV")
-	c, err := config.ReadConfig(ENV)
+	conf, err := config.ReadConfig(ENV)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if command == "serve" {
+		return serve(conf)
 	}
-	conf := c
+	return runCommand(conf, command, args)
+}
+
+func serve(conf config.Configuration) error {
+	// stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// set up tracing, spans are flushed once everything else has stopped
+	shutdownTracing, err := tracing.Setup(ctx, conf.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := shutdownTracing(ctx)
+		if err != nil {
+			log.Println("failed to flush traces", err)
+		}
+	}()
 
-	// create repository
-	repo := repositories.NewPSQLRepository(conf)
+	// create repository, it is connected and migrated once the servers run
+	repo, migrator, err := openRepository(ctx, conf)
+	if err != nil {
+		return err
+	}
 	defer repo.Close()
-	// create purge refresh worker
-	purgeRefreshWorker := workers.NewPurgeRefreshWorker(repo)
-	go purgeRefreshWorker.Start()
+	repo = tracing.NewRepository(metrics.NewRepository(repo))
+
 	// create response writer
 	response := responses.NewAuthResponses(conf.Debug)
 	// create hasher
-	hasher := hash.NewBCryptHash(14)
+	hasher, err := newHasher(conf.Hash)
+	if err != nil {
+		return err
+	}
+	hasher = metrics.NewHash(hasher)
+	// create password policy
+	passwordPolicy, err := policy.NewConfiguredPolicy(conf.Password)
+	if err != nil {
+		return err
+	}
+	// create audit logger
+	auditLogger, err := audit.NewConfiguredLogger(conf.Audit, repo)
+	if err != nil {
+		return err
+	}
+	defer auditLogger.Close()
+	// create directory authenticator
+	var authenticators []authn.Authenticator
+	if conf.LDAP.URL != "" {
+		directory, err := ldapauth.New(conf.LDAP, repo)
+		if err != nil {
+			return err
+		}
+		authenticators = append(authenticators, directory)
+	}
+	// external identity providers, discovered in the background
+	providers, err := federation.NewConfiguredProviders(conf.Federation)
+	if err != nil {
+		return err
+	}
 	// create handler
 	jwt := jwt.NewJWTHelper(conf.JWTKey, conf.JWTMaxAge, conf.RefreshMaxAge)
 	// parse template files
-	templates := template.Must(template.ParseGlob("templates/*.html"))
+	templates, err := template.ParseGlob("templates/*.html")
+	if err != nil {
+		return err
+	}
+
+	// create workers, they are stopped after the server has drained
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		stopWorkers()
+		wg.Wait()
+	}()
+	jobs, err := workers.NewJobs(repo, conf.Scheduler)
+	if err != nil {
+		return err
+	}
+	scheduler := workers.NewScheduler(repo)
+	for _, job := range jobs {
+		scheduler.Add(job)
+	}
+	var webhookWorker *workers.WebhookWorker
+	if conf.Webhook.URLs != "" {
+		webhookWorker = workers.NewWebhookWorker(repo, conf.Webhook)
+	}
+	startWorkers := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scheduler.Start(workerCtx)
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jwt.WatchKeys(workerCtx, repo, keyReloadInterval)
+		}()
+		if webhookWorker != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				webhookWorker.Start(workerCtx)
+			}()
+		}
+	}
+
+	// connect, migrate and load signing keys in the background, so the
+	// health endpoints respond while the database is unavailable
+	started := make(chan struct{})
+	startErr := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := start(workerCtx, conf, repo, migrator, jwt)
+		if err != nil {
+			// stopped by shutdown otherwise
+			if workerCtx.Err() == nil {
+				startErr <- err
+			}
+			return
+		}
+		startWorkers()
+		close(started)
+	}()
+
+	// create health checks
+	checks := health.NewHealth(5 * time.Second)
+	checks.AddCheck("database", repo.Ping)
+	checks.AddCheck("startup", func(ctx context.Context) error {
+		select {
+		case <-started:
+			return nil
+		default:
+			return errors.New("waiting for the database and migrations")
+		}
+	})
+	checks.AddCheck("signing_key", func(ctx context.Context) error { return jwt.CheckKey() })
+	checks.AddCheck("scheduler", scheduler.Check)
 	// create handler
 	handler := handlers.NewMuxHandler(handlers.MuxHandlerConfig{
-		Conf:      conf,
-		Resp:      response,
-		Hasher:    hasher,
-		Repo:      repo,
-		JWT:       jwt,
-		Templates: templates,
+		Conf:           conf,
+		Resp:           response,
+		Hasher:         hasher,
+		Policy:         passwordPolicy,
+		Repo:           repo,
+		JWT:            jwt,
+		Templates:      templates,
+		Health:         checks,
+		Audit:          auditLogger,
+		Authenticators: authenticators,
+		Providers:      providers,
 	})
 	if conf.AllowedOrigins != "" {
 		handler.AllowCORS(strings.Split(conf.AllowedOrigins, ","))
 	}
-	r := handler.GetRouter()
+	err = metrics.RegisterActiveRefresh(repo, time.Duration(conf.Db.QueryTimeout)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// Run servers
+	router := http.NewServeMux()
+	router.Handle("/", handler.GetRouter())
+	servers := []*http.Server{newServer(conf, conf.Port, router)}
+	if conf.MetricsPort == 0 {
+		router.Handle("/metrics", metrics.Handler())
+	} else {
+		servers = append(servers, newServer(conf, conf.MetricsPort, metrics.Handler()))
+	}
+	serverErr := make(chan error, len(servers)+1)
+	var grpcServer *grpc.Server
+	if conf.GRPCPort != 0 {
+		grpcServer, err = newGRPCServer(conf, repo, jwt)
+		if err != nil {
+			return err
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", conf.GRPCPort))
+		if err != nil {
+			return err
+		}
+		go func() {
+			log.Println(fmt.Sprintf("Serving gRPC on %s", listener.Addr()))
+			serverErr <- grpcServer.Serve(listener)
+		}()
+	}
+	for i, server := range servers {
+		go func(server *http.Server, tls bool) {
+			log.Println(fmt.Sprintf("Serving on %s", server.Addr))
+			if tls {
+				serverErr <- server.ListenAndServeTLS(conf.SSLCert, conf.SSLKey)
+			} else {
+				serverErr <- server.ListenAndServe()
+			}
+		}(server, i == 0 && conf.SSLCert != "")
+	}
+
+	select {
+	case err = <-serverErr:
+		return err
+	case err = <-startErr:
+		return err
+	case <-ctx.Done():
+	}
+	// a second signal exits immediately
+	stop()
+	return shutdown(servers, grpcServer, checks, conf.Server)
+}
+
+// Wait up to DB_CONNECT_TIMEOUT for the database, apply pending migrations
+// and load the signing keys. Migrations are only retried while the database
+// is unreachable.
+func start(ctx context.Context, conf config.Configuration, repo repositories.Repository, migrator migrations.Migrator, j *jwt.JWTHelper) error {
+	err := repositories.Retry(ctx, conf.Db.ConnectTimeout, "database not ready", repo.Ping)
+	if err != nil {
+		return err
+	}
+	if conf.MigrateOnStart && migrator != nil {
+		err = repositories.Retry(ctx, conf.Db.ConnectTimeout, "failed to migrate", func(ctx context.Context) error {
+			err := migrator.Up(ctx)
+			if err != nil && repo.Ping(ctx) == nil {
+				// the database is up, so the migration itself failed
+				return repositories.Permanent(err)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = j.LoadKeys(ctx, repo)
+	if err != nil {
+		log.Println("failed to load signing keys, falling back to JWT_KEY", err)
+	}
+	log.Println("Database ready")
+	return nil
+}
+
+func newServer(conf config.Configuration, port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      handler,
+		ReadTimeout:  time.Duration(conf.Server.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(conf.Server.WriteTimeout) * time.Second,
+		IdleTimeout:  time.Duration(conf.Server.IdleTimeout) * time.Second,
+	}
+}
+
+// The gRPC Auth service, over TLS when the HTTP server uses it. Every call
+// must carry a valid session token.
+func newGRPCServer(conf config.Configuration, repo repositories.Repository, j *jwt.JWTHelper) (*grpc.Server, error) {
+	verifier := authgrpc.NewVerifier(j)
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(authgrpc.UnaryServerInterceptor(verifier)),
+		grpc.ChainStreamInterceptor(authgrpc.StreamServerInterceptor(verifier)),
+	}
+	if conf.SSLCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(conf.SSLCert, conf.SSLKey)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	server := grpc.NewServer(opts...)
+	authpb.RegisterAuthServer(server, authgrpc.NewServer(repo, j))
+	return server, nil
+}
+
+// Fail readiness, give load balancers time to notice, then let in-flight
+// requests finish. Workers and the repository are closed by the caller.
+func shutdown(servers []*http.Server, grpcServer *grpc.Server, checks *health.Health, c config.ServerConfig) error {
+	log.Println("Shutting down")
+	checks.Shutdown()
+	time.Sleep(time.Duration(c.ShutdownDrain) * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ShutdownTimeout)*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}
+	log.Println("Server stopped")
+	return nil
+}
 
-	// Run server
-	port := conf.Port
-	log.Println(fmt.Sprintf("Serving on port %d", port))
+// Open the configured database and its migrator without waiting for the
+// database to be up. The demo driver has no migrator.
+func openRepository(ctx context.Context, conf config.Configuration) (repositories.Repository, migrations.Migrator, error) {
+	switch conf.Db.Driver {
+	case "postgres":
+		db, err := repositories.NewDbPool(conf.Db)
+		if err != nil {
+			return nil, nil, err
+		}
+		migrator, err := migrations.NewPSQLMigrator(db)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return repositories.NewPSQLRepository(conf, db), migrator, nil
+	case "sqlite":
+		db, err := repositories.ConnectSQLite(conf.Db)
+		if err != nil {
+			return nil, nil, err
+		}
+		migrator, err := migrations.NewSQLiteMigrator(db)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return repositories.NewSQLiteRepository(conf, db), migrator, nil
+	case "demo":
+		log.Println("Running in demo mode. Data will not be persisted.")
+		return repositories.NewMemoryRepository(conf), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported database driver: %s", conf.Db.Driver)
+	}
+}
 
-	if conf.SSLCert == "" {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), r))
+// newHasher creates a MultiHash that generates hashes with the configured
+// algorithm and checks hashes of every supported algorithm, including
+// legacy formats imported from other systems. If pepper keys are
+// configured, the result is wrapped in a PepperedHash.
+func newHasher(c config.HashConfig) (hash.Hash, error) {
+	if c.Argon2Memory > hash.Argon2MaxMemory {
+		return nil, fmt.Errorf("ARGON2_MEMORY is above %d KiB", hash.Argon2MaxMemory)
+	}
+	bcryptHash := hash.NewBCryptHash(c.BCryptCost)
+	argon2Hash := hash.NewArgon2Hash(c.Argon2Memory, c.Argon2Time, c.Argon2Threads)
+	legacy := []hash.Verifier{
+		hash.NewPBKDF2Hash(),
+		hash.NewScryptHash(),
+		hash.NewDjangoHash(),
+		hash.NewHtpasswdHash(),
+	}
+	var hasher hash.Hash
+	switch c.Algorithm {
+	case "argon2id":
+		hasher = hash.NewMultiHash(argon2Hash, append([]hash.Verifier{bcryptHash}, legacy...)...)
+	case "bcrypt":
+		hasher = hash.NewMultiHash(bcryptHash, append([]hash.Verifier{argon2Hash}, legacy...)...)
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", c.Algorithm)
+	}
+	keys, err := readPepperKeys(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return hasher, nil
+	}
+	return hash.NewPepperedHash(hasher, keys, c.PepperVersion)
+}
+
+// Pepper keys are "<version>:<base64 key>" pairs, comma separated in
+// PEPPER_KEYS or one per line in PEPPER_KEY_FILE
+func readPepperKeys(c config.HashConfig) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	entries := strings.Split(c.PepperKeys, ",")
+	if c.PepperKeyFile != "" {
+		b, err := ioutil.ReadFile(c.PepperKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, strings.Split(string(b), "\n")...)
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid pepper key entry: expected <version>:<base64 key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pepper key for version %s: %v", parts[0], err)
+		}
+		keys[parts[0]] = key
 	}
-	log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%d", port), conf.SSLCert, conf.SSLKey, r))
+	return keys, nil
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/authpb"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/migrations"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCServerRequiresToken(t *testing.T) {
+	ctx := context.Background()
+	repo := repositories.NewMemoryRepository(config.Configuration{})
+	helper := jwt.NewJWTHelper("secret", 20, 3600)
+	server, err := newGRPCServer(config.Configuration{}, repo, helper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := authpb.NewAuthClient(conn)
+
+	user, err := repo.CreateUser(ctx, models.User{Username: "alice", UUID: uuid.New().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetUser(ctx, &authpb.GetUserRequest{Uuid: user.UUID})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatal("expected Unauthenticated without a token, got", err)
+	}
+	token, err := helper.CreateJWT(user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token.Value)
+	pb, err := client.GetUser(authorized, &authpb.GetUserRequest{Uuid: user.UUID})
+	if err != nil || pb.Username != "alice" {
+		t.Fatal("valid token rejected", pb, err)
+	}
+}
+
+// Fails every migration although the database is up
+type brokenMigrator struct {
+	migrations.Migrator
+	attempts int
+}
+
+func (m *brokenMigrator) Up(ctx context.Context) error {
+	m.attempts++
+	return errors.New("syntax error")
+}
+
+func TestStartStopsOnFailedMigration(t *testing.T) {
+	conf := config.Configuration{MigrateOnStart: true}
+	repo := repositories.NewMemoryRepository(conf)
+	migrator := &brokenMigrator{}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := start(ctx, conf, repo, migrator, jwt.NewJWTHelper("secret", 20, 3600))
+	if err == nil || ctx.Err() != nil {
+		t.Fatal("expected the migration error before the timeout", err)
+	}
+	if migrator.attempts != 1 {
+		t.Fatal("failed migration retried", migrator.attempts)
+	}
+}
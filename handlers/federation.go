@@ -0,0 +1,393 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cheebz/go-auth/audit"
+	"github.com/cheebz/go-auth/authn"
+	"github.com/cheebz/go-auth/federation"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/metrics"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// errRegistrationDisabled is returned for new identities when REGISTER is off
+var errRegistrationDisabled = errors.New("registration is disabled")
+
+func (h *MuxHandler) provider(r *http.Request) (federation.Provider, bool) {
+	name := mux.Vars(r)["provider"]
+	for _, provider := range h.Providers {
+		if provider.Name() == name {
+			return provider, true
+		}
+	}
+	return nil, false
+}
+
+// The providers with the identities the user has linked from them
+func (h *MuxHandler) linkedProviders(ctx context.Context, userID int) ([]LinkedProvider, error) {
+	if len(h.Providers) == 0 {
+		return nil, nil
+	}
+	identities, err := h.Repo.GetUserFederatedIdentities(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var providers []LinkedProvider
+	for _, provider := range h.Providers {
+		linked := LinkedProvider{Name: provider.Name(), Title: provider.Title()}
+		for _, identity := range identities {
+			if identity.Provider == provider.Name() {
+				linked.Linked = true
+				linked.Email = identity.Email
+			}
+		}
+		providers = append(providers, linked)
+	}
+	return providers, nil
+}
+
+// Claims of the current session, refreshing it when the JWT has expired
+func (h *MuxHandler) sessionClaims(w http.ResponseWriter, r *http.Request) (*jwt.JWTClaims, error) {
+	claims, err := h.JWT.CheckJWTClaims(r)
+	if err == nil {
+		return claims, nil
+	}
+	return h.refresh(w, r)
+}
+
+// The federation cookie is only sent back to the callback
+func (h *MuxHandler) setFederationCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "federation",
+		Value:    token,
+		Path:     "/auth/oidc/",
+		MaxAge:   jwt.FederationMaxAge,
+		HttpOnly: true,
+		Secure:   h.Conf.SSLCert != "",
+		// the provider redirects back with a top level navigation
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (h *MuxHandler) clearFederationCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "federation",
+		Value:    "",
+		Path:     "/auth/oidc/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   h.Conf.SSLCert != "",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Send the user to the provider, userID is set when linking an identity
+func (h *MuxHandler) startFederation(w http.ResponseWriter, r *http.Request, userID int) {
+	provider, ok := h.provider(r)
+	if !ok {
+		h.Responses.NotFound(w, errors.New("unknown identity provider"))
+		return
+	}
+	claims := jwt.FederationClaims{
+		Provider: provider.Name(),
+		State:    rand.Text(),
+		Nonce:    rand.Text(),
+		Verifier: oauth2.GenerateVerifier(),
+		UserID:   userID,
+		Redirect: r.URL.Query().Get("redirect"),
+	}
+	token, err := h.JWT.CreateFederation(claims)
+	if err != nil {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	authURL, err := provider.AuthCodeURL(r.Context(), claims.State, claims.Nonce, claims.Verifier)
+	if err != nil {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	h.setFederationCookie(w, token)
+	http.Redirect(w, r, authURL, http.StatusSeeOther)
+}
+
+// /oidc/{provider}/login GET
+func (h *MuxHandler) FederatedLogin(w http.ResponseWriter, r *http.Request) {
+	h.startFederation(w, r, 0)
+}
+
+// /oidc/{provider}/link GET
+func (h *MuxHandler) FederatedLink(w http.ResponseWriter, r *http.Request) {
+	claims, err := h.sessionClaims(w, r)
+	if errors.Is(err, errUnavailable) {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	if err != nil {
+		_ = h.clearSession(w, r)
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+	h.startFederation(w, r, claims.UserID)
+}
+
+// /oidc/{provider}/unlink POST
+// Users without a local password keep at least one identity to sign in with
+func (h *MuxHandler) FederatedUnlink(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	provider, ok := h.provider(r)
+	if !ok {
+		h.Responses.NotFound(w, errors.New("unknown identity provider"))
+		return
+	}
+	claims, err := h.sessionClaims(w, r)
+	if errors.Is(err, errUnavailable) {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	if err != nil {
+		_ = h.clearSession(w, r)
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+	user, err := h.Repo.GetUserByID(ctx, claims.UserID)
+	if err != nil {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	if authn.IsExternal(user.Password) {
+		identities, err := h.Repo.GetUserFederatedIdentities(ctx, user.ID)
+		if err != nil {
+			h.Responses.InternalServerError(w, err)
+			return
+		}
+		if len(identities) <= 1 {
+			h.Responses.BadRequest(w, errors.New("the only account you sign in with can't be unlinked"))
+			return
+		}
+	}
+	err = h.Repo.DeleteFederatedIdentity(ctx, user.ID, provider.Name())
+	if errors.Is(err, repositories.ErrNotFound) {
+		h.Responses.NotFound(w, err)
+		return
+	}
+	if err != nil {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	event := userEvent(audit.FederatedUnlink, user)
+	event.Details = map[string]string{"provider": provider.Name()}
+	h.Audit.Log(r, event)
+	http.Redirect(w, r, "/auth/", http.StatusSeeOther)
+}
+
+// /oidc/{provider}/callback GET
+func (h *MuxHandler) FederatedCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.provider(r)
+	if !ok {
+		h.Responses.NotFound(w, errors.New("unknown identity provider"))
+		return
+	}
+	claims, err := h.JWT.CheckFederationClaims(r)
+	h.clearFederationCookie(w)
+	query := r.URL.Query()
+	if err != nil || claims.Provider != provider.Name() ||
+		subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(claims.State)) != 1 {
+		h.Responses.BadRequest(w, errors.New("invalid or expired sign in state"))
+		return
+	}
+	if reason := query.Get("error"); reason != "" {
+		h.federationFailure(w, r, provider, claims, reason, fmt.Errorf("%s sign in failed: %s", provider.Title(), reason))
+		return
+	}
+	identity, err := provider.Exchange(r.Context(), query.Get("code"), claims.Nonce, claims.Verifier)
+	if err != nil {
+		h.federationFailure(w, r, provider, claims, "exchange_failed", err)
+		return
+	}
+	if claims.UserID != 0 {
+		h.linkIdentity(w, r, provider, claims, identity)
+		return
+	}
+	h.federatedSignIn(w, r, provider, claims, identity)
+}
+
+// The provider did not return an identity
+func (h *MuxHandler) federationFailure(w http.ResponseWriter, r *http.Request, provider federation.Provider, claims *jwt.FederationClaims, reason string, err error) {
+	if claims.UserID == 0 {
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
+		h.Audit.Log(r, models.AuditEvent{
+			Type:    audit.LoginFailure,
+			Details: map[string]string{"provider": provider.Name(), "reason": reason},
+		})
+	}
+	h.Responses.UnauthorizedRequest(w, err)
+}
+
+func (h *MuxHandler) federatedSignIn(w http.ResponseWriter, r *http.Request, provider federation.Provider, claims *jwt.FederationClaims, identity federation.Identity) {
+	ctx := r.Context()
+	var user models.User
+	linked, err := h.Repo.GetFederatedIdentity(ctx, provider.Name(), identity.Subject)
+	if err == nil {
+		user, err = h.Repo.GetUserByID(ctx, linked.UserID)
+	} else if errors.Is(err, repositories.ErrNotFound) {
+		user, err = h.registerFederated(r, provider, identity)
+	}
+	if errors.Is(err, errRegistrationDisabled) {
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
+		h.Audit.Log(r, models.AuditEvent{
+			Type:    audit.LoginFailure,
+			Details: map[string]string{"provider": provider.Name(), "reason": "unknown_identity"},
+		})
+		h.Responses.Forbidden(w, errors.New("no account is linked to this identity and registration is disabled"))
+		return
+	}
+	if err != nil {
+		metrics.Logins.WithLabelValues(metrics.Error).Inc()
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	if user.Disabled {
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
+		event := userEvent(audit.LoginFailure, user)
+		event.Details = map[string]string{"provider": provider.Name(), "reason": "disabled"}
+		h.Audit.Log(r, event)
+		h.Responses.UnauthorizedRequest(w, errDisabled)
+		return
+	}
+	err = h.createSession(ctx, w, user)
+	if err != nil {
+		metrics.Logins.WithLabelValues(metrics.Error).Inc()
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	metrics.Logins.WithLabelValues(metrics.Success).Inc()
+	event := userEvent(audit.LoginSuccess, user)
+	event.Details = map[string]string{"provider": provider.Name()}
+	h.Audit.Log(r, event)
+
+	if claims.Redirect != "" {
+		http.Redirect(w, r, claims.Redirect, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/auth/", http.StatusSeeOther)
+}
+
+// Create a user for an identity no one has linked yet. The user has no
+// local password, and is never matched to an existing user by name or
+// email, those link the identity from their account instead.
+func (h *MuxHandler) registerFederated(r *http.Request, provider federation.Provider, identity federation.Identity) (models.User, error) {
+	ctx := r.Context()
+	if !h.Conf.Register {
+		metrics.Registrations.WithLabelValues(metrics.Rejected).Inc()
+		return models.User{}, errRegistrationDisabled
+	}
+	// namespaced, so a name chosen at the provider never claims the name of
+	// a directory user who has not logged in yet
+	username := identity.Username
+	if username == "" {
+		username = identity.Subject
+	}
+	username = provider.Name() + "-" + username
+	var user models.User
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		user = models.User{
+			Username: username,
+			Password: authn.FederatedPassword(provider.Name()),
+			UUID:     uuid.New().String(),
+			Created:  time.Now(),
+		}
+		// the username is taken, by a local user or another identity
+		if attempt > 0 {
+			user.Username += "-" + strings.ToLower(rand.Text()[:6])
+		}
+		user, err = h.Repo.CreateUser(ctx, user)
+		if !errors.Is(err, repositories.ErrConflict) {
+			break
+		}
+	}
+	if err != nil {
+		metrics.Registrations.WithLabelValues(metrics.Error).Inc()
+		return user, err
+	}
+	_, err = h.Repo.CreateFederatedIdentity(ctx, models.FederatedIdentity{
+		UserID:   user.ID,
+		Provider: provider.Name(),
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		Created:  user.Created,
+	})
+	if err != nil {
+		// a concurrent callback linked the identity first
+		if err := h.Repo.DeleteUser(ctx, user.ID); err != nil {
+			log.Println("failed to delete user without identity", err)
+		}
+		metrics.Registrations.WithLabelValues(metrics.Error).Inc()
+		return user, err
+	}
+	metrics.Registrations.WithLabelValues(metrics.Success).Inc()
+	event := userEvent(audit.Register, user)
+	event.Details = map[string]string{"provider": provider.Name()}
+	h.Audit.Log(r, event)
+	return user, nil
+}
+
+// Link the identity to the user who started linking, if they are still
+// logged in
+func (h *MuxHandler) linkIdentity(w http.ResponseWriter, r *http.Request, provider federation.Provider, claims *jwt.FederationClaims, identity federation.Identity) {
+	ctx := r.Context()
+	session, err := h.sessionClaims(w, r)
+	if errors.Is(err, errUnavailable) {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	if err != nil || session.UserID != claims.UserID {
+		h.Responses.UnauthorizedRequest(w, errors.New("log in again to link an account"))
+		return
+	}
+	redirect := claims.Redirect
+	if redirect == "" {
+		redirect = "/auth/"
+	}
+	linked, err := h.Repo.GetFederatedIdentity(ctx, provider.Name(), identity.Subject)
+	if err == nil && linked.UserID == session.UserID {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	_, err = h.Repo.CreateFederatedIdentity(ctx, models.FederatedIdentity{
+		UserID:   session.UserID,
+		Provider: provider.Name(),
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		Created:  time.Now(),
+	})
+	if errors.Is(err, repositories.ErrConflict) {
+		h.Responses.BadRequest(w, fmt.Errorf("a %s account is already linked", provider.Title()))
+		return
+	}
+	if err != nil {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	h.Audit.Log(r, models.AuditEvent{
+		Type:     audit.FederatedLink,
+		UserID:   session.UserID,
+		UUID:     session.UUID,
+		Username: session.Username,
+		Details:  map[string]string{"provider": provider.Name()},
+	})
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cheebz/go-auth/audit"
+	"github.com/cheebz/go-auth/authn"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/federation"
+	"github.com/cheebz/go-auth/federation/oidctest"
+	"github.com/cheebz/go-auth/ldapauth"
+	"github.com/cheebz/go-auth/models"
+	"github.com/jimlambrt/gldap"
+	"github.com/jimlambrt/gldap/testdirectory"
+)
+
+// Serve with the mock provider as "oidc"
+func newFederatedTestServer(t *testing.T, register bool, options ...func(c *MuxHandlerConfig, baseURL string)) (*testServer, *oidctest.Provider) {
+	mock := oidctest.NewProvider(t)
+	options = append([]func(c *MuxHandlerConfig, baseURL string){func(c *MuxHandlerConfig, baseURL string) {
+		c.Conf.Register = register
+		provider := federation.NewOIDC("oidc", "Acme", mock.URL,
+			oidctest.ClientID, oidctest.ClientSecret, baseURL+federation.CallbackPath("oidc"))
+		c.Providers = []federation.Provider{provider}
+	}}, options...)
+	return newTestServer(t, config.Configuration{}, options...), mock
+}
+
+// Start signing in or linking at path, and follow the redirects through
+// the provider back to the callback
+func (s *testServer) federate(path string) (*http.Response, string) {
+	res, body := s.do("GET", path, nil, false)
+	location := res.Header.Get("Location")
+	if res.StatusCode != http.StatusSeeOther || strings.HasPrefix(location, "/") {
+		return res, body
+	}
+	res, err := s.client.Get(location)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	res.Body.Close()
+	callback := res.Header.Get("Location")
+	if res.StatusCode != http.StatusFound || !strings.HasPrefix(callback, s.URL) {
+		s.t.Fatal("provider did not redirect to the callback", res.Status, callback)
+	}
+	return s.do("GET", strings.TrimPrefix(callback, s.URL), nil, false)
+}
+
+func (s *testServer) whoami() models.Auth {
+	res, body := s.do("GET", "/auth/", nil, true)
+	expectStatus(s.t, res, body, http.StatusOK)
+	var auth models.Auth
+	err := json.Unmarshal([]byte(body), &auth)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return auth
+}
+
+func (s *testServer) registerAndLogin(username, password string) {
+	res, body := s.do("POST", "/auth/register", url.Values{
+		"username":         {username},
+		"password":         {password},
+		"confirm-password": {password},
+	}, false)
+	expectStatus(s.t, res, body, http.StatusOK)
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {username}, "password": {password}}, false)
+	expectStatus(s.t, res, body, http.StatusSeeOther)
+}
+
+func TestFederatedLogin(t *testing.T) {
+	s, mock := newFederatedTestServer(t, true)
+	res, body := s.do("GET", "/auth/login?redirect=/app", nil, false)
+	expectStatus(t, res, body, http.StatusOK)
+	if !strings.Contains(body, `href="/auth/oidc/oidc/login?redirect=%2fapp">Sign in with Acme`) {
+		t.Fatal("sign in button missing", body)
+	}
+
+	// usernames are namespaced by the provider, and a local user with the
+	// same name is not taken over
+	s.registerAndLogin("oidc-alice", "correct horse")
+	s.do("GET", "/auth/logout", nil, false)
+	mock.SignIn(&oidctest.User{Subject: "alice-sub", PreferredUsername: "alice", Email: "alice@example.com", EmailVerified: true})
+	res, body = s.federate("/auth/oidc/oidc/login?redirect=/app")
+	expectStatus(t, res, body, http.StatusSeeOther)
+	if res.Header.Get("Location") != "/app" {
+		t.Fatal("unexpected redirect", res.Header.Get("Location"))
+	}
+	registered := s.whoami()
+	if !strings.HasPrefix(registered.Username, "oidc-alice-") {
+		t.Fatal("unexpected username", registered.Username)
+	}
+	user, _ := s.repo.GetUserByUUID(context.Background(), registered.UUID)
+	identity, err := s.repo.GetFederatedIdentity(context.Background(), "oidc", "alice-sub")
+	if err != nil || identity.UserID != user.ID || identity.Email != "alice@example.com" {
+		t.Fatal("identity not linked", identity, err)
+	}
+	if user.Password != authn.FederatedPassword("oidc") {
+		t.Fatal("unexpected password marker", user.Password)
+	}
+
+	s.do("GET", "/auth/logout", nil, false)
+	res, body = s.federate("/auth/oidc/oidc/login")
+	expectStatus(t, res, body, http.StatusSeeOther)
+	if again := s.whoami(); again.UUID != registered.UUID {
+		t.Fatal("signed in as a different user", again)
+	}
+	// users without a password keep their only identity
+	res, body = s.do("POST", "/auth/oidc/oidc/unlink", nil, false)
+	expectStatus(t, res, body, http.StatusBadRequest)
+
+	s.do("GET", "/auth/logout", nil, false)
+	mock.SignIn(nil)
+	res, body = s.federate("/auth/oidc/oidc/login")
+	expectStatus(t, res, body, http.StatusUnauthorized)
+	res, body = s.do("GET", "/auth/oidc/oidc/callback?state=forged&code=code", nil, false)
+	expectStatus(t, res, body, http.StatusBadRequest)
+	res, body = s.do("GET", "/auth/oidc/other/login", nil, false)
+	expectStatus(t, res, body, http.StatusNotFound)
+}
+
+func TestFederatedUserNotAdoptedByDirectory(t *testing.T) {
+	d := testdirectory.Start(t, testdirectory.WithNoTLS(t), testdirectory.WithDefaults(t, &testdirectory.Defaults{
+		Users:  testdirectory.NewUsers(t, []string{"search", "ceo", "oidc-ceo"}),
+		Groups: []*gldap.Entry{testdirectory.NewGroup(t, "admins", []string{"ceo", "oidc-ceo"})},
+	}))
+	s, mock := newFederatedTestServer(t, true, func(c *MuxHandlerConfig, _ string) {
+		directory, err := ldapauth.New(config.LDAPConfig{
+			URL:            fmt.Sprintf("ldap://%s:%d", d.Host(), d.Port()),
+			BindDN:         "cn=search," + testdirectory.DefaultUserDN,
+			BindPassword:   "password",
+			UserBaseDN:     testdirectory.DefaultUserDN,
+			UserFilter:     "(cn=%s)",
+			GroupBaseDN:    testdirectory.DefaultGroupDN,
+			GroupFilter:    "(member=%s)",
+			GroupAttribute: "cn",
+			GroupMap:       "admins:admin",
+			Timeout:        5,
+		}, c.Repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Authenticators = []authn.Authenticator{directory}
+	})
+
+	// the name chosen at the provider is not the directory user's
+	mock.SignIn(&oidctest.User{Subject: "attacker-sub", PreferredUsername: "ceo"})
+	res, body := s.federate("/auth/oidc/oidc/login")
+	expectStatus(t, res, body, http.StatusSeeOther)
+	federated := s.whoami()
+	if federated.Username != "oidc-ceo" {
+		t.Fatal("unexpected username", federated.Username)
+	}
+	s.do("GET", "/auth/logout", nil, false)
+
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {"ceo"}, "password": {"password"}}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	if directory := s.whoami(); directory.UUID == federated.UUID || len(directory.Groups) != 2 {
+		t.Fatal("directory user not provisioned", directory)
+	}
+	s.do("GET", "/auth/logout", nil, false)
+
+	// a directory user with the namespaced name doesn't adopt it either
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {"oidc-ceo"}, "password": {"password"}}, false)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+	user, _ := s.repo.GetUserByUUID(context.Background(), federated.UUID)
+	groups, err := s.repo.GetUserGroups(context.Background(), user.ID)
+	if err != nil || len(groups) != 1 {
+		t.Fatal("directory groups synced onto the federated user", groups, err)
+	}
+}
+
+func TestFederatedRegisterDisabled(t *testing.T) {
+	s, mock := newFederatedTestServer(t, false)
+	mock.SignIn(&oidctest.User{Subject: "alice-sub"})
+	res, body := s.federate("/auth/oidc/oidc/login")
+	expectStatus(t, res, body, http.StatusForbidden)
+	_, err := s.repo.GetUserByName(context.Background(), "oidc-alice-sub")
+	if err == nil {
+		t.Fatal("user registered while registration is disabled")
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	ctx := context.Background()
+	s, mock := newFederatedTestServer(t, true)
+	res, body := s.federate("/auth/oidc/oidc/link")
+	expectStatus(t, res, body, http.StatusSeeOther)
+	if res.Header.Get("Location") != "/auth/login" {
+		t.Fatal("linked without a session", res.Header.Get("Location"))
+	}
+
+	s.registerAndLogin("alice", "correct horse")
+	res, body = s.do("GET", "/auth/", nil, false)
+	if !strings.Contains(body, `<a href="/auth/oidc/oidc/link">Link your Acme account</a>`) {
+		t.Fatal("link missing", body)
+	}
+	mock.SignIn(&oidctest.User{Subject: "work-sub", Email: "alice@work.example", EmailVerified: true})
+	res, body = s.federate("/auth/oidc/oidc/link")
+	expectStatus(t, res, body, http.StatusSeeOther)
+	res, body = s.do("GET", "/auth/", nil, false)
+	if !strings.Contains(body, "Acme (alice@work.example)") {
+		t.Fatal("linked account missing", body)
+	}
+	events, _ := s.repo.GetAuditEvents(ctx, models.AuditFilter{Type: audit.FederatedLink})
+	if len(events) != 1 || events[0].Username != "alice" {
+		t.Fatal("link not audited", events)
+	}
+
+	s.do("GET", "/auth/logout", nil, false)
+	res, body = s.federate("/auth/oidc/oidc/login")
+	expectStatus(t, res, body, http.StatusSeeOther)
+	if auth := s.whoami(); auth.Username != "alice" {
+		t.Fatal("signed in as", auth.Username)
+	}
+
+	// the identity can't be linked to a second user
+	s.do("GET", "/auth/logout", nil, false)
+	s.registerAndLogin("carol", "battery staple")
+	res, body = s.federate("/auth/oidc/oidc/link")
+	expectStatus(t, res, body, http.StatusBadRequest)
+
+	s.do("GET", "/auth/logout", nil, false)
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {"alice"}, "password": {"correct horse"}}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	res, body = s.do("POST", "/auth/oidc/oidc/unlink", nil, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	_, err := s.repo.GetFederatedIdentity(ctx, "oidc", "work-sub")
+	if err == nil {
+		t.Fatal("identity still linked")
+	}
+	res, body = s.do("POST", "/auth/oidc/oidc/unlink", nil, false)
+	expectStatus(t, res, body, http.StatusNotFound)
+}
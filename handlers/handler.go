@@ -14,4 +14,5 @@ type Handler interface {
 	Password(w http.ResponseWriter, r *http.Request)
 	Logout(w http.ResponseWriter, r *http.Request)
 	LogoutAll(w http.ResponseWriter, r *http.Request)
+	AuditLog(w http.ResponseWriter, r *http.Request)
 }
@@ -1,43 +1,93 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/cheebz/go-auth/audit"
+	"github.com/cheebz/go-auth/authn"
+	"github.com/cheebz/go-auth/bulk"
 	"github.com/cheebz/go-auth/captcha"
 	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/federation"
 	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/health"
 	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/metrics"
 	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/policy"
 	"github.com/cheebz/go-auth/repositories"
 	"github.com/cheebz/go-auth/responses"
+	"github.com/cheebz/go-auth/tracing"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type MuxHandler struct {
-	Conf      config.Configuration
-	Responses responses.Responses
-	Hasher    hash.Hash
-	Repo      repositories.Repository
-	JWT       *jwt.JWTHelper
-	Templates *template.Template
-	Router    *mux.Router
+	Conf          config.Configuration
+	Responses     responses.Responses
+	Hasher        hash.Hash
+	Policy        *policy.Policy
+	Repo          repositories.Repository
+	JWT           *jwt.JWTHelper
+	Templates     *template.Template
+	Health        *health.Health
+	Audit         *audit.Logger
+	Authenticator authn.Authenticator
+	Providers     []federation.Provider
+	Router        *mux.Router
 }
 
 type MuxHandlerConfig struct {
 	Conf      config.Configuration
 	Resp      responses.Responses
 	Hasher    hash.Hash
+	Policy    *policy.Policy
 	Repo      repositories.Repository
 	JWT       *jwt.JWTHelper
 	Templates *template.Template
+	Health    *health.Health
+	Audit     *audit.Logger
+	// Tried in order before the local password hashes
+	Authenticators []authn.Authenticator
+	// External identity providers, in the order they are shown
+	Providers []federation.Provider
+}
+
+// PageData is passed to templates that report form errors
+type PageData struct {
+	Msg        string
+	Violations []policy.Violation
+	// Sign in buttons on the login page
+	Providers []federation.Provider
+	Redirect  string
+}
+
+// HomeData is passed to the index template
+type HomeData struct {
+	*jwt.JWTClaims
+	Providers []LinkedProvider
+}
+
+// LinkedProvider is an external identity provider and whether the user
+// has linked an account from it
+type LinkedProvider struct {
+	Name   string
+	Title  string
+	Linked bool
+	Email  string
 }
 
 func NewMuxHandler(c MuxHandlerConfig) Handler {
@@ -45,27 +95,51 @@ func NewMuxHandler(c MuxHandlerConfig) Handler {
 		Conf:      c.Conf,
 		Responses: c.Resp,
 		Hasher:    c.Hasher,
+		Policy:    c.Policy,
 		Repo:      c.Repo,
 		JWT:       c.JWT,
 		Templates: c.Templates,
+		Health:    c.Health,
+		Audit:     c.Audit,
+		Providers: c.Providers,
 		Router:    mux.NewRouter(),
 	}
+	if handler.Policy == nil {
+		handler.Policy = &policy.Policy{}
+	}
+	chain := append(authn.Chain{}, c.Authenticators...)
+	handler.Authenticator = append(chain, &localAuthenticator{h: handler})
 	handler.setupRoutes()
 	return handler
 }
 
 func (h *MuxHandler) setupRoutes() {
+	h.Router.Use(audit.RequestID, otelmux.Middleware(h.Conf.Tracing.ServiceName), metrics.Middleware)
+	if h.Health != nil {
+		h.Router.HandleFunc("/auth/healthz", h.Health.Healthz).Methods("GET")
+		h.Router.HandleFunc("/auth/readyz", h.Health.Readyz).Methods("GET")
+	}
 	h.Router.HandleFunc("/auth/", h.Home).Methods("GET")
+	h.Router.HandleFunc("/auth/.well-known/jwks.json", h.JWKS).Methods("GET")
 	h.Router.HandleFunc("/auth/login", h.LoginPage).Methods("GET")
 	h.Router.HandleFunc("/auth/login", h.Login).Methods("POST")
 	h.Router.HandleFunc("/auth/password", h.PasswordPage).Methods("GET")
 	h.Router.HandleFunc("/auth/password", h.Password).Methods("POST")
 	h.Router.HandleFunc("/auth/logout", h.Logout).Methods("GET")
 	h.Router.HandleFunc("/auth/logoutAll", h.LogoutAll).Methods("GET")
+	h.Router.HandleFunc("/auth/admin/audit", h.AuditLog).Methods("GET")
+	h.Router.HandleFunc("/auth/admin/users/export", h.ExportUsers).Methods("GET")
+	h.Router.HandleFunc("/auth/admin/users/import", h.ImportUsers).Methods("POST")
 	if h.Conf.Register {
 		h.Router.HandleFunc("/auth/register", h.RegisterPage).Methods("GET")
 		h.Router.HandleFunc("/auth/register", h.Register).Methods("POST")
 	}
+	if len(h.Providers) > 0 {
+		h.Router.HandleFunc("/auth/oidc/{provider}/login", h.FederatedLogin).Methods("GET")
+		h.Router.HandleFunc("/auth/oidc/{provider}/link", h.FederatedLink).Methods("GET")
+		h.Router.HandleFunc("/auth/oidc/{provider}/unlink", h.FederatedUnlink).Methods("POST")
+		h.Router.HandleFunc("/auth/oidc/{provider}/callback", h.FederatedCallback).Methods("GET")
+	}
 }
 
 func (h *MuxHandler) GetRouter() http.Handler {
@@ -90,28 +164,81 @@ func acceptJSON(r *http.Request) bool {
 	return false
 }
 
+// errUnavailable marks repository failures, as opposed to invalid sessions
+var errUnavailable = errors.New("repository unavailable")
+
+// errDisabled is returned for accounts an administrator has disabled
+var errDisabled = errors.New("account is disabled")
+
+// errPasswordExpired is returned when a session is refreshed after the
+// password expired. The password change cookie is set instead.
+var errPasswordExpired = errors.New("password has expired")
+
+func unavailable(err error) error {
+	if errors.Is(err, repositories.ErrNotFound) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errUnavailable, err)
+}
+
 func (h *MuxHandler) refresh(w http.ResponseWriter, r *http.Request) (*jwt.JWTClaims, error) {
+	ctx := r.Context()
+	outcome := metrics.Error
+	defer func() {
+		if outcome != "" {
+			metrics.Refreshes.WithLabelValues(outcome).Inc()
+		}
+	}()
 	refreshClaims, err := h.JWT.CheckRefreshClaims(r)
-	if err != nil {
+	if errors.Is(err, http.ErrNoCookie) {
+		outcome = ""
 		return nil, err
 	}
-	err = h.Repo.ValidateRefresh(refreshClaims.UserID, refreshClaims.Id)
 	if err != nil {
+		outcome = metrics.Rejected
 		return nil, err
 	}
-	user, err := h.Repo.GetUserByID(refreshClaims.UserID)
-	if err != nil {
+	err = h.Repo.ValidateRefresh(ctx, refreshClaims.UserID, refreshClaims.Id)
+	if errors.Is(err, repositories.ErrRevoked) {
+		// the token was rotated or logged out, so it may have been stolen
+		outcome = metrics.Rejected
+		metrics.RefreshReuseRejections.Inc()
+		h.Audit.Log(r, models.AuditEvent{Type: audit.RefreshReuse, UserID: refreshClaims.UserID})
 		return nil, err
 	}
-	groups, err := h.Repo.GetUserGroups(user.ID)
-	if err != nil {
+	if errors.Is(err, repositories.ErrNotFound) {
+		outcome = metrics.Rejected
 		return nil, err
 	}
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	user, err := h.Repo.GetUserByID(ctx, refreshClaims.UserID)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	if user.Disabled {
+		outcome = metrics.Rejected
+		return nil, errDisabled
+	}
+	if h.passwordExpired(user) {
+		err = h.setPasswordChangeCookie(w, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		outcome = metrics.PasswordExpired
+		h.Audit.Log(r, userEvent(audit.PasswordExpired, user))
+		return nil, errPasswordExpired
+	}
+	groups, err := h.Repo.GetUserGroups(ctx, user.ID)
+	if err != nil {
+		return nil, unavailable(err)
+	}
 	jwt, err := h.JWT.CreateJWT(user, groups)
 	if err != nil {
 		return nil, err
 	}
-	err = h.Repo.InvalidateRefresh(refreshClaims.Id)
+	err = h.Repo.InvalidateRefresh(ctx, refreshClaims.Id)
 	if err != nil {
 		log.Println("failed to invalidate refresh token", err)
 	}
@@ -119,9 +246,9 @@ func (h *MuxHandler) refresh(w http.ResponseWriter, r *http.Request) (*jwt.JWTCl
 	if err != nil {
 		return nil, err
 	}
-	err = h.Repo.SaveRefresh(user.ID, refreshToken.JTI)
+	err = h.Repo.SaveRefresh(ctx, user.ID, refreshToken.JTI)
 	if err != nil {
-		return nil, err
+		return nil, unavailable(err)
 	}
 	jwtCookie := &http.Cookie{
 		Name:     "jwt",
@@ -130,6 +257,7 @@ func (h *MuxHandler) refresh(w http.ResponseWriter, r *http.Request) (*jwt.JWTCl
 		MaxAge:   h.Conf.JWTMaxAge,
 		HttpOnly: true,
 		Secure:   h.Conf.SSLCert != "",
+		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, jwtCookie)
 	refreshCookie := &http.Cookie{
@@ -139,11 +267,206 @@ func (h *MuxHandler) refresh(w http.ResponseWriter, r *http.Request) (*jwt.JWTCl
 		MaxAge:   h.Conf.RefreshMaxAge,
 		HttpOnly: true,
 		Secure:   h.Conf.SSLCert != "",
+		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, refreshCookie)
+	outcome = metrics.Success
 	return &jwt.Claims, err
 }
 
+func (h *MuxHandler) registerTemplate() string {
+	if h.Conf.HCaptchaSecret != "" {
+		return "register_hCaptcha.html"
+	}
+	return "register.html"
+}
+
+// Report password policy violations as JSON or by re-rendering the form
+func (h *MuxHandler) policyViolation(w http.ResponseWriter, r *http.Request, tmpl string, err error) {
+	var policyErr *policy.Error
+	if !errors.As(err, &policyErr) {
+		h.Responses.BadRequest(w, err)
+		return
+	}
+	if acceptJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(policyErr)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	data := PageData{Msg: "Password does not meet policy", Violations: policyErr.Violations}
+	if err := h.Templates.ExecuteTemplate(w, tmpl, data); err != nil {
+		log.Println("failed to render template", err)
+	}
+}
+
+// The Hash interface has no context, so spans are created here
+func (h *MuxHandler) generateHash(ctx context.Context, password string) (string, error) {
+	_, span := tracing.Tracer().Start(ctx, "Hash.Generate")
+	hash, err := h.Hasher.Generate(password)
+	tracing.End(span, err)
+	return hash, err
+}
+
+// A mismatched password is not recorded as a span error
+func (h *MuxHandler) checkHash(ctx context.Context, hash string, password string) error {
+	_, span := tracing.Tracer().Start(ctx, "Hash.Check")
+	defer span.End()
+	err := h.Hasher.Check(hash, password)
+	span.SetAttributes(attribute.Bool("go_auth.password_match", err == nil))
+	return err
+}
+
+// Check the password against the stored hash
+type localAuthenticator struct {
+	h *MuxHandler
+}
+
+func (a *localAuthenticator) Authenticate(ctx context.Context, username, password string) (models.User, error) {
+	user, err := a.h.Repo.GetUserByName(ctx, username)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return user, authn.ErrUnknownUser
+	}
+	if err != nil {
+		return user, err
+	}
+	// left to the authenticator that provisioned them
+	if authn.IsExternal(user.Password) {
+		return user, authn.ErrUnknownUser
+	}
+	err = a.h.checkHash(ctx, user.Password, password)
+	if err != nil {
+		return user, fmt.Errorf("%w: %v", authn.ErrInvalidCredentials, err)
+	}
+	if !user.Disabled {
+		a.h.rehash(ctx, user, password)
+	}
+	return user, nil
+}
+
+// Upgrade a stored hash that uses an outdated algorithm or weaker parameters
+func (h *MuxHandler) rehash(ctx context.Context, user models.User, password string) {
+	if !h.Hasher.NeedsRehash(user.Password) {
+		return
+	}
+	hash, err := h.generateHash(ctx, password)
+	if err != nil {
+		log.Println("failed to rehash password", err)
+		return
+	}
+	err = h.Repo.ReplacePasswordHash(ctx, user.ID, hash)
+	if err != nil {
+		log.Println("failed to update rehashed password", err)
+	}
+}
+
+// Issue a new JWT and refresh token for the user
+func (h *MuxHandler) createSession(ctx context.Context, w http.ResponseWriter, user models.User) error {
+	groups, err := h.Repo.GetUserGroups(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	jwt, err := h.JWT.CreateJWT(user, groups)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := h.JWT.CreateRefresh(user.ID)
+	if err != nil {
+		return err
+	}
+	err = h.Repo.SaveRefresh(ctx, user.ID, refreshToken.JTI)
+	if err != nil {
+		return err
+	}
+	jwtCookie := &http.Cookie{
+		Name:     "jwt",
+		Value:    jwt.Value,
+		Path:     "/",
+		MaxAge:   h.Conf.JWTMaxAge,
+		HttpOnly: true,
+		Secure:   h.Conf.SSLCert != "",
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, jwtCookie)
+	refreshCookie := &http.Cookie{
+		Name:     "refresh",
+		Value:    refreshToken.Value,
+		Path:     "/",
+		MaxAge:   h.Conf.RefreshMaxAge,
+		HttpOnly: true,
+		Secure:   h.Conf.SSLCert != "",
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, refreshCookie)
+	return nil
+}
+
+// The password form, which returns to redirect once the password is changed
+func passwordURL(redirect string) string {
+	if redirect == "" {
+		return "/auth/password"
+	}
+	return "/auth/password?" + url.Values{"redirect": {redirect}}.Encode()
+}
+
+func (h *MuxHandler) passwordExpired(user models.User) bool {
+	if h.Conf.Password.MaxAge <= 0 || authn.IsExternal(user.Password) {
+		return false
+	}
+	maxAge := time.Duration(h.Conf.Password.MaxAge) * time.Second
+	return time.Since(user.PasswordChanged) > maxAge
+}
+
+// Check a new password against the user's recent password history
+func (h *MuxHandler) passwordReused(ctx context.Context, userID int, password string) (bool, error) {
+	if h.Conf.Password.History <= 0 {
+		return false, nil
+	}
+	history, err := h.Repo.GetPasswordHistory(ctx, userID, h.Conf.Password.History)
+	if err != nil {
+		return false, err
+	}
+	for _, hash := range history {
+		if h.checkHash(ctx, hash, password) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// The password change cookie grants access to the password form only
+func (h *MuxHandler) setPasswordChangeCookie(w http.ResponseWriter, userID int) error {
+	token, err := h.JWT.CreatePasswordChange(userID)
+	if err != nil {
+		return err
+	}
+	passwordChangeCookie := &http.Cookie{
+		Name:     "password_change",
+		Value:    token,
+		Path:     "/auth/password",
+		MaxAge:   jwt.PasswordChangeMaxAge,
+		HttpOnly: true,
+		Secure:   h.Conf.SSLCert != "",
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, passwordChangeCookie)
+	return nil
+}
+
+func (h *MuxHandler) clearPasswordChangeCookie(w http.ResponseWriter) {
+	clearedPasswordChangeCookie := &http.Cookie{
+		Name:     "password_change",
+		Value:    "",
+		Path:     "/auth/password",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   h.Conf.SSLCert != "",
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, clearedPasswordChangeCookie)
+}
+
 // Clear session cookies
 func (h *MuxHandler) clearCookies(w http.ResponseWriter) {
 	clearedJWTCookie := &http.Cookie{
@@ -153,6 +476,7 @@ func (h *MuxHandler) clearCookies(w http.ResponseWriter) {
 		MaxAge:   -1,
 		HttpOnly: true,
 		Secure:   h.Conf.SSLCert != "",
+		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, clearedJWTCookie)
 	clearedRefreshCookie := &http.Cookie{
@@ -162,6 +486,7 @@ func (h *MuxHandler) clearCookies(w http.ResponseWriter) {
 		MaxAge:   -1,
 		HttpOnly: true,
 		Secure:   h.Conf.SSLCert != "",
+		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, clearedRefreshCookie)
 }
@@ -173,7 +498,7 @@ func (h *MuxHandler) clearSession(w http.ResponseWriter, r *http.Request) error
 	if err != nil {
 		return err
 	}
-	err = h.Repo.InvalidateRefresh(refreshClaims.Id)
+	err = h.Repo.InvalidateRefresh(r.Context(), refreshClaims.Id)
 	if err != nil {
 		return err
 	}
@@ -187,7 +512,7 @@ func (h *MuxHandler) clearAllSessions(w http.ResponseWriter, r *http.Request) er
 	if err != nil {
 		return err
 	}
-	err = h.Repo.DeleteAllRefresh(refreshClaims.UserID)
+	err = h.Repo.DeleteAllRefresh(r.Context(), refreshClaims.UserID)
 	if err != nil {
 		return err
 	}
@@ -200,8 +525,16 @@ func (h *MuxHandler) Home(w http.ResponseWriter, r *http.Request) {
 	claims, err := h.JWT.CheckJWTClaims(r)
 	if err != nil {
 		claims, err = h.refresh(w, r)
+		if errors.Is(err, errUnavailable) {
+			h.Responses.InternalServerError(w, err)
+			return
+		}
 		if err != nil {
 			_ = h.clearSession(w, r)
+			if errors.Is(err, errPasswordExpired) && !acceptJSON {
+				http.Redirect(w, r, passwordURL(r.URL.Query().Get("redirect")), http.StatusSeeOther)
+				return
+			}
 			if !acceptJSON {
 				http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
 				return
@@ -217,7 +550,13 @@ func (h *MuxHandler) Home(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !acceptJSON {
-		if err := h.Templates.ExecuteTemplate(w, "index.html", claims); err != nil {
+		providers, err := h.linkedProviders(r.Context(), claims.UserID)
+		if err != nil {
+			h.Responses.InternalServerError(w, err)
+			return
+		}
+		data := HomeData{JWTClaims: claims, Providers: providers}
+		if err := h.Templates.ExecuteTemplate(w, "index.html", data); err != nil {
 			h.Responses.InternalServerError(w, err)
 		}
 		return
@@ -227,6 +566,14 @@ func (h *MuxHandler) Home(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(auth)
 }
 
+// /.well-known/jwks.json GET
+// Public keys are cached for about as long as servers take to reload them
+func (h *MuxHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(h.JWT.JWKS())
+}
+
 // /register GET
 func (h *MuxHandler) RegisterPage(w http.ResponseWriter, r *http.Request) {
 	_, err := h.JWT.CheckJWTClaims(r)
@@ -234,14 +581,8 @@ func (h *MuxHandler) RegisterPage(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/auth/", http.StatusSeeOther)
 		return
 	}
-	if h.Conf.HCaptchaSecret != "" {
-		if err := h.Templates.ExecuteTemplate(w, "register_hCaptcha.html", nil); err != nil {
-			h.Responses.InternalServerError(w, err)
-		}
-	} else {
-		if err := h.Templates.ExecuteTemplate(w, "register.html", nil); err != nil {
-			h.Responses.InternalServerError(w, err)
-		}
+	if err := h.Templates.ExecuteTemplate(w, h.registerTemplate(), nil); err != nil {
+		h.Responses.InternalServerError(w, err)
 	}
 }
 
@@ -255,41 +596,66 @@ func (h *MuxHandler) Register(w http.ResponseWriter, r *http.Request) {
 
 	if h.Conf.HCaptchaSecret != "" {
 		hCaptchaResponse := r.PostForm.Get("h-captcha-response")
-		err = captcha.ValidateHCaptcha(hCaptchaResponse, h.Conf.HCaptchaSecret)
+		err = captcha.ValidateHCaptcha(r.Context(), hCaptchaResponse, h.Conf.HCaptchaSecret)
 		if err != nil {
+			metrics.CaptchaFailures.Inc()
+			metrics.Registrations.WithLabelValues(metrics.Rejected).Inc()
 			h.Responses.BadRequest(w, err)
 			return
 		}
 	}
 
 	username := r.PostForm.Get("username")
-	user, err := h.Repo.GetUserByName(username)
+	_, err = h.Repo.GetUserByName(r.Context(), username)
 	if err == nil {
+		metrics.Registrations.WithLabelValues(metrics.Rejected).Inc()
 		h.Responses.BadRequest(w, errors.New("user already exists"))
 		return
 	}
-	user.Username = username
+	if !errors.Is(err, repositories.ErrNotFound) {
+		metrics.Registrations.WithLabelValues(metrics.Error).Inc()
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	user := models.User{Username: username}
 
 	password := r.PostForm.Get("password")
 	confirmPassword := r.PostForm.Get("confirm-password")
 	if password != confirmPassword {
+		metrics.Registrations.WithLabelValues(metrics.Rejected).Inc()
 		h.Responses.BadRequest(w, errors.New("passwords to not match"))
 		return
 	}
 
-	user.Password, err = h.Hasher.Generate(password)
+	err = h.Policy.Check(username, password)
 	if err != nil {
+		metrics.Registrations.WithLabelValues(metrics.Rejected).Inc()
+		h.policyViolation(w, r, h.registerTemplate(), err)
+		return
+	}
+
+	user.Password, err = h.generateHash(r.Context(), password)
+	if err != nil {
+		metrics.Registrations.WithLabelValues(metrics.Error).Inc()
 		h.Responses.InternalServerError(w, err)
 		return
 	}
 
 	user.UUID = uuid.New().String()
 	user.Created = time.Now()
-	user, err = h.Repo.CreateUser(user)
+	user, err = h.Repo.CreateUser(r.Context(), user)
+	if errors.Is(err, repositories.ErrConflict) {
+		metrics.Registrations.WithLabelValues(metrics.Rejected).Inc()
+		h.Responses.BadRequest(w, errors.New("user already exists"))
+		return
+	}
 	if err != nil {
+		metrics.Registrations.WithLabelValues(metrics.Error).Inc()
 		h.Responses.InternalServerError(w, err)
 		return
 	}
+	metrics.Registrations.WithLabelValues(metrics.Success).Inc()
+	h.Audit.Log(r, userEvent(audit.Register, user))
 
 	query := r.URL.Query()
 	redirect := query.Get("redirect")
@@ -308,7 +674,8 @@ func (h *MuxHandler) LoginPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.Templates.ExecuteTemplate(w, "login.html", nil); err != nil {
+	data := PageData{Providers: h.Providers, Redirect: r.URL.Query().Get("redirect")}
+	if err := h.Templates.ExecuteTemplate(w, "login.html", data); err != nil {
 		h.Responses.InternalServerError(w, err)
 	}
 }
@@ -323,64 +690,64 @@ func (h *MuxHandler) Login(w http.ResponseWriter, r *http.Request) {
 	username := r.Form.Get("username")
 	password := r.Form.Get("password")
 
-	user, err := h.Repo.GetUserByName(username)
-	if err != nil {
+	user, err := h.Authenticator.Authenticate(r.Context(), username, password)
+	if errors.Is(err, authn.ErrUnknownUser) {
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
+		h.Audit.Log(r, models.AuditEvent{
+			Type:     audit.LoginFailure,
+			Username: username,
+			Details:  map[string]string{"reason": "unknown_user"},
+		})
 		h.Responses.UnauthorizedRequest(w, err)
 		return
 	}
-
-	err = h.Hasher.Check(user.Password, password)
-	if err != nil {
+	if errors.Is(err, authn.ErrInvalidCredentials) {
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
+		event := userEvent(audit.LoginFailure, user)
+		event.Username = username
+		event.Details = map[string]string{"reason": "invalid_password"}
+		h.Audit.Log(r, event)
 		h.Responses.UnauthorizedRequest(w, err)
 		return
 	}
-
-	groups, err := h.Repo.GetUserGroups(user.ID)
 	if err != nil {
+		metrics.Logins.WithLabelValues(metrics.Error).Inc()
 		h.Responses.InternalServerError(w, err)
 		return
 	}
-
-	jwt, err := h.JWT.CreateJWT(user, groups)
-	if err != nil {
-		h.Responses.InternalServerError(w, err)
+	if user.Disabled {
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
+		event := userEvent(audit.LoginFailure, user)
+		event.Details = map[string]string{"reason": "disabled"}
+		h.Audit.Log(r, event)
+		h.Responses.UnauthorizedRequest(w, errDisabled)
 		return
 	}
+	query := r.URL.Query()
+	redirect := query.Get("redirect")
 
-	refreshToken, err := h.JWT.CreateRefresh(user.ID)
-	if err != nil {
-		h.Responses.InternalServerError(w, err)
+	if h.passwordExpired(user) {
+		err = h.setPasswordChangeCookie(w, user.ID)
+		if err != nil {
+			metrics.Logins.WithLabelValues(metrics.Error).Inc()
+			h.Responses.InternalServerError(w, err)
+			return
+		}
+		metrics.Logins.WithLabelValues(metrics.PasswordExpired).Inc()
+		h.Audit.Log(r, userEvent(audit.PasswordExpired, user))
+		http.Redirect(w, r, passwordURL(redirect), http.StatusSeeOther)
 		return
 	}
 
-	err = h.Repo.SaveRefresh(user.ID, refreshToken.JTI)
+	err = h.createSession(r.Context(), w, user)
 	if err != nil {
+		metrics.Logins.WithLabelValues(metrics.Error).Inc()
 		h.Responses.InternalServerError(w, err)
 		return
 	}
+	metrics.Logins.WithLabelValues(metrics.Success).Inc()
+	h.Audit.Log(r, userEvent(audit.LoginSuccess, user))
 
-	jwtCookie := &http.Cookie{
-		Name:     "jwt",
-		Value:    jwt.Value,
-		Path:     "/",
-		MaxAge:   h.Conf.JWTMaxAge,
-		HttpOnly: true,
-		Secure:   h.Conf.SSLCert != "",
-	}
-	http.SetCookie(w, jwtCookie)
-
-	refreshCookie := &http.Cookie{
-		Name:     "refresh",
-		Value:    refreshToken.Value,
-		Path:     "/",
-		MaxAge:   h.Conf.RefreshMaxAge,
-		HttpOnly: true,
-		Secure:   h.Conf.SSLCert != "",
-	}
-	http.SetCookie(w, refreshCookie)
-
-	query := r.URL.Query()
-	redirect := query.Get("redirect")
 	if redirect != "" {
 		http.Redirect(w, r, redirect, http.StatusSeeOther)
 		return
@@ -390,31 +757,81 @@ func (h *MuxHandler) Login(w http.ResponseWriter, r *http.Request) {
 
 // /password GET
 func (h *MuxHandler) PasswordPage(w http.ResponseWriter, r *http.Request) {
-	_, err := h.JWT.CheckJWTClaims(r)
-	if err != nil {
-		_, err = h.refresh(w, r)
+	var data *PageData
+	_, err := h.JWT.CheckPasswordChangeClaims(r)
+	if err == nil {
+		data = &PageData{Msg: "Your password has expired and must be changed"}
+	} else {
+		_, err = h.JWT.CheckJWTClaims(r)
 		if err != nil {
-			_ = h.clearSession(w, r)
-			h.Responses.UnauthorizedRequest(w, err)
-			return
+			_, err = h.refresh(w, r)
+			if errors.Is(err, errUnavailable) {
+				h.Responses.InternalServerError(w, err)
+				return
+			}
+			if errors.Is(err, errPasswordExpired) {
+				// the password change cookie is sent with the next request
+				_ = h.clearSession(w, r)
+				http.Redirect(w, r, passwordURL(r.URL.Query().Get("redirect")), http.StatusSeeOther)
+				return
+			}
+			if err != nil {
+				_ = h.clearSession(w, r)
+				h.Responses.UnauthorizedRequest(w, err)
+				return
+			}
 		}
 	}
-	if err := h.Templates.ExecuteTemplate(w, "password.html", nil); err != nil {
+	if err := h.Templates.ExecuteTemplate(w, "password.html", data); err != nil {
 		h.Responses.InternalServerError(w, err)
 	}
 }
 
 // /password POST
 func (h *MuxHandler) Password(w http.ResponseWriter, r *http.Request) {
-	claims, err := h.JWT.CheckJWTClaims(r)
-	if err != nil {
-		claims, err = h.refresh(w, r)
+	var user models.User
+	passwordChangeClaims, err := h.JWT.CheckPasswordChangeClaims(r)
+	expired := err == nil
+	if expired {
+		user, err = h.Repo.GetUserByID(r.Context(), passwordChangeClaims.UserID)
 		if err != nil {
-			_ = h.clearSession(w, r)
-			http.Redirect(w, r, "/auth/", http.StatusSeeOther)
+			h.Responses.InternalServerError(w, err)
+			return
+		}
+		if user.Disabled {
+			h.clearPasswordChangeCookie(w)
+			h.Responses.UnauthorizedRequest(w, errDisabled)
+			return
+		}
+	} else {
+		claims, err := h.JWT.CheckJWTClaims(r)
+		if err != nil {
+			claims, err = h.refresh(w, r)
+			if errors.Is(err, errUnavailable) {
+				h.Responses.InternalServerError(w, err)
+				return
+			}
+			if errors.Is(err, errPasswordExpired) {
+				_ = h.clearSession(w, r)
+				http.Redirect(w, r, passwordURL(r.URL.Query().Get("redirect")), http.StatusSeeOther)
+				return
+			}
+			if err != nil {
+				_ = h.clearSession(w, r)
+				http.Redirect(w, r, "/auth/", http.StatusSeeOther)
+				return
+			}
+		}
+		user, err = h.Repo.GetUserByName(r.Context(), claims.Username)
+		if err != nil {
+			h.Responses.InternalServerError(w, err)
 			return
 		}
 	}
+	if authn.IsExternal(user.Password) {
+		h.Responses.BadRequest(w, errors.New("password is managed by an external provider"))
+		return
+	}
 
 	err = r.ParseForm()
 	if err != nil {
@@ -435,29 +852,49 @@ func (h *MuxHandler) Password(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.Repo.GetUserByName(claims.Username)
+	err = h.Policy.Check(user.Username, newPassword)
 	if err != nil {
-		h.Responses.InternalServerError(w, err)
+		h.policyViolation(w, r, "password.html", err)
 		return
 	}
 
-	err = h.Hasher.Check(user.Password, currentPassword)
+	err = h.checkHash(r.Context(), user.Password, currentPassword)
 	if err != nil {
 		h.Responses.BadRequest(w, errors.New("current password is incorrect"))
 		return
 	}
 
-	password, err := h.Hasher.Generate(newPassword)
+	reused, err := h.passwordReused(r.Context(), user.ID, newPassword)
+	if err != nil {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	if reused {
+		h.Responses.BadRequest(w, errors.New("new password was used recently"))
+		return
+	}
+
+	password, err := h.generateHash(r.Context(), newPassword)
 	if err != nil {
 		h.Responses.InternalServerError(w, err)
 		return
 	}
 
-	err = h.Repo.UpdatePassword(user.ID, password)
+	err = h.Repo.UpdatePassword(r.Context(), user.ID, password)
 	if err != nil {
 		h.Responses.InternalServerError(w, err)
 		return
 	}
+	h.Audit.Log(r, userEvent(audit.PasswordChange, user))
+
+	if expired {
+		h.clearPasswordChangeCookie(w)
+		err = h.createSession(r.Context(), w, user)
+		if err != nil {
+			h.Responses.InternalServerError(w, err)
+			return
+		}
+	}
 
 	query := r.URL.Query()
 	redirect := query.Get("redirect")
@@ -481,6 +918,8 @@ func (h *MuxHandler) Logout(w http.ResponseWriter, r *http.Request) {
 		h.Responses.InternalServerError(w, err)
 		return
 	}
+	metrics.Logouts.WithLabelValues("session").Inc()
+	h.auditLogout(r, audit.Logout)
 
 	query := r.URL.Query()
 	redirect := query.Get("redirect")
@@ -504,6 +943,8 @@ func (h *MuxHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
 		h.Responses.InternalServerError(w, err)
 		return
 	}
+	metrics.Logouts.WithLabelValues("all").Inc()
+	h.auditLogout(r, audit.LogoutAll)
 
 	query := r.URL.Query()
 	redirect := query.Get("redirect")
@@ -513,3 +954,227 @@ func (h *MuxHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Fprintln(w, "Logged out all sessions")
 }
+
+func userEvent(eventType string, user models.User) models.AuditEvent {
+	return models.AuditEvent{
+		Type:     eventType,
+		UserID:   user.ID,
+		UUID:     user.UUID,
+		Username: user.Username,
+	}
+}
+
+// The refresh cookie is still on the request after the session is cleared
+func (h *MuxHandler) auditLogout(r *http.Request, eventType string) {
+	refreshClaims, err := h.JWT.CheckRefreshClaims(r)
+	if err != nil {
+		return
+	}
+	h.Audit.Log(r, models.AuditEvent{Type: eventType, UserID: refreshClaims.UserID})
+}
+
+func isAdmin(groups []models.Group) bool {
+	for _, group := range groups {
+		if group.Name == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the JWT belongs to an admin, writing the error response if not
+func (h *MuxHandler) adminClaims(w http.ResponseWriter, r *http.Request) (*jwt.JWTClaims, bool) {
+	claims, err := h.JWT.CheckJWTClaims(r)
+	return h.checkAdmin(w, claims, err)
+}
+
+// State changing admin requests need the token in the Authorization header,
+// so they can't be forged by a cross-site form
+func (h *MuxHandler) adminBearerClaims(w http.ResponseWriter, r *http.Request) (*jwt.JWTClaims, bool) {
+	claims, err := h.JWT.CheckBearerClaims(r)
+	return h.checkAdmin(w, claims, err)
+}
+
+func (h *MuxHandler) checkAdmin(w http.ResponseWriter, claims *jwt.JWTClaims, err error) (*jwt.JWTClaims, bool) {
+	if err != nil {
+		h.Responses.UnauthorizedRequest(w, err)
+		return nil, false
+	}
+	if !isAdmin(claims.Groups) {
+		h.Responses.Forbidden(w, errors.New("admin group required"))
+		return nil, false
+	}
+	return claims, true
+}
+
+func adminEvent(eventType string, claims *jwt.JWTClaims, details map[string]string) models.AuditEvent {
+	return models.AuditEvent{
+		Type:     eventType,
+		UserID:   claims.UserID,
+		UUID:     claims.UUID,
+		Username: claims.Username,
+		Details:  details,
+	}
+}
+
+// /admin/audit GET
+func (h *MuxHandler) AuditLog(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.adminClaims(w, r)
+	if !ok {
+		return
+	}
+	var err error
+
+	query := r.URL.Query()
+	filter := models.AuditFilter{Type: query.Get("type")}
+	if v := query.Get("user_id"); v != "" {
+		filter.UserID, err = strconv.Atoi(v)
+		if err != nil {
+			h.Responses.BadRequest(w, fmt.Errorf("invalid user_id: %w", err))
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil {
+			h.Responses.BadRequest(w, fmt.Errorf("invalid limit: %w", err))
+			return
+		}
+	}
+	if v := query.Get("since"); v != "" {
+		filter.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			h.Responses.BadRequest(w, fmt.Errorf("invalid since: %w", err))
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		filter.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			h.Responses.BadRequest(w, fmt.Errorf("invalid until: %w", err))
+			return
+		}
+	}
+
+	events, err := h.Repo.GetAuditEvents(r.Context(), filter)
+	if err != nil {
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	h.Audit.Log(r, adminEvent(audit.AdminAuditQuery, claims, map[string]string{"query": r.URL.RawQuery}))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// Content types of the export formats
+var exportContentTypes = map[string]string{
+	bulk.FormatJSONL: "application/x-ndjson",
+	bulk.FormatCSV:   "text/csv",
+}
+
+// Formats of the import content types
+var importFormats = map[string]string{
+	"application/x-ndjson": bulk.FormatJSONL,
+	"text/csv":             bulk.FormatCSV,
+}
+
+// /admin/users/export GET
+func (h *MuxHandler) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.adminClaims(w, r)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = bulk.FormatJSONL
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		h.Responses.BadRequest(w, fmt.Errorf("unsupported format: %s", format))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=users.%s", format))
+	enc, _ := bulk.NewEncoder(w, format)
+	count, err := bulk.Export(r.Context(), h.Repo, enc)
+	if err != nil {
+		// the status is already sent once records have been written
+		if count == 0 {
+			h.Responses.InternalServerError(w, err)
+		} else {
+			log.Println(fmt.Sprintf("user export failed after %d users: %s", count, err.Error()))
+		}
+		return
+	}
+	h.Audit.Log(r, adminEvent(audit.AdminUserExport, claims, map[string]string{
+		"format": format,
+		"users":  strconv.Itoa(count),
+	}))
+}
+
+// Largest request body accepted by the user import
+const maxImportSize = 32 << 20
+
+// /admin/users/import POST
+func (h *MuxHandler) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	claims, ok := h.adminBearerClaims(w, r)
+	if !ok {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	format, ok := importFormats[mediaType]
+	if !ok {
+		h.Responses.UnsupportedMediaType(w, fmt.Errorf("unsupported content type: %s", r.Header.Get("Content-Type")))
+		return
+	}
+	query := r.URL.Query()
+	opts := bulk.ImportOptions{
+		OnConflict: query.Get("on_conflict"),
+		DryRun:     query.Get("dry_run") == "true",
+	}
+	switch opts.OnConflict {
+	case "":
+		opts.OnConflict = repositories.ImportFail
+	case repositories.ImportSkip, repositories.ImportOverwrite, repositories.ImportFail:
+	default:
+		h.Responses.BadRequest(w, fmt.Errorf("unsupported on_conflict: %s", opts.OnConflict))
+		return
+	}
+	if v := query.Get("batch_size"); v != "" {
+		var err error
+		opts.BatchSize, err = strconv.Atoi(v)
+		if err != nil {
+			h.Responses.BadRequest(w, fmt.Errorf("invalid batch_size: %w", err))
+			return
+		}
+	}
+	dec, err := bulk.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize), format)
+	if err != nil {
+		h.Responses.BadRequest(w, err)
+		return
+	}
+	report, err := bulk.Import(r.Context(), h.Repo, h.Hasher, dec, opts)
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, repositories.ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, bulk.ErrMalformed):
+		h.Responses.BadRequest(w, err)
+		return
+	case err != nil:
+		h.Responses.InternalServerError(w, err)
+		return
+	}
+	h.Audit.Log(r, adminEvent(audit.AdminUserImport, claims, map[string]string{
+		"format":      format,
+		"on_conflict": opts.OnConflict,
+		"dry_run":     strconv.FormatBool(opts.DryRun),
+		"created":     strconv.Itoa(report.Created),
+		"updated":     strconv.Itoa(report.Updated),
+		"skipped":     strconv.Itoa(report.Skipped),
+		"rejected":    strconv.Itoa(report.Rejected),
+	}))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,634 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/audit"
+	"github.com/cheebz/go-auth/authn"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/metrics"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/policy"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/cheebz/go-auth/responses"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type testServer struct {
+	*httptest.Server
+	t      *testing.T
+	repo   repositories.Repository
+	hasher hash.Hash
+	jwt    *jwt.JWTHelper
+	client *http.Client
+}
+
+// Options can change the handler config, baseURL is the URL of the server
+func newTestServer(t *testing.T, conf config.Configuration, options ...func(c *MuxHandlerConfig, baseURL string)) *testServer {
+	conf.Register = true
+	conf.JWTKey = "secret"
+	conf.JWTMaxAge = 1200
+	conf.RefreshMaxAge = 2592000
+	repo := repositories.NewMemoryRepository(conf)
+	hasher := hash.NewMultiHash(hash.NewArgon2Hash(1024, 1, 1))
+	jwtHelper := jwt.NewJWTHelper(conf.JWTKey, conf.JWTMaxAge, conf.RefreshMaxAge)
+	c := MuxHandlerConfig{
+		Conf:      conf,
+		Resp:      responses.NewAuthResponses(true),
+		Hasher:    hasher,
+		Policy:    &policy.Policy{MinLength: 8, RejectUsername: true},
+		Repo:      repo,
+		JWT:       jwtHelper,
+		Templates: template.Must(template.ParseGlob("../templates/*.html")),
+		Audit:     audit.NewLogger(false, audit.NewRepositorySink(repo)),
+	}
+	// the listener exists before the server starts
+	server := httptest.NewUnstartedServer(nil)
+	for _, option := range options {
+		option(&c, "http://"+server.Listener.Addr().String())
+	}
+	server.Config.Handler = NewMuxHandler(c).GetRouter()
+	server.Start()
+	t.Cleanup(server.Close)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &testServer{Server: server, t: t, repo: repo, hasher: hasher, jwt: jwtHelper, client: client}
+}
+
+func (s *testServer) do(method, path string, form url.Values, acceptJSON bool) (*http.Response, string) {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if acceptJSON {
+		req.Header.Set("Accept", "application/json")
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+// Drop the JWT cookie so the next request has to use the refresh token
+func (s *testServer) expireJWT() {
+	u, _ := url.Parse(s.URL + "/")
+	s.client.Jar.SetCookies(u, []*http.Cookie{{Name: "jwt", Path: "/", MaxAge: -1}})
+}
+
+// Replace the JWT cookie with one for username in the admin group
+func (s *testServer) promoteToAdmin(username string) models.User {
+	user, err := s.repo.GetUserByName(context.Background(), username)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	token, err := s.jwt.CreateJWT(user, []models.Group{{ID: 2, Name: "admin"}})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	u, _ := url.Parse(s.URL + "/")
+	s.client.Jar.SetCookies(u, []*http.Cookie{{Name: "jwt", Value: token.Value, Path: "/"}})
+	return user
+}
+
+func expectStatus(t *testing.T, res *http.Response, body string, status int) {
+	t.Helper()
+	if res.StatusCode != status {
+		t.Fatalf("expected status %d, got %d: %s", status, res.StatusCode, body)
+	}
+}
+
+func TestSessionFlow(t *testing.T) {
+	s := newTestServer(t, config.Configuration{})
+	logins := func(outcome string) float64 {
+		return testutil.ToFloat64(metrics.Logins.WithLabelValues(outcome))
+	}
+	successes, failures := logins(metrics.Success), logins(metrics.Failure)
+	refreshes := testutil.ToFloat64(metrics.Refreshes.WithLabelValues(metrics.Success))
+
+	res, body := s.do("POST", "/auth/register", url.Values{
+		"username":         {"alice"},
+		"password":         {"correct horse"},
+		"confirm-password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusOK)
+
+	res, body = s.do("POST", "/auth/login", url.Values{
+		"username": {"alice"},
+		"password": {"wrong password"},
+	}, false)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+
+	res, body = s.do("POST", "/auth/login", url.Values{
+		"username": {"alice"},
+		"password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+
+	res, body = s.do("GET", "/auth/", nil, true)
+	expectStatus(t, res, body, http.StatusOK)
+	var auth models.Auth
+	err := json.Unmarshal([]byte(body), &auth)
+	if err != nil {
+		t.Fatal("failed to decode auth", err)
+	}
+	if auth.Username != "alice" || len(auth.Groups) != 1 || auth.Groups[0].Name != "public" {
+		t.Fatal("unexpected auth", auth)
+	}
+
+	s.expireJWT()
+	res, body = s.do("GET", "/auth/", nil, true)
+	expectStatus(t, res, body, http.StatusOK)
+
+	if logins(metrics.Success) != successes+1 || logins(metrics.Failure) != failures+1 {
+		t.Fatal("login outcomes not counted")
+	}
+	if testutil.ToFloat64(metrics.Refreshes.WithLabelValues(metrics.Success)) != refreshes+1 {
+		t.Fatal("refresh not counted")
+	}
+
+	res, body = s.do("GET", "/auth/logout", nil, false)
+	expectStatus(t, res, body, http.StatusOK)
+
+	res, body = s.do("GET", "/auth/", nil, true)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+}
+
+func TestDisabledUser(t *testing.T) {
+	s := newTestServer(t, config.Configuration{})
+	form := url.Values{"username": {"alice"}, "password": {"correct horse"}}
+	res, body := s.do("POST", "/auth/register", url.Values{
+		"username":         {"alice"},
+		"password":         {"correct horse"},
+		"confirm-password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusOK)
+	res, body = s.do("POST", "/auth/login", form, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+
+	user, err := s.repo.GetUserByName(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.repo.SetUserDisabled(context.Background(), user.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the session cannot be refreshed once the JWT expires
+	s.expireJWT()
+	res, body = s.do("GET", "/auth/", nil, true)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+	res, body = s.do("POST", "/auth/login", form, false)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+
+	err = s.repo.SetUserDisabled(context.Background(), user.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, body = s.do("POST", "/auth/login", form, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+}
+
+// Fails every refresh token validation with err
+type refreshRepository struct {
+	repositories.Repository
+	err error
+}
+
+func (r *refreshRepository) ValidateRefresh(ctx context.Context, userID int, jti string) error {
+	return r.err
+}
+
+// Only tokens that were rotated or revoked count as reused
+func TestRefreshReuse(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		reuse float64
+	}{
+		{err: repositories.ErrNotFound, reuse: 0},
+		{err: repositories.ErrRevoked, reuse: 1},
+	} {
+		s := newTestServer(t, config.Configuration{}, func(c *MuxHandlerConfig, _ string) {
+			c.Repo = &refreshRepository{Repository: c.Repo, err: test.err}
+		})
+		res, body := s.do("POST", "/auth/register", url.Values{
+			"username":         {"alice"},
+			"password":         {"correct horse"},
+			"confirm-password": {"correct horse"},
+		}, false)
+		expectStatus(t, res, body, http.StatusOK)
+		res, body = s.do("POST", "/auth/login", url.Values{"username": {"alice"}, "password": {"correct horse"}}, false)
+		expectStatus(t, res, body, http.StatusSeeOther)
+
+		reuses := testutil.ToFloat64(metrics.RefreshReuseRejections)
+		s.expireJWT()
+		res, body = s.do("GET", "/auth/", nil, true)
+		expectStatus(t, res, body, http.StatusUnauthorized)
+		if testutil.ToFloat64(metrics.RefreshReuseRejections) != reuses+test.reuse {
+			t.Fatal("unexpected reuse count for", test.err)
+		}
+	}
+}
+
+// Knows dana, and provisions her like a directory would
+type fakeAuthenticator struct {
+	repo repositories.Repository
+	err  error
+}
+
+func (a *fakeAuthenticator) Authenticate(ctx context.Context, username, password string) (models.User, error) {
+	if a.err != nil {
+		return models.User{}, a.err
+	}
+	if username != "dana" {
+		return models.User{}, authn.ErrUnknownUser
+	}
+	if password != "directory password" {
+		return models.User{}, authn.ErrInvalidCredentials
+	}
+	user, err := a.repo.GetUserByName(ctx, username)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return a.repo.CreateUser(ctx, models.User{Username: username, Password: authn.LDAPPassword, Created: time.Now()})
+	}
+	return user, err
+}
+
+func TestAuthenticators(t *testing.T) {
+	conf := config.Configuration{}
+	conf.Password.MaxAge = 3600
+	fake := &fakeAuthenticator{}
+	s := newTestServer(t, conf, func(c *MuxHandlerConfig, _ string) {
+		c.Authenticators = []authn.Authenticator{fake}
+	})
+	fake.repo = s.repo
+
+	res, body := s.do("POST", "/auth/register", url.Values{
+		"username":         {"alice"},
+		"password":         {"correct horse"},
+		"confirm-password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusOK)
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {"alice"}, "password": {"correct horse"}}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {"dana"}, "password": {"wrong"}}, false)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+
+	// external users never have an expired password
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {"dana"}, "password": {"directory password"}}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	if res.Header.Get("Location") != "/auth/" {
+		t.Fatal("unexpected redirect", res.Header.Get("Location"))
+	}
+	res, body = s.do("GET", "/auth/", nil, true)
+	expectStatus(t, res, body, http.StatusOK)
+	res, body = s.do("POST", "/auth/password", url.Values{
+		"current-password": {"directory password"},
+		"new-password":     {"local password"},
+		"confirm-password": {"local password"},
+	}, false)
+	expectStatus(t, res, body, http.StatusBadRequest)
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {"dana"}, "password": {authn.LDAPPassword}}, false)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+
+	// local users can still log in when the directory is down
+	fake.err = errors.New("directory unavailable")
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {"alice"}, "password": {"correct horse"}}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	res, body = s.do("POST", "/auth/login", url.Values{"username": {"dana"}, "password": {"directory password"}}, false)
+	expectStatus(t, res, body, http.StatusInternalServerError)
+}
+
+func TestRegisterPolicyViolation(t *testing.T) {
+	s := newTestServer(t, config.Configuration{})
+
+	res, body := s.do("POST", "/auth/register", url.Values{
+		"username":         {"alice"},
+		"password":         {"alice"},
+		"confirm-password": {"alice"},
+	}, true)
+	expectStatus(t, res, body, http.StatusBadRequest)
+	var violations struct {
+		Violations []policy.Violation `json:"violations"`
+	}
+	err := json.Unmarshal([]byte(body), &violations)
+	if err != nil {
+		t.Fatal("failed to decode violations", err)
+	}
+	if len(violations.Violations) != 2 {
+		t.Fatal("unexpected violations", violations)
+	}
+
+	res, body = s.do("POST", "/auth/register", url.Values{
+		"username":         {"alice"},
+		"password":         {"alice"},
+		"confirm-password": {"alice"},
+	}, false)
+	expectStatus(t, res, body, http.StatusBadRequest)
+	if !strings.Contains(body, "password is too similar to username") {
+		t.Fatal("violations not rendered", body)
+	}
+}
+
+func TestRegisterWithoutPolicy(t *testing.T) {
+	s := newTestServer(t, config.Configuration{}, func(c *MuxHandlerConfig, baseURL string) {
+		c.Policy = nil
+	})
+	s.registerAndLogin("alice", "alice")
+	res, body := s.do("POST", "/auth/password", url.Values{
+		"current-password": {"alice"},
+		"new-password":     {"bob"},
+		"confirm-password": {"bob"},
+	}, false)
+	expectStatus(t, res, body, http.StatusOK)
+}
+
+func TestExpiredPassword(t *testing.T) {
+	conf := config.Configuration{}
+	conf.Password.MaxAge = 3600
+	conf.Password.History = 2
+	s := newTestServer(t, conf)
+
+	password, err := s.hasher.Generate("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.repo.CreateUser(context.Background(), models.User{
+		Username: "alice",
+		Password: password,
+		Created:  time.Now().Add(-2 * time.Hour),
+		UUID:     "alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, body := s.do("POST", "/auth/login", url.Values{
+		"username": {"alice"},
+		"password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	if res.Header.Get("Location") != "/auth/password" {
+		t.Fatal("expected redirect to password page, got", res.Header.Get("Location"))
+	}
+
+	res, body = s.do("GET", "/auth/", nil, true)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+
+	res, body = s.do("GET", "/auth/password", nil, false)
+	expectStatus(t, res, body, http.StatusOK)
+
+	res, body = s.do("POST", "/auth/password", url.Values{
+		"current-password": {"correct horse"},
+		"new-password":     {"battery staple"},
+		"confirm-password": {"battery staple"},
+	}, false)
+	expectStatus(t, res, body, http.StatusOK)
+
+	res, body = s.do("GET", "/auth/", nil, true)
+	expectStatus(t, res, body, http.StatusOK)
+
+	res, body = s.do("POST", "/auth/password", url.Values{
+		"current-password": {"battery staple"},
+		"new-password":     {"correct horse"},
+		"confirm-password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusBadRequest)
+	if !strings.Contains(body, "used recently") {
+		t.Fatal("expected password reuse to be rejected", body)
+	}
+}
+
+// A session from before the password expired cannot be refreshed
+func TestExpiredPasswordRefresh(t *testing.T) {
+	conf := config.Configuration{}
+	conf.Password.MaxAge = 3600
+	s := newTestServer(t, conf)
+
+	password, err := s.hasher.Generate("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.repo.CreateUser(context.Background(), models.User{
+		Username: "alice",
+		Password: password,
+		Created:  time.Now().Add(-2 * time.Hour),
+		UUID:     "alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := s.jwt.CreateRefresh(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.repo.SaveRefresh(context.Background(), user.ID, refresh.JTI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(s.URL + "/")
+	s.client.Jar.SetCookies(u, []*http.Cookie{{Name: "refresh", Value: refresh.Value, Path: "/"}})
+	expired := testutil.ToFloat64(metrics.Refreshes.WithLabelValues(metrics.PasswordExpired))
+
+	res, body := s.do("GET", "/auth/?redirect=/app", nil, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	if res.Header.Get("Location") != "/auth/password?redirect=%2Fapp" {
+		t.Fatal("expected redirect to password page, got", res.Header.Get("Location"))
+	}
+	if testutil.ToFloat64(metrics.Refreshes.WithLabelValues(metrics.PasswordExpired)) != expired+1 {
+		t.Fatal("expired refresh not counted")
+	}
+	res, body = s.do("GET", "/auth/", nil, true)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+
+	res, body = s.do("POST", "/auth/password", url.Values{
+		"current-password": {"correct horse"},
+		"new-password":     {"battery staple"},
+		"confirm-password": {"battery staple"},
+	}, false)
+	expectStatus(t, res, body, http.StatusOK)
+	res, body = s.do("GET", "/auth/", nil, true)
+	expectStatus(t, res, body, http.StatusOK)
+}
+
+func TestAuditLog(t *testing.T) {
+	s := newTestServer(t, config.Configuration{})
+	res, body := s.do("POST", "/auth/register", url.Values{
+		"username":         {"alice"},
+		"password":         {"correct horse"},
+		"confirm-password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusOK)
+	res, body = s.do("POST", "/auth/login", url.Values{
+		"username": {"alice"},
+		"password": {"wrong password"},
+	}, false)
+	expectStatus(t, res, body, http.StatusUnauthorized)
+	res, body = s.do("POST", "/auth/login", url.Values{
+		"username": {"alice"},
+		"password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	if res.Header.Get("X-Request-ID") == "" {
+		t.Fatal("response has no request id")
+	}
+
+	res, body = s.do("GET", "/auth/admin/audit", nil, true)
+	expectStatus(t, res, body, http.StatusForbidden)
+
+	user := s.promoteToAdmin("alice")
+
+	res, body = s.do("GET", "/auth/admin/audit?user_id="+strconv.Itoa(user.ID), nil, true)
+	expectStatus(t, res, body, http.StatusOK)
+	var events []models.AuditEvent
+	err := json.Unmarshal([]byte(body), &events)
+	if err != nil {
+		t.Fatal("failed to decode audit events", err)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+		if event.IP == "" || event.RequestID == "" || event.UserAgent == "" {
+			t.Fatal("audit event missing request details", event)
+		}
+	}
+	expected := []string{audit.LoginSuccess, audit.LoginFailure, audit.Register}
+	if strings.Join(types, ",") != strings.Join(expected, ",") {
+		t.Fatal("unexpected audit events", types)
+	}
+	if events[1].Details["reason"] != "invalid_password" {
+		t.Fatal("login failure has no reason", events[1])
+	}
+
+	res, body = s.do("GET", "/auth/admin/audit?type="+audit.AdminAuditQuery, nil, true)
+	expectStatus(t, res, body, http.StatusOK)
+	if !strings.Contains(body, `"username":"alice"`) {
+		t.Fatal("admin query not audited", body)
+	}
+	res, body = s.do("GET", "/auth/admin/audit?since=yesterday", nil, true)
+	expectStatus(t, res, body, http.StatusBadRequest)
+}
+
+func TestUserExportImport(t *testing.T) {
+	s := newTestServer(t, config.Configuration{})
+	res, body := s.do("POST", "/auth/register", url.Values{
+		"username":         {"alice"},
+		"password":         {"correct horse"},
+		"confirm-password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusOK)
+	res, body = s.do("POST", "/auth/login", url.Values{
+		"username": {"alice"},
+		"password": {"correct horse"},
+	}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+	for _, cookie := range res.Cookies() {
+		if cookie.SameSite != http.SameSiteLaxMode {
+			t.Fatal("session cookie sent cross-site", cookie)
+		}
+	}
+
+	res, body = s.do("GET", "/auth/admin/users/export", nil, false)
+	expectStatus(t, res, body, http.StatusForbidden)
+	s.promoteToAdmin("alice")
+	var token string
+	u, _ := url.Parse(s.URL + "/")
+	for _, cookie := range s.client.Jar.Cookies(u) {
+		if cookie.Name == "jwt" {
+			token = cookie.Value
+		}
+	}
+
+	res, body = s.do("GET", "/auth/admin/users/export?format=csv", nil, false)
+	expectStatus(t, res, body, http.StatusOK)
+	if res.Header.Get("Content-Type") != "text/csv" || !strings.Contains(body, `alice,"$argon2id$`) {
+		t.Fatal("unexpected export", res.Header, body)
+	}
+	res, body = s.do("GET", "/auth/admin/users/export?format=xml", nil, false)
+	expectStatus(t, res, body, http.StatusBadRequest)
+
+	bob, err := s.hasher.Generate("battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := `{"username":"alice","password":"` + bob + `"}` + "\n" +
+		`{"username":"bob","password":"` + bob + `","groups":["public"]}` + "\n"
+	importAs := func(query, contentType, token string) (*http.Response, string) {
+		req, err := http.NewRequest("POST", s.URL+"/auth/admin/users/import"+query, strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := s.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+	importUsers := func(query string) (*http.Response, string) {
+		return importAs(query, "application/x-ndjson", token)
+	}
+
+	// a cross-site form can send the session cookie, but not a bearer
+	// token or a bulk content type
+	res, body = importAs("", "application/x-ndjson", "")
+	expectStatus(t, res, body, http.StatusUnauthorized)
+	res, body = importAs("", "text/plain", token)
+	expectStatus(t, res, body, http.StatusUnsupportedMediaType)
+	res, body = importUsers("?dry_run=true")
+	expectStatus(t, res, body, http.StatusOK)
+	if !strings.Contains(body, `"dry_run":true,"created":1,"updated":0,"skipped":0,"rejected":1`) {
+		t.Fatal("unexpected dry run report", body)
+	}
+	res, body = importUsers("")
+	expectStatus(t, res, body, http.StatusConflict)
+	res, body = importUsers("?on_conflict=merge")
+	expectStatus(t, res, body, http.StatusBadRequest)
+	res, body = importUsers("?on_conflict=skip")
+	expectStatus(t, res, body, http.StatusOK)
+	res, body = s.do("POST", "/auth/login", url.Values{
+		"username": {"bob"},
+		"password": {"battery staple"},
+	}, false)
+	expectStatus(t, res, body, http.StatusSeeOther)
+}
@@ -0,0 +1,128 @@
+package hash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrMismatchedHashAndPassword = errors.New("hashedPassword is not the hash of the given password")
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Argon2MaxMemory bounds the memory of generated and checked hashes, in KiB
+const Argon2MaxMemory = 1 << 20
+
+type Argon2Hash struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// memory is in KiB
+func NewArgon2Hash(memory uint32, time uint32, threads uint8) Hash {
+	return &Argon2Hash{
+		Memory:  memory,
+		Time:    time,
+		Threads: threads,
+	}
+}
+
+// Generate an Argon2id Hash in PHC string format (see: https://github.com/P-H-C/phc-string-format)
+func (a *Argon2Hash) Generate(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, argon2KeyLength)
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+	return hash, nil
+}
+
+func (a *Argon2Hash) Check(hash, password string) error {
+	p, err := decodeArgon2(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	if subtle.ConstantTimeCompare(key, p.key) != 1 {
+		return ErrMismatchedHashAndPassword
+	}
+	return nil
+}
+
+func (a *Argon2Hash) Validate(hash string) error {
+	_, err := decodeArgon2(hash)
+	return err
+}
+
+func (a *Argon2Hash) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+// Hashes with weaker parameters than configured need a rehash
+func (a *Argon2Hash) NeedsRehash(hash string) bool {
+	p, err := decodeArgon2(hash)
+	if err != nil {
+		return true
+	}
+	return p.memory < a.Memory || p.time < a.Time || p.threads < a.Threads
+}
+
+func decodeArgon2(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrUnknownHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return nil, err
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+	p := &argon2Params{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return nil, err
+	}
+	if p.time < 1 || p.threads < 1 {
+		return nil, fmt.Errorf("%w: argon2 time and parallelism must be at least 1", ErrInvalidHash)
+	}
+	if p.memory < 8*uint32(p.threads) || p.memory > Argon2MaxMemory {
+		return nil, fmt.Errorf("%w: argon2 memory out of range: %d", ErrInvalidHash, p.memory)
+	}
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, err
+	}
+	if len(p.key) < minKeyLength {
+		return nil, fmt.Errorf("%w: argon2 key is shorter than %d bytes", ErrInvalidHash, minKeyLength)
+	}
+	return p, nil
+}
@@ -0,0 +1,55 @@
+package hash
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestArgon2Hash(t *testing.T) {
+	h := NewArgon2Hash(1024, 1, 1)
+	testPassword := "password"
+	testHash, err := h.Generate(testPassword)
+	if err != nil {
+		t.Fatal("failed to generate hash", err)
+	}
+	err = h.Check(testHash, testPassword)
+	if err != nil {
+		t.Fatal("failed to validate hash", err)
+	}
+	err = h.Check(testHash, "wrong")
+	if err == nil {
+		t.Fatal("validated hash with wrong password")
+	}
+	if h.NeedsRehash(testHash) {
+		t.Fatal("hash with current parameters needs rehash")
+	}
+	stronger := NewArgon2Hash(2048, 1, 1)
+	if !stronger.NeedsRehash(testHash) {
+		t.Fatal("hash with weaker parameters does not need rehash")
+	}
+}
+
+func TestArgon2HashInvalid(t *testing.T) {
+	h := NewArgon2Hash(1024, 1, 1)
+	key := "c2FsdHNhbHRzYWx0c2FsdHNhbHRzYWx0c2FsdHNhbHQ"
+	hashes := map[string]string{
+		"no time":        "$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHRzYWx0$" + key,
+		"no parallelism": "$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHRzYWx0$" + key,
+		"low memory":     "$argon2id$v=19$m=4,t=1,p=1$c2FsdHNhbHRzYWx0$" + key,
+		"high memory":    "$argon2id$v=19$m=1048577,t=1,p=1$c2FsdHNhbHRzYWx0$" + key,
+		"empty key":      "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$",
+		"short key":      "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$AA",
+	}
+	for name, invalid := range hashes {
+		t.Run(name, func(t *testing.T) {
+			err := h.Check(invalid, "password")
+			if !errors.Is(err, ErrInvalidHash) {
+				t.Fatal("expected invalid hash", err)
+			}
+			err = h.Validate(invalid)
+			if !errors.Is(err, ErrInvalidHash) {
+				t.Fatal("invalid hash validated", err)
+			}
+		})
+	}
+}
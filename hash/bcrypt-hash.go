@@ -1,6 +1,8 @@
 package hash
 
 import (
+	"strings"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -32,3 +34,24 @@ func (b *BCryptHash) Check(hash, password string) error {
 // 	salt := hex.EncodeToString(saltBytes)
 // 	return salt, err
 // }
+
+// Cost parses the whole hash
+func (b *BCryptHash) Validate(hash string) error {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
+
+func (b *BCryptHash) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$")
+}
+
+// Hashes with a lower cost than configured need a rehash
+func (b *BCryptHash) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost < b.Cost
+}
@@ -0,0 +1,48 @@
+package hash
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+// DjangoHash verifies hashes from Django's default password hasher:
+// pbkdf2_sha256$<iterations>$<salt>$<hash>
+type DjangoHash struct{}
+
+func NewDjangoHash() Verifier {
+	return &DjangoHash{}
+}
+
+func (d *DjangoHash) Check(hash, password string) error {
+	params, err := decodeDjango(hash)
+	if err != nil {
+		return err
+	}
+	return params.check(password)
+}
+
+func (d *DjangoHash) Validate(hash string) error {
+	_, err := decodeDjango(hash)
+	return err
+}
+
+func (d *DjangoHash) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "pbkdf2_sha256$")
+}
+
+func decodeDjango(hash string) (*pbkdf2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2_sha256" {
+		return nil, ErrUnknownHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	return newPBKDF2Params(iterations, []byte(parts[2]), checksum)
+}
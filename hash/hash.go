@@ -1,6 +1,26 @@
 package hash
 
+import "errors"
+
+var (
+	ErrUnknownHash = errors.New("unknown hash format")
+	ErrInvalidHash = errors.New("invalid hash")
+)
+
+// Shorter keys match too many passwords to be trusted
+const minKeyLength = 16
+
+// Verifier checks passwords against hashes in a format it recognizes
+type Verifier interface {
+	Identify(hash string) bool
+	Check(hash, password string) error
+	// Validate parses a hash fully without checking a password
+	Validate(hash string) error
+}
+
+// Hash generates new hashes and checks existing ones
 type Hash interface {
+	Verifier
 	Generate(password string) (string, error)
-	Check(hash, password string) error
+	NeedsRehash(hash string) bool
 }
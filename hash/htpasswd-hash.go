@@ -0,0 +1,135 @@
+package hash
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	apr1Magic = "$apr1$"
+	shaPrefix = "{SHA}"
+	itoa64    = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// HtpasswdHash verifies Apache htpasswd APR1 and SHA hashes.
+// htpasswd bcrypt ($2y$) hashes are handled by BCryptHash.
+type HtpasswdHash struct{}
+
+func NewHtpasswdHash() Verifier {
+	return &HtpasswdHash{}
+}
+
+func (h *HtpasswdHash) Check(hash, password string) error {
+	var expected string
+	switch {
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := strings.SplitN(strings.TrimPrefix(hash, apr1Magic), "$", 2)[0]
+		expected = apr1(password, salt)
+	case strings.HasPrefix(hash, shaPrefix):
+		sum := sha1.Sum([]byte(password))
+		expected = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return ErrUnknownHash
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) != 1 {
+		return ErrMismatchedHashAndPassword
+	}
+	return nil
+}
+
+func (h *HtpasswdHash) Validate(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, apr1Magic):
+		parts := strings.Split(strings.TrimPrefix(hash, apr1Magic), "$")
+		if len(parts) != 2 || len(parts[0]) > 8 || len(parts[1]) != 22 || strings.Trim(parts[1], itoa64) != "" {
+			return fmt.Errorf("%w: malformed apr1 hash", ErrInvalidHash)
+		}
+	case strings.HasPrefix(hash, shaPrefix):
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, shaPrefix))
+		if err != nil || len(sum) != sha1.Size {
+			return fmt.Errorf("%w: malformed SHA hash", ErrInvalidHash)
+		}
+	default:
+		return ErrUnknownHash
+	}
+	return nil
+}
+
+func (h *HtpasswdHash) Identify(hash string) bool {
+	return strings.HasPrefix(hash, apr1Magic) || strings.HasPrefix(hash, shaPrefix)
+}
+
+// APR1 is Apache's variant of the MD5-based crypt algorithm
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(apr1Magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		ctx.Write(altSum[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(apr1Magic + salt + "$")
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		v := uint(final[g[0]])<<16 | uint(final[g[1]])<<8 | uint(final[g[2]])
+		writeItoa64(&out, v, 4)
+	}
+	writeItoa64(&out, uint(final[11]), 2)
+	return out.String()
+}
+
+func writeItoa64(out *strings.Builder, v uint, n int) {
+	for ; n > 0; n-- {
+		out.WriteByte(itoa64[v&0x3f])
+		v >>= 6
+	}
+}
@@ -0,0 +1,81 @@
+package hash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLegacyHashes(t *testing.T) {
+	bcryptHash, err := NewBCryptHash(4).Generate("password")
+	if err != nil {
+		t.Fatal("failed to generate hash", err)
+	}
+	hashes := map[string]string{
+		"pbkdf2":   "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0$sYIePhT5IXESDKvnouJXtE5pTJ6Znbmef4vViYmc9Uc",
+		"scrypt":   "$scrypt$ln=4,r=8,p=1$c2FsdHNhbHRzYWx0$OMhHbSEaEtsu/I0j8kYPfsrH+u3TT8X+IGRK4Kq6rWE",
+		"django":   "pbkdf2_sha256$1000$saltsaltsalt$sYIePhT5IXESDKvnouJXtE5pTJ6Znbmef4vViYmc9Uc=",
+		"apr1":     "$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1",
+		"sha":      "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"htpasswd": strings.Replace(bcryptHash, "$2a$", "$2y$", 1),
+	}
+	h := NewMultiHash(NewArgon2Hash(1024, 1, 1), NewBCryptHash(4),
+		NewPBKDF2Hash(), NewScryptHash(), NewDjangoHash(), NewHtpasswdHash())
+	for name, legacyHash := range hashes {
+		t.Run(name, func(t *testing.T) {
+			err := h.Validate(legacyHash)
+			if err != nil {
+				t.Fatal("valid hash rejected", err)
+			}
+			err = h.Check(legacyHash, "password")
+			if err != nil {
+				t.Fatal("failed to validate hash", err)
+			}
+			err = h.Check(legacyHash, "wrong")
+			if err == nil {
+				t.Fatal("validated hash with wrong password")
+			}
+			if !h.NeedsRehash(legacyHash) {
+				t.Fatal("legacy hash does not need rehash")
+			}
+		})
+	}
+}
+
+func TestLegacyHashesInvalid(t *testing.T) {
+	checksum := "sYIePhT5IXESDKvnouJXtE5pTJ6Znbmef4vViYmc9Uc"
+	hashes := map[string]struct {
+		v    Verifier
+		hash string
+	}{
+		"pbkdf2 empty checksum":  {NewPBKDF2Hash(), "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0$"},
+		"pbkdf2 short checksum":  {NewPBKDF2Hash(), "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0$sQ"},
+		"pbkdf2 no rounds":       {NewPBKDF2Hash(), "$pbkdf2-sha256$0$c2FsdHNhbHRzYWx0$" + checksum},
+		"pbkdf2 many rounds":     {NewPBKDF2Hash(), "$pbkdf2-sha256$2000000000$c2FsdHNhbHRzYWx0$" + checksum},
+		"pbkdf2 long checksum":   {NewPBKDF2Hash(), "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0$" + strings.Repeat("A", 128)},
+		"django empty checksum":  {NewDjangoHash(), "pbkdf2_sha256$1000$saltsaltsalt$"},
+		"django short checksum":  {NewDjangoHash(), "pbkdf2_sha256$1000$saltsaltsalt$sQ=="},
+		"django no iterations":   {NewDjangoHash(), "pbkdf2_sha256$-1$saltsaltsalt$" + checksum + "="},
+		"django many iterations": {NewDjangoHash(), "pbkdf2_sha256$2000000000$saltsaltsalt$" + checksum + "="},
+		"scrypt empty checksum":  {NewScryptHash(), "$scrypt$ln=4,r=8,p=1$c2FsdHNhbHRzYWx0$"},
+		"scrypt short checksum":  {NewScryptHash(), "$scrypt$ln=4,r=8,p=1$c2FsdHNhbHRzYWx0$OA"},
+		"scrypt no ln":           {NewScryptHash(), "$scrypt$ln=0,r=8,p=1$c2FsdHNhbHRzYWx0$" + checksum},
+		"scrypt large ln":        {NewScryptHash(), "$scrypt$ln=40,r=8,p=1$c2FsdHNhbHRzYWx0$" + checksum},
+		"scrypt large memory":    {NewScryptHash(), "$scrypt$ln=20,r=64,p=1$c2FsdHNhbHRzYWx0$" + checksum},
+		"scrypt no r":            {NewScryptHash(), "$scrypt$ln=4,r=0,p=1$c2FsdHNhbHRzYWx0$" + checksum},
+		"scrypt no p":            {NewScryptHash(), "$scrypt$ln=4,r=8,p=0$c2FsdHNhbHRzYWx0$" + checksum},
+		"scrypt large p":         {NewScryptHash(), "$scrypt$ln=4,r=8,p=1024$c2FsdHNhbHRzYWx0$" + checksum},
+	}
+	for name, invalid := range hashes {
+		t.Run(name, func(t *testing.T) {
+			err := invalid.v.Check(invalid.hash, "password")
+			if !errors.Is(err, ErrInvalidHash) {
+				t.Fatal("expected invalid hash", err)
+			}
+			err = invalid.v.Validate(invalid.hash)
+			if !errors.Is(err, ErrInvalidHash) {
+				t.Fatal("invalid hash validated", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package hash
+
+// MultiHash generates hashes with a default algorithm and checks
+// hashes of any known format, detected from the stored string
+type MultiHash struct {
+	Default   Hash
+	Verifiers []Verifier
+}
+
+func NewMultiHash(def Hash, verifiers ...Verifier) Hash {
+	return &MultiHash{
+		Default:   def,
+		Verifiers: verifiers,
+	}
+}
+
+func (m *MultiHash) Generate(password string) (string, error) {
+	return m.Default.Generate(password)
+}
+
+func (m *MultiHash) Check(hash, password string) error {
+	v := m.verifier(hash)
+	if v == nil {
+		return ErrUnknownHash
+	}
+	return v.Check(hash, password)
+}
+
+func (m *MultiHash) Validate(hash string) error {
+	v := m.verifier(hash)
+	if v == nil {
+		return ErrUnknownHash
+	}
+	return v.Validate(hash)
+}
+
+func (m *MultiHash) Identify(hash string) bool {
+	return m.verifier(hash) != nil
+}
+
+// Hashes not produced by the default algorithm always need a rehash
+func (m *MultiHash) NeedsRehash(hash string) bool {
+	if !m.Default.Identify(hash) {
+		return true
+	}
+	return m.Default.NeedsRehash(hash)
+}
+
+func (m *MultiHash) verifier(hash string) Verifier {
+	if m.Default.Identify(hash) {
+		return m.Default
+	}
+	for _, v := range m.Verifiers {
+		if v.Identify(hash) {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package hash
+
+import "testing"
+
+func TestMultiHash(t *testing.T) {
+	bcryptHash := NewBCryptHash(4)
+	argon2Hash := NewArgon2Hash(1024, 1, 1)
+	h := NewMultiHash(argon2Hash, bcryptHash)
+	testPassword := "password"
+
+	legacyHash, err := bcryptHash.Generate(testPassword)
+	if err != nil {
+		t.Fatal("failed to generate hash", err)
+	}
+	err = h.Check(legacyHash, testPassword)
+	if err != nil {
+		t.Fatal("failed to validate legacy hash", err)
+	}
+	if !h.NeedsRehash(legacyHash) {
+		t.Fatal("legacy hash does not need rehash")
+	}
+
+	testHash, err := h.Generate(testPassword)
+	if err != nil {
+		t.Fatal("failed to generate hash", err)
+	}
+	if !argon2Hash.Identify(testHash) {
+		t.Fatal("hash not generated with default algorithm")
+	}
+	if h.NeedsRehash(testHash) {
+		t.Fatal("default hash needs rehash")
+	}
+
+	err = h.Check("plaintext", testPassword)
+	if err != ErrUnknownHash {
+		t.Fatal("expected unknown hash error", err)
+	}
+}
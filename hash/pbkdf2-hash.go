@@ -0,0 +1,93 @@
+package hash
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PBKDF2Hash verifies PBKDF2-SHA256 hashes in passlib's modular crypt format:
+// $pbkdf2-sha256$<rounds>$<salt>$<checksum>
+type PBKDF2Hash struct{}
+
+const (
+	// ten times what Django and OWASP recommend for PBKDF2-SHA256
+	pbkdf2MaxIterations = 10_000_000
+	// every 32 bytes past the first costs another run of every iteration
+	pbkdf2MaxKeyLength = 64
+)
+
+type pbkdf2Params struct {
+	iterations int
+	salt       []byte
+	checksum   []byte
+}
+
+func NewPBKDF2Hash() Verifier {
+	return &PBKDF2Hash{}
+}
+
+func (p *PBKDF2Hash) Check(hash, password string) error {
+	params, err := decodePBKDF2(hash)
+	if err != nil {
+		return err
+	}
+	return params.check(password)
+}
+
+func (p *PBKDF2Hash) Validate(hash string) error {
+	_, err := decodePBKDF2(hash)
+	return err
+}
+
+func (p *PBKDF2Hash) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$pbkdf2-sha256$")
+}
+
+func decodePBKDF2(hash string) (*pbkdf2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != "pbkdf2-sha256" {
+		return nil, ErrUnknownHash
+	}
+	rounds, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	salt, err := decodeAdaptedBase64(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := decodeAdaptedBase64(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	return newPBKDF2Params(rounds, salt, checksum)
+}
+
+// passlib's "adapted base64" uses "." instead of "+" and omits padding
+func decodeAdaptedBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.ReplaceAll(s, ".", "+"))
+}
+
+func newPBKDF2Params(iterations int, salt, checksum []byte) (*pbkdf2Params, error) {
+	if iterations < 1 || iterations > pbkdf2MaxIterations {
+		return nil, fmt.Errorf("%w: pbkdf2 iterations out of range: %d", ErrInvalidHash, iterations)
+	}
+	if len(checksum) < minKeyLength || len(checksum) > pbkdf2MaxKeyLength {
+		return nil, fmt.Errorf("%w: pbkdf2 checksum must be %d to %d bytes", ErrInvalidHash, minKeyLength, pbkdf2MaxKeyLength)
+	}
+	return &pbkdf2Params{iterations: iterations, salt: salt, checksum: checksum}, nil
+}
+
+func (p *pbkdf2Params) check(password string) error {
+	key := pbkdf2.Key([]byte(password), p.salt, p.iterations, len(p.checksum), sha256.New)
+	if subtle.ConstantTimeCompare(key, p.checksum) != 1 {
+		return ErrMismatchedHashAndPassword
+	}
+	return nil
+}
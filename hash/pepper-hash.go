@@ -0,0 +1,97 @@
+package hash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const pepperPrefix = "$pepper$"
+
+// PepperedHash applies a versioned HMAC-SHA256 pepper to passwords before
+// hashing them with the wrapped Hash. Peppered hashes are stored as:
+// $pepper$v=<version>$<inner hash>
+type PepperedHash struct {
+	Inner   Hash
+	Keys    map[string][]byte
+	Version string
+}
+
+func NewPepperedHash(inner Hash, keys map[string][]byte, version string) (Hash, error) {
+	if _, ok := keys[version]; !ok {
+		return nil, fmt.Errorf("no pepper key for version: %s", version)
+	}
+	return &PepperedHash{
+		Inner:   inner,
+		Keys:    keys,
+		Version: version,
+	}, nil
+}
+
+func (p *PepperedHash) Generate(password string) (string, error) {
+	hash, err := p.Inner.Generate(p.pepper(p.Keys[p.Version], password))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%sv=%s$%s", pepperPrefix, p.Version, hash), nil
+}
+
+// Hashes without a pepper are checked against the plain password
+func (p *PepperedHash) Check(hash, password string) error {
+	version, inner, ok := splitPeppered(hash)
+	if !ok {
+		return p.Inner.Check(hash, password)
+	}
+	key, ok := p.Keys[version]
+	if !ok {
+		return fmt.Errorf("no pepper key for version: %s", version)
+	}
+	return p.Inner.Check(inner, p.pepper(key, password))
+}
+
+func (p *PepperedHash) Validate(hash string) error {
+	version, inner, ok := splitPeppered(hash)
+	if !ok {
+		return p.Inner.Validate(hash)
+	}
+	if _, ok := p.Keys[version]; !ok {
+		return fmt.Errorf("no pepper key for version: %s", version)
+	}
+	return p.Inner.Validate(inner)
+}
+
+func (p *PepperedHash) Identify(hash string) bool {
+	_, inner, ok := splitPeppered(hash)
+	if !ok {
+		return p.Inner.Identify(hash)
+	}
+	return p.Inner.Identify(inner)
+}
+
+// Hashes without a pepper or with an older pepper version need a rehash
+func (p *PepperedHash) NeedsRehash(hash string) bool {
+	version, inner, ok := splitPeppered(hash)
+	if !ok || version != p.Version {
+		return true
+	}
+	return p.Inner.NeedsRehash(inner)
+}
+
+func (p *PepperedHash) pepper(key []byte, password string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func splitPeppered(hash string) (string, string, bool) {
+	if !strings.HasPrefix(hash, pepperPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(hash, pepperPrefix), "$", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "v=") {
+		return "", "", false
+	}
+	return strings.TrimPrefix(parts[0], "v="), parts[1], true
+}
@@ -0,0 +1,56 @@
+package hash
+
+import "testing"
+
+func TestPepperedHash(t *testing.T) {
+	inner := NewMultiHash(NewArgon2Hash(1024, 1, 1))
+	keys := map[string][]byte{
+		"1": []byte("old pepper"),
+		"2": []byte("new pepper"),
+	}
+	oldPepper, err := NewPepperedHash(inner, keys, "1")
+	if err != nil {
+		t.Fatal("failed to create hash", err)
+	}
+	newPepper, err := NewPepperedHash(inner, keys, "2")
+	if err != nil {
+		t.Fatal("failed to create hash", err)
+	}
+	testPassword := "password"
+
+	testHash, err := oldPepper.Generate(testPassword)
+	if err != nil {
+		t.Fatal("failed to generate hash", err)
+	}
+	err = newPepper.Check(testHash, testPassword)
+	if err != nil {
+		t.Fatal("failed to validate hash with previous pepper version", err)
+	}
+	if !newPepper.NeedsRehash(testHash) {
+		t.Fatal("hash with previous pepper version does not need rehash")
+	}
+	if oldPepper.NeedsRehash(testHash) {
+		t.Fatal("hash with current pepper version needs rehash")
+	}
+	err = inner.Check(testHash, testPassword)
+	if err == nil {
+		t.Fatal("validated peppered hash without pepper")
+	}
+
+	plainHash, err := inner.Generate(testPassword)
+	if err != nil {
+		t.Fatal("failed to generate hash", err)
+	}
+	err = newPepper.Check(plainHash, testPassword)
+	if err != nil {
+		t.Fatal("failed to validate unpeppered hash", err)
+	}
+	if !newPepper.NeedsRehash(plainHash) {
+		t.Fatal("unpeppered hash does not need rehash")
+	}
+
+	_, err = NewPepperedHash(inner, keys, "3")
+	if err == nil {
+		t.Fatal("created hash with unknown pepper version")
+	}
+}
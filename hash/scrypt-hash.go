@@ -0,0 +1,82 @@
+package hash
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ScryptHash verifies scrypt hashes in passlib's modular crypt format:
+// $scrypt$ln=<log2(N)>,r=<r>,p=<p>$<salt>$<checksum>
+type ScryptHash struct{}
+
+const (
+	scryptMaxLN = 20
+	// in bytes, scrypt needs 128*r*N
+	scryptMaxMemory = 1 << 30
+	scryptMaxP      = 16
+)
+
+type scryptParams struct {
+	ln, r, p int
+	salt     []byte
+	checksum []byte
+}
+
+func NewScryptHash() Verifier {
+	return &ScryptHash{}
+}
+
+func (s *ScryptHash) Check(hash, password string) error {
+	params, err := decodeScrypt(hash)
+	if err != nil {
+		return err
+	}
+	key, err := scrypt.Key([]byte(password), params.salt, 1<<params.ln, params.r, params.p, len(params.checksum))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(key, params.checksum) != 1 {
+		return ErrMismatchedHashAndPassword
+	}
+	return nil
+}
+
+func (s *ScryptHash) Validate(hash string) error {
+	_, err := decodeScrypt(hash)
+	return err
+}
+
+func (s *ScryptHash) Identify(hash string) bool {
+	return strings.HasPrefix(hash, "$scrypt$")
+}
+
+func decodeScrypt(hash string) (*scryptParams, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return nil, ErrUnknownHash
+	}
+	p := &scryptParams{}
+	_, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.ln, &p.r, &p.p)
+	if err != nil {
+		return nil, err
+	}
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	p.checksum, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	if p.ln < 1 || p.ln > scryptMaxLN || p.r < 1 || p.p < 1 || p.p > scryptMaxP || 128*p.r > scryptMaxMemory>>p.ln {
+		return nil, fmt.Errorf("%w: scrypt parameters out of range: ln=%d,r=%d,p=%d", ErrInvalidHash, p.ln, p.r, p.p)
+	}
+	if len(p.checksum) < minKeyLength {
+		return nil, fmt.Errorf("%w: scrypt checksum is shorter than %d bytes", ErrInvalidHash, minKeyLength)
+	}
+	return p, nil
+}
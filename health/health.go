@@ -0,0 +1,120 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+	StatusShutdown    = "shutting_down"
+)
+
+// Check returns an error when a component is not ready
+type Check func(ctx context.Context) error
+
+// Component reports the result of a single check
+type Component struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the readiness response body
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+type Health struct {
+	Timeout      time.Duration
+	mu           sync.RWMutex
+	checks       map[string]Check
+	shuttingDown atomic.Bool
+}
+
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{
+		Timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+// AddCheck registers a named readiness check
+func (h *Health) AddCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Shutdown makes readiness fail so traffic drains before the server stops
+func (h *Health) Shutdown() {
+	h.shuttingDown.Store(true)
+}
+
+// Ready runs every check concurrently and reports the results
+func (h *Health) Ready(ctx context.Context) Report {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	h.mu.RLock()
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	components := make([]Component, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			components[i] = Component{Status: StatusOK, Duration: time.Since(start).String()}
+			if err != nil {
+				components[i].Status = StatusUnavailable
+				components[i].Error = err.Error()
+			}
+		}(i, h.checks[name])
+	}
+	h.mu.RUnlock()
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Components: make(map[string]Component, len(names))}
+	for i, name := range names {
+		report.Components[name] = components[i]
+		if components[i].Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+	if h.shuttingDown.Load() {
+		report.Status = StatusShutdown
+	}
+	return report
+}
+
+// Healthz reports that the process is up and serving requests
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": StatusOK})
+}
+
+// Readyz reports whether the service can take traffic
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := h.Ready(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
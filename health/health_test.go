@@ -0,0 +1,66 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func readyz(t *testing.T, h *Health) (int, Report) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.Readyz(w, httptest.NewRequest("GET", "/auth/readyz", nil))
+	var report Report
+	err := json.NewDecoder(w.Body).Decode(&report)
+	if err != nil {
+		t.Fatal("failed to decode report", err)
+	}
+	return w.Code, report
+}
+
+func TestReadyz(t *testing.T) {
+	h := NewHealth(time.Second)
+	var dbErr error
+	h.AddCheck("database", func(ctx context.Context) error { return dbErr })
+	h.AddCheck("signing_key", func(ctx context.Context) error { return nil })
+
+	code, report := readyz(t, h)
+	if code != http.StatusOK || report.Status != StatusOK || len(report.Components) != 2 {
+		t.Fatal("expected ready", code, report)
+	}
+
+	dbErr = errors.New("connection refused")
+	code, report = readyz(t, h)
+	if code != http.StatusServiceUnavailable || report.Status != StatusUnavailable {
+		t.Fatal("expected not ready", code, report)
+	}
+	db := report.Components["database"]
+	if db.Status != StatusUnavailable || db.Error != "connection refused" {
+		t.Fatal("unexpected database component", db)
+	}
+	if report.Components["signing_key"].Status != StatusOK {
+		t.Fatal("unexpected signing key component", report.Components["signing_key"])
+	}
+
+	dbErr = nil
+	h.Shutdown()
+	code, report = readyz(t, h)
+	if code != http.StatusServiceUnavailable || report.Status != StatusShutdown {
+		t.Fatal("expected not ready while shutting down", code, report)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	h := NewHealth(time.Second)
+	h.AddCheck("database", func(ctx context.Context) error { return errors.New("down") })
+	h.Shutdown()
+	w := httptest.NewRecorder()
+	h.Healthz(w, httptest.NewRequest("GET", "/auth/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("healthz should not depend on readiness", w.Code)
+	}
+}
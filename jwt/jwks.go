@@ -0,0 +1,78 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+)
+
+// JWK is a public signing key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS publishes the public keys that verify tokens. HMAC keys are secret
+// and never included, so tokens they sign can only be verified by go-auth.
+func (j *JWTHelper) JWKS() JWKS {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range j.keys {
+		public, ok := key.verify.(*ecdsa.PublicKey)
+		if !ok {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, NewJWK(key.kid, public))
+	}
+	return jwks
+}
+
+// NewJWK encodes a P-256 public key
+func NewJWK(kid string, key *ecdsa.PublicKey) JWK {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		Kid: kid,
+		Alg: ES256,
+		Use: "sig",
+	}
+}
+
+// PublicKey decodes a P-256 public key
+func (k JWK) PublicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" || k.Alg != ES256 {
+		return nil, fmt.Errorf("key %s is not an ES256 key", k.Kid)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", k.Kid, err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", k.Kid, err)
+	}
+	if len(x) != 32 || len(y) != 32 {
+		return nil, fmt.Errorf("key %s has invalid coordinates", k.Kid)
+	}
+	point := append(append([]byte{4}, x...), y...)
+	key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", k.Kid, err)
+	}
+	return key, nil
+}
@@ -1,7 +1,10 @@
 package jwt
 
 import (
+	"errors"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cheebz/go-auth/models"
@@ -36,10 +39,41 @@ type RefreshToken struct {
 	JTI   string
 }
 
+// PasswordChangeClaims struct
+type PasswordChangeClaims struct {
+	UserID int `json:"user_id"`
+	jwt.StandardClaims
+}
+
+// FederationClaims struct -- The state of a sign in with an external
+// identity provider, kept in a cookie until the provider redirects back
+type FederationClaims struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	// PKCE code verifier
+	Verifier string `json:"verifier"`
+	// Set when a logged in user links an identity to their account
+	UserID   int    `json:"user_id,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+	jwt.StandardClaims
+}
+
+const (
+	passwordChangeAudience = "password_change"
+	PasswordChangeMaxAge   = 600
+	federationAudience     = "federation"
+	FederationMaxAge       = 600
+)
+
 type JWTHelper struct {
 	JWTKey        string
 	JWTMaxAge     int
 	RefreshMaxAge int
+	mu            sync.RWMutex
+	// newest first
+	keys  []signingKey
+	byKID map[string]signingKey
 }
 
 func NewJWTHelper(jwtKey string, jwtMaxAge int, refreshMaxAge int) *JWTHelper {
@@ -50,6 +84,16 @@ func NewJWTHelper(jwtKey string, jwtMaxAge int, refreshMaxAge int) *JWTHelper {
 	}
 }
 
+// Make sure tokens can be signed and verified with the current key
+func (j *JWTHelper) CheckKey() error {
+	tokenString, err := j.sign(jwt.StandardClaims{})
+	if err != nil {
+		return err
+	}
+	_, err = jwt.Parse(tokenString, j.keyFunc)
+	return err
+}
+
 func (j *JWTHelper) CreateJWT(user models.User, groups []models.Group) (JWT, error) {
 	expirationTime := time.Now().Add(time.Duration(j.JWTMaxAge) * time.Minute)
 	claims := JWTClaims{
@@ -62,12 +106,16 @@ func (j *JWTHelper) CreateJWT(user models.User, groups []models.Group) (JWT, err
 			Issuer:    "dev",
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(j.JWTKey))
+	tokenString, err := j.sign(claims)
 	jwt := JWT{Value: tokenString, Claims: claims}
 	return jwt, err
 }
 
+// SignJWT signs session claims as they are, without setting their expiry
+func (j *JWTHelper) SignJWT(claims JWTClaims) (string, error) {
+	return j.sign(claims)
+}
+
 func (j *JWTHelper) CreateRefresh(userID int) (RefreshToken, error) {
 	expirationTime := time.Now().Add(time.Duration(j.RefreshMaxAge) * time.Minute)
 	claims := RefreshClaims{
@@ -78,8 +126,7 @@ func (j *JWTHelper) CreateRefresh(userID int) (RefreshToken, error) {
 			Id:        uuid.New().String(),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(j.JWTKey))
+	tokenString, err := j.sign(claims)
 	refreshToken := RefreshToken{Value: tokenString, JTI: claims.Id}
 	return refreshToken, err
 }
@@ -89,15 +136,41 @@ func (j *JWTHelper) CheckJWTClaims(r *http.Request) (*JWTClaims, error) {
 	if err != nil {
 		return nil, err
 	}
-	tokenString := jwtCookie.Value
+	return j.ParseJWT(jwtCookie.Value)
+}
+
+// CheckBearerClaims validates the session token in the Authorization header.
+// Browsers send cookies with cross-site requests but never this header.
+func (j *JWTHelper) CheckBearerClaims(r *http.Request) (*JWTClaims, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errors.New("bearer token required")
+	}
+	return j.ParseJWT(token)
+}
+
+// ParseJWT validates a session token signed with the helper's keys
+func (j *JWTHelper) ParseJWT(tokenString string) (*JWTClaims, error) {
+	return ParseJWTClaims(tokenString, j.keyFunc)
+}
 
+// ParseJWTClaims validates a session token. Password change and refresh
+// tokens are signed with the same keys, so they are rejected explicitly.
+func ParseJWTClaims(tokenString string, keyFunc jwt.Keyfunc) (*JWTClaims, error) {
 	claims := &JWTClaims{}
-	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(j.JWTKey), nil
-	})
+	_, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
 	if err != nil {
 		return claims, err
 	}
+	if claims.Audience == passwordChangeAudience {
+		return claims, errors.New("password change token is not a session token")
+	}
+	if claims.Audience == federationAudience {
+		return claims, errors.New("federation token is not a session token")
+	}
+	if claims.Id != "" {
+		return claims, errors.New("refresh token is not a session token")
+	}
 	return claims, nil
 }
 
@@ -108,11 +181,68 @@ func (j *JWTHelper) CheckRefreshClaims(r *http.Request) (*RefreshClaims, error)
 	}
 	tokenString := refreshCookie.Value
 	claims := &RefreshClaims{}
-	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(j.JWTKey), nil
-	})
+	_, err = jwt.ParseWithClaims(tokenString, claims, j.keyFunc)
 	if err != nil {
 		return claims, err
 	}
 	return claims, nil
 }
+
+// Create a short-lived token that only allows the user to change an expired password
+func (j *JWTHelper) CreatePasswordChange(userID int) (string, error) {
+	expirationTime := time.Now().Add(PasswordChangeMaxAge * time.Second)
+	claims := PasswordChangeClaims{
+		userID,
+		jwt.StandardClaims{
+			ExpiresAt: expirationTime.Unix(),
+			Issuer:    "dev",
+			Audience:  passwordChangeAudience,
+		},
+	}
+	return j.sign(claims)
+}
+
+func (j *JWTHelper) CheckPasswordChangeClaims(r *http.Request) (*PasswordChangeClaims, error) {
+	passwordChangeCookie, err := r.Cookie("password_change")
+	if err != nil {
+		return nil, err
+	}
+	tokenString := passwordChangeCookie.Value
+	claims := &PasswordChangeClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, j.keyFunc)
+	if err != nil {
+		return claims, err
+	}
+	if claims.Audience != passwordChangeAudience {
+		return claims, errors.New("not a password change token")
+	}
+	return claims, nil
+}
+
+// Create a short-lived token holding the state of a federated sign in
+func (j *JWTHelper) CreateFederation(claims FederationClaims) (string, error) {
+	expirationTime := time.Now().Add(FederationMaxAge * time.Second)
+	claims.StandardClaims = jwt.StandardClaims{
+		ExpiresAt: expirationTime.Unix(),
+		Issuer:    "dev",
+		Audience:  federationAudience,
+	}
+	return j.sign(claims)
+}
+
+func (j *JWTHelper) CheckFederationClaims(r *http.Request) (*FederationClaims, error) {
+	federationCookie, err := r.Cookie("federation")
+	if err != nil {
+		return nil, err
+	}
+	tokenString := federationCookie.Value
+	claims := &FederationClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, j.keyFunc)
+	if err != nil {
+		return claims, err
+	}
+	if claims.Audience != federationAudience {
+		return claims, errors.New("not a federation token")
+	}
+	return claims, nil
+}
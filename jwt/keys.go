@@ -0,0 +1,199 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/cheebz/go-auth/models"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// Signing key algorithms
+const (
+	ES256 = "ES256"
+	HS256 = "HS256"
+)
+
+// KeyStore is implemented by repositories that store signing keys
+type KeyStore interface {
+	GetSigningKeys(ctx context.Context) ([]models.SigningKey, error)
+}
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	sign    interface{}
+	verify  interface{}
+	created time.Time
+}
+
+// GenerateKey creates a signing key with a random kid
+func GenerateKey(algorithm string) (models.SigningKey, error) {
+	key := models.SigningKey{
+		KID:       uuid.New().String(),
+		Algorithm: algorithm,
+		Created:   time.Now().UTC(),
+	}
+	switch algorithm {
+	case ES256:
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return key, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return key, err
+		}
+		key.Key = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	case HS256:
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return key, err
+		}
+		key.Key = base64.StdEncoding.EncodeToString(secret)
+	default:
+		return key, fmt.Errorf("unsupported signing algorithm: %s", algorithm)
+	}
+	return key, nil
+}
+
+func parseKey(k models.SigningKey) (signingKey, error) {
+	key := signingKey{kid: k.KID, created: k.Created}
+	switch k.Algorithm {
+	case ES256:
+		block, _ := pem.Decode([]byte(k.Key))
+		if block == nil {
+			return key, fmt.Errorf("key %s is not PEM encoded", k.KID)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return key, fmt.Errorf("key %s: %w", k.KID, err)
+		}
+		private, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok || private.Curve != elliptic.P256() {
+			return key, fmt.Errorf("key %s is not a P-256 key", k.KID)
+		}
+		key.method = jwt.SigningMethodES256
+		key.sign = private
+		key.verify = &private.PublicKey
+	case HS256:
+		secret, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return key, fmt.Errorf("key %s: %w", k.KID, err)
+		}
+		key.method = jwt.SigningMethodHS256
+		key.sign = secret
+		key.verify = secret
+	default:
+		return key, fmt.Errorf("key %s has unsupported algorithm %s", k.KID, k.Algorithm)
+	}
+	return key, nil
+}
+
+// SetKeys replaces the signing keys. The newest key signs new tokens and
+// every key verifies them. With no keys, tokens are signed with JWTKey.
+func (j *JWTHelper) SetKeys(keys []models.SigningKey) error {
+	parsed := make([]signingKey, 0, len(keys))
+	byKID := make(map[string]signingKey, len(keys))
+	for _, k := range keys {
+		key, err := parseKey(k)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, key)
+		byKID[key.kid] = key
+	}
+	sort.SliceStable(parsed, func(a, b int) bool {
+		return parsed[a].created.After(parsed[b].created)
+	})
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = parsed
+	j.byKID = byKID
+	return nil
+}
+
+// LoadKeys reads the signing keys from the store
+func (j *JWTHelper) LoadKeys(ctx context.Context, store KeyStore) error {
+	keys, err := store.GetSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+	return j.SetKeys(keys)
+}
+
+// WatchKeys reloads the signing keys until the context is done, so keys
+// rotated by another process are picked up
+func (j *JWTHelper) WatchKeys(ctx context.Context, store KeyStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := j.LoadKeys(ctx, store)
+		if err != nil && ctx.Err() == nil {
+			log.Println(fmt.Sprintf("failed to reload signing keys: %s", err.Error()))
+		}
+	}
+}
+
+func (j *JWTHelper) currentKey() (signingKey, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if len(j.keys) == 0 {
+		return signingKey{}, false
+	}
+	return j.keys[0], true
+}
+
+// Sign with the newest key, or the shared JWTKey when there are none
+func (j *JWTHelper) sign(claims jwt.Claims) (string, error) {
+	key, ok := j.currentKey()
+	if !ok {
+		if j.JWTKey == "" {
+			return "", errors.New("signing key is not configured")
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(j.JWTKey))
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.sign)
+}
+
+// Find the key a token was signed with. Tokens without a kid were signed
+// with the shared JWTKey. The algorithm must match the key so a public key
+// can never be used as an HMAC secret.
+func (j *JWTHelper) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if j.JWTKey == "" || token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("token has no key id")
+		}
+		return []byte(j.JWTKey), nil
+	}
+	j.mu.RLock()
+	key, ok := j.byKID[kid]
+	j.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("token algorithm %s does not match key %s", token.Method.Alg(), kid)
+	}
+	return key.verify, nil
+}
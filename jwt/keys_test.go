@@ -0,0 +1,155 @@
+package jwt
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cheebz/go-auth/models"
+	"github.com/golang-jwt/jwt"
+)
+
+func requestWithJWT(value string) *http.Request {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "jwt", Value: value})
+	return r
+}
+
+func TestSigningKeys(t *testing.T) {
+	helper := NewJWTHelper("secret", 20, 3600)
+	user := models.User{ID: 1, Username: "user", UUID: "uuid"}
+	legacy, err := helper.CreateJWT(user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := GenerateKey(ES256)
+	if err != nil {
+		t.Fatal("failed to generate key", err)
+	}
+	err = helper.SetKeys([]models.SigningKey{first})
+	if err != nil {
+		t.Fatal("failed to set keys", err)
+	}
+	err = helper.CheckKey()
+	if err != nil {
+		t.Fatal("key check failed", err)
+	}
+	signed, err := helper.CreateJWT(user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := new(jwt.Parser).ParseUnverified(signed.Value, &JWTClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Method.Alg() != ES256 || token.Header["kid"] != first.KID {
+		t.Fatal("token not signed with the stored key", token.Header)
+	}
+
+	second, err := GenerateKey(HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Created = first.Created.Add(1)
+	err = helper.SetKeys([]models.SigningKey{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := helper.CreateJWT(user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, _ = new(jwt.Parser).ParseUnverified(rotated.Value, &JWTClaims{})
+	if token.Header["kid"] != second.KID {
+		t.Fatal("newest key not used after rotation", token.Header)
+	}
+	for name, value := range map[string]string{"legacy": legacy.Value, "first": signed.Value, "rotated": rotated.Value} {
+		claims, err := helper.CheckJWTClaims(requestWithJWT(value))
+		if err != nil || claims.UserID != user.ID {
+			t.Fatal(name, "token not verified after rotation", err)
+		}
+	}
+
+	err = helper.SetKeys([]models.SigningKey{second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = helper.CheckJWTClaims(requestWithJWT(signed.Value))
+	if err == nil {
+		t.Fatal("token verified after its key was removed")
+	}
+}
+
+func TestKeyAlgorithmMismatch(t *testing.T) {
+	helper := NewJWTHelper("", 20, 3600)
+	key, err := GenerateKey(HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = helper.SetKeys([]models.SigningKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the algorithm in the token header has to match the key its kid names
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS384, JWTClaims{UserID: 1})
+	forged.Header["kid"] = key.KID
+	value, err := forged.SignedString([]byte("guess"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = helper.CheckJWTClaims(requestWithJWT(value))
+	if err == nil {
+		t.Fatal("token with mismatched algorithm verified")
+	}
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{UserID: 1})
+	value, _ = unsigned.SignedString([]byte("guess"))
+	_, err = helper.CheckJWTClaims(requestWithJWT(value))
+	if err == nil {
+		t.Fatal("token without kid verified while no shared key is configured")
+	}
+	_, err = GenerateKey("none")
+	if err == nil {
+		t.Fatal("generated key for unsupported algorithm")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	helper := NewJWTHelper("", 20, 3600)
+	es256, err := GenerateKey(ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs256, err := GenerateKey(HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = helper.SetKeys([]models.SigningKey{es256, hs256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := helper.JWKS()
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != es256.KID {
+		t.Fatal("expected only the ES256 key to be published", jwks)
+	}
+	public, err := jwks.Keys[0].PublicKey()
+	if err != nil {
+		t.Fatal("failed to decode published key", err)
+	}
+	signed, err := helper.sign(JWTClaims{Username: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseJWTClaims(signed, func(token *jwt.Token) (interface{}, error) { return public, nil })
+	if err == nil {
+		t.Fatal("HS256 token verified with public key")
+	}
+	helper.SetKeys([]models.SigningKey{es256})
+	signed, err = helper.sign(JWTClaims{Username: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseJWTClaims(signed, func(token *jwt.Token) (interface{}, error) { return public, nil })
+	if err != nil {
+		t.Fatal("token not verified with published key", err)
+	}
+}
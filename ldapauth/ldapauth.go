@@ -0,0 +1,301 @@
+// Package ldapauth logs users in against an LDAP or Active Directory
+// server. The user is searched for with a service account, and their
+// password is checked by binding as them. Users are provisioned locally on
+// their first login and their mapped directory groups are synced on every
+// login.
+package ldapauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cheebz/go-auth/authn"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/google/uuid"
+)
+
+type Authenticator struct {
+	conf    config.LDAPConfig
+	repo    repositories.Repository
+	tls     *tls.Config
+	timeout time.Duration
+	// lower case directory group names to go-auth group names
+	groupMap map[string]string
+	// go-auth groups whose members are synced with the directory
+	managed []string
+}
+
+func New(c config.LDAPConfig, repo repositories.Repository) (*Authenticator, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %w", err)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("unsupported LDAP URL scheme: %s", u.Scheme)
+	}
+	if c.UserBaseDN == "" {
+		return nil, errors.New("LDAP user base DN is required")
+	}
+	if !strings.Contains(c.UserFilter, "%s") {
+		return nil, fmt.Errorf("LDAP user filter has no %%s: %s", c.UserFilter)
+	}
+	a := &Authenticator{
+		conf:     c,
+		repo:     repo,
+		tls:      &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		timeout:  time.Duration(c.Timeout) * time.Second,
+		groupMap: map[string]string{},
+	}
+	if a.timeout <= 0 {
+		a.timeout = 10 * time.Second
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tls.RootCAs = x509.NewCertPool()
+		if !a.tls.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+	}
+	managed := map[string]bool{}
+	for _, pair := range strings.Split(c.GroupMap, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		directory, group, ok := strings.Cut(pair, ":")
+		if !ok || directory == "" || group == "" {
+			return nil, fmt.Errorf("invalid LDAP group mapping: %s", pair)
+		}
+		a.groupMap[strings.ToLower(directory)] = group
+		managed[group] = true
+	}
+	for group := range managed {
+		a.managed = append(a.managed, group)
+	}
+	sort.Strings(a.managed)
+	if len(a.managed) > 0 && (c.GroupBaseDN == "" || !strings.Contains(c.GroupFilter, "%s")) {
+		return nil, errors.New("LDAP group mapping needs a group base DN and a group filter with %s")
+	}
+	return a, nil
+}
+
+func (a *Authenticator) Authenticate(ctx context.Context, username, password string) (models.User, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if username == "" || password == "" {
+		return models.User{}, authn.ErrUnknownUser
+	}
+	user, err := a.repo.GetUserByName(ctx, username)
+	if err == nil && user.Password != authn.LDAPPassword {
+		// never take over a local or federated account with the same name
+		return user, authn.ErrUnknownUser
+	}
+	if err != nil && !errors.Is(err, repositories.ErrNotFound) {
+		return user, err
+	}
+	groups, err := a.login(ctx, username, password)
+	if err != nil {
+		return user, err
+	}
+	return a.provision(ctx, username, groups)
+}
+
+func (a *Authenticator) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.conf.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout}),
+		ldap.DialWithTLSConfig(a.tls),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP connection failed: %w", err)
+	}
+	conn.SetTimeout(a.timeout)
+	if a.conf.StartTLS {
+		err = conn.StartTLS(a.tls)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP StartTLS failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// Bind as the service account, or anonymously
+func (a *Authenticator) bindService(conn *ldap.Conn) error {
+	var err error
+	if a.conf.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(a.conf.BindDN, a.conf.BindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf("LDAP service bind failed: %w", err)
+	}
+	return nil
+}
+
+func (a *Authenticator) search(conn *ldap.Conn, baseDN, filter string, attributes []string, limit int) ([]*ldap.Entry, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		limit, int(a.timeout.Seconds()), false,
+		filter, attributes, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LDAP search failed: %w", err)
+	}
+	return res.Entries, nil
+}
+
+// Search for the user, bind as them and return the names of their mapped
+// go-auth groups
+func (a *Authenticator) login(ctx context.Context, username, password string) ([]string, error) {
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// the client has no contexts, so abandon the connection instead
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = a.bindService(conn)
+	if err != nil {
+		return nil, err
+	}
+	filter := fmt.Sprintf(a.conf.UserFilter, ldap.EscapeFilter(username))
+	entries, err := a.search(conn, a.conf.UserBaseDN, filter, []string{"dn"}, 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, authn.ErrUnknownUser
+	}
+	if len(entries) > 1 {
+		return nil, fmt.Errorf("LDAP user filter matches more than one entry for %s", username)
+	}
+	userDN := entries[0].DN
+
+	err = conn.Bind(userDN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, authn.ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LDAP bind failed: %w", err)
+	}
+	if len(a.managed) == 0 {
+		return nil, nil
+	}
+
+	// the user may not be allowed to search groups
+	err = a.bindService(conn)
+	if err != nil {
+		return nil, err
+	}
+	filter = fmt.Sprintf(a.conf.GroupFilter, ldap.EscapeFilter(userDN))
+	entries, err = a.search(conn, a.conf.GroupBaseDN, filter, []string{a.conf.GroupAttribute}, 0)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, entry := range entries {
+		group, ok := a.groupMap[strings.ToLower(a.groupName(entry))]
+		if ok {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// Name of a directory group, from its attribute or else the first RDN
+func (a *Authenticator) groupName(entry *ldap.Entry) string {
+	if name := entry.GetAttributeValue(a.conf.GroupAttribute); name != "" {
+		return name
+	}
+	dn, err := ldap.ParseDN(entry.DN)
+	if err != nil || len(dn.RDNs) == 0 {
+		return ""
+	}
+	for _, attr := range dn.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, a.conf.GroupAttribute) {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Create the local user on their first login and sync their groups
+func (a *Authenticator) provision(ctx context.Context, username string, groups []string) (models.User, error) {
+	user, err := a.repo.GetUserByName(ctx, username)
+	if errors.Is(err, repositories.ErrNotFound) {
+		user, err = a.repo.CreateUser(ctx, models.User{
+			Username: username,
+			Password: authn.LDAPPassword,
+			UUID:     uuid.New().String(),
+			Created:  time.Now(),
+		})
+		// a concurrent first login created them
+		if errors.Is(err, repositories.ErrConflict) {
+			user, err = a.repo.GetUserByName(ctx, username)
+		}
+	}
+	if err != nil {
+		return user, err
+	}
+	if user.Password != authn.LDAPPassword {
+		return user, authn.ErrUnknownUser
+	}
+	return user, a.syncGroups(ctx, user, groups)
+}
+
+// Add and remove memberships of the mapped groups only, so groups assigned
+// in go-auth are kept
+func (a *Authenticator) syncGroups(ctx context.Context, user models.User, groups []string) error {
+	current, err := a.repo.GetUserGroups(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	member := map[string]models.Group{}
+	for _, group := range current {
+		member[group.Name] = group
+	}
+	wanted := map[string]bool{}
+	for _, name := range groups {
+		wanted[name] = true
+	}
+	for _, name := range a.managed {
+		group, isMember := member[name]
+		switch {
+		case wanted[name] && !isMember:
+			group, err = a.repo.GetGroupByName(ctx, name)
+			if errors.Is(err, repositories.ErrNotFound) {
+				group, err = a.repo.CreateGroup(ctx, name)
+			}
+			if err != nil {
+				return err
+			}
+			err = a.repo.AddUserToGroup(ctx, user.ID, group.ID)
+		case !wanted[name] && isMember:
+			err = a.repo.RemoveUserFromGroup(ctx, user.ID, group.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package ldapauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/authn"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/google/uuid"
+	"github.com/jimlambrt/gldap"
+	"github.com/jimlambrt/gldap/testdirectory"
+)
+
+var serviceDN = "cn=search," + testdirectory.DefaultUserDN
+
+func startDirectory(t *testing.T, opts ...testdirectory.Option) *testdirectory.Directory {
+	users := testdirectory.NewUsers(t, []string{"search", "alice", "bob", "dave"})
+	return testdirectory.Start(t, append(opts,
+		testdirectory.WithDefaults(t, &testdirectory.Defaults{
+			Users:  users,
+			Groups: directoryGroups(t, []string{"alice"}),
+		}),
+	)...)
+}
+
+func directoryGroups(t *testing.T, admins []string) []*gldap.Entry {
+	return []*gldap.Entry{
+		testdirectory.NewGroup(t, "admins", admins),
+		testdirectory.NewGroup(t, "developers", []string{"alice", "bob"}),
+		testdirectory.NewGroup(t, "sales", []string{"bob"}),
+	}
+}
+
+func testConfig(d *testdirectory.Directory, scheme string) config.LDAPConfig {
+	return config.LDAPConfig{
+		URL:            fmt.Sprintf("%s://%s:%d", scheme, d.Host(), d.Port()),
+		BindDN:         serviceDN,
+		BindPassword:   "password",
+		UserBaseDN:     testdirectory.DefaultUserDN,
+		UserFilter:     "(cn=%s)",
+		GroupBaseDN:    testdirectory.DefaultGroupDN,
+		GroupFilter:    "(member=%s)",
+		GroupAttribute: "cn",
+		GroupMap:       "Admins:admin,developers:developers",
+		Timeout:        5,
+	}
+}
+
+func caFile(t *testing.T, d *testdirectory.Directory) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(path, []byte(d.Cert()), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func groupNames(t *testing.T, repo repositories.Repository, user models.User) []string {
+	groups, err := repo.GetUserGroups(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	return names
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	d := startDirectory(t, testdirectory.WithNoTLS(t))
+	repo := repositories.NewMemoryRepository(config.Configuration{})
+	a, err := New(testConfig(d, "ldap"), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := a.Authenticate(ctx, "alice", "password")
+	if err != nil {
+		t.Fatal("directory login failed", err)
+	}
+	if user.ID == 0 || user.Password != authn.LDAPPassword {
+		t.Fatal("user not provisioned", user)
+	}
+	if names := groupNames(t, repo, user); fmt.Sprint(names) != "[public admin developers]" {
+		t.Fatal("unexpected groups", names)
+	}
+
+	_, err = a.Authenticate(ctx, "alice", "wrong password")
+	if !errors.Is(err, authn.ErrInvalidCredentials) {
+		t.Fatal("expected invalid credentials", err)
+	}
+	_, err = a.Authenticate(ctx, "alice", "")
+	if !errors.Is(err, authn.ErrUnknownUser) {
+		t.Fatal("empty password sent to the directory", err)
+	}
+	_, err = a.Authenticate(ctx, "carol", "password")
+	if !errors.Is(err, authn.ErrUnknownUser) {
+		t.Fatal("expected unknown user", err)
+	}
+
+	// removed from admins in the directory, and given a group in go-auth
+	d.SetGroups(directoryGroups(t, nil)...)
+	other, err := repo.CreateGroup(ctx, "support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.AddUserToGroup(ctx, user.ID, other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := a.Authenticate(ctx, "alice", "password")
+	if err != nil || again.ID != user.ID {
+		t.Fatal("second login failed", again, err)
+	}
+	if names := groupNames(t, repo, user); fmt.Sprint(names) != "[public developers support]" {
+		t.Fatal("groups not synced", names)
+	}
+
+	// local accounts are never taken over by the directory
+	hasher := hash.NewArgon2Hash(1024, 1, 1)
+	password, _ := hasher.Generate("local password")
+	_, err = repo.CreateUser(ctx, models.User{Username: "dave", Password: password, UUID: uuid.New().String(), Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Authenticate(ctx, "dave", "password")
+	if !errors.Is(err, authn.ErrUnknownUser) {
+		t.Fatal("directory logged in as local user", err)
+	}
+	// nor are users registered by an identity provider
+	federated, err := repo.CreateUser(ctx, models.User{Username: "bob", Password: authn.FederatedPassword("github"), UUID: uuid.New().String(), Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Authenticate(ctx, "bob", "password")
+	if !errors.Is(err, authn.ErrUnknownUser) {
+		t.Fatal("directory logged in as federated user", err)
+	}
+	if names := groupNames(t, repo, federated); fmt.Sprint(names) != "[public]" {
+		t.Fatal("groups synced onto federated user", names)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ctx := context.Background()
+	for name, start := range map[string]func() (*testdirectory.Directory, config.LDAPConfig){
+		"ldaps": func() (*testdirectory.Directory, config.LDAPConfig) {
+			d := startDirectory(t)
+			return d, testConfig(d, "ldaps")
+		},
+		"starttls": func() (*testdirectory.Directory, config.LDAPConfig) {
+			d := startDirectory(t, testdirectory.WithNoTLS(t))
+			c := testConfig(d, "ldap")
+			c.StartTLS = true
+			return d, c
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, c := start()
+			untrusted, err := New(c, repositories.NewMemoryRepository(config.Configuration{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = untrusted.Authenticate(ctx, "bob", "password")
+			if err == nil || errors.Is(err, authn.ErrUnknownUser) || errors.Is(err, authn.ErrInvalidCredentials) {
+				t.Fatal("connected to directory with untrusted certificate", err)
+			}
+			c.CAFile = caFile(t, d)
+			a, err := New(c, repositories.NewMemoryRepository(config.Configuration{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = a.Authenticate(ctx, "bob", "password")
+			if err != nil {
+				t.Fatal("login over TLS failed", err)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	valid := config.LDAPConfig{URL: "ldap://localhost", UserBaseDN: "dc=example,dc=org", UserFilter: "(uid=%s)"}
+	_, err := New(valid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func(c *config.LDAPConfig){
+		"scheme":        func(c *config.LDAPConfig) { c.URL = "http://localhost" },
+		"base DN":       func(c *config.LDAPConfig) { c.UserBaseDN = "" },
+		"filter":        func(c *config.LDAPConfig) { c.UserFilter = "(uid=alice)" },
+		"group map":     func(c *config.LDAPConfig) { c.GroupMap = "admins" },
+		"group base DN": func(c *config.LDAPConfig) { c.GroupMap = "admins:admin" },
+		"CA file":       func(c *config.LDAPConfig) { c.CAFile = "missing.pem" },
+	} {
+		c := valid
+		change(&c)
+		_, err := New(c, nil)
+		if err == nil {
+			t.Fatal("accepted invalid", name)
+		}
+	}
+}
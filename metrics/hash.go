@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/cheebz/go-auth/hash"
+)
+
+type instrumentedHash struct {
+	hash.Hash
+}
+
+// NewHash records Generate and Check durations of the wrapped hash
+func NewHash(inner hash.Hash) hash.Hash {
+	return &instrumentedHash{Hash: inner}
+}
+
+func (h *instrumentedHash) Generate(password string) (string, error) {
+	defer observe(hashDuration, time.Now(), "generate")
+	return h.Hash.Generate(password)
+}
+
+func (h *instrumentedHash) Check(hash string, password string) error {
+	defer observe(hashDuration, time.Now(), "check")
+	return h.Hash.Check(hash, password)
+}
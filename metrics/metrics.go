@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "go_auth"
+
+// Outcome label values
+const (
+	Success         = "success"
+	Failure         = "failure"
+	Rejected        = "rejected"
+	PasswordExpired = "password_expired"
+	Error           = "error"
+	Skipped         = "skipped"
+)
+
+// Registry holds every go-auth collector along with the Go runtime and
+// process collectors
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	Logins = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Login attempts by outcome.",
+	}, []string{"outcome"})
+	Registrations = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registrations_total",
+		Help:      "Registration attempts by outcome.",
+	}, []string{"outcome"})
+	Refreshes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "refreshes_total",
+		Help:      "Session refreshes by outcome.",
+	}, []string{"outcome"})
+	RefreshReuseRejections = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "refresh_reuse_rejections_total",
+		Help:      "Refresh tokens rejected because they were already rotated or revoked.",
+	})
+	Logouts = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logouts_total",
+		Help:      "Logouts by scope, either a single session or all sessions.",
+	}, []string{"scope"})
+	CaptchaFailures = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "captcha_failures_total",
+		Help:      "hCaptcha validations that failed.",
+	})
+	JobRuns = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_runs_total",
+		Help:      "Scheduled job runs by outcome, skipped when another replica is the leader.",
+	}, []string{"job", "outcome"})
+	JobRetries = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_retries_total",
+		Help:      "Failed scheduled job attempts that were retried.",
+	}, []string{"job"})
+	JobLastSuccess = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_last_success_timestamp_seconds",
+		Help:      "Unix time the job last succeeded.",
+	}, []string{"job"})
+	SchedulerLeader = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scheduler_leader",
+		Help:      "1 when this replica holds the scheduler lock and runs jobs.",
+	})
+
+	requestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Handler latency by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+	hashDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hash_duration_seconds",
+		Help:      "Password hash generate and check durations.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"operation"})
+	queryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "repository_query_duration_seconds",
+		Help:      "Repository method durations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "result"})
+	jobDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Scheduled job durations including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"job"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// RefreshCounter is implemented by repositories that can count active refresh tokens
+type RefreshCounter interface {
+	CountActiveRefresh(ctx context.Context) (int, error)
+}
+
+// RegisterActiveRefresh adds a gauge that counts active refresh tokens on each scrape
+func RegisterActiveRefresh(counter RefreshCounter, timeout time.Duration) error {
+	return Registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_refresh_tokens",
+		Help:      "Refresh tokens that have not expired.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		count, err := counter.CountActiveRefresh(ctx)
+		if err != nil {
+			return -1
+		}
+		return float64(count)
+	}))
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware records handler latency labelled by the matched route template
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		requestDuration.WithLabelValues(route, r.Method, strconv.Itoa(sw.code)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveJob records a finished job run
+func ObserveJob(job string, start time.Time, err error) {
+	observe(jobDuration, start, job)
+	if err != nil {
+		JobRuns.WithLabelValues(job, Failure).Inc()
+		return
+	}
+	JobRuns.WithLabelValues(job, Success).Inc()
+	JobLastSuccess.WithLabelValues(job).SetToCurrentTime()
+}
+
+func observe(h *prometheus.HistogramVec, start time.Time, labels ...string) {
+	h.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
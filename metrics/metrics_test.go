@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/auth/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/auth/users/42", nil))
+
+	count := testutil.CollectAndCount(requestDuration, "go_auth_http_request_duration_seconds")
+	if count != 1 {
+		t.Fatal("expected one series", count)
+	}
+	observer, err := requestDuration.GetMetricWithLabelValues("/auth/users/{id}", "GET", "418")
+	if err != nil || observer == nil {
+		t.Fatal("route template, method and code not recorded", err)
+	}
+}
+
+func TestInstrumentedRepository(t *testing.T) {
+	repo := NewRepository(repositories.NewMemoryRepository(config.Configuration{}))
+	_, err := repo.GetUserByID(context.Background(), -1)
+	if !errors.Is(err, repositories.ErrNotFound) {
+		t.Fatal("error not passed through", err)
+	}
+	expected := `go_auth_repository_query_duration_seconds_count{method="GetUserByID",result="not_found"} 1`
+	if !strings.Contains(scrape(t), expected) {
+		t.Fatal("repository call not recorded")
+	}
+
+	err = RegisterActiveRefresh(repo, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(scrape(t), "go_auth_active_refresh_tokens 0") {
+		t.Fatal("active refresh gauge not exposed")
+	}
+}
+
+func TestInstrumentedHash(t *testing.T) {
+	hasher := NewHash(hash.NewBCryptHash(4))
+	password, err := hasher.Generate("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hasher.Check(password, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := scrape(t)
+	for _, operation := range []string{"generate", "check"} {
+		if !strings.Contains(body, `go_auth_hash_duration_seconds_count{operation="`+operation+`"} 1`) {
+			t.Fatal("hash operation not recorded", operation)
+		}
+	}
+}
+
+func scrape(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("scrape failed", w.Code)
+	}
+	return w.Body.String()
+}
@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+)
+
+type instrumentedRepository struct {
+	repositories.Repository
+}
+
+// NewRepository records the duration of every call to the wrapped repository
+func NewRepository(inner repositories.Repository) repositories.Repository {
+	return &instrumentedRepository{Repository: inner}
+}
+
+func (r *instrumentedRepository) observe(method string, start time.Time, err error) {
+	result := "ok"
+	switch {
+	case errors.Is(err, repositories.ErrNotFound):
+		result = "not_found"
+	case errors.Is(err, repositories.ErrConflict):
+		result = "conflict"
+	case errors.Is(err, repositories.ErrRevoked):
+		result = "revoked"
+	case err != nil:
+		result = "error"
+	}
+	observe(queryDuration, start, method, result)
+}
+
+func (r *instrumentedRepository) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { r.observe("Ping", start, err) }(time.Now())
+	return r.Repository.Ping(ctx)
+}
+
+func (r *instrumentedRepository) GetUserByID(ctx context.Context, userID int) (user models.User, err error) {
+	defer func(start time.Time) { r.observe("GetUserByID", start, err) }(time.Now())
+	return r.Repository.GetUserByID(ctx, userID)
+}
+
+func (r *instrumentedRepository) GetUserByName(ctx context.Context, username string) (user models.User, err error) {
+	defer func(start time.Time) { r.observe("GetUserByName", start, err) }(time.Now())
+	return r.Repository.GetUserByName(ctx, username)
+}
+
+func (r *instrumentedRepository) GetUserByUUID(ctx context.Context, uuid string) (user models.User, err error) {
+	defer func(start time.Time) { r.observe("GetUserByUUID", start, err) }(time.Now())
+	return r.Repository.GetUserByUUID(ctx, uuid)
+}
+
+func (r *instrumentedRepository) CreateUser(ctx context.Context, user models.User) (created models.User, err error) {
+	defer func(start time.Time) { r.observe("CreateUser", start, err) }(time.Now())
+	return r.Repository.CreateUser(ctx, user)
+}
+
+func (r *instrumentedRepository) GetUserGroups(ctx context.Context, userID int) (groups []models.Group, err error) {
+	defer func(start time.Time) { r.observe("GetUserGroups", start, err) }(time.Now())
+	return r.Repository.GetUserGroups(ctx, userID)
+}
+
+func (r *instrumentedRepository) UpdatePassword(ctx context.Context, userID int, password string) (err error) {
+	defer func(start time.Time) { r.observe("UpdatePassword", start, err) }(time.Now())
+	return r.Repository.UpdatePassword(ctx, userID, password)
+}
+
+func (r *instrumentedRepository) ReplacePasswordHash(ctx context.Context, userID int, password string) (err error) {
+	defer func(start time.Time) { r.observe("ReplacePasswordHash", start, err) }(time.Now())
+	return r.Repository.ReplacePasswordHash(ctx, userID, password)
+}
+
+func (r *instrumentedRepository) GetPasswordHistory(ctx context.Context, userID int, limit int) (history []string, err error) {
+	defer func(start time.Time) { r.observe("GetPasswordHistory", start, err) }(time.Now())
+	return r.Repository.GetPasswordHistory(ctx, userID, limit)
+}
+
+func (r *instrumentedRepository) SaveRefresh(ctx context.Context, userID int, jti string) (err error) {
+	defer func(start time.Time) { r.observe("SaveRefresh", start, err) }(time.Now())
+	return r.Repository.SaveRefresh(ctx, userID, jti)
+}
+
+func (r *instrumentedRepository) ValidateRefresh(ctx context.Context, userID int, jti string) (err error) {
+	defer func(start time.Time) { r.observe("ValidateRefresh", start, err) }(time.Now())
+	return r.Repository.ValidateRefresh(ctx, userID, jti)
+}
+
+func (r *instrumentedRepository) InvalidateRefresh(ctx context.Context, jti string) (err error) {
+	defer func(start time.Time) { r.observe("InvalidateRefresh", start, err) }(time.Now())
+	return r.Repository.InvalidateRefresh(ctx, jti)
+}
+
+func (r *instrumentedRepository) DeleteAllRefresh(ctx context.Context, userID int) (err error) {
+	defer func(start time.Time) { r.observe("DeleteAllRefresh", start, err) }(time.Now())
+	return r.Repository.DeleteAllRefresh(ctx, userID)
+}
+
+func (r *instrumentedRepository) DeleteExpiredRefresh(ctx context.Context) (err error) {
+	defer func(start time.Time) { r.observe("DeleteExpiredRefresh", start, err) }(time.Now())
+	return r.Repository.DeleteExpiredRefresh(ctx)
+}
+
+func (r *instrumentedRepository) CountActiveRefresh(ctx context.Context) (count int, err error) {
+	defer func(start time.Time) { r.observe("CountActiveRefresh", start, err) }(time.Now())
+	return r.Repository.CountActiveRefresh(ctx)
+}
+
+func (r *instrumentedRepository) SaveAuditEvent(ctx context.Context, event models.AuditEvent) (err error) {
+	defer func(start time.Time) { r.observe("SaveAuditEvent", start, err) }(time.Now())
+	return r.Repository.SaveAuditEvent(ctx, event)
+}
+
+func (r *instrumentedRepository) GetAuditEvents(ctx context.Context, filter models.AuditFilter) (events []models.AuditEvent, err error) {
+	defer func(start time.Time) { r.observe("GetAuditEvents", start, err) }(time.Now())
+	return r.Repository.GetAuditEvents(ctx, filter)
+}
+
+func (r *instrumentedRepository) AddUserToGroup(ctx context.Context, userID int, groupID int) (err error) {
+	defer func(start time.Time) { r.observe("AddUserToGroup", start, err) }(time.Now())
+	return r.Repository.AddUserToGroup(ctx, userID, groupID)
+}
+
+func (r *instrumentedRepository) DeleteUser(ctx context.Context, userID int) (err error) {
+	defer func(start time.Time) { r.observe("DeleteUser", start, err) }(time.Now())
+	return r.Repository.DeleteUser(ctx, userID)
+}
+
+func (r *instrumentedRepository) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) (webhooks []models.Webhook, err error) {
+	defer func(start time.Time) { r.observe("ClaimWebhooks", start, err) }(time.Now())
+	return r.Repository.ClaimWebhooks(ctx, limit, lease)
+}
+
+func (r *instrumentedRepository) MarkWebhookDelivered(ctx context.Context, id int64) (err error) {
+	defer func(start time.Time) { r.observe("MarkWebhookDelivered", start, err) }(time.Now())
+	return r.Repository.MarkWebhookDelivered(ctx, id)
+}
+
+func (r *instrumentedRepository) RetryWebhook(ctx context.Context, id int64, lastError string, nextAttempt time.Time) (err error) {
+	defer func(start time.Time) { r.observe("RetryWebhook", start, err) }(time.Now())
+	return r.Repository.RetryWebhook(ctx, id, lastError, nextAttempt)
+}
+
+func (r *instrumentedRepository) MarkWebhookFailed(ctx context.Context, id int64, lastError string) (err error) {
+	defer func(start time.Time) { r.observe("MarkWebhookFailed", start, err) }(time.Now())
+	return r.Repository.MarkWebhookFailed(ctx, id, lastError)
+}
+
+func (r *instrumentedRepository) TryLock(ctx context.Context, name string) (lock repositories.Lock, err error) {
+	defer func(start time.Time) { r.observe("TryLock", start, err) }(time.Now())
+	return r.Repository.TryLock(ctx, name)
+}
+
+func (r *instrumentedRepository) ListUsers(ctx context.Context, afterID int, limit int) (users []models.User, err error) {
+	defer func(start time.Time) { r.observe("ListUsers", start, err) }(time.Now())
+	return r.Repository.ListUsers(ctx, afterID, limit)
+}
+
+func (r *instrumentedRepository) SetUserDisabled(ctx context.Context, userID int, disabled bool) (err error) {
+	defer func(start time.Time) { r.observe("SetUserDisabled", start, err) }(time.Now())
+	return r.Repository.SetUserDisabled(ctx, userID, disabled)
+}
+
+func (r *instrumentedRepository) CreateGroup(ctx context.Context, name string) (group models.Group, err error) {
+	defer func(start time.Time) { r.observe("CreateGroup", start, err) }(time.Now())
+	return r.Repository.CreateGroup(ctx, name)
+}
+
+func (r *instrumentedRepository) GetGroupByName(ctx context.Context, name string) (group models.Group, err error) {
+	defer func(start time.Time) { r.observe("GetGroupByName", start, err) }(time.Now())
+	return r.Repository.GetGroupByName(ctx, name)
+}
+
+func (r *instrumentedRepository) RemoveUserFromGroup(ctx context.Context, userID int, groupID int) (err error) {
+	defer func(start time.Time) { r.observe("RemoveUserFromGroup", start, err) }(time.Now())
+	return r.Repository.RemoveUserFromGroup(ctx, userID, groupID)
+}
+
+func (r *instrumentedRepository) SaveSigningKey(ctx context.Context, key models.SigningKey) (err error) {
+	defer func(start time.Time) { r.observe("SaveSigningKey", start, err) }(time.Now())
+	return r.Repository.SaveSigningKey(ctx, key)
+}
+
+func (r *instrumentedRepository) GetSigningKeys(ctx context.Context) (keys []models.SigningKey, err error) {
+	defer func(start time.Time) { r.observe("GetSigningKeys", start, err) }(time.Now())
+	return r.Repository.GetSigningKeys(ctx)
+}
+
+func (r *instrumentedRepository) DeleteSigningKey(ctx context.Context, kid string) (err error) {
+	defer func(start time.Time) { r.observe("DeleteSigningKey", start, err) }(time.Now())
+	return r.Repository.DeleteSigningKey(ctx, kid)
+}
+
+func (r *instrumentedRepository) ImportUsers(ctx context.Context, users []models.UserImport, onConflict string) (outcomes []string, err error) {
+	defer func(start time.Time) { r.observe("ImportUsers", start, err) }(time.Now())
+	return r.Repository.ImportUsers(ctx, users, onConflict)
+}
+
+func (r *instrumentedRepository) CreateFederatedIdentity(ctx context.Context, identity models.FederatedIdentity) (created models.FederatedIdentity, err error) {
+	defer func(start time.Time) { r.observe("CreateFederatedIdentity", start, err) }(time.Now())
+	return r.Repository.CreateFederatedIdentity(ctx, identity)
+}
+
+func (r *instrumentedRepository) GetFederatedIdentity(ctx context.Context, provider string, subject string) (identity models.FederatedIdentity, err error) {
+	defer func(start time.Time) { r.observe("GetFederatedIdentity", start, err) }(time.Now())
+	return r.Repository.GetFederatedIdentity(ctx, provider, subject)
+}
+
+func (r *instrumentedRepository) GetUserFederatedIdentities(ctx context.Context, userID int) (identities []models.FederatedIdentity, err error) {
+	defer func(start time.Time) { r.observe("GetUserFederatedIdentities", start, err) }(time.Now())
+	return r.Repository.GetUserFederatedIdentities(ctx, userID)
+}
+
+func (r *instrumentedRepository) DeleteFederatedIdentity(ctx context.Context, userID int, provider string) (err error) {
+	defer func(start time.Time) { r.observe("DeleteFederatedIdentity", start, err) }(time.Now())
+	return r.Repository.DeleteFederatedIdentity(ctx, userID, provider)
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cheebz/go-auth/jwt"
+)
+
+type contextKey struct{}
+
+// NewContext returns a context carrying claims
+func NewContext(ctx context.Context, claims *jwt.JWTClaims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims put in the context by Require or
+// Optional
+func ClaimsFromContext(ctx context.Context) (*jwt.JWTClaims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*jwt.JWTClaims)
+	return claims, ok
+}
+
+// InGroup reports whether the claims include any of the groups
+func InGroup(claims *jwt.JWTClaims, groups ...string) bool {
+	for _, group := range claims.Groups {
+		for _, name := range groups {
+			if group.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequireGroup only lets requests through whose claims include the group.
+// It has to run after Require.
+func RequireGroup(group string) func(http.Handler) http.Handler {
+	return RequireAnyGroup(group)
+}
+
+// RequireAnyGroup only lets requests through whose claims include at least
+// one of the groups. It has to run after Require.
+func RequireAnyGroup(groups ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !InGroup(claims, groups...) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cheebz/go-auth/jwt"
+)
+
+const (
+	defaultJWKSMaxAge = 5 * time.Minute
+	// Unknown key ids only trigger a fetch this often, so forged tokens
+	// cannot be used to flood go-auth with requests
+	minFetchInterval = 10 * time.Second
+	// Fetches outlive the request that started them, so they need their
+	// own limit in case the client has none
+	fetchTimeout = 30 * time.Second
+)
+
+// keySet caches the public keys fetched from a JWKS URL
+type keySet struct {
+	client  *http.Client
+	url     string
+	maxAge  time.Duration
+	mu      sync.Mutex
+	keys    map[string]*ecdsa.PublicKey
+	fetched time.Time
+	// closed once the fetch in flight is done, nil when there is none
+	fetching chan struct{}
+	err      error
+}
+
+func newKeySet(client *http.Client, url string, maxAge time.Duration) *keySet {
+	if maxAge <= 0 {
+		maxAge = defaultJWKSMaxAge
+	}
+	return &keySet{client: client, url: url, maxAge: maxAge}
+}
+
+// Look up a key. Stale keys are returned while the set is fetched in the
+// background, unknown keys wait for a fetch.
+func (s *keySet) get(ctx context.Context, kid string) (*ecdsa.PublicKey, error) {
+	s.mu.Lock()
+	key, ok := s.keys[kid]
+	age := time.Since(s.fetched)
+	if ok {
+		if age >= s.maxAge {
+			s.startFetch()
+		}
+		s.mu.Unlock()
+		return key, nil
+	}
+	done := s.fetching
+	if done == nil && age >= minFetchInterval {
+		done = s.startFetch()
+	}
+	s.mu.Unlock()
+	if done == nil {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok = s.keys[kid]
+	if !ok {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	return key, nil
+}
+
+// Start fetching the set unless a fetch is already in flight, and return a
+// channel closed once it is done. Callers must hold the lock.
+func (s *keySet) startFetch() chan struct{} {
+	if s.fetching != nil {
+		return s.fetching
+	}
+	done := make(chan struct{})
+	s.fetching = done
+	s.fetched = time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+		defer cancel()
+		keys, err := s.fetch(ctx)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// keep using known keys while go-auth is unreachable
+		if err == nil {
+			s.keys = keys
+		}
+		s.err = err
+		s.fetching = nil
+		close(done)
+	}()
+	return done
+}
+
+func (s *keySet) fetch(ctx context.Context) (map[string]*ecdsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s", res.Status)
+	}
+	var jwks jwt.JWKS
+	err = json.NewDecoder(res.Body).Decode(&jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+	keys := make(map[string]*ecdsa.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		key, err := k.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,182 @@
+// Package middleware verifies go-auth session tokens in services that sit
+// behind go-auth.
+//
+//	auth, err := middleware.New(middleware.Config{
+//		JWKSURL:    "https://example.com/auth/.well-known/jwks.json",
+//		RefreshURL: "https://example.com/auth/",
+//	})
+//	admin := auth.Require(middleware.RequireGroup("admin")(handler))
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cheebz/go-auth/jwt"
+	gojwt "github.com/golang-jwt/jwt"
+)
+
+// ErrNoToken is returned when a request carries neither a bearer token nor
+// a jwt cookie
+var ErrNoToken = errors.New("no token")
+
+// Config of the middleware. Secret, JWKSURL or both are required.
+type Config struct {
+	// go-auth's JWT_KEY, which verifies tokens signed without a key id
+	Secret string
+	// Where go-auth publishes its ES256 public keys
+	JWKSURL string
+	// How long fetched keys are used before they are fetched again
+	JWKSMaxAge time.Duration
+	// go-auth's /auth/ endpoint. When set, a browser session whose jwt
+	// cookie expired is refreshed with its refresh cookie, and the new
+	// cookies are passed on in the response. This only works when the
+	// service and go-auth share a host, so the browser sends them both.
+	RefreshURL string
+	// Used for JWKS and refresh requests, defaults to a client with a
+	// ten second timeout
+	Client *http.Client
+	// Writes the response to requests without a valid token, defaults to
+	// 401 Unauthorized
+	Unauthorized func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+type Middleware struct {
+	conf   Config
+	client *http.Client
+	keys   *keySet
+}
+
+func New(c Config) (*Middleware, error) {
+	if c.Secret == "" && c.JWKSURL == "" {
+		return nil, errors.New("a secret or JWKS URL is required")
+	}
+	m := &Middleware{conf: c, client: c.Client}
+	if m.client == nil {
+		m.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if c.JWKSURL != "" {
+		m.keys = newKeySet(m.client, c.JWKSURL, c.JWKSMaxAge)
+	}
+	if m.conf.Unauthorized == nil {
+		m.conf.Unauthorized = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+	}
+	return m, nil
+}
+
+// Verify validates a session token
+func (m *Middleware) Verify(ctx context.Context, tokenString string) (*jwt.JWTClaims, error) {
+	return jwt.ParseJWTClaims(tokenString, func(token *gojwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			if m.conf.Secret == "" || token.Method != gojwt.SigningMethodHS256 {
+				return nil, errors.New("token has no key id")
+			}
+			return []byte(m.conf.Secret), nil
+		}
+		if m.keys == nil {
+			return nil, fmt.Errorf("unknown signing key %s", kid)
+		}
+		if token.Method != gojwt.SigningMethodES256 {
+			return nil, fmt.Errorf("token algorithm %s does not match key %s", token.Method.Alg(), kid)
+		}
+		return m.keys.get(ctx, kid)
+	})
+}
+
+// Token returns the bearer token of a request, or its jwt cookie
+func Token(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", errors.New("invalid authorization header")
+		}
+		return token, nil
+	}
+	cookie, err := r.Cookie("jwt")
+	if err != nil {
+		return "", ErrNoToken
+	}
+	return cookie.Value, nil
+}
+
+// Authenticate returns the claims of the request's token, refreshing the
+// session through go-auth if it has expired and RefreshURL is set
+func (m *Middleware) Authenticate(w http.ResponseWriter, r *http.Request) (*jwt.JWTClaims, error) {
+	token, err := Token(r)
+	if err == nil {
+		var claims *jwt.JWTClaims
+		claims, err = m.Verify(r.Context(), token)
+		if err == nil {
+			return claims, nil
+		}
+	}
+	if m.conf.RefreshURL == "" || r.Header.Get("Authorization") != "" {
+		return nil, err
+	}
+	refreshCookie, cookieErr := r.Cookie("refresh")
+	if cookieErr != nil {
+		return nil, err
+	}
+	return m.refresh(w, r, refreshCookie)
+}
+
+// Ask go-auth for a new session and pass its cookies on to the browser
+func (m *Middleware) refresh(w http.ResponseWriter, r *http.Request, refreshCookie *http.Cookie) (*jwt.JWTClaims, error) {
+	req, err := http.NewRequestWithContext(r.Context(), "GET", m.conf.RefreshURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.AddCookie(refreshCookie)
+	res, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("refresh failed: %w", err)
+	}
+	defer res.Body.Close()
+	// expired sessions are cleared as well as refreshed ones set
+	for _, cookie := range res.Header.Values("Set-Cookie") {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("refresh failed: %s", res.Status)
+	}
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == "jwt" {
+			return m.Verify(r.Context(), cookie.Value)
+		}
+	}
+	return nil, errors.New("refresh did not return a token")
+}
+
+// Require rejects requests without a valid token and puts the claims of
+// the others in their context
+func (m *Middleware) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := m.Authenticate(w, r)
+		if err != nil {
+			m.conf.Unauthorized(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), claims)))
+	})
+}
+
+// Optional puts the claims of a valid token in the request context, and
+// passes requests without one on unchanged
+func (m *Middleware) Optional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := m.Authenticate(w, r)
+		if err == nil {
+			r = r.WithContext(NewContext(r.Context(), claims))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
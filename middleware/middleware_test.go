@@ -0,0 +1,293 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/audit"
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/handlers"
+	"github.com/cheebz/go-auth/hash"
+	"github.com/cheebz/go-auth/jwt"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/policy"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/cheebz/go-auth/responses"
+	"github.com/google/uuid"
+)
+
+var testUser = models.User{ID: 1, Username: "alice", UUID: uuid.New().String()}
+
+// Echo the username in the context, or "anonymous"
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		w.Write([]byte("anonymous"))
+		return
+	}
+	w.Write([]byte(claims.Username))
+})
+
+func serve(handler http.Handler, token string, bearer bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	if bearer {
+		r.Header.Set("Authorization", "Bearer "+token)
+	} else if token != "" {
+		r.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestSecret(t *testing.T) {
+	helper := jwt.NewJWTHelper("secret", 20, 3600)
+	token, err := helper.CreateJWT(testUser, []models.Group{{ID: 2, Name: "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := helper.CreateRefresh(testUser.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordChange, err := helper.CreatePasswordChange(testUser.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	federation, err := helper.CreateFederation(jwt.FederationClaims{Provider: "google", UserID: testUser.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Config{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bearer := range []bool{false, true} {
+		w := serve(m.Require(whoami), token.Value, bearer)
+		if w.Code != http.StatusOK || w.Body.String() != "alice" {
+			t.Fatal("valid token rejected", bearer, w.Code, w.Body)
+		}
+	}
+	for name, value := range map[string]string{
+		"missing":         "",
+		"garbage":         "not a token",
+		"refresh":         refresh.Value,
+		"password change": passwordChange,
+		"federation":      federation,
+	} {
+		w := serve(m.Require(whoami), value, false)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatal(name, "token accepted", w.Code)
+		}
+	}
+	w := serve(m.Optional(whoami), "", false)
+	if w.Code != http.StatusOK || w.Body.String() != "anonymous" {
+		t.Fatal("optional request without token rejected", w.Code, w.Body)
+	}
+
+	w = serve(m.Require(RequireGroup("admin")(whoami)), token.Value, false)
+	if w.Code != http.StatusOK {
+		t.Fatal("admin rejected", w.Code)
+	}
+	w = serve(m.Require(RequireAnyGroup("billing", "support")(whoami)), token.Value, true)
+	if w.Code != http.StatusForbidden {
+		t.Fatal("user without group allowed", w.Code)
+	}
+	w = serve(RequireGroup("admin")(whoami), token.Value, false)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("group checked without claims", w.Code)
+	}
+
+	_, err = New(Config{})
+	if err == nil {
+		t.Fatal("created middleware without keys")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	helper := jwt.NewJWTHelper("", 20, 3600)
+	key, err := jwt.GenerateKey(jwt.ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = helper.SetKeys([]models.SigningKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(helper.JWKS())
+	}))
+	defer server.Close()
+	token, err := helper.CreateJWT(testUser, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(Config{JWKSURL: server.URL, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		w := serve(m.Require(whoami), token.Value, true)
+		if w.Code != http.StatusOK || w.Body.String() != "alice" {
+			t.Fatal("token signed with published key rejected", w.Code, w.Body)
+		}
+	}
+	if fetches != 1 {
+		t.Fatal("keys not cached", fetches)
+	}
+
+	// an HS256 token claiming the published key must not verify with the secret
+	other := jwt.NewJWTHelper("secret", 20, 3600)
+	secret, err := jwt.GenerateKey(jwt.HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.KID = key.KID
+	err = other.SetKeys([]models.SigningKey{secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := other.CreateJWT(testUser, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(m.Require(whoami), forged.Value, true)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("token with mismatched algorithm accepted", w.Code)
+	}
+}
+
+func TestJWKSRefreshInBackground(t *testing.T) {
+	helper := jwt.NewJWTHelper("", 20, 3600)
+	key, err := jwt.GenerateKey(jwt.ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = helper.SetKeys([]models.SigningKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := json.Marshal(helper.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stall := make(chan struct{})
+	stalled := make(chan struct{}, 1)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if fetches > 1 {
+			select {
+			case stalled <- struct{}{}:
+			default:
+			}
+			<-stall
+		}
+		w.Write(jwks)
+	}))
+	defer server.Close()
+	defer close(stall)
+	token, err := helper.CreateJWT(testUser, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(Config{JWKSURL: server.URL, JWKSMaxAge: time.Nanosecond, Client: &http.Client{Timeout: 2 * time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(m.Require(whoami), token.Value, true)
+	if w.Code != http.StatusOK {
+		t.Fatal("token signed with published key rejected", w.Code, w.Body)
+	}
+	// the keys are stale and go-auth hangs, the cached key is still used
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		w = serve(m.Require(whoami), token.Value, true)
+		if w.Code != http.StatusOK {
+			t.Fatal("token rejected while the keys were fetched", w.Code, w.Body)
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("token checks waited for the fetch", time.Since(start))
+	}
+	<-stalled
+}
+
+func TestRefresh(t *testing.T) {
+	conf := config.Configuration{JWTKey: "secret", JWTMaxAge: 1200, RefreshMaxAge: 3600, Register: true}
+	repo := repositories.NewMemoryRepository(conf)
+	hasher := hash.NewMultiHash(hash.NewArgon2Hash(1024, 1, 1))
+	handler := handlers.NewMuxHandler(handlers.MuxHandlerConfig{
+		Conf:      conf,
+		Resp:      responses.NewAuthResponses(true),
+		Hasher:    hasher,
+		Policy:    &policy.Policy{MinLength: 8},
+		Repo:      repo,
+		JWT:       jwt.NewJWTHelper(conf.JWTKey, conf.JWTMaxAge, conf.RefreshMaxAge),
+		Templates: template.Must(template.ParseGlob("../templates/*.html")),
+		Audit:     audit.NewLogger(false),
+	})
+	server := httptest.NewServer(handler.GetRouter())
+	defer server.Close()
+	password, err := hasher.Generate("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.CreateUser(context.Background(), models.User{Username: "alice", Password: password, UUID: uuid.New().String(), Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.PostForm(server.URL+"/auth/login", url.Values{"username": {"alice"}, "password": {"correct horse"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	var refreshCookie *http.Cookie
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == "refresh" {
+			refreshCookie = cookie
+		}
+	}
+	if refreshCookie == nil {
+		t.Fatal("login did not set a refresh cookie")
+	}
+
+	m, err := New(Config{Secret: "secret", RefreshURL: server.URL + "/auth/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(refreshCookie)
+	w := httptest.NewRecorder()
+	m.Require(whoami).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Fatal("session not refreshed", w.Code, w.Body)
+	}
+	cookies := strings.Join(w.Header().Values("Set-Cookie"), "\n")
+	if !strings.Contains(cookies, "jwt=") || !strings.Contains(cookies, "refresh=") {
+		t.Fatal("refreshed cookies not passed on", cookies)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "refresh", Value: "invalid"})
+	w = httptest.NewRecorder()
+	m.Require(whoami).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("invalid refresh cookie accepted", w.Code)
+	}
+}
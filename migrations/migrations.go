@@ -0,0 +1,195 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var sqlFS embed.FS
+
+// Migration is a single versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status of a migration in a database
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Migrator interface {
+	Up(ctx context.Context) error
+	Down(ctx context.Context, steps int) error
+	Status(ctx context.Context) ([]Status, error)
+}
+
+// Load migrations from files named <version>_<name>.up.sql and
+// <version>_<name>.down.sql, ordered by version
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var direction string
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name: %s", name)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version: %s", name)
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[1] {
+			return nil, fmt.Errorf("conflicting names for migration %d: %s, %s", version, m.Name, parts[1])
+		}
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("missing up migration for version %d", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// PSQLMigrations are the embedded Postgres migrations
+func PSQLMigrations() ([]Migration, error) {
+	return Load(sqlFS, "postgres")
+}
+
+// SQLiteMigrations are the embedded SQLite migrations
+func SQLiteMigrations() ([]Migration, error) {
+	return Load(sqlFS, "sqlite")
+}
+
+// session is a locked connection to a database that tracks migrations
+type session interface {
+	applied(ctx context.Context) (map[int]time.Time, error)
+	// run a migration script and record it in the same transaction
+	apply(ctx context.Context, script string, version int, name string, up bool) error
+}
+
+// backend serializes migration sessions for a database
+type backend interface {
+	withLock(ctx context.Context, fn func(s session) error) error
+}
+
+// migrator applies migrations through a database specific backend
+type migrator struct {
+	backend    backend
+	migrations []Migration
+}
+
+// Apply all pending migrations
+func (m *migrator) Up(ctx context.Context) error {
+	return m.backend.withLock(ctx, func(s session) error {
+		applied, err := s.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			log.Printf("Applying migration %04d_%s\n", migration.Version, migration.Name)
+			err = s.apply(ctx, migration.Up, migration.Version, migration.Name, true)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Revert the most recently applied migrations
+func (m *migrator) Down(ctx context.Context, steps int) error {
+	return m.backend.withLock(ctx, func(s session) error {
+		applied, err := s.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %04d_%s cannot be reverted", migration.Version, migration.Name)
+			}
+			log.Printf("Reverting migration %04d_%s\n", migration.Version, migration.Name)
+			err = s.apply(ctx, migration.Down, migration.Version, migration.Name, false)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+func (m *migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.backend.withLock(ctx, func(s session) error {
+		applied, err := s.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			appliedAt, ok := applied[migration.Version]
+			statuses = append(statuses, Status{
+				Migration: migration,
+				Applied:   ok,
+				AppliedAt: appliedAt,
+			})
+		}
+		return nil
+	})
+	return statuses, err
+}
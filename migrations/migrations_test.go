@@ -0,0 +1,57 @@
+package migrations
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/0002_second.up.sql":   {Data: []byte("CREATE TABLE b ();")},
+		"sql/0002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"sql/0001_first.up.sql":    {Data: []byte("CREATE TABLE a ();")},
+		"sql/README.md":            {Data: []byte("ignored")},
+	}
+	migrations, err := Load(fsys, "sql")
+	if err != nil {
+		t.Fatal("failed to load migrations", err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+	if migrations[0].Version != 1 || migrations[0].Name != "first" || migrations[0].Down != "" {
+		t.Fatal("unexpected first migration", migrations[0])
+	}
+	if migrations[1].Version != 2 || migrations[1].Down != "DROP TABLE b;" {
+		t.Fatal("unexpected second migration", migrations[1])
+	}
+
+	fsys["sql/0003_orphan.down.sql"] = &fstest.MapFile{Data: []byte("DROP TABLE c;")}
+	_, err = Load(fsys, "sql")
+	if err == nil {
+		t.Fatal("loaded migration without up script")
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	loaders := map[string]func() ([]Migration, error){
+		"postgres": PSQLMigrations,
+		"sqlite":   SQLiteMigrations,
+	}
+	for name, load := range loaders {
+		t.Run(name, func(t *testing.T) {
+			migrations, err := load()
+			if err != nil {
+				t.Fatal("failed to load embedded migrations", err)
+			}
+			for i, m := range migrations {
+				if m.Version != i+1 {
+					t.Fatalf("migration versions are not sequential at %04d_%s", m.Version, m.Name)
+				}
+				if m.Down == "" {
+					t.Fatalf("migration %04d_%s has no down script", m.Version, m.Name)
+				}
+			}
+		})
+	}
+}
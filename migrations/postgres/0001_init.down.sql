@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS public.password_history;
+DROP TABLE IF EXISTS public.user_groups;
+DROP TABLE IF EXISTS public.user_refresh;
+DROP TABLE IF EXISTS public."groups";
+DROP TABLE IF EXISTS public.users;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS public.users_username_key;
@@ -0,0 +1,24 @@
+-- Databases created by init_db.sql allowed duplicate usernames, and the
+-- index can't be created while they exist. Rename or delete the users this
+-- reports, keeping the one that should own the name, e.g.
+--   UPDATE public.users SET username = username || '-' || id WHERE id = <id>;
+-- and run the migrations again.
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(format('%s (ids %s)', username, ids), ', ')
+	INTO duplicates
+	FROM (
+		SELECT username, string_agg(id::text, ', ' ORDER BY id) AS ids
+		FROM public.users
+		GROUP BY username
+		HAVING count(*) > 1
+	) d;
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'duplicate usernames: %. Rename or delete the duplicate users, then run the migrations again', duplicates;
+	END IF;
+END
+$$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON public.users USING btree (username);
@@ -0,0 +1,18 @@
+-- public.audit_log definition
+-- user_id has no foreign key so events outlive deleted users
+
+CREATE TABLE IF NOT EXISTS public.audit_log (
+	id bigserial NOT NULL,
+	"time" timestamptz NOT NULL,
+	"type" varchar NOT NULL,
+	user_id int4 NULL,
+	uuid text NULL,
+	username varchar NULL,
+	ip varchar NOT NULL,
+	user_agent text NOT NULL,
+	request_id text NOT NULL,
+	details jsonb NULL,
+	CONSTRAINT audit_log_pkey PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS audit_log_time ON public.audit_log USING btree ("time");
+CREATE INDEX IF NOT EXISTS audit_log_user_id_time ON public.audit_log USING btree (user_id, "time");
@@ -0,0 +1,16 @@
+-- public.webhook_outbox definition
+-- Rows are written in the same transaction as the change they describe
+
+CREATE TABLE IF NOT EXISTS public.webhook_outbox (
+	id bigserial NOT NULL,
+	endpoint text NOT NULL,
+	event_type varchar NOT NULL,
+	payload jsonb NOT NULL,
+	created timestamptz NOT NULL,
+	status varchar NOT NULL DEFAULT 'pending',
+	attempts int4 NOT NULL DEFAULT 0,
+	next_attempt timestamptz NOT NULL,
+	last_error text NULL,
+	CONSTRAINT webhook_outbox_pkey PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS webhook_outbox_pending ON public.webhook_outbox USING btree (next_attempt) WHERE status = 'pending';
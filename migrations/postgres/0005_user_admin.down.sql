@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.signing_keys;
+DROP INDEX IF EXISTS public.groups_name_key;
+ALTER TABLE public.users DROP COLUMN IF EXISTS disabled;
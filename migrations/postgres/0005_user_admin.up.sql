@@ -0,0 +1,15 @@
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS disabled boolean NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX IF NOT EXISTS groups_name_key ON public."groups" USING btree ("name");
+
+
+-- public.signing_keys definition
+-- The newest key signs tokens, every key verifies them
+
+CREATE TABLE IF NOT EXISTS public.signing_keys (
+	kid text NOT NULL,
+	algorithm varchar NOT NULL,
+	"key" text NOT NULL,
+	created timestamptz NOT NULL,
+	CONSTRAINT signing_keys_pkey PRIMARY KEY (kid)
+);
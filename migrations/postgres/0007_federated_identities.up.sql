@@ -0,0 +1,17 @@
+-- public.federated_identities definition
+-- Links a subject at an external identity provider to a local user
+
+CREATE TABLE IF NOT EXISTS public.federated_identities (
+	id serial NOT NULL,
+	user_id int4 NOT NULL,
+	provider varchar NOT NULL,
+	subject text NOT NULL,
+	email text NULL,
+	created timestamptz NOT NULL,
+	CONSTRAINT federated_identities_pkey PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS federated_identities_provider_subject_key ON public.federated_identities USING btree (provider, subject);
+CREATE UNIQUE INDEX IF NOT EXISTS federated_identities_user_id_provider_key ON public.federated_identities USING btree (user_id, provider);
+
+ALTER TABLE public.federated_identities DROP CONSTRAINT IF EXISTS fki_federated_identities_user_id;
+ALTER TABLE public.federated_identities ADD CONSTRAINT fki_federated_identities_user_id FOREIGN KEY (user_id) REFERENCES public.users(id);
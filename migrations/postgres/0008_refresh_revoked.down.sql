@@ -0,0 +1 @@
+ALTER TABLE public.user_refresh DROP COLUMN IF EXISTS revoked;
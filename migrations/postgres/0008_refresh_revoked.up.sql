@@ -0,0 +1,3 @@
+-- Invalidated refresh tokens are kept until they expire, so a token that is
+-- presented again after the grace period is reported as reused
+ALTER TABLE public.user_refresh ADD COLUMN IF NOT EXISTS revoked timestamptz NULL;
@@ -0,0 +1,101 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Arbitrary key for the advisory lock that serializes migrations across replicas
+const psqlLockKey = 7263548190
+
+type psqlBackend struct {
+	db *pgxpool.Pool
+}
+
+type psqlSession struct {
+	conn *pgxpool.Conn
+}
+
+func NewPSQLMigrator(db *pgxpool.Pool) (Migrator, error) {
+	migrations, err := PSQLMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{
+		backend:    &psqlBackend{db: db},
+		migrations: migrations,
+	}, nil
+}
+
+// Hold a session-level advisory lock so concurrent replicas don't race
+func (b *psqlBackend) withLock(ctx context.Context, fn func(s session) error) error {
+	conn, err := b.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1);", psqlLockKey)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1);", psqlLockKey)
+		if err != nil {
+			log.Println("failed to release migration lock", err)
+		}
+	}()
+	sql := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint NOT NULL,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT current_timestamp,
+		CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+	);`
+	_, err = conn.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+	return fn(&psqlSession{conn: conn})
+}
+
+func (s *psqlSession) applied(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := s.conn.Query(ctx, "SELECT version, applied_at FROM schema_migrations;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func (s *psqlSession) apply(ctx context.Context, script string, version int, name string, up bool) error {
+	tx, err := s.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, script)
+	if err != nil {
+		return err
+	}
+	if up {
+		_, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2);", version, name)
+	} else {
+		_, err = tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1;", version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
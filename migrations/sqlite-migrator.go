@@ -0,0 +1,85 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type sqliteBackend struct {
+	db *sql.DB
+}
+
+type sqliteSession struct {
+	conn *sql.Conn
+}
+
+func NewSQLiteMigrator(db *sql.DB) (Migrator, error) {
+	migrations, err := SQLiteMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{
+		backend:    &sqliteBackend{db: db},
+		migrations: migrations,
+	}, nil
+}
+
+// SQLite serializes writers itself, so a dedicated connection is enough
+func (b *sqliteBackend) withLock(ctx context.Context, fn func(s session) error) error {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	);`
+	_, err = conn.ExecContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	return fn(&sqliteSession{conn: conn})
+}
+
+func (s *sqliteSession) applied(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := s.conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func (s *sqliteSession) apply(ctx context.Context, script string, version int, name string, up bool) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?);", version, name, time.Now().UTC())
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?;", version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS password_history;
+DROP TABLE IF EXISTS user_groups;
+DROP TABLE IF EXISTS user_refresh;
+DROP TABLE IF EXISTS groups;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL,
+	password TEXT NOT NULL,
+	created TIMESTAMP NOT NULL,
+	uuid TEXT NOT NULL,
+	password_changed TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS groups (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL
+);
+
+INSERT INTO groups (name)
+SELECT name FROM (SELECT 'public' AS name UNION ALL SELECT 'admin')
+WHERE NOT EXISTS (SELECT * FROM groups);
+
+-- expires is stored as unix seconds
+CREATE TABLE IF NOT EXISTS user_refresh (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	jti TEXT NOT NULL,
+	expires INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_groups (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	group_id INTEGER NOT NULL REFERENCES groups(id)
+);
+CREATE INDEX IF NOT EXISTS fki_user_groups_group_id ON user_groups (group_id);
+CREATE INDEX IF NOT EXISTS fki_user_groups_user_id ON user_groups (user_id);
+
+CREATE TABLE IF NOT EXISTS password_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	password TEXT NOT NULL,
+	created TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS fki_password_history_user_id ON password_history (user_id);
@@ -0,0 +1,15 @@
+-- user_id has no foreign key so events outlive deleted users
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TIMESTAMP NOT NULL,
+	type TEXT NOT NULL,
+	user_id INTEGER,
+	uuid TEXT,
+	username TEXT,
+	ip TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	request_id TEXT NOT NULL,
+	details TEXT
+);
+CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
+CREATE INDEX IF NOT EXISTS audit_log_user_id_time ON audit_log (user_id, time);
@@ -0,0 +1,14 @@
+-- Rows are written in the same transaction as the change they describe
+-- next_attempt is stored as unix seconds
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	endpoint TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	created TIMESTAMP NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt INTEGER NOT NULL,
+	last_error TEXT
+);
+CREATE INDEX IF NOT EXISTS webhook_outbox_pending ON webhook_outbox (next_attempt) WHERE status = 'pending';
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS signing_keys;
+DROP INDEX IF EXISTS groups_name_key;
+ALTER TABLE users DROP COLUMN disabled;
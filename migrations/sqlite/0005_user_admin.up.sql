@@ -0,0 +1,11 @@
+ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT 0;
+
+CREATE UNIQUE INDEX IF NOT EXISTS groups_name_key ON groups (name);
+
+-- The newest key signs tokens, every key verifies them
+CREATE TABLE IF NOT EXISTS signing_keys (
+	kid TEXT PRIMARY KEY,
+	algorithm TEXT NOT NULL,
+	key TEXT NOT NULL,
+	created TIMESTAMP NOT NULL
+);
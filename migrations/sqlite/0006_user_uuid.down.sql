@@ -0,0 +1 @@
+DROP INDEX IF EXISTS users_uuid_idx;
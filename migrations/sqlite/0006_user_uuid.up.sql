@@ -0,0 +1,2 @@
+-- users are looked up by uuid over gRPC
+CREATE INDEX IF NOT EXISTS users_uuid_idx ON users (uuid);
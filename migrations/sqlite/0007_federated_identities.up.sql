@@ -0,0 +1,11 @@
+-- Links a subject at an external identity provider to a local user
+CREATE TABLE IF NOT EXISTS federated_identities (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	email TEXT,
+	created TIMESTAMP NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS federated_identities_provider_subject_key ON federated_identities (provider, subject);
+CREATE UNIQUE INDEX IF NOT EXISTS federated_identities_user_id_provider_key ON federated_identities (user_id, provider);
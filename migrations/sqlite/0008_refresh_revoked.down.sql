@@ -0,0 +1 @@
+ALTER TABLE user_refresh DROP COLUMN revoked;
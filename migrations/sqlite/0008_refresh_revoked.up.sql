@@ -0,0 +1,4 @@
+-- Invalidated refresh tokens are kept until they expire, so a token that is
+-- presented again after the grace period is reported as reused
+-- revoked is stored as unix seconds
+ALTER TABLE user_refresh ADD COLUMN revoked INTEGER;
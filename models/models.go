@@ -6,11 +6,13 @@ import (
 
 // User struct -- This is the user model
 type User struct {
-	ID       int       `json:"id"`
-	Username string    `json:"username"`
-	Password string    `json:"password"`
-	Created  time.Time `json:"created"`
-	UUID     string    `json:"uuid"`
+	ID              int       `json:"id"`
+	Username        string    `json:"username"`
+	Password        string    `json:"password"`
+	Created         time.Time `json:"created"`
+	UUID            string    `json:"uuid"`
+	PasswordChanged time.Time `json:"password_changed"`
+	Disabled        bool      `json:"disabled"`
 }
 
 // Group struct -- This is the group model
@@ -19,9 +21,86 @@ type Group struct {
 	Name string `json:"name"`
 }
 
+// UserImport struct -- A user written by a bulk import along with the IDs
+// of the groups it belongs to
+type UserImport struct {
+	User     User
+	GroupIDs []int
+}
+
+// FederatedIdentity struct -- Links the subject of an external identity
+// provider to a local user
+type FederatedIdentity struct {
+	ID       int       `json:"id"`
+	UserID   int       `json:"user_id"`
+	Provider string    `json:"provider"`
+	Subject  string    `json:"subject"`
+	Email    string    `json:"email,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// SigningKey struct -- A key used to sign tokens. Key holds the PEM encoded
+// private key, or the base64 encoded secret for HMAC algorithms.
+type SigningKey struct {
+	KID       string    `json:"kid"`
+	Algorithm string    `json:"algorithm"`
+	Key       string    `json:"-"`
+	Created   time.Time `json:"created"`
+}
+
 // Auth struct that is returned to user upon authentication
 type Auth struct {
 	Username string  `json:"username"`
 	UUID     string  `json:"uuid"`
 	Groups   []Group `json:"groups"`
 }
+
+// AuditEvent struct -- A security event recorded by the audit log
+type AuditEvent struct {
+	ID        int64             `json:"id,omitempty"`
+	Time      time.Time         `json:"time"`
+	Type      string            `json:"type"`
+	UserID    int               `json:"user_id,omitempty"`
+	UUID      string            `json:"uuid,omitempty"`
+	Username  string            `json:"username,omitempty"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	RequestID string            `json:"request_id"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// AuditFilter struct -- Criteria for querying the audit log, zero values match everything
+type AuditFilter struct {
+	UserID int
+	Type   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// Webhook struct -- An outgoing webhook waiting in the outbox
+type Webhook struct {
+	ID          int64
+	Endpoint    string
+	EventType   string
+	Payload     []byte
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+}
+
+// WebhookEvent struct -- The JSON payload delivered to webhook endpoints
+type WebhookEvent struct {
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Created time.Time   `json:"created"`
+	User    WebhookUser `json:"user"`
+	Group   *Group      `json:"group,omitempty"`
+}
+
+// WebhookUser struct -- The user a webhook event is about
+type WebhookUser struct {
+	ID       int    `json:"id"`
+	UUID     string `json:"uuid"`
+	Username string `json:"username"`
+}
@@ -0,0 +1,166 @@
+package policy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Corpus of breached passwords
+type Corpus interface {
+	Contains(password string) bool
+}
+
+// SHA1Corpus holds the exact SHA-1 hashes of a breached-password corpus.
+// It takes about 50 bytes of memory per hash, so large corpora belong in a
+// BloomFilter.
+type SHA1Corpus struct {
+	hashes map[[sha1.Size]byte]struct{}
+}
+
+// LoadSHA1Corpus reads a corpus from a file of SHA-1 hashes, one per line
+// and optionally suffixed with ":<count>", or from a directory of
+// k-anonymity range files named by their 5 character hash prefix, each
+// holding "<suffix>:<count>" lines
+func LoadSHA1Corpus(path string) (*SHA1Corpus, error) {
+	c := &SHA1Corpus{hashes: make(map[[sha1.Size]byte]struct{})}
+	err := scanSHA1Corpus(path, func(sum [sha1.Size]byte) {
+		c.hashes[sum] = struct{}{}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *SHA1Corpus) Contains(password string) bool {
+	_, ok := c.hashes[sha1.Sum([]byte(password))]
+	return ok
+}
+
+// BloomFilter is a compact, probabilistic breached-password corpus that
+// never misses a breached password but may reject a small fraction of others
+type BloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+func NewBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// LoadBloomFilter builds a BloomFilter from a corpus in any format
+// accepted by LoadSHA1Corpus
+func LoadBloomFilter(path string, falsePositiveRate float64) (*BloomFilter, error) {
+	n := 0
+	err := scanSHA1Corpus(path, func(sum [sha1.Size]byte) {
+		n++
+	})
+	if err != nil {
+		return nil, err
+	}
+	b := NewBloomFilter(n, falsePositiveRate)
+	err = scanSHA1Corpus(path, b.Add)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *BloomFilter) Add(sum [sha1.Size]byte) {
+	h1, h2 := bloomHashes(sum)
+	for i := uint64(0); i < b.k; i++ {
+		idx := (h1 + i*h2) % b.m
+		b.bits[idx/64] |= 1 << (idx % 64)
+	}
+}
+
+func (b *BloomFilter) Contains(password string) bool {
+	h1, h2 := bloomHashes(sha1.Sum([]byte(password)))
+	for i := uint64(0); i < b.k; i++ {
+		idx := (h1 + i*h2) % b.m
+		if b.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SHA-1 output is uniformly distributed, so it can seed double hashing directly
+func bloomHashes(sum [sha1.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+func scanSHA1Corpus(path string, fn func([sha1.Size]byte)) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return scanSHA1File(path, "", fn)
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		prefix := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		if len(prefix) != 5 {
+			continue
+		}
+		err = scanSHA1File(filepath.Join(path, f.Name()), prefix, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanSHA1File(path string, prefix string, fn func([sha1.Size]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		entry = prefix + strings.SplitN(entry, ":", 2)[0]
+		var sum [sha1.Size]byte
+		b, err := hex.DecodeString(entry)
+		if err != nil || len(b) != sha1.Size {
+			return fmt.Errorf("%s:%d: invalid SHA-1 hash", path, line)
+		}
+		copy(sum[:], b)
+		fn(sum)
+	}
+	return scanner.Err()
+}
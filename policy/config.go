@@ -0,0 +1,47 @@
+package policy
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/cheebz/go-auth/config"
+)
+
+const bloomFalsePositiveRate = 0.001
+
+// NewConfiguredPolicy creates a Policy from configuration, loading the
+// banned and breached password lists from disk
+func NewConfiguredPolicy(c config.PasswordConfig) (*Policy, error) {
+	p := &Policy{
+		MinLength:      c.MinLength,
+		MaxLength:      c.MaxLength,
+		Banned:         make(map[string]bool),
+		RejectUsername: c.RejectUsername,
+	}
+	banned := strings.Split(c.Banned, ",")
+	if c.BannedFile != "" {
+		b, err := ioutil.ReadFile(c.BannedFile)
+		if err != nil {
+			return nil, err
+		}
+		banned = append(banned, strings.Split(string(b), "\n")...)
+	}
+	for _, password := range banned {
+		password = strings.TrimSpace(password)
+		if password != "" {
+			p.Banned[strings.ToLower(password)] = true
+		}
+	}
+	if c.BreachedFile != "" {
+		var err error
+		if c.BreachedBloom {
+			p.BreachedCorpus, err = LoadBloomFilter(c.BreachedFile, bloomFalsePositiveRate)
+		} else {
+			p.BreachedCorpus, err = LoadSHA1Corpus(c.BreachedFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
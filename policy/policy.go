@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Violation codes
+const (
+	TooShort        = "too_short"
+	TooLong         = "too_long"
+	Banned          = "banned"
+	SimilarUsername = "similar_to_username"
+	Breached        = "breached"
+)
+
+// Violation of a single password policy rule
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is returned when a password violates one or more policy rules
+type Error struct {
+	Violations []Violation
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Message
+	}
+	return fmt.Sprintf("password does not meet policy: %s", strings.Join(msgs, "; "))
+}
+
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Error      string      `json:"error"`
+		Violations []Violation `json:"violations"`
+	}{
+		Error:      "password does not meet policy",
+		Violations: e.Violations,
+	})
+}
+
+// Policy for new passwords
+type Policy struct {
+	MinLength      int
+	MaxLength      int
+	Banned         map[string]bool
+	RejectUsername bool
+	BreachedCorpus Corpus
+}
+
+// Check a new password for the given user against the policy
+func (p *Policy) Check(username, password string) error {
+	var violations []Violation
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, Violation{
+			Code:    TooShort,
+			Message: fmt.Sprintf("password must be at least %d characters", p.MinLength),
+		})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, Violation{
+			Code:    TooLong,
+			Message: fmt.Sprintf("password must be at most %d characters", p.MaxLength),
+		})
+	}
+	if p.Banned[strings.ToLower(password)] {
+		violations = append(violations, Violation{
+			Code:    Banned,
+			Message: "password is too common",
+		})
+	}
+	if p.RejectUsername && similarToUsername(username, password) {
+		violations = append(violations, Violation{
+			Code:    SimilarUsername,
+			Message: "password is too similar to username",
+		})
+	}
+	if p.BreachedCorpus != nil && p.BreachedCorpus.Contains(password) {
+		violations = append(violations, Violation{
+			Code:    Breached,
+			Message: "password has appeared in a data breach",
+		})
+	}
+	if len(violations) > 0 {
+		return &Error{Violations: violations}
+	}
+	return nil
+}
+
+// A password is too similar if it contains the username, forwards or reversed.
+// Very short usernames are ignored, since almost any password would match.
+func similarToUsername(username, password string) bool {
+	u := strings.ToLower(username)
+	p := strings.ToLower(password)
+	if utf8.RuneCountInString(u) < 3 {
+		return false
+	}
+	return strings.Contains(p, u) || strings.Contains(p, reverse(u))
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func violationCodes(err error) []string {
+	var policyErr *Error
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+	var codes []string
+	for _, v := range policyErr.Violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func TestPolicy(t *testing.T) {
+	p := &Policy{
+		MinLength:      8,
+		MaxLength:      16,
+		Banned:         map[string]bool{"password1": true},
+		RejectUsername: true,
+	}
+	tests := map[string]struct {
+		username string
+		password string
+		codes    []string
+	}{
+		"valid":    {"alice", "correct horse", nil},
+		"short":    {"alice", "a", []string{TooShort}},
+		"long":     {"alice", "correct horse battery staple", []string{TooLong}},
+		"banned":   {"alice", "Password1", []string{Banned}},
+		"username": {"alice", "alice12345", []string{SimilarUsername}},
+		"reversed": {"alice", "12345ecila", []string{SimilarUsername}},
+		"multiple": {"alice", "alice", []string{TooShort, SimilarUsername}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			codes := violationCodes(p.Check(test.username, test.password))
+			if strings.Join(codes, ",") != strings.Join(test.codes, ",") {
+				t.Fatalf("expected violations %v, got %v", test.codes, codes)
+			}
+		})
+	}
+}
+
+func TestBreachedCorpus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	breached := []string{"hunter2", "letmein"}
+	var lines []string
+	for _, password := range breached {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":42")
+	}
+	file := filepath.Join(dir, "corpus.txt")
+	err = ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rangeDir := filepath.Join(dir, "ranges")
+	err = os.Mkdir(rangeDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		err = ioutil.WriteFile(filepath.Join(rangeDir, line[:5]+".txt"), []byte(line[5:]), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sha1File, err := LoadSHA1Corpus(file)
+	if err != nil {
+		t.Fatal("failed to load corpus file", err)
+	}
+	sha1Ranges, err := LoadSHA1Corpus(rangeDir)
+	if err != nil {
+		t.Fatal("failed to load corpus ranges", err)
+	}
+	bloom, err := LoadBloomFilter(file, 0.001)
+	if err != nil {
+		t.Fatal("failed to load bloom filter", err)
+	}
+	corpora := map[string]Corpus{"file": sha1File, "ranges": sha1Ranges, "bloom": bloom}
+	for name, corpus := range corpora {
+		t.Run(name, func(t *testing.T) {
+			for _, password := range breached {
+				if !corpus.Contains(password) {
+					t.Fatalf("corpus does not contain %q", password)
+				}
+			}
+			if corpus.Contains("correct horse battery staple") {
+				t.Fatal("corpus contains unbreached password")
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package repositories
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cheebz/go-auth/models"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+func auditLimit(limit int) int {
+	if limit <= 0 {
+		return defaultAuditLimit
+	}
+	if limit > maxAuditLimit {
+		return maxAuditLimit
+	}
+	return limit
+}
+
+// Build the WHERE clause for an audit filter. placeholder returns the bind
+// parameter for the nth argument.
+func auditWhere(filter models.AuditFilter, placeholder func(n int) string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, placeholder(len(args))))
+	}
+	if filter.UserID != 0 {
+		add("user_id = %s", filter.UserID)
+	}
+	if filter.Type != "" {
+		add("type = %s", filter.Type)
+	}
+	if !filter.Since.IsZero() {
+		add("time >= %s", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		add("time < %s", filter.Until.UTC())
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// Encode details as JSON, or nil to store NULL
+func auditDetails(details map[string]string) (interface{}, error) {
+	if len(details) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Store a zero user ID as NULL
+func nullableUserID(userID int) interface{} {
+	if userID == 0 {
+		return nil
+	}
+	return userID
+}
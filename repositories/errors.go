@@ -0,0 +1,26 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+	// ErrRevoked is returned for a refresh token that was rotated or logged
+	// out and is presented again after the grace period
+	ErrRevoked = errors.New("revoked")
+)
+
+// Invalidated refresh tokens stay valid this long for concurrent requests
+var refreshGracePeriod = 2 * time.Minute
+
+// Bound a repository call by the configured query timeout, in seconds
+func withTimeout(ctx context.Context, timeout int) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+}
@@ -0,0 +1,19 @@
+package repositories
+
+// How ImportUsers handles a username that already exists
+const (
+	// Leave the existing user untouched
+	ImportSkip = "skip"
+	// Replace the password, status and groups of the existing user. Its ID,
+	// UUID and creation time are kept.
+	ImportOverwrite = "overwrite"
+	// Roll back the whole batch with ErrConflict
+	ImportFail = "fail"
+)
+
+// What ImportUsers did with each user
+const (
+	ImportCreated = "created"
+	ImportUpdated = "updated"
+	ImportSkipped = "skipped"
+)
@@ -0,0 +1,53 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Lock is an advisory lock held until it is released or its session is lost
+type Lock interface {
+	// Check returns an error once the lock can no longer be relied on
+	Check(ctx context.Context) error
+	Release(ctx context.Context) error
+}
+
+// processLocks are only visible within this process, which is enough for
+// stores that are not shared between replicas
+type processLocks struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func (l *processLocks) tryLock(name string) (Lock, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[name] {
+		return nil, fmt.Errorf("%w: lock %s is held", ErrConflict, name)
+	}
+	if l.held == nil {
+		l.held = make(map[string]bool)
+	}
+	l.held[name] = true
+	return &processLock{locks: l, name: name}, nil
+}
+
+type processLock struct {
+	locks *processLocks
+	name  string
+	once  sync.Once
+}
+
+func (l *processLock) Check(ctx context.Context) error {
+	return nil
+}
+
+func (l *processLock) Release(ctx context.Context) error {
+	l.once.Do(func() {
+		l.locks.mu.Lock()
+		defer l.locks.mu.Unlock()
+		delete(l.locks.held, l.name)
+	})
+	return nil
+}
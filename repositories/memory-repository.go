@@ -0,0 +1,666 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/models"
+)
+
+type memoryRefresh struct {
+	userID  int
+	expires time.Time
+	// zero until the token is invalidated
+	revoked time.Time
+}
+
+type memoryPassword struct {
+	id       int
+	password string
+	created  time.Time
+}
+
+type memoryWebhook struct {
+	models.Webhook
+	status    string
+	lastError string
+}
+
+// MemoryRepository keeps all data in memory. It is intended for tests and
+// demo mode, and loses everything on restart.
+type MemoryRepository struct {
+	Conf            config.Configuration
+	mu              sync.RWMutex
+	users           map[int]models.User
+	groups          map[int]models.Group
+	userGroups      map[int][]int
+	refresh         map[string]memoryRefresh
+	passwordHistory map[int][]memoryPassword
+	auditLog        []models.AuditEvent
+	webhooks        []memoryWebhook
+	locks           processLocks
+	signingKeys     []models.SigningKey
+	identities      []models.FederatedIdentity
+	nextUserID      int
+	nextGroupID     int
+	nextPasswordID  int
+	nextIdentityID  int
+}
+
+func NewMemoryRepository(conf config.Configuration) Repository {
+	return &MemoryRepository{
+		Conf:  conf,
+		users: make(map[int]models.User),
+		groups: map[int]models.Group{
+			1: {ID: 1, Name: "public"},
+			2: {ID: 2, Name: "admin"},
+		},
+		userGroups:      make(map[int][]int),
+		refresh:         make(map[string]memoryRefresh),
+		passwordHistory: make(map[int][]memoryPassword),
+		nextUserID:      1,
+		nextGroupID:     3,
+		nextPasswordID:  1,
+		nextIdentityID:  1,
+	}
+}
+
+func (r *MemoryRepository) Close() {}
+
+func (r *MemoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (r *MemoryRepository) GetUserByID(ctx context.Context, userID int) (models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	user, ok := r.users[userID]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (r *MemoryRepository) GetUserByName(ctx context.Context, username string) (models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, user := range r.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return models.User{}, ErrNotFound
+}
+
+func (r *MemoryRepository) GetUserByUUID(ctx context.Context, uuid string) (models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, user := range r.users {
+		if user.UUID == uuid {
+			return user, nil
+		}
+	}
+	return models.User{}, ErrNotFound
+}
+
+func (r *MemoryRepository) CreateUser(ctx context.Context, user models.User) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.Username == user.Username {
+			return user, fmt.Errorf("%w: username %s already exists", ErrConflict, user.Username)
+		}
+	}
+	user.ID = r.nextUserID
+	user.PasswordChanged = user.Created
+	err := r.queueWebhooks(WebhookUserRegistered, user, nil)
+	if err != nil {
+		return user, err
+	}
+	r.nextUserID++
+	r.users[user.ID] = user
+	r.userGroups[user.ID] = []int{1}
+	return user, nil
+}
+
+func (r *MemoryRepository) GetUserGroups(ctx context.Context, userID int) ([]models.Group, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var groups []models.Group
+	for _, groupID := range r.userGroups[userID] {
+		groups = append(groups, r.groups[groupID])
+	}
+	return groups, nil
+}
+
+// Move the current password into the history and set a new one
+func (r *MemoryRepository) UpdatePassword(ctx context.Context, userID int, password string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	err := r.queueWebhooks(WebhookUserPasswordChanged, user, nil)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	history := append(r.passwordHistory[userID], memoryPassword{
+		id:       r.nextPasswordID,
+		password: user.Password,
+		created:  now,
+	})
+	r.nextPasswordID++
+	keep := r.Conf.Password.History
+	if keep < 0 {
+		keep = 0
+	}
+	if len(history) > keep {
+		history = history[len(history)-keep:]
+	}
+	r.passwordHistory[userID] = history
+	user.Password = password
+	user.PasswordChanged = now
+	r.users[userID] = user
+	return nil
+}
+
+func (r *MemoryRepository) ReplacePasswordHash(ctx context.Context, userID int, password string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Password = password
+	r.users[userID] = user
+	return nil
+}
+
+// Get previous password hashes, most recent first
+func (r *MemoryRepository) GetPasswordHistory(ctx context.Context, userID int, limit int) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	history := make([]memoryPassword, len(r.passwordHistory[userID]))
+	copy(history, r.passwordHistory[userID])
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].id > history[j].id
+	})
+	var passwords []string
+	for i := 0; i < len(history) && i < limit; i++ {
+		passwords = append(passwords, history[i].password)
+	}
+	return passwords, nil
+}
+
+func (r *MemoryRepository) SaveRefresh(ctx context.Context, userID int, jti string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refresh[jti] = memoryRefresh{
+		userID:  userID,
+		expires: time.Now().Add(time.Duration(r.Conf.RefreshMaxAge) * time.Second),
+	}
+	return nil
+}
+
+func (r *MemoryRepository) ValidateRefresh(ctx context.Context, userID int, jti string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	refresh, ok := r.refresh[jti]
+	now := time.Now()
+	if !ok || refresh.userID != userID || !refresh.expires.After(now) {
+		return ErrNotFound
+	}
+	if !refresh.revoked.IsZero() && !refresh.revoked.After(now) {
+		return ErrRevoked
+	}
+	return nil
+}
+
+// Invalidate refresh to account for concurrent requests
+func (r *MemoryRepository) InvalidateRefresh(ctx context.Context, jti string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	refresh, ok := r.refresh[jti]
+	if !ok || !refresh.revoked.IsZero() {
+		return nil
+	}
+	refresh.revoked = time.Now().Add(refreshGracePeriod)
+	r.refresh[jti] = refresh
+	return nil
+}
+
+func (r *MemoryRepository) DeleteAllRefresh(ctx context.Context, userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for jti, refresh := range r.refresh {
+		if refresh.userID == userID {
+			delete(r.refresh, jti)
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) DeleteExpiredRefresh(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for jti, refresh := range r.refresh {
+		if refresh.expires.Before(now) {
+			delete(r.refresh, jti)
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) CountActiveRefresh(ctx context.Context) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	count := 0
+	now := time.Now()
+	for _, refresh := range r.refresh {
+		if refresh.expires.After(now) && (refresh.revoked.IsZero() || refresh.revoked.After(now)) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *MemoryRepository) SaveAuditEvent(ctx context.Context, event models.AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	event.ID = int64(len(r.auditLog) + 1)
+	r.auditLog = append(r.auditLog, event)
+	return nil
+}
+
+// Newest events first
+func (r *MemoryRepository) GetAuditEvents(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	events := []models.AuditEvent{}
+	for _, event := range r.auditLog {
+		if filter.UserID != 0 && event.UserID != filter.UserID {
+			continue
+		}
+		if filter.Type != "" && event.Type != filter.Type {
+			continue
+		}
+		if !filter.Since.IsZero() && event.Time.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && !event.Time.Before(filter.Until) {
+			continue
+		}
+		events = append(events, event)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Time.Equal(events[j].Time) {
+			return events[i].ID > events[j].ID
+		}
+		return events[i].Time.After(events[j].Time)
+	})
+	if limit := auditLimit(filter.Limit); len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (r *MemoryRepository) AddUserToGroup(ctx context.Context, userID int, groupID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	group, ok := r.groups[groupID]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, id := range r.userGroups[userID] {
+		if id == groupID {
+			return fmt.Errorf("%w: user is already in group", ErrConflict)
+		}
+	}
+	err := r.queueWebhooks(WebhookUserGroupAdded, user, &group)
+	if err != nil {
+		return err
+	}
+	r.userGroups[userID] = append(r.userGroups[userID], groupID)
+	return nil
+}
+
+// Delete a user along with their sessions, groups and password history
+func (r *MemoryRepository) DeleteUser(ctx context.Context, userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	err := r.queueWebhooks(WebhookUserDeleted, user, nil)
+	if err != nil {
+		return err
+	}
+	for jti, refresh := range r.refresh {
+		if refresh.userID == userID {
+			delete(r.refresh, jti)
+		}
+	}
+	delete(r.userGroups, userID)
+	delete(r.passwordHistory, userID)
+	identities := r.identities[:0]
+	for _, identity := range r.identities {
+		if identity.UserID != userID {
+			identities = append(identities, identity)
+		}
+	}
+	r.identities = identities
+	delete(r.users, userID)
+	return nil
+}
+
+// Callers must hold the write lock
+func (r *MemoryRepository) queueWebhooks(eventType string, user models.User, group *models.Group) error {
+	webhooks, err := newWebhooks(r.Conf.Webhook, eventType, user, group)
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		webhook.ID = int64(len(r.webhooks) + 1)
+		r.webhooks = append(r.webhooks, memoryWebhook{Webhook: webhook, status: webhookPending})
+	}
+	return nil
+}
+
+func (r *MemoryRepository) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.Webhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var due []*memoryWebhook
+	for i := range r.webhooks {
+		webhook := &r.webhooks[i]
+		if webhook.status == webhookPending && !webhook.NextAttempt.After(now) {
+			due = append(due, webhook)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+	var webhooks []models.Webhook
+	for i := 0; i < len(due) && i < limit; i++ {
+		due[i].NextAttempt = now.Add(lease)
+		webhooks = append(webhooks, due[i].Webhook)
+	}
+	return webhooks, nil
+}
+
+func (r *MemoryRepository) MarkWebhookDelivered(ctx context.Context, id int64) error {
+	return r.updateWebhook(id, func(webhook *memoryWebhook) {
+		webhook.status = webhookDelivered
+		webhook.lastError = ""
+	})
+}
+
+func (r *MemoryRepository) RetryWebhook(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error {
+	return r.updateWebhook(id, func(webhook *memoryWebhook) {
+		webhook.lastError = lastError
+		webhook.NextAttempt = nextAttempt
+	})
+}
+
+// Give up on a webhook, it stays in the outbox for inspection
+func (r *MemoryRepository) MarkWebhookFailed(ctx context.Context, id int64, lastError string) error {
+	return r.updateWebhook(id, func(webhook *memoryWebhook) {
+		webhook.status = webhookFailed
+		webhook.lastError = lastError
+	})
+}
+
+func (r *MemoryRepository) updateWebhook(id int64, update func(webhook *memoryWebhook)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id < 1 || id > int64(len(r.webhooks)) {
+		return ErrNotFound
+	}
+	webhook := &r.webhooks[id-1]
+	webhook.Attempts++
+	update(webhook)
+	return nil
+}
+
+func (r *MemoryRepository) TryLock(ctx context.Context, name string) (Lock, error) {
+	return r.locks.tryLock(name)
+}
+
+// List users ordered by id, starting after afterID
+func (r *MemoryRepository) ListUsers(ctx context.Context, afterID int, limit int) ([]models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	users := []models.User{}
+	for _, user := range r.users {
+		if user.ID > afterID {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (r *MemoryRepository) SetUserDisabled(ctx context.Context, userID int, disabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Disabled = disabled
+	r.users[userID] = user
+	return nil
+}
+
+func (r *MemoryRepository) CreateGroup(ctx context.Context, name string) (models.Group, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, group := range r.groups {
+		if group.Name == name {
+			return models.Group{Name: name}, fmt.Errorf("%w: group %s already exists", ErrConflict, name)
+		}
+	}
+	group := models.Group{ID: r.nextGroupID, Name: name}
+	r.nextGroupID++
+	r.groups[group.ID] = group
+	return group, nil
+}
+
+func (r *MemoryRepository) GetGroupByName(ctx context.Context, name string) (models.Group, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, group := range r.groups {
+		if group.Name == name {
+			return group, nil
+		}
+	}
+	return models.Group{Name: name}, ErrNotFound
+}
+
+func (r *MemoryRepository) RemoveUserFromGroup(ctx context.Context, userID int, groupID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	groupIDs := r.userGroups[userID]
+	for i, id := range groupIDs {
+		if id == groupID {
+			r.userGroups[userID] = append(groupIDs[:i:i], groupIDs[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *MemoryRepository) SaveSigningKey(ctx context.Context, key models.SigningKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.signingKeys {
+		if k.KID == key.KID {
+			return fmt.Errorf("%w: key %s already exists", ErrConflict, key.KID)
+		}
+	}
+	r.signingKeys = append(r.signingKeys, key)
+	return nil
+}
+
+// Newest keys first
+func (r *MemoryRepository) GetSigningKeys(ctx context.Context) ([]models.SigningKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := make([]models.SigningKey, len(r.signingKeys))
+	copy(keys, r.signingKeys)
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].KID > keys[j].KID
+		}
+		return keys[i].Created.After(keys[j].Created)
+	})
+	return keys, nil
+}
+
+func (r *MemoryRepository) DeleteSigningKey(ctx context.Context, kid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, key := range r.signingKeys {
+		if key.KID == kid {
+			r.signingKeys = append(r.signingKeys[:i:i], r.signingKeys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Check the whole batch before changing anything so it is applied atomically
+func (r *MemoryRepository) ImportUsers(ctx context.Context, users []models.UserImport, onConflict string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing := make(map[string]models.User, len(r.users))
+	for _, user := range r.users {
+		existing[user.Username] = user
+	}
+	outcomes := make([]string, len(users))
+	for i, u := range users {
+		for _, groupID := range u.GroupIDs {
+			if _, ok := r.groups[groupID]; !ok {
+				return nil, ErrNotFound
+			}
+		}
+		if _, ok := existing[u.User.Username]; !ok {
+			outcomes[i] = ImportCreated
+			existing[u.User.Username] = u.User
+			continue
+		}
+		switch onConflict {
+		case ImportSkip:
+			outcomes[i] = ImportSkipped
+		case ImportOverwrite:
+			outcomes[i] = ImportUpdated
+		default:
+			return nil, fmt.Errorf("%w: username %s already exists", ErrConflict, u.User.Username)
+		}
+	}
+	for i, u := range users {
+		user := u.User
+		eventType := WebhookUserRegistered
+		switch outcomes[i] {
+		case ImportSkipped:
+			continue
+		case ImportCreated:
+			user.ID = r.nextUserID
+			r.nextUserID++
+		case ImportUpdated:
+			current := existing[user.Username]
+			user.ID, user.UUID, user.Created = current.ID, current.UUID, current.Created
+			eventType = ""
+			if current.Password != user.Password {
+				eventType = WebhookUserPasswordChanged
+			}
+		}
+		if eventType != "" {
+			err := r.queueWebhooks(eventType, user, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.users[user.ID] = user
+		existing[user.Username] = user
+		r.userGroups[user.ID] = append([]int(nil), u.GroupIDs...)
+	}
+	return outcomes, nil
+}
+
+func (r *MemoryRepository) CreateFederatedIdentity(ctx context.Context, identity models.FederatedIdentity) (models.FederatedIdentity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[identity.UserID]; !ok {
+		return identity, ErrNotFound
+	}
+	for _, i := range r.identities {
+		if i.Provider != identity.Provider {
+			continue
+		}
+		if i.Subject == identity.Subject {
+			return identity, fmt.Errorf("%w: %s identity %s is already linked", ErrConflict, identity.Provider, identity.Subject)
+		}
+		if i.UserID == identity.UserID {
+			return identity, fmt.Errorf("%w: user already has a %s identity", ErrConflict, identity.Provider)
+		}
+	}
+	identity.ID = r.nextIdentityID
+	r.nextIdentityID++
+	r.identities = append(r.identities, identity)
+	return identity, nil
+}
+
+func (r *MemoryRepository) GetFederatedIdentity(ctx context.Context, provider string, subject string) (models.FederatedIdentity, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, identity := range r.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+	return models.FederatedIdentity{}, ErrNotFound
+}
+
+// Ordered by provider
+func (r *MemoryRepository) GetUserFederatedIdentities(ctx context.Context, userID int) ([]models.FederatedIdentity, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var identities []models.FederatedIdentity
+	for _, identity := range r.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].Provider < identities[j].Provider })
+	return identities, nil
+}
+
+func (r *MemoryRepository) DeleteFederatedIdentity(ctx context.Context, userID int, provider string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, identity := range r.identities {
+		if identity.UserID == userID && identity.Provider == provider {
+			r.identities = append(r.identities[:i:i], r.identities[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
@@ -2,100 +2,265 @@ package repositories
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cheebz/go-auth/config"
 	"github.com/cheebz/go-auth/models"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+const maxBackoff = 30 * time.Second
+
 type PSQLRepository struct {
 	Conf config.Configuration
 	Db   *pgxpool.Pool
 }
 
-func NewPSQLRepository(conf config.Configuration) Repository {
+func NewPSQLRepository(conf config.Configuration, db *pgxpool.Pool) Repository {
 	return &PSQLRepository{
 		Conf: conf,
-		Db:   connectDb(conf.Db),
+		Db:   db,
+	}
+}
+
+// ConnectDb creates a connection pool and waits for the database with
+// exponential backoff. The pool is returned even if the database is still
+// unreachable once DB_CONNECT_TIMEOUT has passed.
+func ConnectDb(ctx context.Context, s config.DataSource) (*pgxpool.Pool, error) {
+	db, err := NewDbPool(s)
+	if err != nil {
+		return nil, err
+	}
+	err = Retry(ctx, s.ConnectTimeout, "database not ready", db.Ping)
+	if err != nil {
+		return db, err
 	}
+	log.Printf("Connected to %s as %s\n", db.Config().ConnConfig.Database, db.Config().ConnConfig.User)
+	return db, nil
 }
 
-// connect to db
-func connectDb(s config.DataSource) *pgxpool.Pool {
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		s.Host, s.Port, s.User, s.Password, s.Dbname)
-	db, err := pgxpool.Connect(context.Background(), psqlInfo)
+// NewDbPool creates a connection pool without requiring the database to be up
+func NewDbPool(s config.DataSource) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(psqlDSN(s))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
-		os.Exit(1)
+		return nil, err
+	}
+	poolConfig.LazyConnect = true
+	if s.MaxConns > 0 {
+		poolConfig.MaxConns = int32(s.MaxConns)
+	}
+	if s.MinConns > 0 {
+		poolConfig.MinConns = int32(s.MinConns)
+	}
+	if s.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = time.Duration(s.MaxConnLifetime) * time.Second
+	}
+	if s.MaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = time.Duration(s.MaxConnIdleTime) * time.Second
+	}
+	return pgxpool.ConnectConfig(context.Background(), poolConfig)
+}
+
+// Build a DSN from the data source, unless a full DSN or URL is given
+func psqlDSN(s config.DataSource) string {
+	if s.URL != "" {
+		return s.URL
+	}
+	params := []struct {
+		key   string
+		value string
+	}{
+		{"host", s.Host},
+		{"port", strconv.Itoa(s.Port)},
+		{"user", s.User},
+		{"password", s.Password},
+		{"dbname", s.Dbname},
+		{"sslmode", s.SSLMode},
+		{"sslrootcert", s.SSLRootCert},
+		{"sslcert", s.SSLCert},
+		{"sslkey", s.SSLKey},
+	}
+	var dsn []string
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p.value)
+		dsn = append(dsn, fmt.Sprintf("%s='%s'", p.key, value))
 	}
-	log.Printf("Connected to %s as %s\n", s.Dbname, s.User)
-	return db
+	return strings.Join(dsn, " ")
+}
+
+// permanentError stops Retry
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error retrying won't fix, Retry returns it straight away
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// Retry fn until it succeeds, backing off up to maxBackoff between attempts.
+// A timeout of zero retries until the context is done.
+func Retry(ctx context.Context, timeout int, what string, fn func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	backoff := time.Second
+	for {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			return fmt.Errorf("%s: %w", what, permanent.err)
+		}
+		log.Printf("%s, retrying in %s: %v\n", what, backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", what, err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Map Postgres errors to repository errors
+func psqlError(err error) error {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrNotFound
+	case errors.As(err, &pgErr) && pgErr.Code == "23505":
+		return fmt.Errorf("%w: %s", ErrConflict, pgErr.Detail)
+	}
+	return err
 }
 
 func (r *PSQLRepository) Close() {
 	r.Db.Close()
 }
 
-func (r *PSQLRepository) GetUserByID(userID int) (models.User, error) {
-	sql := "SELECT * FROM users WHERE id = $1;"
+func (r *PSQLRepository) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	return r.Db.Ping(ctx)
+}
+
+func (r *PSQLRepository) GetUserByID(ctx context.Context, userID int) (models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT id, username, password, created, uuid, password_changed, disabled FROM users WHERE id = $1;"
 	var user models.User
-	err := r.Db.QueryRow(context.Background(), sql, userID).Scan(
+	err := r.Db.QueryRow(ctx, sql, userID).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Password,
 		&user.Created,
 		&user.UUID,
+		&user.PasswordChanged,
+		&user.Disabled,
 	)
 	if err != nil {
-		return user, err
+		return user, psqlError(err)
 	}
 	return user, nil
 }
 
-func (r *PSQLRepository) GetUserByName(username string) (models.User, error) {
-	sql := "SELECT * FROM users WHERE username = $1;"
+func (r *PSQLRepository) GetUserByName(ctx context.Context, username string) (models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT id, username, password, created, uuid, password_changed, disabled FROM users WHERE username = $1;"
 	var user models.User
-	err := r.Db.QueryRow(context.Background(), sql, username).Scan(
+	err := r.Db.QueryRow(ctx, sql, username).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Password,
 		&user.Created,
 		&user.UUID,
+		&user.PasswordChanged,
+		&user.Disabled,
 	)
 	if err != nil {
-		return user, err
+		return user, psqlError(err)
+	}
+	return user, nil
+}
+
+func (r *PSQLRepository) GetUserByUUID(ctx context.Context, uuid string) (models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT id, username, password, created, uuid, password_changed, disabled FROM users WHERE uuid = $1;"
+	var user models.User
+	err := r.Db.QueryRow(ctx, sql, uuid).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Password,
+		&user.Created,
+		&user.UUID,
+		&user.PasswordChanged,
+		&user.Disabled,
+	)
+	if err != nil {
+		return user, psqlError(err)
 	}
 	return user, nil
 }
 
-func (r *PSQLRepository) CreateUser(user models.User) (models.User, error) {
-	tx, err := r.Db.Begin(context.Background())
+func (r *PSQLRepository) CreateUser(ctx context.Context, user models.User) (models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.Begin(ctx)
 	if err != nil {
-		return user, err
+		return user, psqlError(err)
 	}
-	sql := `INSERT INTO users (username, password, created, uuid) VALUES ($1, $2, $3, $4) RETURNING id;`
-	err = tx.QueryRow(context.Background(), sql, user.Username, user.Password, user.Created, user.UUID).Scan(&user.ID)
+	sql := `INSERT INTO users (username, password, created, uuid, password_changed, disabled) VALUES ($1, $2, $3, $4, $3, $5) RETURNING id;`
+	err = tx.QueryRow(ctx, sql, user.Username, user.Password, user.Created, user.UUID, user.Disabled).Scan(&user.ID)
 	if err != nil {
-		tx.Rollback(context.Background())
-		return user, err
+		tx.Rollback(ctx)
+		return user, psqlError(err)
 	}
 	sql = "INSERT INTO user_groups (user_id, group_id) VALUES ($1, 1);"
-	_, err = tx.Exec(context.Background(), sql, user.ID)
+	_, err = tx.Exec(ctx, sql, user.ID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return user, psqlError(err)
+	}
+	err = r.insertWebhooks(ctx, tx, WebhookUserRegistered, user, nil)
 	if err != nil {
-		tx.Rollback(context.Background())
+		tx.Rollback(ctx)
 		return user, err
 	}
-	tx.Commit(context.Background())
+	err = tx.Commit(ctx)
+	if err != nil {
+		return user, psqlError(err)
+	}
+	user.PasswordChanged = user.Created
 	return user, nil
 }
 
-func (r *PSQLRepository) GetUserGroups(userID int) ([]models.Group, error) {
+func (r *PSQLRepository) GetUserGroups(ctx context.Context, userID int) ([]models.Group, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
 	sql := `SELECT groups.id, groups.name
 	FROM groups 
 	INNER JOIN user_groups 
@@ -103,9 +268,9 @@ func (r *PSQLRepository) GetUserGroups(userID int) ([]models.Group, error) {
 	INNER JOIN users
 	ON users.id = user_groups.user_id
 	WHERE users.id = $1;`
-	rows, err := r.Db.Query(context.Background(), sql, userID)
+	rows, err := r.Db.Query(ctx, sql, userID)
 	if err != nil {
-		return nil, err
+		return nil, psqlError(err)
 	}
 	defer rows.Close()
 	var groups []models.Group
@@ -113,85 +278,770 @@ func (r *PSQLRepository) GetUserGroups(userID int) ([]models.Group, error) {
 		var group models.Group
 		err = rows.Scan(&group.ID, &group.Name)
 		if err != nil {
-			return groups, err
+			return groups, psqlError(err)
 		}
 		groups = append(groups, group)
 	}
 	err = rows.Err()
 	if err != nil {
-		return groups, err
+		return groups, psqlError(err)
 	}
 	return groups, nil
 }
 
-func (r *PSQLRepository) UpdatePassword(userID int, password string) error {
+// Move the current password into the history and set a new one
+func (r *PSQLRepository) UpdatePassword(ctx context.Context, userID int, password string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.Begin(ctx)
+	if err != nil {
+		return psqlError(err)
+	}
+	sql := `INSERT INTO password_history (user_id, password, created)
+	SELECT id, password, current_timestamp FROM users WHERE id = $1;`
+	_, err = tx.Exec(ctx, sql, userID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return psqlError(err)
+	}
+	sql = `DELETE FROM password_history
+	WHERE user_id = $1
+	AND id NOT IN (
+		SELECT id FROM password_history
+		WHERE user_id = $1
+		ORDER BY created DESC, id DESC
+		LIMIT $2
+	);`
+	_, err = tx.Exec(ctx, sql, userID, r.Conf.Password.History)
+	if err != nil {
+		tx.Rollback(ctx)
+		return psqlError(err)
+	}
+	sql = `UPDATE users SET password = $1, password_changed = current_timestamp
+	WHERE id = $2
+	RETURNING username, uuid;`
+	user := models.User{ID: userID}
+	err = tx.QueryRow(ctx, sql, password, userID).Scan(&user.Username, &user.UUID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return psqlError(err)
+	}
+	err = r.insertWebhooks(ctx, tx, WebhookUserPasswordChanged, user, nil)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	return psqlError(tx.Commit(ctx))
+}
+
+// Replace the stored hash of the current password, e.g. after a rehash
+func (r *PSQLRepository) ReplacePasswordHash(ctx context.Context, userID int, password string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
 	sql := "UPDATE users SET password = $1 WHERE id = $2;"
 
-	_, err := r.Db.Exec(context.Background(), sql, password, userID)
+	tag, err := r.Db.Exec(ctx, sql, password, userID)
 	if err != nil {
-		return err
+		return psqlError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
 	}
 	return nil
 }
 
-func (r *PSQLRepository) SaveRefresh(userID int, jti string) error {
+// Get previous password hashes, most recent first
+func (r *PSQLRepository) GetPasswordHistory(ctx context.Context, userID int, limit int) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `SELECT password FROM password_history
+	WHERE user_id = $1
+	ORDER BY created DESC, id DESC
+	LIMIT $2;`
+	rows, err := r.Db.Query(ctx, sql, userID, limit)
+	if err != nil {
+		return nil, psqlError(err)
+	}
+	defer rows.Close()
+	var passwords []string
+	for rows.Next() {
+		var password string
+		err = rows.Scan(&password)
+		if err != nil {
+			return passwords, psqlError(err)
+		}
+		passwords = append(passwords, password)
+	}
+	err = rows.Err()
+	if err != nil {
+		return passwords, psqlError(err)
+	}
+	return passwords, nil
+}
+
+func (r *PSQLRepository) SaveRefresh(ctx context.Context, userID int, jti string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
 	sql := `INSERT INTO user_refresh (user_id, jti, expires)
 	VALUES ($1, $2, current_timestamp + ($3 || ' seconds')::interval);`
 
-	_, err := r.Db.Exec(context.Background(), sql, userID, jti, fmt.Sprintf("%d", r.Conf.RefreshMaxAge))
+	_, err := r.Db.Exec(ctx, sql, userID, jti, fmt.Sprintf("%d", r.Conf.RefreshMaxAge))
 	if err != nil {
-		return err
+		return psqlError(err)
 	}
 	return nil
 }
 
-func (r *PSQLRepository) ValidateRefresh(userID int, jti string) error {
-	sql := `SELECT 1 FROM user_refresh
+func (r *PSQLRepository) ValidateRefresh(ctx context.Context, userID int, jti string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `SELECT coalesce(revoked <= current_timestamp, false) FROM user_refresh
 	WHERE user_id = $1
-	AND jti = $2;`
+	AND jti = $2
+	AND expires > current_timestamp;`
 
-	var result int
-	err := r.Db.QueryRow(context.Background(), sql, userID, jti).Scan(&result)
+	var revoked bool
+	err := r.Db.QueryRow(ctx, sql, userID, jti).Scan(&revoked)
 	if err != nil {
-		return err
+		return psqlError(err)
 	}
-	if result != 1 {
-		return errors.New("invalid refresh token")
+	if revoked {
+		return ErrRevoked
 	}
 	return nil
 }
 
 // Invalidate refresh to account for concurrent requests
-func (r *PSQLRepository) InvalidateRefresh(jti string) error {
+func (r *PSQLRepository) InvalidateRefresh(ctx context.Context, jti string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
 	sql := `UPDATE user_refresh
-	SET expires = current_timestamp + (2 || ' minutes')::interval
-	WHERE jti = $1;`
+	SET revoked = current_timestamp + ($2 || ' seconds')::interval
+	WHERE jti = $1
+	AND revoked IS NULL;`
 
-	_, err := r.Db.Exec(context.Background(), sql, jti)
+	_, err := r.Db.Exec(ctx, sql, jti, fmt.Sprintf("%d", int(refreshGracePeriod.Seconds())))
 	if err != nil {
-		return err
+		return psqlError(err)
 	}
 	return nil
 }
 
-func (r *PSQLRepository) DeleteAllRefresh(userID int) error {
+func (r *PSQLRepository) DeleteAllRefresh(ctx context.Context, userID int) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
 	sql := `DELETE FROM user_refresh
 	WHERE user_id = $1;`
 
-	_, err := r.Db.Exec(context.Background(), sql, userID)
+	_, err := r.Db.Exec(ctx, sql, userID)
 	if err != nil {
-		return err
+		return psqlError(err)
 	}
 	return nil
 }
 
-func (r *PSQLRepository) DeleteExpiredRefresh() error {
+func (r *PSQLRepository) DeleteExpiredRefresh(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
 	sql := `DELETE FROM user_refresh
 	WHERE expires < current_timestamp;`
 
-	_, err := r.Db.Exec(context.Background(), sql)
+	_, err := r.Db.Exec(ctx, sql)
+	if err != nil {
+		return psqlError(err)
+	}
+	return nil
+}
+
+func (r *PSQLRepository) CountActiveRefresh(ctx context.Context) (int, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `SELECT count(*) FROM user_refresh
+	WHERE expires > current_timestamp
+	AND (revoked IS NULL OR revoked > current_timestamp);`
+
+	var count int
+	err := r.Db.QueryRow(ctx, sql).Scan(&count)
+	if err != nil {
+		return 0, psqlError(err)
+	}
+	return count, nil
+}
+
+func (r *PSQLRepository) SaveAuditEvent(ctx context.Context, event models.AuditEvent) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	details, err := auditDetails(event.Details)
 	if err != nil {
 		return err
 	}
+	sql := `INSERT INTO audit_log (time, type, user_id, uuid, username, ip, user_agent, request_id, details)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::jsonb);`
+	_, err = r.Db.Exec(ctx, sql,
+		event.Time,
+		event.Type,
+		nullableUserID(event.UserID),
+		event.UUID,
+		event.Username,
+		event.IP,
+		event.UserAgent,
+		event.RequestID,
+		details,
+	)
+	if err != nil {
+		return psqlError(err)
+	}
+	return nil
+}
+
+// Newest events first
+func (r *PSQLRepository) GetAuditEvents(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	where, args := auditWhere(filter, func(n int) string { return fmt.Sprintf("$%d", n) })
+	args = append(args, auditLimit(filter.Limit))
+	sql := fmt.Sprintf(`SELECT id, time, type, COALESCE(user_id, 0), COALESCE(uuid, ''), COALESCE(username, ''),
+	ip, user_agent, request_id, details
+	FROM audit_log
+	%s
+	ORDER BY time DESC, id DESC
+	LIMIT $%d;`, where, len(args))
+	rows, err := r.Db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, psqlError(err)
+	}
+	defer rows.Close()
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var event models.AuditEvent
+		var details []byte
+		err = rows.Scan(
+			&event.ID,
+			&event.Time,
+			&event.Type,
+			&event.UserID,
+			&event.UUID,
+			&event.Username,
+			&event.IP,
+			&event.UserAgent,
+			&event.RequestID,
+			&details,
+		)
+		if err != nil {
+			return events, psqlError(err)
+		}
+		if details != nil {
+			err = json.Unmarshal(details, &event.Details)
+			if err != nil {
+				return events, err
+			}
+		}
+		events = append(events, event)
+	}
+	return events, psqlError(rows.Err())
+}
+
+func (r *PSQLRepository) AddUserToGroup(ctx context.Context, userID int, groupID int) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.Begin(ctx)
+	if err != nil {
+		return psqlError(err)
+	}
+	user := models.User{ID: userID}
+	sql := "SELECT username, uuid FROM users WHERE id = $1 FOR UPDATE;"
+	err = tx.QueryRow(ctx, sql, userID).Scan(&user.Username, &user.UUID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return psqlError(err)
+	}
+	group := models.Group{ID: groupID}
+	sql = "SELECT name FROM groups WHERE id = $1;"
+	err = tx.QueryRow(ctx, sql, groupID).Scan(&group.Name)
+	if err != nil {
+		tx.Rollback(ctx)
+		return psqlError(err)
+	}
+	sql = `INSERT INTO user_groups (user_id, group_id)
+	SELECT $1, $2
+	WHERE NOT EXISTS (SELECT 1 FROM user_groups WHERE user_id = $1 AND group_id = $2);`
+	tag, err := tx.Exec(ctx, sql, userID, groupID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return psqlError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		tx.Rollback(ctx)
+		return fmt.Errorf("%w: user is already in group", ErrConflict)
+	}
+	err = r.insertWebhooks(ctx, tx, WebhookUserGroupAdded, user, &group)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	return psqlError(tx.Commit(ctx))
+}
+
+// Delete a user along with their sessions, groups and password history
+func (r *PSQLRepository) DeleteUser(ctx context.Context, userID int) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.Begin(ctx)
+	if err != nil {
+		return psqlError(err)
+	}
+	user := models.User{ID: userID}
+	sql := "SELECT username, uuid FROM users WHERE id = $1 FOR UPDATE;"
+	err = tx.QueryRow(ctx, sql, userID).Scan(&user.Username, &user.UUID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return psqlError(err)
+	}
+	for _, sql := range []string{
+		"DELETE FROM user_refresh WHERE user_id = $1;",
+		"DELETE FROM user_groups WHERE user_id = $1;",
+		"DELETE FROM password_history WHERE user_id = $1;",
+		"DELETE FROM federated_identities WHERE user_id = $1;",
+		"DELETE FROM users WHERE id = $1;",
+	} {
+		_, err = tx.Exec(ctx, sql, userID)
+		if err != nil {
+			tx.Rollback(ctx)
+			return psqlError(err)
+		}
+	}
+	err = r.insertWebhooks(ctx, tx, WebhookUserDeleted, user, nil)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	return psqlError(tx.Commit(ctx))
+}
+
+// Write outbox rows as part of the caller's transaction
+func (r *PSQLRepository) insertWebhooks(ctx context.Context, tx pgx.Tx, eventType string, user models.User, group *models.Group) error {
+	webhooks, err := newWebhooks(r.Conf.Webhook, eventType, user, group)
+	if err != nil {
+		return err
+	}
+	sql := `INSERT INTO webhook_outbox (endpoint, event_type, payload, created, next_attempt)
+	VALUES ($1, $2, $3::jsonb, $4, $5);`
+	for _, webhook := range webhooks {
+		_, err = tx.Exec(ctx, sql, webhook.Endpoint, webhook.EventType, string(webhook.Payload), webhook.Created, webhook.NextAttempt)
+		if err != nil {
+			return psqlError(err)
+		}
+	}
+	return nil
+}
+
+// Claim pending webhooks that are due by pushing their next attempt past
+// the lease, so other replicas skip them while they are being delivered
+func (r *PSQLRepository) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.Webhook, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `UPDATE webhook_outbox
+	SET next_attempt = current_timestamp + $2 * interval '1 second'
+	WHERE id IN (
+		SELECT id FROM webhook_outbox
+		WHERE status = 'pending'
+		AND next_attempt <= current_timestamp
+		ORDER BY next_attempt, id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, endpoint, event_type, payload, created, attempts, next_attempt;`
+	rows, err := r.Db.Query(ctx, sql, limit, lease.Seconds())
+	if err != nil {
+		return nil, psqlError(err)
+	}
+	defer rows.Close()
+	var webhooks []models.Webhook
+	for rows.Next() {
+		var webhook models.Webhook
+		err = rows.Scan(
+			&webhook.ID,
+			&webhook.Endpoint,
+			&webhook.EventType,
+			&webhook.Payload,
+			&webhook.Created,
+			&webhook.Attempts,
+			&webhook.NextAttempt,
+		)
+		if err != nil {
+			return webhooks, psqlError(err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, psqlError(rows.Err())
+}
+
+func (r *PSQLRepository) MarkWebhookDelivered(ctx context.Context, id int64) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `UPDATE webhook_outbox
+	SET status = 'delivered', attempts = attempts + 1, last_error = NULL
+	WHERE id = $1;`
+	tag, err := r.Db.Exec(ctx, sql, id)
+	if err != nil {
+		return psqlError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PSQLRepository) RetryWebhook(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `UPDATE webhook_outbox
+	SET attempts = attempts + 1, last_error = $2, next_attempt = $3
+	WHERE id = $1;`
+	tag, err := r.Db.Exec(ctx, sql, id, lastError, nextAttempt)
+	if err != nil {
+		return psqlError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Give up on a webhook, it stays in the outbox for inspection
+func (r *PSQLRepository) MarkWebhookFailed(ctx context.Context, id int64, lastError string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `UPDATE webhook_outbox
+	SET status = 'failed', attempts = attempts + 1, last_error = $2
+	WHERE id = $1;`
+	tag, err := r.Db.Exec(ctx, sql, id, lastError)
+	if err != nil {
+		return psqlError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Take a session level advisory lock on a dedicated connection, which is
+// held until it is released or the connection drops
+func (r *PSQLRepository) TryLock(ctx context.Context, name string) (Lock, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	conn, err := r.Db.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var locked bool
+	sql := "SELECT pg_try_advisory_lock(hashtextextended($1, 0));"
+	err = conn.QueryRow(ctx, sql, name).Scan(&locked)
+	if err != nil {
+		conn.Release()
+		return nil, psqlError(err)
+	}
+	if !locked {
+		conn.Release()
+		return nil, fmt.Errorf("%w: lock %s is held", ErrConflict, name)
+	}
+	return &psqlLock{conf: r.Conf, conn: conn, name: name}, nil
+}
+
+type psqlLock struct {
+	conf config.Configuration
+	conn *pgxpool.Conn
+	name string
+}
+
+func (l *psqlLock) Check(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, l.conf.Db.QueryTimeout)
+	defer cancel()
+	return l.conn.Ping(ctx)
+}
+
+// Unlock and return the connection to the pool. A connection whose unlock
+// failed is closed so the lock cannot outlive it.
+func (l *psqlLock) Release(ctx context.Context) error {
+	if l.conn == nil {
+		return nil
+	}
+	ctx, cancel := withTimeout(ctx, l.conf.Db.QueryTimeout)
+	defer cancel()
+	_, err := l.conn.Exec(ctx, "SELECT pg_advisory_unlock(hashtextextended($1, 0));", l.name)
+	if err != nil {
+		l.conn.Conn().Close(context.Background())
+	}
+	l.conn.Release()
+	l.conn = nil
+	return psqlError(err)
+}
+
+// List users ordered by id, starting after afterID
+func (r *PSQLRepository) ListUsers(ctx context.Context, afterID int, limit int) ([]models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `SELECT id, username, password, created, uuid, password_changed, disabled FROM users
+	WHERE id > $1
+	ORDER BY id
+	LIMIT $2;`
+	rows, err := r.Db.Query(ctx, sql, afterID, limit)
+	if err != nil {
+		return nil, psqlError(err)
+	}
+	defer rows.Close()
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		err = rows.Scan(
+			&user.ID,
+			&user.Username,
+			&user.Password,
+			&user.Created,
+			&user.UUID,
+			&user.PasswordChanged,
+			&user.Disabled,
+		)
+		if err != nil {
+			return users, psqlError(err)
+		}
+		users = append(users, user)
+	}
+	return users, psqlError(rows.Err())
+}
+
+func (r *PSQLRepository) SetUserDisabled(ctx context.Context, userID int, disabled bool) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "UPDATE users SET disabled = $1 WHERE id = $2;"
+	tag, err := r.Db.Exec(ctx, sql, disabled, userID)
+	if err != nil {
+		return psqlError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PSQLRepository) CreateGroup(ctx context.Context, name string) (models.Group, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	group := models.Group{Name: name}
+	sql := "INSERT INTO groups (name) VALUES ($1) RETURNING id;"
+	err := r.Db.QueryRow(ctx, sql, name).Scan(&group.ID)
+	if err != nil {
+		return group, psqlError(err)
+	}
+	return group, nil
+}
+
+func (r *PSQLRepository) GetGroupByName(ctx context.Context, name string) (models.Group, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	group := models.Group{Name: name}
+	sql := "SELECT id FROM groups WHERE name = $1;"
+	err := r.Db.QueryRow(ctx, sql, name).Scan(&group.ID)
+	if err != nil {
+		return group, psqlError(err)
+	}
+	return group, nil
+}
+
+func (r *PSQLRepository) RemoveUserFromGroup(ctx context.Context, userID int, groupID int) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "DELETE FROM user_groups WHERE user_id = $1 AND group_id = $2;"
+	tag, err := r.Db.Exec(ctx, sql, userID, groupID)
+	if err != nil {
+		return psqlError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PSQLRepository) SaveSigningKey(ctx context.Context, key models.SigningKey) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "INSERT INTO signing_keys (kid, algorithm, key, created) VALUES ($1, $2, $3, $4);"
+	_, err := r.Db.Exec(ctx, sql, key.KID, key.Algorithm, key.Key, key.Created)
+	return psqlError(err)
+}
+
+// Newest keys first
+func (r *PSQLRepository) GetSigningKeys(ctx context.Context) ([]models.SigningKey, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT kid, algorithm, key, created FROM signing_keys ORDER BY created DESC, kid DESC;"
+	rows, err := r.Db.Query(ctx, sql)
+	if err != nil {
+		return nil, psqlError(err)
+	}
+	defer rows.Close()
+	var keys []models.SigningKey
+	for rows.Next() {
+		var key models.SigningKey
+		err = rows.Scan(&key.KID, &key.Algorithm, &key.Key, &key.Created)
+		if err != nil {
+			return keys, psqlError(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, psqlError(rows.Err())
+}
+
+func (r *PSQLRepository) DeleteSigningKey(ctx context.Context, kid string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "DELETE FROM signing_keys WHERE kid = $1;"
+	tag, err := r.Db.Exec(ctx, sql, kid)
+	if err != nil {
+		return psqlError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PSQLRepository) ImportUsers(ctx context.Context, users []models.UserImport, onConflict string) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.Begin(ctx)
+	if err != nil {
+		return nil, psqlError(err)
+	}
+	outcomes := make([]string, len(users))
+	for i, u := range users {
+		outcomes[i], err = r.importUser(ctx, tx, u, onConflict)
+		if err != nil {
+			tx.Rollback(ctx)
+			return nil, err
+		}
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, psqlError(err)
+	}
+	return outcomes, nil
+}
+
+func (r *PSQLRepository) importUser(ctx context.Context, tx pgx.Tx, u models.UserImport, onConflict string) (string, error) {
+	user := u.User
+	var existing string
+	sql := "SELECT id, uuid, password FROM users WHERE username = $1 FOR UPDATE;"
+	err := tx.QueryRow(ctx, sql, user.Username).Scan(&user.ID, &user.UUID, &existing)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", psqlError(err)
+	}
+	outcome := ImportCreated
+	eventType := WebhookUserRegistered
+	if err == nil {
+		switch onConflict {
+		case ImportSkip:
+			return ImportSkipped, nil
+		case ImportOverwrite:
+		default:
+			return "", fmt.Errorf("%w: username %s already exists", ErrConflict, user.Username)
+		}
+		sql = "UPDATE users SET password = $1, password_changed = $2, disabled = $3 WHERE id = $4;"
+		_, err = tx.Exec(ctx, sql, user.Password, user.PasswordChanged, user.Disabled, user.ID)
+		if err != nil {
+			return "", psqlError(err)
+		}
+		sql = "DELETE FROM user_groups WHERE user_id = $1;"
+		_, err = tx.Exec(ctx, sql, user.ID)
+		if err != nil {
+			return "", psqlError(err)
+		}
+		outcome = ImportUpdated
+		eventType = ""
+		if existing != user.Password {
+			eventType = WebhookUserPasswordChanged
+		}
+	} else {
+		sql = `INSERT INTO users (username, password, created, uuid, password_changed, disabled)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id;`
+		err = tx.QueryRow(ctx, sql, user.Username, user.Password, user.Created, user.UUID, user.PasswordChanged, user.Disabled).Scan(&user.ID)
+		if err != nil {
+			return "", psqlError(err)
+		}
+	}
+	sql = "INSERT INTO user_groups (user_id, group_id) VALUES ($1, $2);"
+	for _, groupID := range u.GroupIDs {
+		_, err = tx.Exec(ctx, sql, user.ID, groupID)
+		if err != nil {
+			return "", psqlError(err)
+		}
+	}
+	if eventType != "" {
+		err = r.insertWebhooks(ctx, tx, eventType, user, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+	return outcome, nil
+}
+
+func (r *PSQLRepository) CreateFederatedIdentity(ctx context.Context, identity models.FederatedIdentity) (models.FederatedIdentity, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `INSERT INTO federated_identities (user_id, provider, subject, email, created)
+	SELECT id, $2::varchar, $3::text, NULLIF($4::text, ''), $5::timestamptz FROM users WHERE id = $1
+	RETURNING id;`
+	err := r.Db.QueryRow(ctx, sql, identity.UserID, identity.Provider, identity.Subject, identity.Email, identity.Created).Scan(&identity.ID)
+	if err != nil {
+		return identity, psqlError(err)
+	}
+	return identity, nil
+}
+
+func (r *PSQLRepository) GetFederatedIdentity(ctx context.Context, provider string, subject string) (models.FederatedIdentity, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	identity := models.FederatedIdentity{Provider: provider, Subject: subject}
+	sql := "SELECT id, user_id, COALESCE(email, ''), created FROM federated_identities WHERE provider = $1 AND subject = $2;"
+	err := r.Db.QueryRow(ctx, sql, provider, subject).Scan(&identity.ID, &identity.UserID, &identity.Email, &identity.Created)
+	if err != nil {
+		return identity, psqlError(err)
+	}
+	return identity, nil
+}
+
+// Ordered by provider
+func (r *PSQLRepository) GetUserFederatedIdentities(ctx context.Context, userID int) ([]models.FederatedIdentity, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT id, provider, subject, COALESCE(email, ''), created FROM federated_identities WHERE user_id = $1 ORDER BY provider;"
+	rows, err := r.Db.Query(ctx, sql, userID)
+	if err != nil {
+		return nil, psqlError(err)
+	}
+	defer rows.Close()
+	var identities []models.FederatedIdentity
+	for rows.Next() {
+		identity := models.FederatedIdentity{UserID: userID}
+		err = rows.Scan(&identity.ID, &identity.Provider, &identity.Subject, &identity.Email, &identity.Created)
+		if err != nil {
+			return identities, psqlError(err)
+		}
+		identities = append(identities, identity)
+	}
+	return identities, psqlError(rows.Err())
+}
+
+func (r *PSQLRepository) DeleteFederatedIdentity(ctx context.Context, userID int, provider string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "DELETE FROM federated_identities WHERE user_id = $1 AND provider = $2;"
+	tag, err := r.Db.Exec(ctx, sql, userID, provider)
+	if err != nil {
+		return psqlError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
@@ -1,17 +1,69 @@
 package repositories
 
-import "github.com/cheebz/go-auth/models"
+import (
+	"context"
+	"time"
 
+	"github.com/cheebz/go-auth/models"
+)
+
+// Repository methods return ErrNotFound when a record does not exist and
+// ErrConflict when it would violate a uniqueness constraint. Any other
+// error means the underlying store failed.
+//
+// CreateUser, UpdatePassword, AddUserToGroup and DeleteUser queue webhooks
+// in the outbox within the same transaction as the change.
+//
+// ImportUsers writes a batch of users in one transaction and returns what
+// it did with each of them, see ImportSkip, ImportOverwrite and ImportFail.
+// Created users queue registration webhooks and overwritten users whose
+// hash changed queue password change webhooks.
+//
+// A user has at most one federated identity per provider, and a provider
+// subject is linked to at most one user.
+//
+// ValidateRefresh returns ErrRevoked for an invalidated refresh token once
+// the grace period has passed, and ErrNotFound for unknown or expired ones.
+// Invalidated tokens are kept until they expire.
+//
+// TryLock returns ErrConflict when the lock is already held.
 type Repository interface {
 	Close()
-	GetUserByID(userID int) (models.User, error)
-	GetUserByName(username string) (models.User, error)
-	CreateUser(user models.User) (models.User, error)
-	GetUserGroups(userID int) ([]models.Group, error)
-	UpdatePassword(userID int, password string) error
-	SaveRefresh(userID int, jti string) error
-	ValidateRefresh(userID int, jti string) error
-	InvalidateRefresh(jti string) error
-	DeleteAllRefresh(userID int) error
-	DeleteExpiredRefresh() error
+	Ping(ctx context.Context) error
+	GetUserByID(ctx context.Context, userID int) (models.User, error)
+	GetUserByName(ctx context.Context, username string) (models.User, error)
+	GetUserByUUID(ctx context.Context, uuid string) (models.User, error)
+	CreateUser(ctx context.Context, user models.User) (models.User, error)
+	GetUserGroups(ctx context.Context, userID int) ([]models.Group, error)
+	UpdatePassword(ctx context.Context, userID int, password string) error
+	ReplacePasswordHash(ctx context.Context, userID int, password string) error
+	GetPasswordHistory(ctx context.Context, userID int, limit int) ([]string, error)
+	SaveRefresh(ctx context.Context, userID int, jti string) error
+	ValidateRefresh(ctx context.Context, userID int, jti string) error
+	InvalidateRefresh(ctx context.Context, jti string) error
+	DeleteAllRefresh(ctx context.Context, userID int) error
+	DeleteExpiredRefresh(ctx context.Context) error
+	CountActiveRefresh(ctx context.Context) (int, error)
+	SaveAuditEvent(ctx context.Context, event models.AuditEvent) error
+	GetAuditEvents(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error)
+	AddUserToGroup(ctx context.Context, userID int, groupID int) error
+	DeleteUser(ctx context.Context, userID int) error
+	ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.Webhook, error)
+	MarkWebhookDelivered(ctx context.Context, id int64) error
+	RetryWebhook(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error
+	MarkWebhookFailed(ctx context.Context, id int64, lastError string) error
+	TryLock(ctx context.Context, name string) (Lock, error)
+	ListUsers(ctx context.Context, afterID int, limit int) ([]models.User, error)
+	SetUserDisabled(ctx context.Context, userID int, disabled bool) error
+	CreateGroup(ctx context.Context, name string) (models.Group, error)
+	GetGroupByName(ctx context.Context, name string) (models.Group, error)
+	RemoveUserFromGroup(ctx context.Context, userID int, groupID int) error
+	SaveSigningKey(ctx context.Context, key models.SigningKey) error
+	GetSigningKeys(ctx context.Context) ([]models.SigningKey, error)
+	DeleteSigningKey(ctx context.Context, kid string) error
+	ImportUsers(ctx context.Context, users []models.UserImport, onConflict string) ([]string, error)
+	CreateFederatedIdentity(ctx context.Context, identity models.FederatedIdentity) (models.FederatedIdentity, error)
+	GetFederatedIdentity(ctx context.Context, provider string, subject string) (models.FederatedIdentity, error)
+	GetUserFederatedIdentities(ctx context.Context, userID int) ([]models.FederatedIdentity, error)
+	DeleteFederatedIdentity(ctx context.Context, userID int, provider string) error
 }
@@ -0,0 +1,857 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/migrations"
+	"github.com/cheebz/go-auth/models"
+	"github.com/google/uuid"
+)
+
+type repositoryFactory func(t *testing.T, conf config.Configuration) Repository
+
+func testConfiguration() config.Configuration {
+	conf := config.Configuration{RefreshMaxAge: 3600}
+	conf.Password.History = 2
+	return conf
+}
+
+func TestMemoryRepository(t *testing.T) {
+	testRepository(t, func(t *testing.T, conf config.Configuration) Repository {
+		return NewMemoryRepository(conf)
+	})
+}
+
+func TestSQLiteRepository(t *testing.T) {
+	testRepository(t, func(t *testing.T, conf config.Configuration) Repository {
+		conf.Db.Path = filepath.Join(t.TempDir(), "go-auth.db")
+		db, err := ConnectSQLite(conf.Db)
+		if err != nil {
+			t.Fatal("failed to open database", err)
+		}
+		migrator, err := migrations.NewSQLiteMigrator(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = migrator.Up(context.Background())
+		if err != nil {
+			t.Fatal("failed to migrate", err)
+		}
+		repo := NewSQLiteRepository(conf, db)
+		t.Cleanup(repo.Close)
+		return repo
+	})
+}
+
+// Runs against an existing Postgres database when TEST_DB_HOST is set.
+// The database is migrated and users are created with unique names,
+// but it is not cleaned up afterwards.
+func TestPSQLRepository(t *testing.T) {
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		t.Skip("TEST_DB_HOST not set")
+	}
+	port, _ := strconv.Atoi(os.Getenv("TEST_DB_PORT"))
+	if port == 0 {
+		port = 5432
+	}
+	testRepository(t, func(t *testing.T, conf config.Configuration) Repository {
+		conf.Db = config.DataSource{
+			Host:     host,
+			Port:     port,
+			Dbname:   os.Getenv("TEST_DB_NAME"),
+			User:     os.Getenv("TEST_DB_USER"),
+			Password: os.Getenv("TEST_DB_PASSWORD"),
+		}
+		db, err := ConnectDb(context.Background(), conf.Db)
+		if err != nil {
+			t.Fatal("failed to connect to database", err)
+		}
+		migrator, err := migrations.NewPSQLMigrator(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = migrator.Up(context.Background())
+		if err != nil {
+			t.Fatal("failed to migrate", err)
+		}
+		repo := NewPSQLRepository(conf, db)
+		t.Cleanup(repo.Close)
+		return repo
+	})
+}
+
+func createTestUser(t *testing.T, repo Repository) models.User {
+	t.Helper()
+	ctx := context.Background()
+	user, err := repo.CreateUser(ctx, models.User{
+		Username: "user-" + uuid.New().String(),
+		Password: "hash",
+		Created:  time.Now().Add(-time.Hour).Truncate(time.Second),
+		UUID:     uuid.New().String(),
+	})
+	if err != nil {
+		t.Fatal("failed to create user", err)
+	}
+	return user
+}
+
+// testRepository is the conformance suite every Repository must pass
+func testRepository(t *testing.T, newRepo repositoryFactory) {
+	ctx := context.Background()
+
+	t.Run("users", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		err := repo.Ping(ctx)
+		if err != nil {
+			t.Fatal("failed to ping", err)
+		}
+		user := createTestUser(t, repo)
+		if user.ID == 0 {
+			t.Fatal("created user has no id")
+		}
+		byID, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal("failed to get user by id", err)
+		}
+		byName, err := repo.GetUserByName(ctx, user.Username)
+		if err != nil {
+			t.Fatal("failed to get user by name", err)
+		}
+		byUUID, err := repo.GetUserByUUID(ctx, user.UUID)
+		if err != nil {
+			t.Fatal("failed to get user by uuid", err)
+		}
+		for _, u := range []models.User{byID, byName, byUUID} {
+			if u.ID != user.ID || u.Username != user.Username || u.Password != user.Password || u.UUID != user.UUID {
+				t.Fatal("unexpected user", u)
+			}
+			if !u.Created.Equal(user.Created) || !u.PasswordChanged.Equal(user.Created) {
+				t.Fatal("unexpected user timestamps", u)
+			}
+		}
+		_, err = repo.GetUserByName(ctx, "missing-"+uuid.New().String())
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found for missing user by name", err)
+		}
+		_, err = repo.GetUserByUUID(ctx, uuid.New().String())
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found for missing user by uuid", err)
+		}
+		_, err = repo.GetUserByID(ctx, -1)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found for missing user by id", err)
+		}
+		duplicate := user
+		duplicate.UUID = uuid.New().String()
+		_, err = repo.CreateUser(ctx, duplicate)
+		if !errors.Is(err, ErrConflict) {
+			t.Fatal("expected conflict for duplicate username", err)
+		}
+
+		if byID.Disabled {
+			t.Fatal("new user is disabled")
+		}
+		err = repo.SetUserDisabled(ctx, user.ID, true)
+		if err != nil {
+			t.Fatal("failed to disable user", err)
+		}
+		disabled, err := repo.GetUserByName(ctx, user.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !disabled.Disabled {
+			t.Fatal("user not disabled", disabled)
+		}
+		err = repo.SetUserDisabled(ctx, -1, true)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found disabling missing user", err)
+		}
+	})
+
+	t.Run("list users", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		var created []models.User
+		for i := 0; i < 3; i++ {
+			created = append(created, createTestUser(t, repo))
+		}
+		afterID := created[0].ID - 1
+		users, err := repo.ListUsers(ctx, afterID, 2)
+		if err != nil {
+			t.Fatal("failed to list users", err)
+		}
+		if len(users) != 2 || users[0].ID != created[0].ID || users[1].ID != created[1].ID {
+			t.Fatal("unexpected first page", users)
+		}
+		if users[0].Username != created[0].Username || users[0].Password != created[0].Password {
+			t.Fatal("listed user incomplete", users[0])
+		}
+		users, err = repo.ListUsers(ctx, users[1].ID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) == 0 || users[0].ID != created[2].ID {
+			t.Fatal("unexpected second page", users)
+		}
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		user := createTestUser(t, repo)
+		groups, err := repo.GetUserGroups(ctx, user.ID)
+		if err != nil {
+			t.Fatal("failed to get groups", err)
+		}
+		if len(groups) != 1 || groups[0].Name != "public" {
+			t.Fatal("new user is not only in the public group", groups)
+		}
+		err = repo.AddUserToGroup(ctx, user.ID, 2)
+		if err != nil {
+			t.Fatal("failed to add user to group", err)
+		}
+		groups, err = repo.GetUserGroups(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != 2 {
+			t.Fatal("user not added to group", groups)
+		}
+		err = repo.AddUserToGroup(ctx, user.ID, 2)
+		if !errors.Is(err, ErrConflict) {
+			t.Fatal("expected conflict adding user to group twice", err)
+		}
+		err = repo.AddUserToGroup(ctx, user.ID, -1)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found adding user to missing group", err)
+		}
+		err = repo.AddUserToGroup(ctx, -1, 2)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found adding missing user to group", err)
+		}
+		err = repo.RemoveUserFromGroup(ctx, user.ID, 2)
+		if err != nil {
+			t.Fatal("failed to remove user from group", err)
+		}
+		err = repo.RemoveUserFromGroup(ctx, user.ID, 2)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found removing user from group twice", err)
+		}
+
+		name := "group-" + uuid.New().String()
+		group, err := repo.CreateGroup(ctx, name)
+		if err != nil {
+			t.Fatal("failed to create group", err)
+		}
+		if group.ID == 0 || group.Name != name {
+			t.Fatal("unexpected group", group)
+		}
+		_, err = repo.CreateGroup(ctx, name)
+		if !errors.Is(err, ErrConflict) {
+			t.Fatal("expected conflict creating duplicate group", err)
+		}
+		byName, err := repo.GetGroupByName(ctx, name)
+		if err != nil || byName != group {
+			t.Fatal("failed to get group by name", byName, err)
+		}
+		_, err = repo.GetGroupByName(ctx, "missing-"+uuid.New().String())
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found for missing group", err)
+		}
+		err = repo.AddUserToGroup(ctx, user.ID, group.ID)
+		if err != nil {
+			t.Fatal("failed to add user to new group", err)
+		}
+	})
+
+	t.Run("import users", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		existing := createTestUser(t, repo)
+		created := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+		imported := models.UserImport{
+			User: models.User{
+				Username:        "user-" + uuid.New().String(),
+				Password:        "imported",
+				Created:         created,
+				UUID:            uuid.New().String(),
+				PasswordChanged: created.Add(time.Hour),
+				Disabled:        true,
+			},
+			GroupIDs: []int{1, 2},
+		}
+		overwrite := models.UserImport{
+			User: models.User{
+				Username:        existing.Username,
+				Password:        "overwritten",
+				Created:         created,
+				UUID:            uuid.New().String(),
+				PasswordChanged: created,
+			},
+			GroupIDs: []int{2},
+		}
+
+		_, err := repo.ImportUsers(ctx, []models.UserImport{imported, overwrite}, ImportFail)
+		if !errors.Is(err, ErrConflict) {
+			t.Fatal("expected conflict importing existing user", err)
+		}
+		_, err = repo.GetUserByName(ctx, imported.User.Username)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("failed batch was not rolled back", err)
+		}
+
+		outcomes, err := repo.ImportUsers(ctx, []models.UserImport{imported, overwrite}, ImportSkip)
+		if err != nil {
+			t.Fatal("failed to import users", err)
+		}
+		if len(outcomes) != 2 || outcomes[0] != ImportCreated || outcomes[1] != ImportSkipped {
+			t.Fatal("unexpected outcomes skipping conflicts", outcomes)
+		}
+		user, err := repo.GetUserByName(ctx, imported.User.Username)
+		if err != nil {
+			t.Fatal("imported user not found", err)
+		}
+		if user.UUID != imported.User.UUID || user.Password != "imported" || !user.Disabled ||
+			!user.Created.Equal(created) || !user.PasswordChanged.Equal(imported.User.PasswordChanged) {
+			t.Fatal("imported user does not match", user)
+		}
+		groups, err := repo.GetUserGroups(ctx, user.ID)
+		if err != nil || len(groups) != 2 {
+			t.Fatal("imported groups not set", groups, err)
+		}
+		skipped, _ := repo.GetUserByName(ctx, existing.Username)
+		if skipped.Password != existing.Password {
+			t.Fatal("skipped user was changed", skipped)
+		}
+
+		outcomes, err = repo.ImportUsers(ctx, []models.UserImport{overwrite}, ImportOverwrite)
+		if err != nil {
+			t.Fatal("failed to overwrite user", err)
+		}
+		if len(outcomes) != 1 || outcomes[0] != ImportUpdated {
+			t.Fatal("unexpected outcomes overwriting", outcomes)
+		}
+		updated, err := repo.GetUserByName(ctx, existing.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.ID != existing.ID || updated.UUID != existing.UUID || updated.Password != "overwritten" {
+			t.Fatal("user not overwritten in place", updated)
+		}
+		groups, err = repo.GetUserGroups(ctx, existing.ID)
+		if err != nil || len(groups) != 1 || groups[0].ID != 2 {
+			t.Fatal("groups not replaced", groups, err)
+		}
+	})
+
+	t.Run("delete user", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		user := createTestUser(t, repo)
+		jti := uuid.New().String()
+		err := repo.SaveRefresh(ctx, user.ID, jti)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.UpdatePassword(ctx, user.ID, "hash2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		identity := models.FederatedIdentity{UserID: user.ID, Provider: "google", Subject: uuid.New().String(), Created: time.Now()}
+		_, err = repo.CreateFederatedIdentity(ctx, identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.DeleteUser(ctx, user.ID)
+		if err != nil {
+			t.Fatal("failed to delete user", err)
+		}
+		_, err = repo.GetUserByID(ctx, user.ID)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found getting deleted user", err)
+		}
+		err = repo.ValidateRefresh(ctx, user.ID, jti)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("refresh of deleted user still valid", err)
+		}
+		_, err = repo.GetFederatedIdentity(ctx, identity.Provider, identity.Subject)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("identity of deleted user still linked", err)
+		}
+		err = repo.DeleteUser(ctx, user.ID)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found deleting missing user", err)
+		}
+	})
+
+	t.Run("passwords", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		user := createTestUser(t, repo)
+		for _, password := range []string{"hash2", "hash3", "hash4"} {
+			err := repo.UpdatePassword(ctx, user.ID, password)
+			if err != nil {
+				t.Fatal("failed to update password", err)
+			}
+		}
+		updated, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Password != "hash4" || !updated.PasswordChanged.After(user.PasswordChanged) {
+			t.Fatal("password not updated", updated)
+		}
+		err = repo.UpdatePassword(ctx, -1, "hash")
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found updating password of missing user", err)
+		}
+		history, err := repo.GetPasswordHistory(ctx, user.ID, 10)
+		if err != nil {
+			t.Fatal("failed to get password history", err)
+		}
+		if len(history) != 2 || history[0] != "hash3" || history[1] != "hash2" {
+			t.Fatal("unexpected password history", history)
+		}
+
+		err = repo.ReplacePasswordHash(ctx, user.ID, "rehashed")
+		if err != nil {
+			t.Fatal("failed to replace password hash", err)
+		}
+		rehashed, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rehashed.Password != "rehashed" || !rehashed.PasswordChanged.Equal(updated.PasswordChanged) {
+			t.Fatal("password hash not replaced in place", rehashed)
+		}
+		history, err = repo.GetPasswordHistory(ctx, user.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 {
+			t.Fatal("replacing password hash changed history", history)
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		user := createTestUser(t, repo)
+		active, err := repo.CountActiveRefresh(ctx)
+		if err != nil {
+			t.Fatal("failed to count refresh", err)
+		}
+		jti := uuid.New().String()
+		err = repo.SaveRefresh(ctx, user.ID, jti)
+		if err != nil {
+			t.Fatal("failed to save refresh", err)
+		}
+		count, err := repo.CountActiveRefresh(ctx)
+		if err != nil {
+			t.Fatal("failed to count refresh", err)
+		}
+		if count != active+1 {
+			t.Fatal("unexpected active refresh count", count, active)
+		}
+		err = repo.ValidateRefresh(ctx, user.ID, jti)
+		if err != nil {
+			t.Fatal("failed to validate refresh", err)
+		}
+		err = repo.ValidateRefresh(ctx, user.ID+1, jti)
+		if err == nil {
+			t.Fatal("validated refresh for another user")
+		}
+		err = repo.InvalidateRefresh(ctx, jti)
+		if err != nil {
+			t.Fatal("failed to invalidate refresh", err)
+		}
+		err = repo.ValidateRefresh(ctx, user.ID, jti)
+		if err != nil {
+			t.Fatal("invalidated refresh not valid during grace period", err)
+		}
+		err = repo.DeleteAllRefresh(ctx, user.ID)
+		if err != nil {
+			t.Fatal("failed to delete refresh", err)
+		}
+		err = repo.ValidateRefresh(ctx, user.ID, jti)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found validating deleted refresh", err)
+		}
+	})
+
+	t.Run("revoked refresh", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		user := createTestUser(t, repo)
+		gracePeriod := refreshGracePeriod
+		refreshGracePeriod = -time.Minute
+		t.Cleanup(func() { refreshGracePeriod = gracePeriod })
+		active, err := repo.CountActiveRefresh(ctx)
+		if err != nil {
+			t.Fatal("failed to count refresh", err)
+		}
+		jti := uuid.New().String()
+		err = repo.SaveRefresh(ctx, user.ID, jti)
+		if err != nil {
+			t.Fatal("failed to save refresh", err)
+		}
+		err = repo.InvalidateRefresh(ctx, jti)
+		if err != nil {
+			t.Fatal("failed to invalidate refresh", err)
+		}
+		err = repo.ValidateRefresh(ctx, user.ID, jti)
+		if !errors.Is(err, ErrRevoked) {
+			t.Fatal("expected revoked validating refresh after the grace period", err)
+		}
+		err = repo.ValidateRefresh(ctx, user.ID+1, jti)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found validating refresh for another user", err)
+		}
+		count, err := repo.CountActiveRefresh(ctx)
+		if err != nil {
+			t.Fatal("failed to count refresh", err)
+		}
+		if count != active {
+			t.Fatal("revoked refresh counted as active", count, active)
+		}
+		// kept until it expires
+		err = repo.DeleteExpiredRefresh(ctx)
+		if err != nil {
+			t.Fatal("failed to delete expired refresh", err)
+		}
+		err = repo.ValidateRefresh(ctx, user.ID, jti)
+		if !errors.Is(err, ErrRevoked) {
+			t.Fatal("revoked refresh deleted before it expired", err)
+		}
+	})
+
+	t.Run("expired refresh", func(t *testing.T) {
+		conf := testConfiguration()
+		conf.RefreshMaxAge = -60
+		repo := newRepo(t, conf)
+		user := createTestUser(t, repo)
+		active, err := repo.CountActiveRefresh(ctx)
+		if err != nil {
+			t.Fatal("failed to count refresh", err)
+		}
+		jti := uuid.New().String()
+		err = repo.SaveRefresh(ctx, user.ID, jti)
+		if err != nil {
+			t.Fatal("failed to save refresh", err)
+		}
+		err = repo.ValidateRefresh(ctx, user.ID, jti)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found validating expired refresh", err)
+		}
+		count, err := repo.CountActiveRefresh(ctx)
+		if err != nil {
+			t.Fatal("failed to count refresh", err)
+		}
+		if count != active {
+			t.Fatal("expired refresh counted as active", count, active)
+		}
+		err = repo.DeleteExpiredRefresh(ctx)
+		if err != nil {
+			t.Fatal("failed to delete expired refresh", err)
+		}
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		user := createTestUser(t, repo)
+		now := time.Now().Truncate(time.Second)
+		events := []models.AuditEvent{
+			{Time: now.Add(-2 * time.Hour), Type: "login_failure", UserID: user.ID, Username: user.Username, Details: map[string]string{"reason": "invalid_password"}},
+			{Time: now.Add(-time.Hour), Type: "login_success", UserID: user.ID, UUID: user.UUID, Username: user.Username},
+			{Time: now, Type: "logout", UserID: user.ID},
+			{Time: now, Type: "login_failure", Username: "unknown-" + uuid.New().String()},
+		}
+		for _, event := range events {
+			event.IP = "192.0.2.1"
+			event.UserAgent = "test"
+			event.RequestID = uuid.New().String()
+			err := repo.SaveAuditEvent(ctx, event)
+			if err != nil {
+				t.Fatal("failed to save audit event", err)
+			}
+		}
+
+		found, err := repo.GetAuditEvents(ctx, models.AuditFilter{UserID: user.ID})
+		if err != nil {
+			t.Fatal("failed to get audit events", err)
+		}
+		if len(found) != 3 || found[0].Type != "logout" || found[2].Type != "login_failure" {
+			t.Fatal("unexpected audit events", found)
+		}
+		if found[2].Details["reason"] != "invalid_password" || found[2].IP != "192.0.2.1" || !found[2].Time.Equal(events[0].Time) {
+			t.Fatal("audit event not stored", found[2])
+		}
+		if found[1].UUID != user.UUID || found[1].Details != nil {
+			t.Fatal("unexpected audit event", found[1])
+		}
+
+		found, err = repo.GetAuditEvents(ctx, models.AuditFilter{UserID: user.ID, Type: "login_failure"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 {
+			t.Fatal("audit events not filtered by type", found)
+		}
+		found, err = repo.GetAuditEvents(ctx, models.AuditFilter{UserID: user.ID, Since: now.Add(-90 * time.Minute), Until: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[0].Type != "login_success" {
+			t.Fatal("audit events not filtered by time", found)
+		}
+		found, err = repo.GetAuditEvents(ctx, models.AuditFilter{UserID: user.ID, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 2 {
+			t.Fatal("audit events not limited", found)
+		}
+	})
+
+	t.Run("webhooks", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		_ = createTestUser(t, repo)
+		webhooks, err := repo.ClaimWebhooks(ctx, 10, time.Minute)
+		if err != nil {
+			t.Fatal("failed to claim webhooks", err)
+		}
+		if len(webhooks) != 0 {
+			t.Fatal("webhooks queued while disabled", webhooks)
+		}
+
+		conf := testConfiguration()
+		conf.Webhook.URLs = "http://example.test/a, http://example.test/b"
+		repo = newRepo(t, conf)
+		user := createTestUser(t, repo)
+		webhooks, err = repo.ClaimWebhooks(ctx, 10, time.Minute)
+		if err != nil {
+			t.Fatal("failed to claim webhooks", err)
+		}
+		sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+		if len(webhooks) != 2 || webhooks[0].Endpoint != "http://example.test/a" || webhooks[1].Endpoint != "http://example.test/b" {
+			t.Fatal("unexpected webhooks", webhooks)
+		}
+		var event models.WebhookEvent
+		err = json.Unmarshal(webhooks[0].Payload, &event)
+		if err != nil {
+			t.Fatal("invalid webhook payload", err)
+		}
+		if event.Type != WebhookUserRegistered || event.User.ID != user.ID || event.User.UUID != user.UUID || event.ID == "" {
+			t.Fatal("unexpected webhook event", event)
+		}
+		if string(webhooks[1].Payload) != string(webhooks[0].Payload) {
+			t.Fatal("endpoints received different payloads")
+		}
+		claimed, err := repo.ClaimWebhooks(ctx, 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(claimed) != 0 {
+			t.Fatal("leased webhooks claimed again", claimed)
+		}
+
+		err = repo.MarkWebhookDelivered(ctx, webhooks[0].ID)
+		if err != nil {
+			t.Fatal("failed to mark webhook delivered", err)
+		}
+		err = repo.RetryWebhook(ctx, webhooks[1].ID, "status 500", time.Now().Add(-time.Second))
+		if err != nil {
+			t.Fatal("failed to retry webhook", err)
+		}
+		claimed, err = repo.ClaimWebhooks(ctx, 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(claimed) != 1 || claimed[0].ID != webhooks[1].ID || claimed[0].Attempts != 1 {
+			t.Fatal("retried webhook not claimed", claimed)
+		}
+		err = repo.MarkWebhookFailed(ctx, webhooks[1].ID, "status 500")
+		if err != nil {
+			t.Fatal("failed to mark webhook failed", err)
+		}
+		err = repo.MarkWebhookDelivered(ctx, -1)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found for missing webhook", err)
+		}
+
+		err = repo.UpdatePassword(ctx, user.ID, "hash2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.AddUserToGroup(ctx, user.ID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.DeleteUser(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claimed, err = repo.ClaimWebhooks(ctx, 1, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(claimed) != 1 {
+			t.Fatal("claim not limited", claimed)
+		}
+		rest, err := repo.ClaimWebhooks(ctx, 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types := map[string]int{}
+		for _, webhook := range append(claimed, rest...) {
+			types[webhook.EventType]++
+			err = repo.MarkWebhookDelivered(ctx, webhook.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(types) != 3 || types[WebhookUserPasswordChanged] != 2 || types[WebhookUserGroupAdded] != 2 || types[WebhookUserDeleted] != 2 {
+			t.Fatal("unexpected lifecycle webhooks", types)
+		}
+	})
+
+	t.Run("signing keys", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		now := time.Now().Truncate(time.Second)
+		older := models.SigningKey{KID: uuid.New().String(), Algorithm: "HS256", Key: "c2VjcmV0", Created: now.Add(-time.Hour)}
+		newer := models.SigningKey{KID: uuid.New().String(), Algorithm: "ES256", Key: "pem", Created: now}
+		for _, key := range []models.SigningKey{older, newer} {
+			err := repo.SaveSigningKey(ctx, key)
+			if err != nil {
+				t.Fatal("failed to save signing key", err)
+			}
+		}
+		err := repo.SaveSigningKey(ctx, newer)
+		if !errors.Is(err, ErrConflict) {
+			t.Fatal("expected conflict saving duplicate kid", err)
+		}
+		keys, err := repo.GetSigningKeys(ctx)
+		if err != nil {
+			t.Fatal("failed to get signing keys", err)
+		}
+		if len(keys) < 2 || keys[0].KID != newer.KID || keys[0].Key != newer.Key || !keys[0].Created.Equal(newer.Created) {
+			t.Fatal("newest signing key not first", keys)
+		}
+		for _, key := range []models.SigningKey{older, newer} {
+			err = repo.DeleteSigningKey(ctx, key.KID)
+			if err != nil {
+				t.Fatal("failed to delete signing key", err)
+			}
+		}
+		err = repo.DeleteSigningKey(ctx, newer.KID)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found deleting missing key", err)
+		}
+	})
+
+	t.Run("federated identities", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		user := createTestUser(t, repo)
+		other := createTestUser(t, repo)
+		now := time.Now().Truncate(time.Second)
+		github := models.FederatedIdentity{UserID: user.ID, Provider: "github", Subject: uuid.New().String(), Created: now}
+		google := models.FederatedIdentity{UserID: user.ID, Provider: "google", Subject: uuid.New().String(), Email: "user@example.com", Created: now}
+		for _, identity := range []models.FederatedIdentity{google, github} {
+			created, err := repo.CreateFederatedIdentity(ctx, identity)
+			if err != nil || created.ID == 0 {
+				t.Fatal("failed to create identity", created, err)
+			}
+		}
+		_, err := repo.CreateFederatedIdentity(ctx, models.FederatedIdentity{UserID: other.ID, Provider: "google", Subject: google.Subject, Created: now})
+		if !errors.Is(err, ErrConflict) {
+			t.Fatal("expected conflict linking subject to a second user", err)
+		}
+		_, err = repo.CreateFederatedIdentity(ctx, models.FederatedIdentity{UserID: user.ID, Provider: "google", Subject: uuid.New().String(), Created: now})
+		if !errors.Is(err, ErrConflict) {
+			t.Fatal("expected conflict linking a second google identity", err)
+		}
+		_, err = repo.CreateFederatedIdentity(ctx, models.FederatedIdentity{UserID: other.ID + 1000, Provider: "google", Subject: uuid.New().String(), Created: now})
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found linking missing user", err)
+		}
+
+		found, err := repo.GetFederatedIdentity(ctx, "google", google.Subject)
+		if err != nil || found.UserID != user.ID || found.Email != google.Email || !found.Created.Equal(now) {
+			t.Fatal("unexpected identity", found, err)
+		}
+		_, err = repo.GetFederatedIdentity(ctx, "github", google.Subject)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found for subject of another provider", err)
+		}
+		identities, err := repo.GetUserFederatedIdentities(ctx, user.ID)
+		if err != nil || len(identities) != 2 || identities[0].Provider != "github" || identities[1].Subject != google.Subject {
+			t.Fatal("unexpected identities", identities, err)
+		}
+
+		err = repo.DeleteFederatedIdentity(ctx, user.ID, "google")
+		if err != nil {
+			t.Fatal("failed to delete identity", err)
+		}
+		err = repo.DeleteFederatedIdentity(ctx, user.ID, "google")
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatal("expected not found deleting missing identity", err)
+		}
+		_, err = repo.CreateFederatedIdentity(ctx, models.FederatedIdentity{UserID: other.ID, Provider: "google", Subject: google.Subject, Created: now})
+		if err != nil {
+			t.Fatal("failed to link unlinked subject", err)
+		}
+	})
+
+	t.Run("locks", func(t *testing.T) {
+		repo := newRepo(t, testConfiguration())
+		name := "test-" + uuid.New().String()
+		lock, err := repo.TryLock(ctx, name)
+		if err != nil {
+			t.Fatal("failed to take lock", err)
+		}
+		err = lock.Check(ctx)
+		if err != nil {
+			t.Fatal("held lock failed check", err)
+		}
+		_, err = repo.TryLock(ctx, name)
+		if !errors.Is(err, ErrConflict) {
+			t.Fatal("expected conflict taking held lock", err)
+		}
+		other, err := repo.TryLock(ctx, name+"-other")
+		if err != nil {
+			t.Fatal("failed to take another lock", err)
+		}
+		other.Release(ctx)
+		err = lock.Release(ctx)
+		if err != nil {
+			t.Fatal("failed to release lock", err)
+		}
+		lock, err = repo.TryLock(ctx, name)
+		if err != nil {
+			t.Fatal("failed to take released lock", err)
+		}
+		lock.Release(ctx)
+	})
+}
+
+func TestPSQLDSN(t *testing.T) {
+	dsn := psqlDSN(config.DataSource{
+		Host:     "db",
+		Port:     5432,
+		User:     "auth",
+		Password: `it's a \secret`,
+		Dbname:   "auth",
+		SSLMode:  "verify-full",
+	})
+	expected := `host='db' port='5432' user='auth' password='it\'s a \\secret' dbname='auth' sslmode='verify-full'`
+	if dsn != expected {
+		t.Fatal("unexpected dsn", dsn)
+	}
+	url := "postgres://auth@db/auth?sslmode=require"
+	if psqlDSN(config.DataSource{URL: url, Host: "ignored"}) != url {
+		t.Fatal("url not used as dsn")
+	}
+}
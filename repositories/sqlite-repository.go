@@ -0,0 +1,853 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/models"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+type SQLiteRepository struct {
+	Conf  config.Configuration
+	Db    *sql.DB
+	locks processLocks
+}
+
+func NewSQLiteRepository(conf config.Configuration, db *sql.DB) Repository {
+	return &SQLiteRepository{
+		Conf: conf,
+		Db:   db,
+	}
+}
+
+// open sqlite db
+func ConnectSQLite(s config.DataSource) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", s.Path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Printf("Opened %s\n", s.Path)
+	return db, nil
+}
+
+// Map SQLite errors to repository errors
+func sqliteError(err error) error {
+	var sqliteErr *sqlite.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound
+	case errors.As(err, &sqliteErr) && (sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY):
+		return fmt.Errorf("%w: %s", ErrConflict, sqliteErr.Error())
+	}
+	return err
+}
+
+func (r *SQLiteRepository) Close() {
+	r.Db.Close()
+}
+
+func (r *SQLiteRepository) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	return r.Db.PingContext(ctx)
+}
+
+func (r *SQLiteRepository) GetUserByID(ctx context.Context, userID int) (models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT id, username, password, created, uuid, password_changed, disabled FROM users WHERE id = ?;"
+	var user models.User
+	err := r.Db.QueryRowContext(ctx, sql, userID).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Password,
+		&user.Created,
+		&user.UUID,
+		&user.PasswordChanged,
+		&user.Disabled,
+	)
+	if err != nil {
+		return user, sqliteError(err)
+	}
+	return user, nil
+}
+
+func (r *SQLiteRepository) GetUserByName(ctx context.Context, username string) (models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT id, username, password, created, uuid, password_changed, disabled FROM users WHERE username = ?;"
+	var user models.User
+	err := r.Db.QueryRowContext(ctx, sql, username).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Password,
+		&user.Created,
+		&user.UUID,
+		&user.PasswordChanged,
+		&user.Disabled,
+	)
+	if err != nil {
+		return user, sqliteError(err)
+	}
+	return user, nil
+}
+
+func (r *SQLiteRepository) GetUserByUUID(ctx context.Context, uuid string) (models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT id, username, password, created, uuid, password_changed, disabled FROM users WHERE uuid = ?;"
+	var user models.User
+	err := r.Db.QueryRowContext(ctx, sql, uuid).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Password,
+		&user.Created,
+		&user.UUID,
+		&user.PasswordChanged,
+		&user.Disabled,
+	)
+	if err != nil {
+		return user, sqliteError(err)
+	}
+	return user, nil
+}
+
+func (r *SQLiteRepository) CreateUser(ctx context.Context, user models.User) (models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return user, sqliteError(err)
+	}
+	sql := `INSERT INTO users (username, password, created, uuid, password_changed, disabled) VALUES (?, ?, ?, ?, ?, ?) RETURNING id;`
+	err = tx.QueryRowContext(ctx, sql, user.Username, user.Password, user.Created.UTC(), user.UUID, user.Created.UTC(), user.Disabled).Scan(&user.ID)
+	if err != nil {
+		tx.Rollback()
+		return user, sqliteError(err)
+	}
+	sql = "INSERT INTO user_groups (user_id, group_id) VALUES (?, 1);"
+	_, err = tx.ExecContext(ctx, sql, user.ID)
+	if err != nil {
+		tx.Rollback()
+		return user, sqliteError(err)
+	}
+	err = r.insertWebhooks(ctx, tx, WebhookUserRegistered, user, nil)
+	if err != nil {
+		tx.Rollback()
+		return user, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return user, sqliteError(err)
+	}
+	user.PasswordChanged = user.Created
+	return user, nil
+}
+
+func (r *SQLiteRepository) GetUserGroups(ctx context.Context, userID int) ([]models.Group, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `SELECT groups.id, groups.name
+	FROM groups
+	INNER JOIN user_groups
+	ON user_groups.group_id = groups.id
+	WHERE user_groups.user_id = ?;`
+	rows, err := r.Db.QueryContext(ctx, sql, userID)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+	var groups []models.Group
+	for rows.Next() {
+		var group models.Group
+		err = rows.Scan(&group.ID, &group.Name)
+		if err != nil {
+			return groups, sqliteError(err)
+		}
+		groups = append(groups, group)
+	}
+	err = rows.Err()
+	if err != nil {
+		return groups, sqliteError(err)
+	}
+	return groups, nil
+}
+
+// Move the current password into the history and set a new one
+func (r *SQLiteRepository) UpdatePassword(ctx context.Context, userID int, password string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteError(err)
+	}
+	now := time.Now().UTC()
+	sql := `INSERT INTO password_history (user_id, password, created)
+	SELECT id, password, ? FROM users WHERE id = ?;`
+	_, err = tx.ExecContext(ctx, sql, now, userID)
+	if err != nil {
+		tx.Rollback()
+		return sqliteError(err)
+	}
+	sql = `DELETE FROM password_history
+	WHERE user_id = ?
+	AND id NOT IN (
+		SELECT id FROM password_history
+		WHERE user_id = ?
+		ORDER BY created DESC, id DESC
+		LIMIT ?
+	);`
+	_, err = tx.ExecContext(ctx, sql, userID, userID, r.Conf.Password.History)
+	if err != nil {
+		tx.Rollback()
+		return sqliteError(err)
+	}
+	sql = "UPDATE users SET password = ?, password_changed = ? WHERE id = ? RETURNING username, uuid;"
+	user := models.User{ID: userID}
+	err = tx.QueryRowContext(ctx, sql, password, now, userID).Scan(&user.Username, &user.UUID)
+	if err != nil {
+		tx.Rollback()
+		return sqliteError(err)
+	}
+	err = r.insertWebhooks(ctx, tx, WebhookUserPasswordChanged, user, nil)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return sqliteError(tx.Commit())
+}
+
+// Replace the stored hash of the current password, e.g. after a rehash
+func (r *SQLiteRepository) ReplacePasswordHash(ctx context.Context, userID int, password string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "UPDATE users SET password = ? WHERE id = ?;"
+	result, err := r.Db.ExecContext(ctx, sql, password, userID)
+	if err != nil {
+		return sqliteError(err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Get previous password hashes, most recent first
+func (r *SQLiteRepository) GetPasswordHistory(ctx context.Context, userID int, limit int) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `SELECT password FROM password_history
+	WHERE user_id = ?
+	ORDER BY created DESC, id DESC
+	LIMIT ?;`
+	rows, err := r.Db.QueryContext(ctx, sql, userID, limit)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+	var passwords []string
+	for rows.Next() {
+		var password string
+		err = rows.Scan(&password)
+		if err != nil {
+			return passwords, sqliteError(err)
+		}
+		passwords = append(passwords, password)
+	}
+	err = rows.Err()
+	if err != nil {
+		return passwords, sqliteError(err)
+	}
+	return passwords, nil
+}
+
+func (r *SQLiteRepository) SaveRefresh(ctx context.Context, userID int, jti string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `INSERT INTO user_refresh (user_id, jti, expires) VALUES (?, ?, ?);`
+	expires := time.Now().Add(time.Duration(r.Conf.RefreshMaxAge) * time.Second).Unix()
+	_, err := r.Db.ExecContext(ctx, sql, userID, jti, expires)
+	if err != nil {
+		return sqliteError(err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) ValidateRefresh(ctx context.Context, userID int, jti string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `SELECT coalesce(revoked <= ?, 0) FROM user_refresh
+	WHERE user_id = ?
+	AND jti = ?
+	AND expires > ?;`
+
+	now := time.Now().Unix()
+	var revoked bool
+	err := r.Db.QueryRowContext(ctx, sql, now, userID, jti, now).Scan(&revoked)
+	if err != nil {
+		return sqliteError(err)
+	}
+	if revoked {
+		return ErrRevoked
+	}
+	return nil
+}
+
+// Invalidate refresh to account for concurrent requests
+func (r *SQLiteRepository) InvalidateRefresh(ctx context.Context, jti string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `UPDATE user_refresh SET revoked = ? WHERE jti = ? AND revoked IS NULL;`
+	_, err := r.Db.ExecContext(ctx, sql, time.Now().Add(refreshGracePeriod).Unix(), jti)
+	if err != nil {
+		return sqliteError(err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteAllRefresh(ctx context.Context, userID int) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `DELETE FROM user_refresh WHERE user_id = ?;`
+	_, err := r.Db.ExecContext(ctx, sql, userID)
+	if err != nil {
+		return sqliteError(err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteExpiredRefresh(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `DELETE FROM user_refresh WHERE expires < ?;`
+	_, err := r.Db.ExecContext(ctx, sql, time.Now().Unix())
+	if err != nil {
+		return sqliteError(err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) CountActiveRefresh(ctx context.Context) (int, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `SELECT count(*) FROM user_refresh WHERE expires > ? AND (revoked IS NULL OR revoked > ?);`
+	now := time.Now().Unix()
+	var count int
+	err := r.Db.QueryRowContext(ctx, sql, now, now).Scan(&count)
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+	return count, nil
+}
+
+func (r *SQLiteRepository) SaveAuditEvent(ctx context.Context, event models.AuditEvent) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	details, err := auditDetails(event.Details)
+	if err != nil {
+		return err
+	}
+	sql := `INSERT INTO audit_log (time, type, user_id, uuid, username, ip, user_agent, request_id, details)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err = r.Db.ExecContext(ctx, sql,
+		event.Time.UTC(),
+		event.Type,
+		nullableUserID(event.UserID),
+		event.UUID,
+		event.Username,
+		event.IP,
+		event.UserAgent,
+		event.RequestID,
+		details,
+	)
+	if err != nil {
+		return sqliteError(err)
+	}
+	return nil
+}
+
+// Newest events first
+func (r *SQLiteRepository) GetAuditEvents(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	where, args := auditWhere(filter, func(n int) string { return "?" })
+	args = append(args, auditLimit(filter.Limit))
+	sql := fmt.Sprintf(`SELECT id, time, type, COALESCE(user_id, 0), COALESCE(uuid, ''), COALESCE(username, ''),
+	ip, user_agent, request_id, details
+	FROM audit_log
+	%s
+	ORDER BY time DESC, id DESC
+	LIMIT ?;`, where)
+	rows, err := r.Db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var event models.AuditEvent
+		var details *string
+		err = rows.Scan(
+			&event.ID,
+			&event.Time,
+			&event.Type,
+			&event.UserID,
+			&event.UUID,
+			&event.Username,
+			&event.IP,
+			&event.UserAgent,
+			&event.RequestID,
+			&details,
+		)
+		if err != nil {
+			return events, sqliteError(err)
+		}
+		if details != nil {
+			err = json.Unmarshal([]byte(*details), &event.Details)
+			if err != nil {
+				return events, err
+			}
+		}
+		events = append(events, event)
+	}
+	return events, sqliteError(rows.Err())
+}
+
+func (r *SQLiteRepository) AddUserToGroup(ctx context.Context, userID int, groupID int) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteError(err)
+	}
+	user := models.User{ID: userID}
+	sql := "SELECT username, uuid FROM users WHERE id = ?;"
+	err = tx.QueryRowContext(ctx, sql, userID).Scan(&user.Username, &user.UUID)
+	if err != nil {
+		tx.Rollback()
+		return sqliteError(err)
+	}
+	group := models.Group{ID: groupID}
+	sql = "SELECT name FROM groups WHERE id = ?;"
+	err = tx.QueryRowContext(ctx, sql, groupID).Scan(&group.Name)
+	if err != nil {
+		tx.Rollback()
+		return sqliteError(err)
+	}
+	sql = `INSERT INTO user_groups (user_id, group_id)
+	SELECT ?, ?
+	WHERE NOT EXISTS (SELECT 1 FROM user_groups WHERE user_id = ? AND group_id = ?);`
+	result, err := tx.ExecContext(ctx, sql, userID, groupID, userID, groupID)
+	if err != nil {
+		tx.Rollback()
+		return sqliteError(err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return fmt.Errorf("%w: user is already in group", ErrConflict)
+	}
+	err = r.insertWebhooks(ctx, tx, WebhookUserGroupAdded, user, &group)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return sqliteError(tx.Commit())
+}
+
+// Delete a user along with their sessions, groups and password history
+func (r *SQLiteRepository) DeleteUser(ctx context.Context, userID int) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteError(err)
+	}
+	user := models.User{ID: userID}
+	sql := "SELECT username, uuid FROM users WHERE id = ?;"
+	err = tx.QueryRowContext(ctx, sql, userID).Scan(&user.Username, &user.UUID)
+	if err != nil {
+		tx.Rollback()
+		return sqliteError(err)
+	}
+	for _, sql := range []string{
+		"DELETE FROM user_refresh WHERE user_id = ?;",
+		"DELETE FROM user_groups WHERE user_id = ?;",
+		"DELETE FROM password_history WHERE user_id = ?;",
+		"DELETE FROM federated_identities WHERE user_id = ?;",
+		"DELETE FROM users WHERE id = ?;",
+	} {
+		_, err = tx.ExecContext(ctx, sql, userID)
+		if err != nil {
+			tx.Rollback()
+			return sqliteError(err)
+		}
+	}
+	err = r.insertWebhooks(ctx, tx, WebhookUserDeleted, user, nil)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return sqliteError(tx.Commit())
+}
+
+// Write outbox rows as part of the caller's transaction
+func (r *SQLiteRepository) insertWebhooks(ctx context.Context, tx *sql.Tx, eventType string, user models.User, group *models.Group) error {
+	webhooks, err := newWebhooks(r.Conf.Webhook, eventType, user, group)
+	if err != nil {
+		return err
+	}
+	sql := `INSERT INTO webhook_outbox (endpoint, event_type, payload, created, next_attempt)
+	VALUES (?, ?, ?, ?, ?);`
+	for _, webhook := range webhooks {
+		_, err = tx.ExecContext(ctx, sql, webhook.Endpoint, webhook.EventType, string(webhook.Payload), webhook.Created, webhook.NextAttempt.Unix())
+		if err != nil {
+			return sqliteError(err)
+		}
+	}
+	return nil
+}
+
+// Claim pending webhooks that are due by pushing their next attempt past the lease
+func (r *SQLiteRepository) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.Webhook, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	now := time.Now()
+	sql := `UPDATE webhook_outbox
+	SET next_attempt = ?
+	WHERE id IN (
+		SELECT id FROM webhook_outbox
+		WHERE status = 'pending'
+		AND next_attempt <= ?
+		ORDER BY next_attempt, id
+		LIMIT ?
+	)
+	RETURNING id, endpoint, event_type, payload, created, attempts, next_attempt;`
+	rows, err := r.Db.QueryContext(ctx, sql, now.Add(lease).Unix(), now.Unix(), limit)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+	var webhooks []models.Webhook
+	for rows.Next() {
+		var webhook models.Webhook
+		var payload string
+		var nextAttempt int64
+		err = rows.Scan(
+			&webhook.ID,
+			&webhook.Endpoint,
+			&webhook.EventType,
+			&payload,
+			&webhook.Created,
+			&webhook.Attempts,
+			&nextAttempt,
+		)
+		if err != nil {
+			return webhooks, sqliteError(err)
+		}
+		webhook.Payload = []byte(payload)
+		webhook.NextAttempt = time.Unix(nextAttempt, 0)
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, sqliteError(rows.Err())
+}
+
+func (r *SQLiteRepository) MarkWebhookDelivered(ctx context.Context, id int64) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `UPDATE webhook_outbox
+	SET status = 'delivered', attempts = attempts + 1, last_error = NULL
+	WHERE id = ?;`
+	return r.execAffecting(ctx, sql, id)
+}
+
+func (r *SQLiteRepository) RetryWebhook(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `UPDATE webhook_outbox
+	SET attempts = attempts + 1, last_error = ?, next_attempt = ?
+	WHERE id = ?;`
+	return r.execAffecting(ctx, sql, lastError, nextAttempt.Unix(), id)
+}
+
+// Give up on a webhook, it stays in the outbox for inspection
+func (r *SQLiteRepository) MarkWebhookFailed(ctx context.Context, id int64, lastError string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `UPDATE webhook_outbox
+	SET status = 'failed', attempts = attempts + 1, last_error = ?
+	WHERE id = ?;`
+	return r.execAffecting(ctx, sql, lastError, id)
+}
+
+// SQLite databases are not shared between replicas, so locks only need to
+// exclude other goroutines in this process
+func (r *SQLiteRepository) TryLock(ctx context.Context, name string) (Lock, error) {
+	return r.locks.tryLock(name)
+}
+
+// List users ordered by id, starting after afterID
+func (r *SQLiteRepository) ListUsers(ctx context.Context, afterID int, limit int) ([]models.User, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `SELECT id, username, password, created, uuid, password_changed, disabled FROM users
+	WHERE id > ?
+	ORDER BY id
+	LIMIT ?;`
+	rows, err := r.Db.QueryContext(ctx, sql, afterID, limit)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+	users := []models.User{}
+	for rows.Next() {
+		var user models.User
+		err = rows.Scan(
+			&user.ID,
+			&user.Username,
+			&user.Password,
+			&user.Created,
+			&user.UUID,
+			&user.PasswordChanged,
+			&user.Disabled,
+		)
+		if err != nil {
+			return users, sqliteError(err)
+		}
+		users = append(users, user)
+	}
+	return users, sqliteError(rows.Err())
+}
+
+func (r *SQLiteRepository) SetUserDisabled(ctx context.Context, userID int, disabled bool) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "UPDATE users SET disabled = ? WHERE id = ?;"
+	return r.execAffecting(ctx, sql, disabled, userID)
+}
+
+func (r *SQLiteRepository) CreateGroup(ctx context.Context, name string) (models.Group, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	group := models.Group{Name: name}
+	sql := "INSERT INTO groups (name) VALUES (?) RETURNING id;"
+	err := r.Db.QueryRowContext(ctx, sql, name).Scan(&group.ID)
+	if err != nil {
+		return group, sqliteError(err)
+	}
+	return group, nil
+}
+
+func (r *SQLiteRepository) GetGroupByName(ctx context.Context, name string) (models.Group, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	group := models.Group{Name: name}
+	sql := "SELECT id FROM groups WHERE name = ?;"
+	err := r.Db.QueryRowContext(ctx, sql, name).Scan(&group.ID)
+	if err != nil {
+		return group, sqliteError(err)
+	}
+	return group, nil
+}
+
+func (r *SQLiteRepository) RemoveUserFromGroup(ctx context.Context, userID int, groupID int) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "DELETE FROM user_groups WHERE user_id = ? AND group_id = ?;"
+	return r.execAffecting(ctx, sql, userID, groupID)
+}
+
+func (r *SQLiteRepository) SaveSigningKey(ctx context.Context, key models.SigningKey) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "INSERT INTO signing_keys (kid, algorithm, key, created) VALUES (?, ?, ?, ?);"
+	_, err := r.Db.ExecContext(ctx, sql, key.KID, key.Algorithm, key.Key, key.Created.UTC())
+	return sqliteError(err)
+}
+
+// Newest keys first
+func (r *SQLiteRepository) GetSigningKeys(ctx context.Context) ([]models.SigningKey, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT kid, algorithm, key, created FROM signing_keys ORDER BY created DESC, kid DESC;"
+	rows, err := r.Db.QueryContext(ctx, sql)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+	var keys []models.SigningKey
+	for rows.Next() {
+		var key models.SigningKey
+		err = rows.Scan(&key.KID, &key.Algorithm, &key.Key, &key.Created)
+		if err != nil {
+			return keys, sqliteError(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, sqliteError(rows.Err())
+}
+
+func (r *SQLiteRepository) DeleteSigningKey(ctx context.Context, kid string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "DELETE FROM signing_keys WHERE kid = ?;"
+	return r.execAffecting(ctx, sql, kid)
+}
+
+// Run a statement, returning ErrNotFound if it changed no rows
+func (r *SQLiteRepository) execAffecting(ctx context.Context, sql string, args ...interface{}) error {
+	result, err := r.Db.ExecContext(ctx, sql, args...)
+	if err != nil {
+		return sqliteError(err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) ImportUsers(ctx context.Context, users []models.UserImport, onConflict string) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	tx, err := r.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	outcomes := make([]string, len(users))
+	for i, u := range users {
+		outcomes[i], err = r.importUser(ctx, tx, u, onConflict)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	return outcomes, nil
+}
+
+func (r *SQLiteRepository) importUser(ctx context.Context, tx *sql.Tx, u models.UserImport, onConflict string) (string, error) {
+	user := u.User
+	var existing string
+	sql := "SELECT id, uuid, password FROM users WHERE username = ?;"
+	err := sqliteError(tx.QueryRowContext(ctx, sql, user.Username).Scan(&user.ID, &user.UUID, &existing))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	outcome := ImportCreated
+	eventType := WebhookUserRegistered
+	if err == nil {
+		switch onConflict {
+		case ImportSkip:
+			return ImportSkipped, nil
+		case ImportOverwrite:
+		default:
+			return "", fmt.Errorf("%w: username %s already exists", ErrConflict, user.Username)
+		}
+		sql = "UPDATE users SET password = ?, password_changed = ?, disabled = ? WHERE id = ?;"
+		_, err = tx.ExecContext(ctx, sql, user.Password, user.PasswordChanged.UTC(), user.Disabled, user.ID)
+		if err != nil {
+			return "", sqliteError(err)
+		}
+		sql = "DELETE FROM user_groups WHERE user_id = ?;"
+		_, err = tx.ExecContext(ctx, sql, user.ID)
+		if err != nil {
+			return "", sqliteError(err)
+		}
+		outcome = ImportUpdated
+		eventType = ""
+		if existing != user.Password {
+			eventType = WebhookUserPasswordChanged
+		}
+	} else {
+		sql = `INSERT INTO users (username, password, created, uuid, password_changed, disabled)
+		VALUES (?, ?, ?, ?, ?, ?) RETURNING id;`
+		err = tx.QueryRowContext(ctx, sql, user.Username, user.Password, user.Created.UTC(), user.UUID, user.PasswordChanged.UTC(), user.Disabled).Scan(&user.ID)
+		if err != nil {
+			return "", sqliteError(err)
+		}
+	}
+	sql = "INSERT INTO user_groups (user_id, group_id) VALUES (?, ?);"
+	for _, groupID := range u.GroupIDs {
+		_, err = tx.ExecContext(ctx, sql, user.ID, groupID)
+		if err != nil {
+			return "", sqliteError(err)
+		}
+	}
+	if eventType != "" {
+		err = r.insertWebhooks(ctx, tx, eventType, user, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+	return outcome, nil
+}
+
+func (r *SQLiteRepository) CreateFederatedIdentity(ctx context.Context, identity models.FederatedIdentity) (models.FederatedIdentity, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := `INSERT INTO federated_identities (user_id, provider, subject, email, created)
+	SELECT id, ?, ?, NULLIF(?, ''), ? FROM users WHERE id = ?
+	RETURNING id;`
+	err := r.Db.QueryRowContext(ctx, sql, identity.Provider, identity.Subject, identity.Email, identity.Created, identity.UserID).Scan(&identity.ID)
+	if err != nil {
+		return identity, sqliteError(err)
+	}
+	return identity, nil
+}
+
+func (r *SQLiteRepository) GetFederatedIdentity(ctx context.Context, provider string, subject string) (models.FederatedIdentity, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	identity := models.FederatedIdentity{Provider: provider, Subject: subject}
+	sql := "SELECT id, user_id, COALESCE(email, ''), created FROM federated_identities WHERE provider = ? AND subject = ?;"
+	err := r.Db.QueryRowContext(ctx, sql, provider, subject).Scan(&identity.ID, &identity.UserID, &identity.Email, &identity.Created)
+	if err != nil {
+		return identity, sqliteError(err)
+	}
+	return identity, nil
+}
+
+// Ordered by provider
+func (r *SQLiteRepository) GetUserFederatedIdentities(ctx context.Context, userID int) ([]models.FederatedIdentity, error) {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "SELECT id, provider, subject, COALESCE(email, ''), created FROM federated_identities WHERE user_id = ? ORDER BY provider;"
+	rows, err := r.Db.QueryContext(ctx, sql, userID)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+	var identities []models.FederatedIdentity
+	for rows.Next() {
+		identity := models.FederatedIdentity{UserID: userID}
+		err = rows.Scan(&identity.ID, &identity.Provider, &identity.Subject, &identity.Email, &identity.Created)
+		if err != nil {
+			return identities, sqliteError(err)
+		}
+		identities = append(identities, identity)
+	}
+	return identities, sqliteError(rows.Err())
+}
+
+func (r *SQLiteRepository) DeleteFederatedIdentity(ctx context.Context, userID int, provider string) error {
+	ctx, cancel := withTimeout(ctx, r.Conf.Db.QueryTimeout)
+	defer cancel()
+	sql := "DELETE FROM federated_identities WHERE user_id = ? AND provider = ?;"
+	return r.execAffecting(ctx, sql, userID, provider)
+}
@@ -0,0 +1,73 @@
+package repositories
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/models"
+	"github.com/google/uuid"
+)
+
+// Webhook event types
+const (
+	WebhookUserRegistered      = "user.registered"
+	WebhookUserPasswordChanged = "user.password_changed"
+	WebhookUserGroupAdded      = "user.group_added"
+	WebhookUserDeleted         = "user.deleted"
+)
+
+// Outbox row statuses
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+func webhookEndpoints(c config.WebhookConfig) []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(c.URLs, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// Build one outbox row per configured endpoint, or none when webhooks are
+// disabled. Every row for an event carries the same event ID so receivers
+// can deduplicate retries.
+func newWebhooks(c config.WebhookConfig, eventType string, user models.User, group *models.Group) ([]models.Webhook, error) {
+	endpoints := webhookEndpoints(c)
+	if len(endpoints) == 0 {
+		return nil, nil
+	}
+	now := time.Now().UTC()
+	payload, err := json.Marshal(models.WebhookEvent{
+		ID:      uuid.New().String(),
+		Type:    eventType,
+		Created: now,
+		User: models.WebhookUser{
+			ID:       user.ID,
+			UUID:     user.UUID,
+			Username: user.Username,
+		},
+		Group: group,
+	})
+	if err != nil {
+		return nil, err
+	}
+	webhooks := make([]models.Webhook, len(endpoints))
+	for i, endpoint := range endpoints {
+		webhooks[i] = models.Webhook{
+			Endpoint:    endpoint,
+			EventType:   eventType,
+			Payload:     payload,
+			Created:     now,
+			NextAttempt: now,
+		}
+	}
+	return webhooks, nil
+}
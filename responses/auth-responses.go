@@ -46,6 +46,26 @@ func (r *AuthResponses) UnauthorizedRequest(w http.ResponseWriter, err error) {
 	http.Error(w, msg, http.StatusUnauthorized)
 }
 
+func (r *AuthResponses) Forbidden(w http.ResponseWriter, err error) {
+	var msg string
+	if r.Debug {
+		msg = err.Error()
+	} else {
+		msg = "Forbidden"
+	}
+	http.Error(w, msg, http.StatusForbidden)
+}
+
+func (r *AuthResponses) UnsupportedMediaType(w http.ResponseWriter, err error) {
+	var msg string
+	if r.Debug {
+		msg = err.Error()
+	} else {
+		msg = "Unsupported media type"
+	}
+	http.Error(w, msg, http.StatusUnsupportedMediaType)
+}
+
 func (r *AuthResponses) InternalServerError(w http.ResponseWriter, err error) {
 	logging.LogCaller(err)
 	var msg string
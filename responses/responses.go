@@ -6,5 +6,7 @@ type Responses interface {
 	BadRequest(w http.ResponseWriter, err error)
 	NotFound(w http.ResponseWriter, err error)
 	UnauthorizedRequest(w http.ResponseWriter, err error)
+	Forbidden(w http.ResponseWriter, err error)
+	UnsupportedMediaType(w http.ResponseWriter, err error)
 	InternalServerError(w http.ResponseWriter, err error)
 }
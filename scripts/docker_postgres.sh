@@ -5,5 +5,4 @@ docker run -d \
 	-e POSTGRES_USER=auth \
 	-e POSTGRES_PASSWORD=my-secret-password \
 	-v $PWD/pgdata/:/var/lib/postgresql/data/ \
-	-v $PWD/deploy/db/:/docker-entrypoint-initdb.d/ \
 	postgres:14
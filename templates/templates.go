@@ -0,0 +1,16 @@
+// Package templates embeds the default HTML templates, for servers started
+// without the templates directory
+package templates
+
+import (
+	"embed"
+	"html/template"
+)
+
+//go:embed *.html
+var files embed.FS
+
+// Parse the embedded templates
+func Parse() (*template.Template, error) {
+	return template.ParseFS(files, "*.html")
+}
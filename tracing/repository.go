@@ -0,0 +1,280 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tracedRepository struct {
+	repositories.Repository
+}
+
+// NewRepository creates a span for every call to the wrapped repository
+func NewRepository(inner repositories.Repository) repositories.Repository {
+	return &tracedRepository{Repository: inner}
+}
+
+func (r *tracedRepository) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, "Repository."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// Missing records and revoked refresh tokens are expected outcomes, not
+// failed spans
+func (r *tracedRepository) end(span trace.Span, err error) {
+	if errors.Is(err, repositories.ErrNotFound) {
+		span.SetAttributes(attribute.Bool("go_auth.not_found", true))
+		err = nil
+	}
+	if errors.Is(err, repositories.ErrRevoked) {
+		span.SetAttributes(attribute.Bool("go_auth.revoked", true))
+		err = nil
+	}
+	End(span, err)
+}
+
+func userID(id int) attribute.KeyValue {
+	return attribute.Int("go_auth.user_id", id)
+}
+
+func webhookID(id int64) attribute.KeyValue {
+	return attribute.Int64("go_auth.webhook_id", id)
+}
+
+func (r *tracedRepository) Ping(ctx context.Context) (err error) {
+	ctx, span := r.start(ctx, "Ping")
+	defer func() { r.end(span, err) }()
+	return r.Repository.Ping(ctx)
+}
+
+func (r *tracedRepository) GetUserByID(ctx context.Context, id int) (user models.User, err error) {
+	ctx, span := r.start(ctx, "GetUserByID", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetUserByID(ctx, id)
+}
+
+func (r *tracedRepository) GetUserByName(ctx context.Context, username string) (user models.User, err error) {
+	ctx, span := r.start(ctx, "GetUserByName")
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetUserByName(ctx, username)
+}
+
+func (r *tracedRepository) GetUserByUUID(ctx context.Context, uuid string) (user models.User, err error) {
+	ctx, span := r.start(ctx, "GetUserByUUID")
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetUserByUUID(ctx, uuid)
+}
+
+func (r *tracedRepository) CreateUser(ctx context.Context, user models.User) (created models.User, err error) {
+	ctx, span := r.start(ctx, "CreateUser")
+	defer func() { r.end(span, err) }()
+	return r.Repository.CreateUser(ctx, user)
+}
+
+func (r *tracedRepository) GetUserGroups(ctx context.Context, id int) (groups []models.Group, err error) {
+	ctx, span := r.start(ctx, "GetUserGroups", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetUserGroups(ctx, id)
+}
+
+func (r *tracedRepository) UpdatePassword(ctx context.Context, id int, password string) (err error) {
+	ctx, span := r.start(ctx, "UpdatePassword", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.UpdatePassword(ctx, id, password)
+}
+
+func (r *tracedRepository) ReplacePasswordHash(ctx context.Context, id int, password string) (err error) {
+	ctx, span := r.start(ctx, "ReplacePasswordHash", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.ReplacePasswordHash(ctx, id, password)
+}
+
+func (r *tracedRepository) GetPasswordHistory(ctx context.Context, id int, limit int) (history []string, err error) {
+	ctx, span := r.start(ctx, "GetPasswordHistory", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetPasswordHistory(ctx, id, limit)
+}
+
+func (r *tracedRepository) SaveRefresh(ctx context.Context, id int, jti string) (err error) {
+	ctx, span := r.start(ctx, "SaveRefresh", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.SaveRefresh(ctx, id, jti)
+}
+
+func (r *tracedRepository) ValidateRefresh(ctx context.Context, id int, jti string) (err error) {
+	ctx, span := r.start(ctx, "ValidateRefresh", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.ValidateRefresh(ctx, id, jti)
+}
+
+func (r *tracedRepository) InvalidateRefresh(ctx context.Context, jti string) (err error) {
+	ctx, span := r.start(ctx, "InvalidateRefresh")
+	defer func() { r.end(span, err) }()
+	return r.Repository.InvalidateRefresh(ctx, jti)
+}
+
+func (r *tracedRepository) DeleteAllRefresh(ctx context.Context, id int) (err error) {
+	ctx, span := r.start(ctx, "DeleteAllRefresh", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.DeleteAllRefresh(ctx, id)
+}
+
+func (r *tracedRepository) DeleteExpiredRefresh(ctx context.Context) (err error) {
+	ctx, span := r.start(ctx, "DeleteExpiredRefresh")
+	defer func() { r.end(span, err) }()
+	return r.Repository.DeleteExpiredRefresh(ctx)
+}
+
+func (r *tracedRepository) CountActiveRefresh(ctx context.Context) (count int, err error) {
+	ctx, span := r.start(ctx, "CountActiveRefresh")
+	defer func() { r.end(span, err) }()
+	return r.Repository.CountActiveRefresh(ctx)
+}
+
+func (r *tracedRepository) SaveAuditEvent(ctx context.Context, event models.AuditEvent) (err error) {
+	ctx, span := r.start(ctx, "SaveAuditEvent", attribute.String("go_auth.audit_type", event.Type))
+	defer func() { r.end(span, err) }()
+	return r.Repository.SaveAuditEvent(ctx, event)
+}
+
+func (r *tracedRepository) GetAuditEvents(ctx context.Context, filter models.AuditFilter) (events []models.AuditEvent, err error) {
+	ctx, span := r.start(ctx, "GetAuditEvents")
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetAuditEvents(ctx, filter)
+}
+
+func (r *tracedRepository) AddUserToGroup(ctx context.Context, id int, groupID int) (err error) {
+	ctx, span := r.start(ctx, "AddUserToGroup", userID(id), attribute.Int("go_auth.group_id", groupID))
+	defer func() { r.end(span, err) }()
+	return r.Repository.AddUserToGroup(ctx, id, groupID)
+}
+
+func (r *tracedRepository) DeleteUser(ctx context.Context, id int) (err error) {
+	ctx, span := r.start(ctx, "DeleteUser", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.DeleteUser(ctx, id)
+}
+
+func (r *tracedRepository) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) (webhooks []models.Webhook, err error) {
+	ctx, span := r.start(ctx, "ClaimWebhooks")
+	defer func() { r.end(span, err) }()
+	return r.Repository.ClaimWebhooks(ctx, limit, lease)
+}
+
+func (r *tracedRepository) MarkWebhookDelivered(ctx context.Context, id int64) (err error) {
+	ctx, span := r.start(ctx, "MarkWebhookDelivered", webhookID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.MarkWebhookDelivered(ctx, id)
+}
+
+func (r *tracedRepository) RetryWebhook(ctx context.Context, id int64, lastError string, nextAttempt time.Time) (err error) {
+	ctx, span := r.start(ctx, "RetryWebhook", webhookID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.RetryWebhook(ctx, id, lastError, nextAttempt)
+}
+
+func (r *tracedRepository) MarkWebhookFailed(ctx context.Context, id int64, lastError string) (err error) {
+	ctx, span := r.start(ctx, "MarkWebhookFailed", webhookID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.MarkWebhookFailed(ctx, id, lastError)
+}
+
+func (r *tracedRepository) TryLock(ctx context.Context, name string) (lock repositories.Lock, err error) {
+	ctx, span := r.start(ctx, "TryLock", attribute.String("go_auth.lock", name))
+	defer func() {
+		// Losing the race for a lock is expected, not a failed span
+		if errors.Is(err, repositories.ErrConflict) {
+			span.SetAttributes(attribute.Bool("go_auth.lock_held", true))
+			r.end(span, nil)
+			return
+		}
+		r.end(span, err)
+	}()
+	return r.Repository.TryLock(ctx, name)
+}
+
+func (r *tracedRepository) ListUsers(ctx context.Context, afterID int, limit int) (users []models.User, err error) {
+	ctx, span := r.start(ctx, "ListUsers")
+	defer func() { r.end(span, err) }()
+	return r.Repository.ListUsers(ctx, afterID, limit)
+}
+
+func (r *tracedRepository) SetUserDisabled(ctx context.Context, id int, disabled bool) (err error) {
+	ctx, span := r.start(ctx, "SetUserDisabled", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.SetUserDisabled(ctx, id, disabled)
+}
+
+func (r *tracedRepository) CreateGroup(ctx context.Context, name string) (group models.Group, err error) {
+	ctx, span := r.start(ctx, "CreateGroup")
+	defer func() { r.end(span, err) }()
+	return r.Repository.CreateGroup(ctx, name)
+}
+
+func (r *tracedRepository) GetGroupByName(ctx context.Context, name string) (group models.Group, err error) {
+	ctx, span := r.start(ctx, "GetGroupByName")
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetGroupByName(ctx, name)
+}
+
+func (r *tracedRepository) RemoveUserFromGroup(ctx context.Context, id int, groupID int) (err error) {
+	ctx, span := r.start(ctx, "RemoveUserFromGroup", userID(id), attribute.Int("go_auth.group_id", groupID))
+	defer func() { r.end(span, err) }()
+	return r.Repository.RemoveUserFromGroup(ctx, id, groupID)
+}
+
+func (r *tracedRepository) SaveSigningKey(ctx context.Context, key models.SigningKey) (err error) {
+	ctx, span := r.start(ctx, "SaveSigningKey", attribute.String("go_auth.kid", key.KID))
+	defer func() { r.end(span, err) }()
+	return r.Repository.SaveSigningKey(ctx, key)
+}
+
+func (r *tracedRepository) GetSigningKeys(ctx context.Context) (keys []models.SigningKey, err error) {
+	ctx, span := r.start(ctx, "GetSigningKeys")
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetSigningKeys(ctx)
+}
+
+func (r *tracedRepository) DeleteSigningKey(ctx context.Context, kid string) (err error) {
+	ctx, span := r.start(ctx, "DeleteSigningKey", attribute.String("go_auth.kid", kid))
+	defer func() { r.end(span, err) }()
+	return r.Repository.DeleteSigningKey(ctx, kid)
+}
+
+func (r *tracedRepository) ImportUsers(ctx context.Context, users []models.UserImport, onConflict string) (outcomes []string, err error) {
+	ctx, span := r.start(ctx, "ImportUsers", attribute.Int("go_auth.import_size", len(users)), attribute.String("go_auth.on_conflict", onConflict))
+	defer func() { r.end(span, err) }()
+	return r.Repository.ImportUsers(ctx, users, onConflict)
+}
+
+func (r *tracedRepository) CreateFederatedIdentity(ctx context.Context, identity models.FederatedIdentity) (created models.FederatedIdentity, err error) {
+	ctx, span := r.start(ctx, "CreateFederatedIdentity", userID(identity.UserID), attribute.String("go_auth.provider", identity.Provider))
+	defer func() { r.end(span, err) }()
+	return r.Repository.CreateFederatedIdentity(ctx, identity)
+}
+
+func (r *tracedRepository) GetFederatedIdentity(ctx context.Context, provider string, subject string) (identity models.FederatedIdentity, err error) {
+	ctx, span := r.start(ctx, "GetFederatedIdentity", attribute.String("go_auth.provider", provider))
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetFederatedIdentity(ctx, provider, subject)
+}
+
+func (r *tracedRepository) GetUserFederatedIdentities(ctx context.Context, id int) (identities []models.FederatedIdentity, err error) {
+	ctx, span := r.start(ctx, "GetUserFederatedIdentities", userID(id))
+	defer func() { r.end(span, err) }()
+	return r.Repository.GetUserFederatedIdentities(ctx, id)
+}
+
+func (r *tracedRepository) DeleteFederatedIdentity(ctx context.Context, id int, provider string) (err error) {
+	ctx, span := r.start(ctx, "DeleteFederatedIdentity", userID(id), attribute.String("go_auth.provider", provider))
+	defer func() { r.end(span, err) }()
+	return r.Repository.DeleteFederatedIdentity(ctx, id, provider)
+}
@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/repositories"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestRepositorySpans(t *testing.T) {
+	recorder := recordSpans(t)
+	repo := NewRepository(repositories.NewMemoryRepository(config.Configuration{}))
+
+	ctx, parent := Tracer().Start(context.Background(), "parent")
+	_, err := repo.GetUserByID(ctx, -1)
+	if err == nil {
+		t.Fatal("expected missing user")
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "Repository.GetUserByID" {
+		t.Fatal("unexpected spans", spans)
+	}
+	span := spans[0]
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatal("repository span is not a child of the caller")
+	}
+	if span.Status().Code == codes.Error {
+		t.Fatal("not found recorded as an error")
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	recorder := recordSpans(t)
+	_, err := Setup(context.Background(), config.TracingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.Use(otelmux.Middleware("go-auth"))
+	r.HandleFunc("/auth/", func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest("GET", "/auth/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatal("expected a span for the route", spans)
+	}
+	if spans[0].SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatal("incoming trace context not used", spans[0].SpanContext().TraceID())
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	path := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(context.Background(), config.TracingConfig{
+		Exporter:    "stdout",
+		File:        path,
+		SampleRatio: 1,
+		ServiceName: "go-auth",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Tracer().Start(context.Background(), "exported")
+	span.End()
+	err = shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"Name":"exported"`) {
+		t.Fatal("span not written to file", string(b))
+	}
+}
+
+func TestUnsupportedExporter(t *testing.T) {
+	_, err := Setup(context.Background(), config.TracingConfig{Exporter: "zipkin"})
+	if err == nil {
+		t.Fatal("expected error for unsupported exporter")
+	}
+}
@@ -0,0 +1,35 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/repositories"
+)
+
+// NewJob applies the configured jitter, retries and timeout to a job
+func NewJob(name string, spec string, conf config.SchedulerConfig, run func(ctx context.Context) error) (Job, error) {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return Job{}, err
+	}
+	return Job{
+		Name:         name,
+		Schedule:     schedule,
+		Run:          run,
+		Jitter:       time.Duration(conf.Jitter) * time.Second,
+		Retries:      conf.Retries,
+		RetryBackoff: time.Duration(conf.RetryBackoff) * time.Second,
+		Timeout:      time.Duration(conf.Timeout) * time.Second,
+	}, nil
+}
+
+// NewJobs builds every scheduled job
+func NewJobs(repo repositories.Repository, conf config.SchedulerConfig) ([]Job, error) {
+	purgeRefresh, err := NewJob("purge_refresh", conf.PurgeRefreshSchedule, conf, repo.DeleteExpiredRefresh)
+	if err != nil {
+		return nil, err
+	}
+	return []Job{purgeRefresh}, nil
+}
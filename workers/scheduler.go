@@ -0,0 +1,236 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheebz/go-auth/metrics"
+	"github.com/cheebz/go-auth/repositories"
+)
+
+const (
+	// Advisory lock held by the replica that runs scheduled jobs
+	schedulerLock         = "go-auth:scheduler"
+	defaultLeaderInterval = 15 * time.Second
+	defaultRetryBackoff   = 10 * time.Second
+)
+
+// Job is a unit of background work run on a schedule
+type Job struct {
+	Name     string
+	Schedule Schedule
+	Run      func(ctx context.Context) error
+	// Random delay added to each run so jobs do not all start at once
+	Jitter time.Duration
+	// Attempts after the first failure, each waiting twice as long as the last
+	Retries      int
+	RetryBackoff time.Duration
+	// Limit on each attempt, zero for none
+	Timeout time.Duration
+}
+
+// Locker is implemented by repositories that provide advisory locks
+type Locker interface {
+	TryLock(ctx context.Context, name string) (repositories.Lock, error)
+}
+
+// Scheduler runs jobs on the one replica that holds the scheduler lock.
+// Other replicas keep trying to take the lock and skip their runs until
+// they do.
+type Scheduler struct {
+	Locker Locker
+	// How often leadership is checked or contested
+	LeaderInterval time.Duration
+	jobs           []Job
+	mu             sync.Mutex
+	lock           repositories.Lock
+	leader         atomic.Bool
+	// unix nanoseconds the leader loop last ran
+	heartbeat atomic.Int64
+}
+
+func NewScheduler(locker Locker) *Scheduler {
+	return &Scheduler{
+		Locker:         locker,
+		LeaderInterval: defaultLeaderInterval,
+	}
+}
+
+// Add registers a job, it must be called before Start
+func (s *Scheduler) Add(job Job) {
+	s.jobs = append(s.jobs, job)
+}
+
+// Leader reports whether this replica is currently running jobs
+func (s *Scheduler) Leader() bool {
+	return s.leader.Load()
+}
+
+// Run jobs until the context is done, then release leadership
+func (s *Scheduler) Start(ctx context.Context) {
+	s.elect(ctx)
+	var wg sync.WaitGroup
+	for _, job := range s.jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.loop(ctx, job)
+		}()
+	}
+	ticker := time.NewTicker(s.LeaderInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			s.resign()
+			return
+		case <-ticker.C:
+			s.elect(ctx)
+		}
+	}
+}
+
+// Take the scheduler lock, or confirm it is still held
+func (s *Scheduler) elect(ctx context.Context) {
+	s.heartbeat.Store(time.Now().UnixNano())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lock != nil {
+		err := s.lock.Check(ctx)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println(fmt.Sprintf("lost scheduler lock: %s", err.Error()))
+		s.lock.Release(context.Background())
+		s.lock = nil
+		s.setLeader(false)
+	}
+	lock, err := s.Locker.TryLock(ctx, schedulerLock)
+	if err != nil {
+		if !errors.Is(err, repositories.ErrConflict) && ctx.Err() == nil {
+			log.Println(fmt.Sprintf("failed to take scheduler lock: %s", err.Error()))
+		}
+		return
+	}
+	s.lock = lock
+	s.setLeader(true)
+}
+
+func (s *Scheduler) resign() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lock == nil {
+		return
+	}
+	err := s.lock.Release(context.Background())
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to release scheduler lock: %s", err.Error()))
+	}
+	s.lock = nil
+	s.setLeader(false)
+}
+
+func (s *Scheduler) setLeader(leader bool) {
+	s.leader.Store(leader)
+	if leader {
+		metrics.SchedulerLeader.Set(1)
+	} else {
+		metrics.SchedulerLeader.Set(0)
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, job Job) {
+	for {
+		next := job.Schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Println(fmt.Sprintf("job %s has no further runs", job.Name))
+			return
+		}
+		if job.Jitter > 0 {
+			next = next.Add(rand.N(job.Jitter))
+		}
+		if !sleep(ctx, time.Until(next)) {
+			return
+		}
+		if !s.Leader() {
+			metrics.JobRuns.WithLabelValues(job.Name, metrics.Skipped).Inc()
+			continue
+		}
+		s.run(ctx, job)
+	}
+}
+
+// Run a job now, retrying with backoff until it succeeds or runs out of attempts
+func (s *Scheduler) run(ctx context.Context, job Job) error {
+	start := time.Now()
+	backoff := job.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = s.attempt(ctx, job)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if attempt >= job.Retries {
+			log.Println(fmt.Sprintf("job %s failed after %d attempts: %s", job.Name, attempt+1, err.Error()))
+			break
+		}
+		log.Println(fmt.Sprintf("job %s failed, retrying in %s: %s", job.Name, backoff, err.Error()))
+		metrics.JobRetries.WithLabelValues(job.Name).Inc()
+		if !sleep(ctx, backoff) {
+			break
+		}
+		backoff *= 2
+	}
+	if ctx.Err() == nil {
+		metrics.ObserveJob(job.Name, start, err)
+	}
+	return err
+}
+
+func (s *Scheduler) attempt(ctx context.Context, job Job) error {
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.Timeout)
+		defer cancel()
+	}
+	return job.Run(ctx)
+}
+
+// Check reports an error if the scheduler is not running. A replica that
+// is not the leader is still healthy.
+func (s *Scheduler) Check(ctx context.Context) error {
+	heartbeat := s.heartbeat.Load()
+	if heartbeat == 0 {
+		return fmt.Errorf("scheduler has not started")
+	}
+	since := time.Since(time.Unix(0, heartbeat))
+	if since > 3*s.LeaderInterval {
+		return fmt.Errorf("scheduler last ran %s ago", since.Truncate(time.Second))
+	}
+	return nil
+}
+
+// sleep waits for d, returning false if the context is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
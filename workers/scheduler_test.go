@@ -0,0 +1,136 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/repositories"
+)
+
+func TestParseSchedule(t *testing.T) {
+	start := time.Date(2024, time.January, 31, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, time.January, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, time.February, 1, 3, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.January, 31, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2024, time.February, 29, 12, 0, 0, 0, time.UTC)},
+		{"30 9 1,15 * 1-5", time.Date(2024, time.February, 1, 9, 30, 0, 0, time.UTC)},
+		{"@every 1h", time.Date(2024, time.January, 31, 11, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.spec)
+		if err != nil {
+			t.Fatal(test.spec, err)
+		}
+		next := schedule.Next(start)
+		if !next.Equal(test.next) {
+			t.Error(test.spec, "expected", test.next, "got", next)
+		}
+	}
+	never, err := ParseSchedule("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !never.Next(start).IsZero() {
+		t.Error("impossible schedule has a next run", never.Next(start))
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "@every 1ms", "@sometimes"} {
+		_, err := ParseSchedule(spec)
+		if err == nil {
+			t.Error("expected error parsing", spec)
+		}
+	}
+}
+
+func TestSchedulerRetries(t *testing.T) {
+	var attempts atomic.Int32
+	scheduler := NewScheduler(repositories.NewMemoryRepository(config.Configuration{}))
+	err := scheduler.run(context.Background(), Job{
+		Name: "flaky",
+		Run: func(ctx context.Context) error {
+			if attempts.Add(1) < 3 {
+				return errors.New("failed")
+			}
+			return nil
+		},
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+	})
+	if err != nil || attempts.Load() != 3 {
+		t.Fatal("job not retried until it succeeded", attempts.Load(), err)
+	}
+
+	attempts.Store(0)
+	err = scheduler.run(context.Background(), Job{
+		Name: "broken",
+		Run: func(ctx context.Context) error {
+			attempts.Add(1)
+			return errors.New("failed")
+		},
+		Retries:      1,
+		RetryBackoff: time.Millisecond,
+	})
+	if err == nil || attempts.Load() != 2 {
+		t.Fatal("job not given up after retries", attempts.Load(), err)
+	}
+}
+
+func TestSchedulerLeader(t *testing.T) {
+	repo := repositories.NewMemoryRepository(config.Configuration{})
+	var runs [2]atomic.Int32
+	var schedulers [2]*Scheduler
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	for i := range schedulers {
+		schedulers[i] = NewScheduler(repo)
+		schedulers[i].LeaderInterval = 10 * time.Millisecond
+		schedulers[i].Add(Job{
+			Name:     "job",
+			Schedule: Every(10 * time.Millisecond),
+			Run: func(ctx context.Context) error {
+				runs[i].Add(1)
+				return nil
+			},
+		})
+	}
+	go func() {
+		schedulers[0].Start(ctx)
+		done <- struct{}{}
+	}()
+	for !schedulers[0].Leader() {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		schedulers[1].Start(ctx)
+		done <- struct{}{}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if schedulers[1].Leader() || runs[1].Load() != 0 {
+		t.Fatal("second replica ran jobs while the first held the lock")
+	}
+	if runs[0].Load() == 0 {
+		t.Fatal("leader did not run jobs")
+	}
+	if err := schedulers[1].Check(ctx); err != nil {
+		t.Fatal("follower reported unhealthy", err)
+	}
+	cancel()
+	<-done
+	<-done
+
+	// the lock is released on shutdown so another replica can take over
+	lock, err := repo.TryLock(context.Background(), schedulerLock)
+	if err != nil {
+		t.Fatal("scheduler lock not released", err)
+	}
+	lock.Release(context.Background())
+}
@@ -0,0 +1,146 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+)
+
+const (
+	webhookBatchSize  = 20
+	webhookMinBackoff = 30 * time.Second
+	webhookMaxBackoff = 6 * time.Hour
+)
+
+type WebhookWorker struct {
+	Repo   repositories.Repository
+	Conf   config.WebhookConfig
+	Client *http.Client
+}
+
+func NewWebhookWorker(repo repositories.Repository, conf config.WebhookConfig) *WebhookWorker {
+	return &WebhookWorker{
+		Repo: repo,
+		Conf: conf,
+		Client: &http.Client{
+			Timeout: time.Duration(conf.Timeout) * time.Second,
+		},
+	}
+}
+
+// Deliver webhooks from the outbox until the context is done
+func (w *WebhookWorker) Start(ctx context.Context) {
+	interval := time.Duration(w.Conf.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.Deliver(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deliver claims due webhooks and sends them until the outbox has none left
+func (w *WebhookWorker) Deliver(ctx context.Context) {
+	for ctx.Err() == nil {
+		// Lease long enough that a slow endpoint is not sent the same webhook twice
+		lease := w.Client.Timeout*webhookBatchSize + time.Minute
+		webhooks, err := w.Repo.ClaimWebhooks(ctx, webhookBatchSize, lease)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println(fmt.Sprintf("failed to claim webhooks: %s", err.Error()))
+			}
+			return
+		}
+		for _, webhook := range webhooks {
+			w.deliver(ctx, webhook)
+		}
+		if len(webhooks) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+func (w *WebhookWorker) deliver(ctx context.Context, webhook models.Webhook) {
+	sendErr := w.send(ctx, webhook)
+	if sendErr == nil {
+		err := w.Repo.MarkWebhookDelivered(ctx, webhook.ID)
+		if err != nil {
+			log.Println(fmt.Sprintf("failed to mark webhook %d delivered: %s", webhook.ID, err.Error()))
+		}
+		return
+	}
+	var err error
+	if webhook.Attempts+1 >= w.Conf.MaxAttempts {
+		log.Println(fmt.Sprintf("giving up on webhook %d to %s: %s", webhook.ID, webhook.Endpoint, sendErr.Error()))
+		err = w.Repo.MarkWebhookFailed(ctx, webhook.ID, sendErr.Error())
+	} else {
+		err = w.Repo.RetryWebhook(ctx, webhook.ID, sendErr.Error(), time.Now().Add(webhookBackoff(webhook.Attempts)))
+	}
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to reschedule webhook %d: %s", webhook.ID, err.Error()))
+	}
+}
+
+func (w *WebhookWorker) send(ctx context.Context, webhook models.Webhook) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Endpoint, bytes.NewReader(webhook.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", strconv.FormatInt(webhook.ID, 10))
+	req.Header.Set("X-Webhook-Event", webhook.EventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+SignWebhook(w.Conf.Secret, timestamp, webhook.Payload))
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>". Receivers
+// should recompute it and reject stale timestamps to prevent replays.
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Exponential backoff from the number of failed attempts so far
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookMinBackoff
+	for i := 0; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
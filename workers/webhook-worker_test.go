@@ -0,0 +1,126 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cheebz/go-auth/config"
+	"github.com/cheebz/go-auth/models"
+	"github.com/cheebz/go-auth/repositories"
+)
+
+func TestWebhookWorker(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var received []models.WebhookEvent
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		signature := "sha256=" + SignWebhook("secret", r.Header.Get("X-Webhook-Timestamp"), body)
+		if r.Header.Get("X-Webhook-Signature") != signature {
+			t.Error("invalid signature", r.Header.Get("X-Webhook-Signature"))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event models.WebhookEvent
+		err = json.Unmarshal(body, &event)
+		if err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("X-Webhook-Event") != event.Type {
+			t.Error("unexpected event header", r.Header.Get("X-Webhook-Event"))
+		}
+		received = append(received, event)
+	}))
+	defer receiver.Close()
+
+	conf := config.Configuration{}
+	conf.Webhook = config.WebhookConfig{URLs: receiver.URL, Secret: "secret", MaxAttempts: 3, Timeout: 5}
+	repo := repositories.NewMemoryRepository(conf)
+	user, err := repo.CreateUser(ctx, models.User{Username: "user", Password: "hash", UUID: "uuid", Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := NewWebhookWorker(repo, conf.Webhook)
+
+	worker.Deliver(ctx)
+	if len(received) != 0 {
+		t.Fatal("failed delivery recorded as received", received)
+	}
+	webhooks, err := repo.ClaimWebhooks(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 0 {
+		t.Fatal("failed webhook retried without backoff", webhooks)
+	}
+	// pretend the backoff has passed
+	err = repo.RetryWebhook(ctx, 1, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worker.Deliver(ctx)
+	if len(received) != 1 || received[0].Type != repositories.WebhookUserRegistered || received[0].User.ID != user.ID {
+		t.Fatal("webhook not delivered", received)
+	}
+	webhooks, err = repo.ClaimWebhooks(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 0 {
+		t.Fatal("delivered webhook still pending", webhooks)
+	}
+}
+
+func TestWebhookWorkerGivesUp(t *testing.T) {
+	ctx := context.Background()
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	conf := config.Configuration{}
+	conf.Webhook = config.WebhookConfig{URLs: receiver.URL, Secret: "secret", MaxAttempts: 1, Timeout: 5}
+	repo := repositories.NewMemoryRepository(conf)
+	_, err := repo.CreateUser(ctx, models.User{Username: "user", Password: "hash", UUID: "uuid", Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewWebhookWorker(repo, conf.Webhook).Deliver(ctx)
+	// a failed webhook is never claimed again, even once due
+	err = repo.RetryWebhook(ctx, 1, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks, err := repo.ClaimWebhooks(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 0 {
+		t.Fatal("webhook retried after max attempts", webhooks)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	if webhookBackoff(0) != webhookMinBackoff || webhookBackoff(1) != 2*webhookMinBackoff {
+		t.Fatal("unexpected backoff", webhookBackoff(0), webhookBackoff(1))
+	}
+	if webhookBackoff(100) != webhookMaxBackoff {
+		t.Fatal("backoff not capped", webhookBackoff(100))
+	}
+}